@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"time"
 
 	"github.com/Aiven-Open/nomad-droplets-autoscaler/plugin"
 	"github.com/google/uuid"
@@ -9,11 +10,38 @@ import (
 	"github.com/hashicorp/nomad-autoscaler/plugins"
 )
 
+// tracingShutdownTimeout bounds how long pending spans are flushed for once
+// the plugin stops, as Nomad kills the plugin soon after asking it to stop.
+const tracingShutdownTimeout = 2 * time.Second
+
+var (
+	logger          hclog.Logger = hclog.NewNullLogger()
+	shutDownTracing              = func(context.Context) error { return nil }
+	// pluginCtx lives as long as the plugin is served, and stopPlugin ends
+	// it, stopping the work the plugin does in the background.
+	pluginCtx, stopPlugin = context.WithCancel(context.Background())
+)
+
 func main() {
 	uuid.EnableRandPool()
 	plugins.Serve(factory)
+	stopPlugin()
+
+	ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+	defer cancel()
+	if err := shutDownTracing(ctx); err != nil {
+		logger.Warn("cannot shut down the trace exporter", "error", err)
+	}
 }
 
 func factory(log hclog.Logger) interface{} {
-	return plugin.NewDODropletsPlugin(context.Background(), log, plugin.Must(plugin.NewVault()))
+	logger = log
+	shutdown, err := plugin.SetUpTracing(context.Background(), log)
+	if err != nil {
+		log.Error("cannot set up tracing", "error", err)
+	}
+	shutDownTracing = shutdown
+	vault := plugin.Must(plugin.NewVault())
+	vault.StartRenewingToken(pluginCtx, log)
+	return plugin.NewDODropletsPlugin(pluginCtx, log, vault)
 }
@@ -0,0 +1,255 @@
+package plugin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/godo"
+	"github.com/hashicorp/go-retryablehttp"
+	"golang.org/x/oauth2"
+)
+
+// account is a DigitalOcean account which droplets are scaled in, as
+// selected by an API token. Reserved addresses belong to an account, so each
+// has its own pool of them.
+type account struct {
+	// id identifies the account without revealing its token. It is empty
+	// for the plugin's own account.
+	id                    string
+	client                DigitalOceanWrapper
+	reservedAddressesPool *ReservedAddressesPool
+}
+
+// accountID returns the identifier of the account of the given token.
+func accountID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// normalizeToken strips the whitespace and quotes around a token, such as
+// the newline at the end of a token file.
+func normalizeToken(token string) string {
+	return strings.Trim(strings.TrimSpace(token), "'")
+}
+
+// pluginToken returns the contents of the plugin's token, which is either
+// configured or given by the environment.
+func (t *TargetPlugin) pluginToken() (string, error) {
+	token, ok := t.config[configKeyToken]
+	if !ok {
+		token = getEnv("DIGITALOCEAN_TOKEN", "DIGITALOCEAN_ACCESS_TOKEN")
+		if len(token) == 0 {
+			return "", fmt.Errorf("unable to find DigitalOcean token")
+		}
+		return normalizeToken(token), nil
+	}
+	contents, err := pathOrContents(token)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token: %w", err)
+	}
+	return normalizeToken(contents), nil
+}
+
+// accountFor returns the account selected by the token of a scaling policy.
+// Policies without a token of their own, or whose token has the same
+// contents as the plugin's, however they are given, use the plugin's
+// account. Clients for other tokens are created once and cached, so that
+// each account has a single pool of reserved addresses.
+func (t *TargetPlugin) accountFor(config map[string]string) (*account, error) {
+	pluginAccount := &account{
+		client:                t.client,
+		reservedAddressesPool: t.reservedAddressesPool,
+	}
+	token, ok := config[configKeyToken]
+	if !ok || token == "" || token == t.config[configKeyToken] {
+		return pluginAccount, nil
+	}
+	contents, err := pathOrContents(token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token: %w", err)
+	}
+	contents = normalizeToken(contents)
+	if pluginToken, err := t.pluginToken(); err == nil && contents == pluginToken {
+		return pluginAccount, nil
+	}
+
+	t.accountsMutex.Lock()
+	defer t.accountsMutex.Unlock()
+	if a, ok := t.accounts[contents]; ok {
+		return a, nil
+	}
+	client, err := t.newGodoClient(contents)
+	if err != nil {
+		return nil, err
+	}
+	a := &account{
+		id:                    accountID(contents),
+		client:                client,
+		reservedAddressesPool: CreateReservedAddressesPool(t.logger, WithDigitalOceanWrapper(client)),
+	}
+	if t.accounts == nil {
+		t.accounts = make(map[string]*account)
+	}
+	t.accounts[contents] = a
+	return a, nil
+}
+
+// rebuildAccounts gives the cached accounts clients made with the current
+// configuration, keeping their pools of reserved addresses. An account whose
+// token is now the plugin's is forgotten, as the plugin's account is used
+// for it from now on.
+func (t *TargetPlugin) rebuildAccounts(pluginToken string) error {
+	t.accountsMutex.Lock()
+	defer t.accountsMutex.Unlock()
+	for token, a := range t.accounts {
+		if token == pluginToken {
+			delete(t.accounts, token)
+			continue
+		}
+		client, err := t.newGodoClient(token)
+		if err != nil {
+			return err
+		}
+		a.reservedAddressesPool.setClient(client)
+		t.accounts[token] = &account{
+			id:                    a.id,
+			client:                client,
+			reservedAddressesPool: a.reservedAddressesPool,
+		}
+	}
+	return nil
+}
+
+const (
+	// defaultAPITimeout is how long each attempt at a request to the
+	// DigitalOcean API may take.
+	defaultAPITimeout = time.Minute
+	// defaultAPIRetryMax is how many times a failed request is retried by
+	// godo, as for clients created by godo.NewFromToken.
+	defaultAPIRetryMax = 4
+
+	godoRetryWaitMin = 1.0
+	godoRetryWaitMax = 30.0
+)
+
+// newGodoClient returns a client for the DigitalOcean API using the given
+// token. Unless the plugin was given an HTTP client, e.g. in tests, requests
+// go through the configured proxy, or the one given by the standard
+// environment variables, and are limited by the configured timeout.
+func (t *TargetPlugin) newGodoClient(token string) (*GodoWrapper, error) {
+	retryMaxS, ok := t.config[configKeyAPIRetryMax]
+	if !ok {
+		retryMaxS = strconv.Itoa(defaultAPIRetryMax)
+	}
+	retryMax, err := strconv.Atoi(retryMaxS)
+	if err != nil || retryMax < 0 {
+		return nil, fmt.Errorf(
+			"config param %s must be a non-negative integer",
+			configKeyAPIRetryMax,
+		)
+	}
+
+	httpClient := t.httpClient
+	if httpClient == nil {
+		timeoutS, ok := t.config[configKeyAPITimeout]
+		if !ok {
+			timeoutS = defaultAPITimeout.String()
+		}
+		timeout, err := time.ParseDuration(timeoutS)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf(
+				"config param %s must be a positive duration",
+				configKeyAPITimeout,
+			)
+		}
+		proxy, err := parseProxyURL(configKeyHTTPSProxy, t.config[configKeyHTTPSProxy])
+		if err != nil {
+			return nil, err
+		}
+		httpClient = newHTTPClient(proxy, timeout)
+	}
+	return newGodoClient(token, t.config[configKeyAPIURL], httpClient, retryMax)
+}
+
+// newHTTPClient returns an HTTP client which sends requests through the
+// given proxy, or the one given by the standard environment variables if it
+// is empty.
+func newHTTPClient(proxy *url.URL, timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if proxy != nil {
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
+
+// parseProxyURL parses the proxy URL given by the config param key, which
+// is nil if it is empty.
+func parseProxyURL(key, proxy string) (*url.URL, error) {
+	if proxy == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" ||
+		(u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") {
+		return nil, fmt.Errorf("config param %s must be an absolute http, https or socks5 URL", key)
+	}
+	return u, nil
+}
+
+// newGodoClient returns a client for the DigitalOcean API at the given base
+// URL, or at the public endpoint if it is empty, which makes requests with
+// the given HTTP client and retries those which fail up to retryMax times.
+func newGodoClient(
+	token, apiURL string,
+	httpClient *http.Client,
+	retryMax int,
+) (*GodoWrapper, error) {
+	source := oauth2.StaticTokenSource(&oauth2.Token{
+		AccessToken: normalizeToken(token),
+	})
+	client, err := godo.New(
+		&http.Client{
+			Transport: &oauth2.Transport{Source: source, Base: httpClient.Transport},
+			Timeout:   httpClient.Timeout,
+		},
+		godo.WithRetryAndBackoffs(godo.RetryConfig{
+			RetryMax:     retryMax,
+			RetryWaitMin: godo.PtrTo(godoRetryWaitMin),
+			RetryWaitMax: godo.PtrTo(godoRetryWaitMax),
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	// godo retries requests using an HTTP client of its own, which has to be
+	// given the transport as well
+	if transport, ok := client.HTTPClient.Transport.(*oauth2.Transport); ok {
+		if retrying, ok := transport.Base.(*retryablehttp.RoundTripper); ok {
+			retrying.Client.HTTPClient.Transport = httpClient.Transport
+		}
+	}
+
+	if apiURL != "" {
+		u, err := url.Parse(apiURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf(
+				"config param %s must be an absolute http or https URL",
+				configKeyAPIURL,
+			)
+		}
+		// API paths are resolved relative to the base URL
+		if !strings.HasSuffix(u.Path, "/") {
+			u.Path += "/"
+		}
+		if err := godo.SetBaseURL(u.String())(client); err != nil {
+			return nil, fmt.Errorf("invalid value for config param %s: %w", configKeyAPIURL, err)
+		}
+	}
+	return &GodoWrapper{Client: client}, nil
+}
@@ -0,0 +1,187 @@
+package plugin
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccountFor(t *testing.T) {
+	mock := createMockGodo()
+	pool := CreateReservedAddressesPool(hclog.NewNullLogger(), WithDigitalOceanWrapper(mock))
+	tp := &TargetPlugin{
+		config:                map[string]string{"token": "t0ken"},
+		logger:                hclog.NewNullLogger(),
+		client:                mock,
+		reservedAddressesPool: pool,
+	}
+
+	// policies without a token of their own use the plugin's account
+	for _, config := range []map[string]string{{}, {"token": "t0ken"}} {
+		account, err := tp.accountFor(config)
+		require.NoError(t, err)
+		require.Same(t, mock, account.client)
+		require.Same(t, pool, account.reservedAddressesPool)
+	}
+
+	// other tokens get an account of their own, which is reused
+	other, err := tp.accountFor(map[string]string{"token": "0ther"})
+	require.NoError(t, err)
+	require.NotSame(t, mock, other.client)
+	require.NotSame(t, pool, other.reservedAddressesPool)
+	again, err := tp.accountFor(map[string]string{"token": "0ther"})
+	require.NoError(t, err)
+	require.Same(t, other, again)
+	require.NotEqual(t, other.id, "")
+	require.NotContains(t, other.id, "0ther")
+
+	// the plugin's token given as a file is still the plugin's account
+	path := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(path, []byte("t0ken\n"), 0o600))
+	account, err := tp.accountFor(map[string]string{"token": path})
+	require.NoError(t, err)
+	require.Same(t, pool, account.reservedAddressesPool)
+	require.Empty(t, account.id)
+
+	// pools of the same name in different accounts are told apart
+	template := &dropletTemplate{name: "hashi-batch"}
+	otherTemplate := &dropletTemplate{name: "hashi-batch", account: other.id}
+	require.NotEqual(t, template.poolKey(), otherTemplate.poolKey())
+
+	// reloading the configuration gives the cached accounts new clients,
+	// keeping their pools of reserved addresses
+	require.NoError(t, tp.rebuildAccounts("t0ken"))
+	rebuilt, err := tp.accountFor(map[string]string{"token": "0ther"})
+	require.NoError(t, err)
+	require.NotSame(t, other.client, rebuilt.client)
+	require.Same(t, other.reservedAddressesPool, rebuilt.reservedAddressesPool)
+	require.Equal(t, other.id, rebuilt.id)
+
+	// unless the plugin's own account now has the token
+	require.NoError(t, tp.rebuildAccounts("0ther"))
+	require.Empty(t, tp.accounts)
+}
+
+func TestNewGodoClientWithAPIURL(t *testing.T) {
+	var path, authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		authorization = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"tag": {"name": "hashi-batch"}}`))
+	}))
+	defer server.Close()
+
+	client, err := newGodoClient("t0ken", server.URL+"/proxy", http.DefaultClient, defaultAPIRetryMax)
+	require.NoError(t, err)
+	tag, _, err := client.Tags().Get(t.Context(), "hashi-batch")
+	require.NoError(t, err)
+	require.Equal(t, "hashi-batch", tag.Name)
+	require.Equal(t, "/proxy/v2/tags/hashi-batch", path)
+	require.Equal(t, "Bearer t0ken", authorization)
+
+	client, err = newGodoClient("t0ken", "", http.DefaultClient, defaultAPIRetryMax)
+	require.NoError(t, err)
+	require.Equal(t, "https://api.digitalocean.com/", client.Client.BaseURL.String())
+
+	for _, apiURL := range []string{"localhost:8080", "ftp://localhost/", "http://", "://"} {
+		_, err = newGodoClient("t0ken", apiURL, http.DefaultClient, defaultAPIRetryMax)
+		require.Error(t, err, apiURL)
+	}
+}
+
+func TestNewGodoClientWithProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"tag": {"name": "hashi-batch"}}`))
+	}))
+	defer proxy.Close()
+
+	tp := &TargetPlugin{config: map[string]string{
+		"api_url":     "http://api.example.invalid/",
+		"https_proxy": proxy.URL,
+		"api_timeout": "5s",
+	}}
+	client, err := tp.newGodoClient("t0ken")
+	require.NoError(t, err)
+	_, _, err = client.Tags().Get(t.Context(), "hashi-batch")
+	require.NoError(t, err)
+	require.Equal(t, []string{"http://api.example.invalid/v2/tags/hashi-batch"}, proxied)
+
+	tp.config["https_proxy"] = "proxy:3128"
+	_, err = tp.newGodoClient("t0ken")
+	require.ErrorContains(t, err, "https_proxy")
+
+	tp.config["https_proxy"] = ""
+	tp.config["api_timeout"] = "soon"
+	_, err = tp.newGodoClient("t0ken")
+	require.ErrorContains(t, err, "api_timeout")
+}
+
+// roundTripperFunc allows a function to be used as an HTTP transport.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestNewGodoClientWithInjectedHTTPClient(t *testing.T) {
+	var requested []string
+	tp := &TargetPlugin{
+		config: map[string]string{},
+		httpClient: &http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			requested = append(requested, r.URL.String())
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Content-Type": []string{"application/json"}},
+				Body:       io.NopCloser(strings.NewReader(`{"tag": {"name": "hashi-batch"}}`)),
+				Request:    r,
+			}, nil
+		})},
+	}
+	client, err := tp.newGodoClient("t0ken")
+	require.NoError(t, err)
+	_, _, err = client.Tags().Get(t.Context(), "hashi-batch")
+	require.NoError(t, err)
+	require.Equal(t, []string{"https://api.digitalocean.com/v2/tags/hashi-batch"}, requested)
+}
+
+func TestNewGodoClientRetryMax(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	tp := &TargetPlugin{config: map[string]string{
+		"api_url":       server.URL,
+		"api_retry_max": "0",
+	}}
+	client, err := tp.newGodoClient("t0ken")
+	require.NoError(t, err)
+	_, _, err = client.Tags().Get(t.Context(), "hashi-batch")
+	require.Error(t, err)
+	require.Equal(t, 1, attempts)
+
+	attempts = 0
+	tp.config["api_retry_max"] = "1"
+	client, err = tp.newGodoClient("t0ken")
+	require.NoError(t, err)
+	_, _, err = client.Tags().Get(t.Context(), "hashi-batch")
+	require.Error(t, err)
+	require.Equal(t, 2, attempts)
+
+	tp.config["api_retry_max"] = "-1"
+	_, err = tp.newGodoClient("t0ken")
+	require.ErrorContains(t, err, "api_retry_max")
+}
@@ -0,0 +1,153 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/digitalocean/godo"
+	"github.com/hashicorp/go-hclog"
+)
+
+// parseDropletIDs parses a comma-separated list of droplet IDs, ignoring
+// duplicates and empty entries.
+func parseDropletIDs(s string) ([]int, error) {
+	var ids []int
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		id, err := strconv.Atoi(field)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("%q is not a droplet ID", field)
+		}
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+const (
+	// nodePoolTagPrefix starts the tag of the Nomad node pool of the
+	// droplets of a pool, if tag_node_metadata is set.
+	nodePoolTagPrefix = "nomad-node-pool:"
+	// poolTagPrefix starts the tag naming the pool of every droplet which
+	// the plugin creates or adopts, which tells the droplets of different
+	// pools apart whatever they are named and however else they are tagged.
+	poolTagPrefix = "autoscaler-pool:"
+)
+
+// poolTag returns the tag which marks the droplets of the template's pool.
+func (d *dropletTemplate) poolTag() string {
+	return SanitizeTag(poolTagPrefix + d.name)
+}
+
+// dropletTags returns the tags of the droplets of the template's pool,
+// including the tag marking the pool.
+func (d *dropletTemplate) dropletTags() []string {
+	return append(slices.Clone(d.tags), d.poolTag())
+}
+
+// adoptedDroplet identifies a droplet which was adopted into a pool.
+type adoptedDroplet struct {
+	pool      string
+	dropletID int
+}
+
+// adoptDroplets brings the existing droplets listed by the template into its
+// pool, by giving them the pool's tags, including the tag marking the pool,
+// so that they are counted and scaled in like the droplets the plugin
+// created. Each droplet is only adopted once, and droplets which already
+// carry the pool's name tag are left alone.
+func (t *TargetPlugin) adoptDroplets(ctx context.Context, template *dropletTemplate) error {
+	log := t.logger.With(logKeyAction, "adopt", logKeyTag, template.name)
+	errorList := make([]error, 0)
+	adopted := 0
+	for _, dropletID := range template.adoptDropletIDs {
+		key := adoptedDroplet{pool: template.poolKey(), dropletID: dropletID}
+		if _, done := t.adoptedDroplets.Load(key); done {
+			continue
+		}
+		log := log.With(logKeyDropletID, strconv.Itoa(dropletID))
+		reqCtx, cancel := context.WithTimeout(ctx, template.requestTimeout)
+		droplet, _, err := template.client.Droplets().Get(reqCtx, dropletID)
+		cancel()
+		if isNotFoundError(err) {
+			errorList = append(errorList, fmt.Errorf("droplet %v does not exist", dropletID))
+			continue
+		}
+		if err != nil {
+			errorList = append(errorList, fmt.Errorf("cannot describe droplet %v: %w", dropletID, err))
+			continue
+		}
+		if slices.Contains(droplet.Tags, template.name) {
+			t.adoptedDroplets.Store(key, struct{}{})
+			continue
+		}
+		if pool := otherPool(droplet, template); pool != "" {
+			errorList = append(errorList, fmt.Errorf(
+				"droplet %v is already in the pool of %v",
+				dropletID,
+				pool,
+			))
+			continue
+		}
+		if template.dryRun {
+			log.Info("dry run: would adopt droplet", "tags", template.dropletTags())
+			continue
+		}
+		if err := tagDroplet(ctx, log, template, droplet, template.dropletTags()); err != nil {
+			errorList = append(errorList, fmt.Errorf("cannot adopt droplet %v: %w", dropletID, err))
+			continue
+		}
+		t.adoptedDroplets.Store(key, struct{}{})
+		adopted++
+		log.Info("adopted droplet", "tags", template.dropletTags())
+	}
+	if adopted > 0 {
+		t.dropletCounts.invalidate(template.poolKey())
+	}
+	return errors.Join(errorList...)
+}
+
+// otherPool returns the name of the pool of another policy which the droplet
+// is in, or an empty string if there is none. Membership is decided from the
+// tag marking the pool alone, as other policies may not have been seen yet,
+// and neither the names nor the other tags of droplets say which pool they
+// are in.
+func otherPool(droplet *godo.Droplet, template *dropletTemplate) string {
+	for _, tag := range droplet.Tags {
+		if strings.HasPrefix(tag, poolTagPrefix) && tag != template.poolTag() {
+			return strings.TrimPrefix(tag, poolTagPrefix)
+		}
+	}
+	return ""
+}
+
+// tagDroplet gives the droplet all the given tags which it does not already
+// have.
+func tagDroplet(ctx context.Context, log hclog.Logger, template *dropletTemplate, droplet *godo.Droplet, tags []string) error {
+	for _, tag := range tags {
+		if slices.Contains(droplet.Tags, tag) {
+			continue
+		}
+		// tags must exist before resources can be tagged with them
+		if _, _, err := template.client.Tags().Create(ctx, &godo.TagCreateRequest{Name: tag}); err != nil {
+			return fmt.Errorf("could not create tag %v: %w", tag, err)
+		}
+		if err := RetryOnTransientError(ctx, log, template.name, func(ctx context.Context, cancel context.CancelCauseFunc) error {
+			_, err := template.client.Tags().TagResources(ctx, tag, &godo.TagResourcesRequest{
+				Resources: []godo.Resource{{ID: strconv.Itoa(droplet.ID), Type: godo.DropletResourceType}},
+			})
+			return err
+		}); err != nil {
+			return fmt.Errorf("could not tag the droplet with %v: %w", tag, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package plugin
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/coder/quartz"
+	"github.com/digitalocean/godo"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDropletIDs(t *testing.T) {
+	ids, err := parseDropletIDs("12, 34,,12")
+	require.NoError(t, err)
+	require.Equal(t, []int{12, 34}, ids)
+
+	ids, err = parseDropletIDs("")
+	require.NoError(t, err)
+	require.Empty(t, ids)
+
+	_, err = parseDropletIDs("12,abc")
+	require.ErrorContains(t, err, `"abc" is not a droplet ID`)
+	_, err = parseDropletIDs("-1")
+	require.Error(t, err)
+}
+
+func TestAdoptDroplets(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	mock.droplets[1] = &godo.Droplet{ID: 1, Name: "manual-1", Status: "active"}
+	mock.droplets[2] = &godo.Droplet{ID: 2, Name: "manual-2", Status: "active", Tags: []string{"nomad-client"}}
+	// already in the pools of other policies, which have not been seen yet
+	mock.droplets[3] = &godo.Droplet{ID: 3, Name: "custom-1", Status: "active", Tags: []string{"autoscaler-pool:otherpool"}}
+	// merely named after one of its tags
+	mock.droplets[5] = &godo.Droplet{ID: 5, Name: "web-server-5", Status: "active", Tags: []string{"web"}}
+	config := map[string]string{
+		"name":           "mydropletname",
+		"region":         "lon1",
+		"size":           "s1",
+		"snapshot_id":    "12345",
+		"token":          "t0ken",
+		"tags":           "nomad-client",
+		"adopt_droplets": "1,2,3,4,5",
+	}
+	tp := &TargetPlugin{
+		ctx:           ctx,
+		config:        config,
+		logger:        hclog.NewNullLogger(),
+		client:        mock,
+		dropletCounts: newDropletCountsCache(quartz.NewMock(t)),
+	}
+	template := Must(tp.createDropletTemplate(config))
+	require.Equal(t, []int{1, 2, 3, 4, 5}, template.adoptDropletIDs)
+
+	err := tp.adoptDroplets(ctx, template)
+	require.ErrorContains(t, err, "droplet 3 is already in the pool of otherpool")
+	require.ErrorContains(t, err, "droplet 4 does not exist")
+	require.NotContains(t, err.Error(), "droplet 5")
+	require.Equal(t, []string{"mydropletname", "nomad-client", "autoscaler-pool:mydropletname"}, mock.droplets[1].Tags)
+	require.Equal(t, []string{"nomad-client", "mydropletname", "autoscaler-pool:mydropletname"}, mock.droplets[2].Tags)
+	require.Equal(t, []string{"autoscaler-pool:otherpool"}, mock.droplets[3].Tags)
+	require.Equal(t, []string{"web", "mydropletname", "nomad-client", "autoscaler-pool:mydropletname"}, mock.droplets[5].Tags)
+
+	// the adopted droplets are now counted in the pool
+	total, err := tp.countDropletsTotal(ctx, template)
+	require.NoError(t, err)
+	require.EqualValues(t, 3, total)
+
+	// adopting again does nothing to the droplets already adopted
+	delete(mock.droplets, 3)
+	mock.untaggableDroplets = []int{1, 2}
+	err = tp.adoptDroplets(ctx, template)
+	require.ErrorContains(t, err, "droplet 3 does not exist")
+	require.NotContains(t, err.Error(), "droplet 1")
+
+	// a droplet adopted into one pool is still checked by another, which
+	// does not adopt it
+	config["name"] = "otherdropletname"
+	config["adopt_droplets"] = "1"
+	mock.untaggableDroplets = nil
+	otherTemplate := Must(tp.createDropletTemplate(config))
+	err = tp.adoptDroplets(ctx, otherTemplate)
+	require.ErrorContains(t, err, "droplet 1 is already in the pool of mydropletname")
+	require.Equal(t, []string{"mydropletname", "nomad-client", "autoscaler-pool:mydropletname"}, mock.droplets[1].Tags)
+}
+
+func TestAdoptDropletsCreatedByAnotherPool(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	config := map[string]string{
+		"name":          "otherpool",
+		"region":        "lon1",
+		"size":          "s1",
+		"snapshot_id":   "12345",
+		"token":         "t0ken",
+		"name_template": "worker-{short}",
+	}
+	tp := &TargetPlugin{
+		ctx:           ctx,
+		config:        config,
+		logger:        hclog.NewNullLogger(),
+		client:        mock,
+		dropletCounts: newDropletCountsCache(quartz.NewMock(t)),
+	}
+	createdIDs, err := tp.scaleOut(ctx, nil, 1, 1, Must(tp.createDropletTemplate(config)), config)
+	require.NoError(t, err)
+	require.Contains(t, mock.droplets[createdIDs[0]].Tags, "autoscaler-pool:otherpool")
+
+	// a droplet created by another pool is recognised by the tag marking
+	// its pool, even though it is not named after the pool
+	config["name"] = "mydropletname"
+	config["adopt_droplets"] = strconv.Itoa(createdIDs[0])
+	err = tp.adoptDroplets(ctx, Must(tp.createDropletTemplate(config)))
+	require.ErrorContains(t, err, "is already in the pool of otherpool")
+	require.NotContains(t, mock.droplets[createdIDs[0]].Tags, "mydropletname")
+}
+
+func TestAdoptDropletsDryRun(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	mock.droplets[1] = &godo.Droplet{ID: 1, Name: "manual-1", Status: "active"}
+	config := map[string]string{
+		"name":           "mydropletname",
+		"region":         "lon1",
+		"size":           "s1",
+		"snapshot_id":    "12345",
+		"token":          "t0ken",
+		"adopt_droplets": "1",
+		"dry_run":        "true",
+	}
+	tp := &TargetPlugin{
+		ctx:           ctx,
+		config:        config,
+		logger:        hclog.NewNullLogger(),
+		client:        mock,
+		dropletCounts: newDropletCountsCache(quartz.NewMock(t)),
+	}
+	template := Must(tp.createDropletTemplate(config))
+	require.NoError(t, tp.adoptDroplets(ctx, template))
+	require.Empty(t, mock.droplets[1].Tags)
+}
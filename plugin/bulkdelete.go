@@ -0,0 +1,182 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/digitalocean/godo"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// bulkDeleteDroplets deletes the droplets with a few requests however many
+// there are, rather than powering off and deleting each one in turn. The
+// droplets are given a tag of their own, so that they can be powered off
+// and deleted by tag without affecting the rest of the pool. Their Nomad
+// nodes are still drained first.
+func (t *TargetPlugin) bulkDeleteDroplets(
+	ctx context.Context,
+	outcome *scalingOutcome,
+	template *dropletTemplate,
+	instanceIDs map[string]string,
+) (err error) {
+	ctx, span := startSpan(ctx, "bulk_delete_droplets",
+		attribute.String(logKeyTag, template.name),
+		attribute.Int("count", len(instanceIDs)))
+	defer func() { endSpan(span, err) }()
+
+	dropletsToDelete, errorList, err := t.resolveDropletIDs(ctx, template, instanceIDs)
+	if err != nil {
+		return errors.Join(append(errorList, err)...)
+	}
+
+	dropletIDs, drainErrors := t.drainNodes(ctx, template, dropletsToDelete)
+	errorList = append(errorList, drainErrors...)
+	if len(dropletIDs) == 0 {
+		return errors.Join(errorList...)
+	}
+
+	tag := SanitizeTag(template.name + "-delete-" + uuid.Must(uuid.NewRandom()).String()[:8])
+	log := t.logger.With(logKeyAction, "bulk_delete", logKeyTag, tag, "droplets", dropletIDs)
+	if _, _, err := template.client.Tags().Create(ctx, &godo.TagCreateRequest{Name: tag}); err != nil {
+		return errors.Join(append(errorList, fmt.Errorf("could not create tag %v: %w", tag, err))...)
+	}
+	// the tag is no longer needed once its droplets are gone, or if they
+	// could not be deleted
+	defer func() {
+		reqCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), template.requestTimeout)
+		defer cancel()
+		if _, err := template.client.Tags().Delete(reqCtx, tag); err != nil {
+			log.Warn("could not delete the tag of the deleted droplets", "error", err)
+		}
+	}()
+	resources := make([]godo.Resource, 0, len(dropletIDs))
+	for _, dropletID := range dropletIDs {
+		resources = append(resources, godo.Resource{ID: strconv.Itoa(dropletID), Type: godo.DropletResourceType})
+	}
+	if err := RetryOnTransientError(ctx, log, template.name, func(ctx context.Context, cancel context.CancelCauseFunc) error {
+		_, err := template.client.Tags().TagResources(ctx, tag, &godo.TagResourcesRequest{Resources: resources})
+		return err
+	}); err != nil {
+		return errors.Join(append(errorList, fmt.Errorf("could not tag the droplets to delete: %w", err))...)
+	}
+
+	if !template.forceDelete {
+		log.Debug("Gracefully shutting down droplets...")
+		// the droplets may be gone, or already off, if an earlier attempt
+		// succeeded without its response arriving
+		err := retryRequest(ctx, log, template.name, template.clock(), template.requestTimeout, func(ctx context.Context) error {
+			_, _, err := template.client.DropletActions().PowerOffByTag(ctx, tag)
+			if isNotFoundError(err) || isAlreadyPoweredOffError(err) {
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			return errors.Join(append(errorList, fmt.Errorf("error shutting down droplets: %w", err))...)
+		}
+		waitCtx, cancel := context.WithTimeout(ctx, template.shutdownTimeout)
+		semaphore := make(chan struct{}, template.maxDeleteConcurrency)
+		wg := &sync.WaitGroup{}
+		for _, dropletID := range dropletIDs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				select {
+				case semaphore <- struct{}{}:
+					defer func() { <-semaphore }()
+				case <-waitCtx.Done():
+					return
+				}
+				log := log.With(logKeyDropletID, strconv.Itoa(dropletID))
+				if err := waitForDropletState(
+					waitCtx,
+					"off",
+					dropletID,
+					template.client.Droplets(),
+					template.statePollInterval,
+					template.statePollMaxInterval,
+					template.clock(),
+					log,
+				); err != nil {
+					log.Warn("Timeout while waiting to for droplet to become 'off'", "error", err)
+				}
+			}()
+		}
+		wg.Wait()
+		cancel()
+	}
+
+	log.Debug("Deleting droplets...")
+	err = retryRequest(ctx, log, template.name, template.clock(), template.requestTimeout, func(ctx context.Context) error {
+		_, err := template.client.Droplets().DeleteByTag(ctx, tag)
+		if isNotFoundError(err) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return errors.Join(append(errorList, fmt.Errorf("error deleting droplets: %w", err))...)
+	}
+	dropletsDeleted.WithLabelValues(template.name).Add(float64(len(dropletIDs)))
+	for range dropletIDs {
+		outcome.dropletDeleted()
+	}
+	return errors.Join(errorList...)
+}
+
+// drainNodes drains the Nomad nodes of the droplets concurrently, but no more
+// than the configured number at a time. It returns the IDs of the droplets
+// whose nodes were drained, or which have none, along with the errors of
+// those which could not be drained.
+func (t *TargetPlugin) drainNodes(
+	ctx context.Context,
+	template *dropletTemplate,
+	dropletsToDelete map[int]string,
+) ([]int, []error) {
+	if t.nomadNodes == nil {
+		return slices.Sorted(maps.Keys(dropletsToDelete)), nil
+	}
+	semaphore := make(chan struct{}, template.maxDeleteConcurrency)
+	wg := &sync.WaitGroup{}
+	mutex := &sync.Mutex{}
+	var (
+		drained   []int
+		errorList []error
+	)
+	for dropletID, nodeID := range dropletsToDelete {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			if nodeID != "" {
+				log := t.logger.With(logKeyAction, "drain", logKeyDropletID, strconv.Itoa(dropletID))
+				select {
+				case semaphore <- struct{}{}:
+					err = drainNode(ctx, nodeID, template.drainDeadline, t.nomadNodes, log)
+					<-semaphore
+				case <-ctx.Done():
+					err = ctx.Err()
+				}
+				if err != nil {
+					log.Error("error draining node", "error", err)
+				}
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				errorList = append(errorList, fmt.Errorf("droplet %v: %w", dropletID, err))
+			} else {
+				drained = append(drained, dropletID)
+			}
+		}()
+	}
+	wg.Wait()
+	slices.Sort(drained)
+	return drained, errorList
+}
@@ -0,0 +1,147 @@
+package plugin
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/quartz"
+	"github.com/digitalocean/godo"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScaleInWithBulkDelete(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	config := map[string]string{
+		"name":        "mydropletname",
+		"region":      "lon1",
+		"size":        "s1",
+		"snapshot_id": "12345",
+		"token":       "t0ken",
+		"bulk_delete": "true",
+	}
+	clusterUtils := &mockClusterUtils{
+		dropletNames: []string{"mydropletname-1", "mydropletname-2", "mydropletname-3"},
+	}
+	tp := &TargetPlugin{
+		ctx:          ctx,
+		config:       config,
+		logger:       hclog.NewNullLogger(),
+		client:       mock,
+		clusterUtils: clusterUtils,
+	}
+	for id, name := range clusterUtils.dropletNames {
+		mock.droplets[id] = &godo.Droplet{
+			ID:     id,
+			Name:   name,
+			Status: "active",
+			Tags:   []string{"mydropletname"},
+		}
+	}
+	template := Must(tp.createDropletTemplate(config))
+	require.True(t, template.bulkDelete)
+
+	require.NoError(t, tp.scaleIn(ctx, nil, 1, 2, template, config))
+	require.Equal(t, 1, mock.deleteByTagCalls)
+	require.Len(t, clusterUtils.postScaleIn, 2)
+	// only the droplets selected by Nomad were deleted
+	require.Len(t, mock.droplets, 1)
+	require.Equal(t, "mydropletname-3", mock.droplets[2].Name)
+	require.Equal(t, "active", mock.droplets[2].Status)
+	require.Equal(t, []string{"mydropletname"}, mock.droplets[2].Tags)
+	// and the temporary tag was cleaned up
+	for tag := range mock.tags {
+		require.False(t, strings.HasPrefix(tag, "mydropletname-delete-"), tag)
+	}
+}
+
+func TestBulkDeleteDropletsFailure(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	mock.undeletableDroplets = []int{1}
+	config := map[string]string{
+		"name":         "mydropletname",
+		"region":       "lon1",
+		"size":         "s1",
+		"snapshot_id":  "12345",
+		"token":        "t0ken",
+		"force_delete": "true",
+	}
+	tp := &TargetPlugin{
+		ctx:    ctx,
+		config: config,
+		logger: hclog.NewNullLogger(),
+		client: mock,
+	}
+	for id, name := range []string{"mydropletname-1", "mydropletname-2"} {
+		mock.droplets[id] = &godo.Droplet{
+			ID:     id,
+			Name:   name,
+			Status: "active",
+			Tags:   []string{"mydropletname"},
+		}
+	}
+	template := Must(tp.createDropletTemplate(config))
+
+	err := tp.bulkDeleteDroplets(ctx, nil, template, map[string]string{"mydropletname-1": "", "mydropletname-2": ""})
+	require.ErrorContains(t, err, "error deleting droplets")
+	require.Len(t, mock.droplets, 2)
+	require.Len(t, mock.tags, 0)
+}
+
+func TestBulkDeleteDropletsWithLostResponses(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	clock := quartz.NewMock(t)
+	mock := createMockGodo()
+	config := map[string]string{
+		"name":            "mydropletname",
+		"region":          "lon1",
+		"size":            "s1",
+		"snapshot_id":     "12345",
+		"token":           "t0ken",
+		"request_timeout": "10ms",
+	}
+	tp := &TargetPlugin{
+		ctx:                   ctx,
+		config:                config,
+		logger:                hclog.NewNullLogger(),
+		client:                mock,
+		reservedAddressesPool: mock.NewReservedAddressPool(hclog.NewNullLogger(), clock),
+	}
+	for id, name := range []string{"mydropletname-1", "mydropletname-2"} {
+		mock.droplets[id] = &godo.Droplet{
+			ID:     id,
+			Name:   name,
+			Status: "active",
+			Tags:   []string{"mydropletname"},
+		}
+	}
+	template := Must(tp.createDropletTemplate(config))
+	trap := clock.Trap().NewTimer()
+	defer trap.Close()
+	retried := func() {
+		trap.MustWait(ctx).MustRelease(ctx)
+		_, w := clock.AdvanceNext()
+		w.MustWait(ctx)
+	}
+
+	// the first attempts to power off and to delete the droplets take
+	// effect, but time out, and are retried
+	mock.lostPowerOffs.Store(1)
+	mock.lostDeletes.Store(1)
+	result := make(chan error)
+	go func() {
+		result <- tp.bulkDeleteDroplets(ctx, nil, template, map[string]string{"mydropletname-1": "", "mydropletname-2": ""})
+	}()
+	retried()
+	retried()
+	require.NoError(t, <-result)
+	require.Equal(t, 2, mock.deleteByTagCalls)
+	require.Empty(t, mock.droplets)
+}
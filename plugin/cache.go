@@ -0,0 +1,152 @@
+package plugin
+
+import (
+	"sync"
+	"time"
+
+	"github.com/coder/quartz"
+)
+
+const defaultCountCacheTTL = 5 * time.Second
+
+// settledCountsMaxAge is how long the counts of a pool whose droplets were
+// all ready may stand in for listing the droplets again, as long as the
+// pool still has as many droplets.
+const settledCountsMaxAge = time.Minute
+
+// dropletCountsCache briefly caches the droplet counts of each policy, keyed
+// by the template's name, so that the frequent calls to Status don't all
+// list every droplet. It is safe for concurrent use.
+//
+// Every name has a generation, which is bumped whenever its counts are
+// invalidated, so that counts which were computed before e.g. a scaling
+// action changed the droplets are not cached after it.
+type dropletCountsCache struct {
+	clock quartz.Clock
+
+	mutex       sync.Mutex
+	entries     map[string]cachedDropletCounts
+	generations map[string]uint64
+}
+
+type cachedDropletCounts struct {
+	counts  *dropletCounts
+	expires time.Time
+	// listed is when the counts were cached, as the expired counts may
+	// still be reused by getSettled
+	listed time.Time
+}
+
+func newDropletCountsCache(clock quartz.Clock) *dropletCountsCache {
+	return &dropletCountsCache{
+		clock:       clock,
+		entries:     make(map[string]cachedDropletCounts),
+		generations: make(map[string]uint64),
+	}
+}
+
+// get returns the cached counts for the given name, if they have not yet
+// expired, along with the name's current generation, which must be passed to
+// put when caching counts computed after the call.
+func (c *dropletCountsCache) get(name string) (*dropletCounts, uint64, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	generation := c.generations[name]
+	entry, ok := c.entries[name]
+	if !ok || !c.clock.Now().Before(entry.expires) {
+		return nil, generation, false
+	}
+	return entry.counts, generation, true
+}
+
+// put caches the counts for the given name for the ttl. Nothing is cached if
+// the ttl is not positive, or if the counts have been invalidated since the
+// given generation was returned by get.
+func (c *dropletCountsCache) put(name string, generation uint64, counts *dropletCounts, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if generation != c.generations[name] {
+		return
+	}
+	now := c.clock.Now()
+	c.entries[name] = cachedDropletCounts{
+		counts:  counts,
+		expires: now.Add(ttl),
+		listed:  now,
+	}
+}
+
+// getSettled returns the counts cached for the given name even if they have
+// expired, as long as they were cached less than maxAge ago and all of the
+// droplets were ready then. They have not been invalidated since, so they
+// still hold unless droplets changed outside of scaling actions.
+func (c *dropletCountsCache) getSettled(name string, maxAge time.Duration) (*dropletCounts, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, ok := c.entries[name]
+	if !ok || c.clock.Since(entry.listed) >= maxAge || entry.counts.active != entry.counts.total {
+		return nil, false
+	}
+	return entry.counts, true
+}
+
+// invalidate forgets the cached counts for the given name, and stops any
+// counts computed before the call from being cached.
+func (c *dropletCountsCache) invalidate(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.entries, name)
+	c.generations[name]++
+}
+
+// resolvedNameTTL is how long the resources which names resolve to are
+// cached, so that a renamed or replaced resource is picked up eventually.
+const resolvedNameTTL = 10 * time.Minute
+
+// resolvedNamesCache caches what the names of resources resolve to, such as
+// the IDs of VPCs given by name, so that they are not looked up through the
+// API on every call to Status. Its zero value is ready to use, with the real
+// clock. It is safe for concurrent use.
+type resolvedNamesCache[T any] struct {
+	clock quartz.Clock
+
+	mutex   sync.Mutex
+	entries map[string]cachedResolution[T]
+}
+
+type cachedResolution[T any] struct {
+	value   T
+	expires time.Time
+}
+
+// resolve returns what the name with the given key resolved to, if it has
+// not yet expired, or resolves it again. Failures are not cached.
+func (c *resolvedNamesCache[T]) resolve(key string, resolve func() (T, error)) (T, error) {
+	c.mutex.Lock()
+	if c.clock == nil {
+		c.clock = quartz.NewReal()
+	}
+	entry, ok := c.entries[key]
+	now := c.clock.Now()
+	c.mutex.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.value, nil
+	}
+
+	// the mutex is not held while resolving, so that a slow request does
+	// not hold up the resolution of other names
+	value, err := resolve()
+	if err != nil {
+		return value, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]cachedResolution[T])
+	}
+	c.entries[key] = cachedResolution[T]{value: value, expires: now.Add(resolvedNameTTL)}
+	return value, nil
+}
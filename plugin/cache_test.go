@@ -0,0 +1,105 @@
+package plugin
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/coder/quartz"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDropletCountsCache(t *testing.T) {
+	clock := quartz.NewMock(t)
+	cache := newDropletCountsCache(clock)
+	counts := &dropletCounts{total: 2, active: 2}
+
+	_, generation, ok := cache.get("hashi-batch")
+	require.False(t, ok)
+
+	cache.put("hashi-batch", generation, counts, time.Second)
+	cached, _, ok := cache.get("hashi-batch")
+	require.True(t, ok)
+	require.Same(t, counts, cached)
+	_, _, ok = cache.get("unrelated")
+	require.False(t, ok)
+
+	// the counts expire after the ttl
+	clock.Advance(time.Second)
+	_, generation, ok = cache.get("hashi-batch")
+	require.False(t, ok)
+
+	// or when invalidated
+	cache.put("hashi-batch", generation, counts, time.Second)
+	cache.invalidate("hashi-batch")
+	_, _, ok = cache.get("hashi-batch")
+	require.False(t, ok)
+
+	// counts computed before an invalidation are not cached after it
+	cache.put("hashi-batch", generation, counts, time.Second)
+	_, generation, ok = cache.get("hashi-batch")
+	require.False(t, ok)
+
+	// a zero ttl disables caching
+	cache.put("hashi-batch", generation, counts, 0)
+	_, _, ok = cache.get("hashi-batch")
+	require.False(t, ok)
+}
+
+func TestDropletCountsCacheSettled(t *testing.T) {
+	clock := quartz.NewMock(t)
+	cache := newDropletCountsCache(clock)
+	settled := &dropletCounts{total: 2, active: 2}
+
+	// expired counts stand in for a while if all the droplets were ready
+	cache.put("hashi-batch", 0, settled, time.Second)
+	clock.Advance(time.Second)
+	_, _, ok := cache.get("hashi-batch")
+	require.False(t, ok)
+	cached, ok := cache.getSettled("hashi-batch", time.Minute)
+	require.True(t, ok)
+	require.Same(t, settled, cached)
+	clock.Advance(time.Minute)
+	_, ok = cache.getSettled("hashi-batch", time.Minute)
+	require.False(t, ok)
+
+	// but not if any droplet was not ready
+	cache.put("hashi-batch", 0, &dropletCounts{total: 2, active: 1}, time.Second)
+	_, ok = cache.getSettled("hashi-batch", time.Minute)
+	require.False(t, ok)
+
+	// nor once invalidated
+	cache.put("hashi-batch", 0, settled, time.Second)
+	cache.invalidate("hashi-batch")
+	_, ok = cache.getSettled("hashi-batch", time.Minute)
+	require.False(t, ok)
+}
+
+func TestResolvedNamesCache(t *testing.T) {
+	var cache resolvedNamesCache[int]
+	cache.clock = quartz.NewMock(t)
+	lookups := 0
+	resolve := func() (int, error) {
+		lookups++
+		if lookups == 1 {
+			return 0, errors.New("unavailable")
+		}
+		return lookups, nil
+	}
+
+	// failures are not cached
+	_, err := cache.resolve("nomad", resolve)
+	require.Error(t, err)
+	value, err := cache.resolve("nomad", resolve)
+	require.NoError(t, err)
+	require.Equal(t, 2, value)
+	value, err = cache.resolve("nomad", resolve)
+	require.NoError(t, err)
+	require.Equal(t, 2, value)
+	require.Equal(t, 2, lookups)
+
+	// other names are resolved on their own
+	value, err = cache.resolve("other", resolve)
+	require.NoError(t, err)
+	require.Equal(t, 3, value)
+}
@@ -1,14 +1,193 @@
 package plugin
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
 	"regexp"
 	"strings"
+	"text/template"
+	"time"
 
 	"github.com/goccy/go-yaml"
 )
 
+// MaxUserDataSize is the largest user data, in bytes, which DigitalOcean
+// accepts when creating a droplet.
+const MaxUserDataSize = 64 * 1024
+
+// ValidateUserDataSize returns an error if the user data is too large
+// to be accepted by DigitalOcean.
+func ValidateUserDataSize(userData string) error {
+	if overflow := len(userData) - MaxUserDataSize; overflow > 0 {
+		return fmt.Errorf(
+			"user data is %v bytes, which exceeds the %v byte limit by %v bytes",
+			len(userData),
+			MaxUserDataSize,
+			overflow,
+		)
+	}
+	return nil
+}
+
+const (
+	// userDataFetchTimeout limits how long fetching user data from a URL may take.
+	userDataFetchTimeout = 30 * time.Second
+	// maxFetchedUserDataSize is the largest user data, in bytes, which will
+	// be fetched from a URL. This is larger than MaxUserDataSize, as the user
+	// data may still be compressed.
+	maxFetchedUserDataSize = 1024 * 1024
+)
+
+// ResolveUserData returns the user data referred to by value. This may be an
+// http(s) URL to fetch the user data from, a path to a file containing the
+// user data, or otherwise the user data itself.
+func ResolveUserData(ctx context.Context, value string) (string, error) {
+	if len(value) == 0 {
+		return value, nil
+	}
+	if u, err := url.Parse(value); err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+		return fetchUserData(ctx, u.String())
+	}
+	content, err := os.ReadFile(value)
+	if err == nil {
+		// file was found at this location, so use its content
+		return string(content), nil
+	}
+	// otherwise, assume the string contains the user data
+	return value, nil
+}
+
+func fetchUserData(ctx context.Context, url string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, userDataFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to fetch user data from %v: %w", url, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to fetch user data from %v: %w", url, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to fetch user data from %v: %v", url, resp.Status)
+	}
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxFetchedUserDataSize+1))
+	if err != nil {
+		return "", fmt.Errorf("unable to fetch user data from %v: %w", url, err)
+	}
+	if len(content) > maxFetchedUserDataSize {
+		return "", fmt.Errorf(
+			"user data at %v is larger than %v bytes",
+			url,
+			maxFetchedUserDataSize,
+		)
+	}
+	return string(content), nil
+}
+
+// compressUserDataThreshold is the size, in bytes, above which user data is
+// compressed even if compression has not been requested.
+const compressUserDataThreshold = MaxUserDataSize * 3 / 4
+
+// CompressUserData gzips the user data. As DigitalOcean only accepts user
+// data as text, the compressed data is base64-encoded in a MIME multipart
+// message, which cloud-init will transparently decompress.
+func CompressUserData(userData string) (string, error) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	if _, err := gz.Write([]byte(userData)); err != nil {
+		return "", fmt.Errorf("unable to compress user data: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return "", fmt.Errorf("unable to compress user data: %w", err)
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"application/x-gzip"},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {`attachment; filename="user-data.gz"`},
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to create MIME part: %w", err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(compressed.Bytes())
+	// MIME requires base64 lines to be no longer than 76 characters
+	for len(encoded) > 76 {
+		_, _ = part.Write([]byte(encoded[:76] + "\r\n"))
+		encoded = encoded[76:]
+	}
+	_, _ = part.Write([]byte(encoded + "\r\n"))
+	if err := writer.Close(); err != nil {
+		return "", fmt.Errorf("unable to finish MIME message: %w", err)
+	}
+
+	return fmt.Sprintf(
+		"Content-Type: multipart/mixed; boundary=%q\r\nMIME-Version: 1.0\r\n\r\n%v",
+		writer.Boundary(),
+		body.String(),
+	), nil
+}
+
+// UserDataVariables are the values which a user data template can refer to,
+// such as {{ .Region }}.
+type UserDataVariables struct {
+	// Name is the name of the droplet pool.
+	Name string
+	// Region is the region the droplet is created in.
+	Region string
+	// Size is the preferred size of the droplet, which it is created with
+	// unless that size is unavailable.
+	Size string
+	// Index is the position of the droplet among those created in the region
+	// by the same scale-out, counting from 0.
+	Index int
+	// DropletName is the name of the droplet.
+	DropletName string
+}
+
+// RenderUserData renders the user data as a Go template with the variables.
+// Only the template language's built-in functions are available.
+func RenderUserData(userData string, variables UserDataVariables) (string, error) {
+	tmpl, err := template.New("user_data").Option("missingkey=error").Parse(userData)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse the user data template: %w", err)
+	}
+	var rendered strings.Builder
+	if err := tmpl.Execute(&rendered, variables); err != nil {
+		return "", fmt.Errorf("cannot render the user data template: %w", err)
+	}
+	return rendered.String(), nil
+}
+
+// PrepareUserData compresses the user data if requested, or if it is close
+// to the size limit, and verifies the result will be accepted by DigitalOcean.
+func PrepareUserData(userData string, compress bool) (string, error) {
+	if len(userData) != 0 && (compress || len(userData) > compressUserDataThreshold) {
+		var err error
+		userData, err = CompressUserData(userData)
+		if err != nil {
+			return "", err
+		}
+	}
+	if err := ValidateUserDataSize(userData); err != nil {
+		return "", err
+	}
+	return userData, nil
+}
+
 type CloudConfigPart struct {
 	Type    string `json:"type"`
 	Content string `json:"content"`
@@ -60,39 +239,54 @@ func (c *CloudConfigArchive) String() string {
 
 // PrependShellScriptToUserData will prepend a cloud-boothook section to the
 // existing user data, which may be empty, a
-// bare shell command, or using the cloud-config-archive format
+// bare shell command, a cloud-config document, or using the
+// cloud-config-archive format
 func PrependShellScriptToUserData(originalUserData, script string) (string, error) {
+	return insertShellScriptIntoUserData(originalUserData, script, true)
+}
+
+// AppendShellScriptToUserData is like PrependShellScriptToUserData, but the
+// script is run after any existing user data rather than before it
+func AppendShellScriptToUserData(originalUserData, script string) (string, error) {
+	return insertShellScriptIntoUserData(originalUserData, script, false)
+}
+
+func insertShellScriptIntoUserData(originalUserData, script string, prepend bool) (string, error) {
 	originalUserData = strings.TrimSpace(originalUserData)
-	cca := NewCloudConfigArchive(CloudConfigPart{Type: "text/x-shellscript", Content: script})
+	scriptPart := CloudConfigPart{Type: "text/x-shellscript", Content: script}
 
+	var originalParts []CloudConfigPart
+	switch {
 	// empty original data
-	if len(originalUserData) == 0 {
-		return cca.String(), nil
-	}
+	case len(originalUserData) == 0:
 
 	// MIME multipart
-	if strings.HasPrefix(originalUserData, "Content-Type:") {
+	case strings.HasPrefix(originalUserData, "Content-Type:"):
 		return "", errors.New("MIME multipart is not supported")
-	}
 
-	// raw shell script, so append to cloud config archive
-	if strings.HasPrefix(originalUserData, "#!") {
-		cca.Parts = append(
-			cca.Parts,
-			CloudConfigPart{Type: "text/x-shellscript", Content: originalUserData},
-		)
-		return cca.String(), nil
-	}
+	// raw shell script, so add to cloud config archive
+	case strings.HasPrefix(originalUserData, "#!"):
+		originalParts = []CloudConfigPart{{Type: "text/x-shellscript", Content: originalUserData}}
 
-	// cloud config archive, so just prepend another script
-	if strings.HasPrefix(originalUserData, "#cloud-config-archive\n") {
+	// cloud config archive, so just add another script
+	case strings.HasPrefix(originalUserData, "#cloud-config-archive\n"):
 		sections := strings.SplitN(originalUserData, "\n", 2)
 		originalCca, err := ParseCloudConfigArchive(sections[1])
 		if err != nil {
 			return "", fmt.Errorf("unable to parse original cloud-config-archive: %w", err)
 		}
-		cca.Parts = append(cca.Parts, originalCca.Parts...)
-		return cca.String(), nil
+		originalParts = originalCca.Parts
+
+	// cloud config, so wrap it as a part of the cloud config archive
+	case strings.HasPrefix(originalUserData, "#cloud-config\n"):
+		originalParts = []CloudConfigPart{{Type: "text/cloud-config", Content: originalUserData}}
+
+	default:
+		return "", errors.New("unrecognised user data format")
+	}
+
+	if prepend {
+		return NewCloudConfigArchive(append([]CloudConfigPart{scriptPart}, originalParts...)...).String(), nil
 	}
-	return "", errors.New("unrecognised user data format")
+	return NewCloudConfigArchive(append(originalParts, scriptPart)...).String(), nil
 }
@@ -1,6 +1,17 @@
 package plugin_test
 
 import (
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/Aiven-Open/nomad-droplets-autoscaler/plugin"
@@ -49,6 +60,25 @@ func TestCloudConfigArchive(t *testing.T) {
 `, result)
 }
 
+func TestCloudConfig(t *testing.T) {
+	result, err := plugin.PrependShellScriptToUserData(`#cloud-config
+runcmd:
+- echo "this is from a cloud-config." > /var/tmp/runcmd.txt
+`, ShellScript)
+	require.NoError(t, err)
+	require.Equal(t, `#cloud-config-archive
+- type: text/x-shellscript
+  content: |
+    #!/bin/bash
+    echo "Hello, world"
+- type: text/cloud-config
+  content: |
+    #cloud-config
+    runcmd:
+    - echo "this is from a cloud-config." > /var/tmp/runcmd.txt
+`, result)
+}
+
 func TestCloudConfigArchiveDifferentIndentationLevel(t *testing.T) {
 	result, err := plugin.PrependShellScriptToUserData(`#cloud-config-archive
 -   type: "text/cloud-boothook"
@@ -123,3 +153,182 @@ bootcmd:
 	)
 	require.Error(t, err)
 }
+
+func TestValidateUserDataSize(t *testing.T) {
+	require.NoError(t, plugin.ValidateUserDataSize(strings.Repeat("a", plugin.MaxUserDataSize)))
+	err := plugin.ValidateUserDataSize(strings.Repeat("a", plugin.MaxUserDataSize+10))
+	require.ErrorContains(t, err, "by 10 bytes")
+}
+
+func TestAppendEmpty(t *testing.T) {
+	result, err := plugin.AppendShellScriptToUserData("   ", ShellScript)
+	require.NoError(t, err)
+	require.Equal(t, `#cloud-config-archive
+- type: text/x-shellscript
+  content: |
+    #!/bin/bash
+    echo "Hello, world"
+`, result)
+}
+
+func TestAppendCloudConfigArchive(t *testing.T) {
+	result, err := plugin.AppendShellScriptToUserData(`#cloud-config-archive
+- type: "text/cloud-boothook"
+  content: |
+    #!/bin/sh
+    echo "this is from a boothook." > /var/tmp/boothook.txt
+- type: "text/cloud-config"
+  content: |
+    bootcmd:
+    - echo "this is from a cloud-config." > /var/tmp/bootcmd.txt
+`, ShellScript)
+	require.NoError(t, err)
+	require.Equal(t, `#cloud-config-archive
+- type: text/cloud-boothook
+  content: |
+    #!/bin/sh
+    echo "this is from a boothook." > /var/tmp/boothook.txt
+- type: text/cloud-config
+  content: |
+    bootcmd:
+    - echo "this is from a cloud-config." > /var/tmp/bootcmd.txt
+- type: text/x-shellscript
+  content: |
+    #!/bin/bash
+    echo "Hello, world"
+`, result)
+}
+
+func TestAppendCloudConfig(t *testing.T) {
+	result, err := plugin.AppendShellScriptToUserData(`#cloud-config
+runcmd:
+- echo "this is from a cloud-config." > /var/tmp/runcmd.txt
+`, ShellScript)
+	require.NoError(t, err)
+	require.Equal(t, `#cloud-config-archive
+- type: text/cloud-config
+  content: |
+    #cloud-config
+    runcmd:
+    - echo "this is from a cloud-config." > /var/tmp/runcmd.txt
+- type: text/x-shellscript
+  content: |
+    #!/bin/bash
+    echo "Hello, world"
+`, result)
+}
+
+func TestAppendShellScript(t *testing.T) {
+	result, err := plugin.AppendShellScriptToUserData(`#!/bin/sh
+shutdown -h 10
+`, ShellScript)
+	require.NoError(t, err)
+	require.Equal(t, `#cloud-config-archive
+- type: text/x-shellscript
+  content: |
+    #!/bin/sh
+    shutdown -h 10
+- type: text/x-shellscript
+  content: |
+    #!/bin/bash
+    echo "Hello, world"
+`, result)
+}
+
+func TestAppendMultipartMime(t *testing.T) {
+	_, err := plugin.AppendShellScriptToUserData(`Content-Type: multipart/mixed; boundary="==="
+MIME-Version: 1.0
+`, ShellScript)
+	require.Error(t, err)
+}
+
+func TestCompressUserData(t *testing.T) {
+	userData, err := plugin.PrependShellScriptToUserData(`#!/bin/sh
+shutdown -h 10
+`, ShellScript)
+	require.NoError(t, err)
+
+	compressed, err := plugin.CompressUserData(userData)
+	require.NoError(t, err)
+
+	msg, err := mail.ReadMessage(strings.NewReader(compressed))
+	require.NoError(t, err)
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	require.Equal(t, "multipart/mixed", mediaType)
+
+	part, err := multipart.NewReader(msg.Body, params["boundary"]).NextPart()
+	require.NoError(t, err)
+	require.Equal(t, "application/x-gzip", part.Header.Get("Content-Type"))
+
+	gz, err := gzip.NewReader(base64.NewDecoder(base64.StdEncoding, part))
+	require.NoError(t, err)
+	uncompressed, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	require.Equal(t, userData, string(uncompressed))
+}
+
+func TestPrepareUserData(t *testing.T) {
+	result, err := plugin.PrepareUserData(ShellScript, false)
+	require.NoError(t, err)
+	require.Equal(t, ShellScript, result)
+
+	result, err = plugin.PrepareUserData(ShellScript, true)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(result, "Content-Type: multipart/mixed"))
+
+	// large, but easily compressible
+	result, err = plugin.PrepareUserData(strings.Repeat("a", plugin.MaxUserDataSize+1), false)
+	require.NoError(t, err)
+	require.Less(t, len(result), plugin.MaxUserDataSize)
+}
+
+func TestResolveUserData(t *testing.T) {
+	ctx := t.Context()
+
+	result, err := plugin.ResolveUserData(ctx, ShellScript)
+	require.NoError(t, err)
+	require.Equal(t, ShellScript, result)
+
+	path := filepath.Join(t.TempDir(), "user-data.sh")
+	require.NoError(t, os.WriteFile(path, []byte(ShellScript), 0o600))
+	result, err = plugin.ResolveUserData(ctx, path)
+	require.NoError(t, err)
+	require.Equal(t, ShellScript, result)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/user-data.sh" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(ShellScript))
+	}))
+	defer server.Close()
+	result, err = plugin.ResolveUserData(ctx, server.URL+"/user-data.sh")
+	require.NoError(t, err)
+	require.Equal(t, ShellScript, result)
+
+	_, err = plugin.ResolveUserData(ctx, server.URL+"/missing.sh")
+	require.Error(t, err)
+}
+
+func TestRenderUserData(t *testing.T) {
+	variables := plugin.UserDataVariables{
+		Name:        "hashi-batch",
+		Region:      "lon1",
+		Size:        "s-1vcpu-1gb",
+		Index:       2,
+		DropletName: "hashi-batch-1234",
+	}
+	rendered, err := plugin.RenderUserData(
+		"#!/bin/sh\necho {{ .Name }} {{ .Region }} {{ .Size }} {{ .Index }} {{ .DropletName }}\n",
+		variables,
+	)
+	require.NoError(t, err)
+	require.Equal(t, "#!/bin/sh\necho hashi-batch lon1 s-1vcpu-1gb 2 hashi-batch-1234\n", rendered)
+
+	_, err = plugin.RenderUserData("#!/bin/sh\necho {{ .Name", variables)
+	require.ErrorContains(t, err, "cannot parse the user data template")
+	_, err = plugin.RenderUserData("#!/bin/sh\necho {{ .Token }}\n", variables)
+	require.ErrorContains(t, err, "cannot render the user data template")
+}
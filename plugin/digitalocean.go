@@ -4,132 +4,562 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"os"
+	"net/url"
+	"regexp"
 	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/coder/quartz"
 	"github.com/digitalocean/godo"
 	"github.com/google/uuid"
 	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/scaleutils"
 	"github.com/hashicorp/nomad/api"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
-	defaultRetryInterval = 10 * time.Second
-	defaultRetryLimit    = 15
+	defaultRetryLimit = 15
+
+	// by default, Nomad nodes are matched to droplets by their hostname,
+	// which is the droplet's name
+	defaultNodeIDAttribute = "unique.hostname"
+
+	// scaleInStrategyOldestFirst makes scale in prefer deleting the oldest
+	// droplets, e.g. to roll out a new image.
+	scaleInStrategyOldestFirst = "oldest_first"
+
+	// each API request is given up on after this long, so that a single
+	// stuck request cannot stall a scaling action indefinitely
+	defaultRequestTimeout = 30 * time.Second
+
+	// waiting for droplets to become stable starts with short intervals,
+	// which double after each attempt up to stableRetryMaxInterval.
+	stableRetryInterval    = 2 * time.Second
+	stableRetryMaxInterval = 30 * time.Second
+
+	// defaultMaxCreateConcurrency is how many droplets may be created at once.
+	defaultMaxCreateConcurrency = 10
+
+	// defaultMaxDeleteConcurrency is how many droplets may be deleted at once.
+	defaultMaxDeleteConcurrency = 10
+
+	// maxTagDeleteConcurrency is how many unused tags may be deleted at once.
+	maxTagDeleteConcurrency = 5
+
+	// at most tagDeleteBurst unused tags are deleted at once, after which
+	// one more may be deleted every tagDeleteRechargePeriod. This leaves
+	// most of the API rate limit for scaling.
+	tagDeleteBurst          = 10
+	tagDeleteRechargePeriod = time.Second
+
+	// unusedTagGracePeriod is how long a tag must have existed for before
+	// it is cleaned up for being unused, as it may not have been assigned
+	// to its droplet yet.
+	unusedTagGracePeriod = time.Minute
+
+	// the default interval between, and number of, checks for a new
+	// droplet's network information, before it can be used for secure
+	// introduction.
+	defaultNetworkWaitInterval = 6 * time.Second
+	defaultNetworkWaitAttempts = 10
+
+	// defaultShutdownTimeout is how long to wait for a droplet to power off
+	// before deleting it anyway.
+	defaultShutdownTimeout = 5 * time.Minute
 )
 
 type dropletTemplate struct {
-	createReservedAddresses     bool
-	ipv6                        bool
-	name                        string
-	region                      string
-	reserveIPv4Addresses        bool
-	reserveIPv6Addresses        bool
+	// account identifies the account of the droplets, so that pools of the
+	// same name in different accounts are told apart
+	account                             string
+	adoptDropletIDs                     []int
+	backupPolicy                        *godo.DropletBackupPolicyRequest
+	backups                             bool
+	bulkDelete                          bool
+	client                              DigitalOceanWrapper
+	compressUserData                    bool
+	countCacheTTL                       time.Duration
+	createReservedAddresses             bool
+	createStagger                       time.Duration
+	drainDeadline                       time.Duration
+	dropletAgent                        *bool
+	dryRun                              bool
+	firewallID                          string
+	forceDelete                         bool
+	ipv6                                bool
+	maxCount                            int64
+	maxCreateConcurrency                int
+	maxDeleteConcurrency                int
+	minCount                            int64
+	monitoring                          bool
+	name                                string
+	nameTemplate                        string
+	nodeJoinTimeout                     time.Duration
+	projectID                           string
+	readyCheckPort                      int
+	readyCheckTimeout                   time.Duration
+	readyGracePeriod                    time.Duration
+	reclaimOrphanedAddresses            bool
+	reservationExpiry                   time.Duration
+	reservationWaitInterval             time.Duration
+	reservationWaitTimeout              time.Duration
+	requestTimeout                      time.Duration
+	rollbackOnFailure                   bool
+	scaleActionTimeout                  time.Duration
+	scaleInStrategy                     string
+	scaleOutNotifyProxy                 *url.URL
+	scaleOutNotifyTimeout               time.Duration
+	scaleOutNotifyURL                   string
+	regions                             []string
+	reservedAddressesPool               *ReservedAddressesPool
+	reserveIPv4Addresses                bool
+	reserveIPv6Addresses                bool
+	pinnedIPv4Addresses                 []string
+	pinnedIPv6Addresses                 []string
+	secureIntroductionAppend            bool
+	secureIntroductionBindSecretIdCidrs bool
+	// secureIntroduction is set if new droplets are given a secret
+	secureIntroduction          bool
 	secureIntroductionAppRole   string
+	secureIntroductionPreShared bool
 	secureIntroductionTagPrefix string
+	networkWaitAttempts         int
+	networkWaitInterval         time.Duration
+	secretNumUses               int
 	secretValidity              time.Duration
 	wrappedSecretValidity       time.Duration
-	secureIntroductionFilename  string
-	size                        string
+	secureIntroductionFilenames []string
+	secureIntroductionFileOwner string
+	shutdownTimeout             time.Duration
+	sizes                       []string
 	snapshotID                  int
 	sshKeys                     []string
+	statePollInterval           time.Duration
+	statePollMaxInterval        time.Duration
 	tags                        []string
 	userData                    string
+	userDataTemplate            bool
+	vaultAppRoleMount           string
+	volumes                     []string
 	vpc                         string
 }
 
+// clock returns the clock which retries wait on. It is the clock of the
+// reserved addresses pool, so that tests may replace it.
+func (d *dropletTemplate) clock() quartz.Clock {
+	if d.reservedAddressesPool == nil {
+		return quartz.NewReal()
+	}
+	return d.reservedAddressesPool.clock
+}
+
+// poolKey identifies the template's pool of droplets, by account and name.
+func (d *dropletTemplate) poolKey() string {
+	return d.account + "/" + d.name
+}
+
+// clampCount bounds the desired number of droplets by the configured minimum
+// and maximum.
+func (d *dropletTemplate) clampCount(count int64) int64 {
+	return min(max(count, d.minCount), d.maxCount)
+}
+
+// prereservationExpiry returns how long addresses are provisionally reserved
+// for a batch of count droplets, which must be long enough for the last of
+// them to be created. Unless an expiry is configured, each wave of droplets
+// created concurrently is given the default expiry, on top of the stagger
+// between their creations.
+func (d *dropletTemplate) prereservationExpiry(count int) time.Duration {
+	if d.reservationExpiry > 0 {
+		return d.reservationExpiry
+	}
+	concurrency := max(d.maxCreateConcurrency, 1)
+	waves := max((count+concurrency-1)/concurrency, 1)
+	return time.Duration(waves)*defaultPrereservationExpiry + time.Duration(max(count-1, 0))*d.createStagger
+}
+
+// renderUserData renders the user data template for the i-th droplet created
+// in the region.
+func (d *dropletTemplate) renderUserData(userData, region, dropletName string, i int) (string, error) {
+	return RenderUserData(userData, UserDataVariables{
+		Name:        d.name,
+		Region:      region,
+		Size:        d.sizes[0],
+		Index:       i,
+		DropletName: dropletName,
+	})
+}
+
+// secretIdOptions returns the options for generating secure introduction
+// SecretIDs for the droplets.
+func (d *dropletTemplate) secretIdOptions() []SecretIdOption {
+	return []SecretIdOption{
+		WithAppRoleMountPath(d.vaultAppRoleMount),
+		WithSecretIdCidrs(d.secureIntroductionBindSecretIdCidrs),
+		WithNumUses(d.secretNumUses),
+	}
+}
+
+// scaleOut creates diff droplets from the template. It returns the IDs of the
+// droplets it created, even when it then fails, including any droplets which
+// were deleted again by a rollback.
 func (t *TargetPlugin) scaleOut(
 	ctx context.Context,
+	outcome *scalingOutcome,
 	desired, diff int64,
 	template *dropletTemplate,
 	config map[string]string,
-) error {
-	log := t.logger.With("action", "scale_out")
+) (_ []int, err error) {
+	ctx, span := startSpan(ctx, "scale_out",
+		attribute.String(logKeyTag, template.name),
+		attribute.StringSlice("regions", template.regions),
+		attribute.Int64("desired", desired),
+		attribute.Int64("count", diff))
+	defer func() { endSpan(span, err) }()
+
+	log := t.logger.With(logKeyAction, "scale_out", logKeyTag, template.name)
 
 	log.Debug("creating DigitalOcean droplets", "template", fmt.Sprintf("%+v", template))
 
+	// the notification lists the reserved addresses assigned to each
+	// droplet, so they are recorded even when no summary is being logged
+	if template.scaleOutNotifyURL != "" && outcome == nil {
+		outcome = &scalingOutcome{}
+	}
+
 	ctx, cancel := context.WithCancelCause(ctx)
 	defer cancel(nil)
+
+	// check the user data before any addresses are reserved or secrets are
+	// generated, as DigitalOcean would reject it anyway
+	userData, err := ResolveUserData(ctx, template.userData)
+	if err != nil {
+		return nil, err
+	}
+	checkedUserData := userData
+	if template.userDataTemplate {
+		checkedUserData, err = template.renderUserData(userData, template.regions[0], "", 0)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user data: %w", err)
+		}
+	}
+	if _, err := PrepareUserData(checkedUserData, template.compressUserData); err != nil {
+		return nil, fmt.Errorf("invalid user data: %w", err)
+	}
+
+	// likewise, check the image can be used before creating any droplets
+	if err := validateImage(ctx, template.client.Images(), template.snapshotID, template.regions); err != nil {
+		return nil, fmt.Errorf("invalid %v: %w", configKeySnapshotID, err)
+	}
+
+	if template.dryRun {
+		log.Info("dry run: would create droplets",
+			"count", diff,
+			"desired", desired,
+			"regions", template.regions,
+			"sizes", template.sizes,
+			"image", template.snapshotID,
+			"reserve_ipv4_addresses", template.reserveIPv4Addresses,
+			"reserve_ipv6_addresses", template.reserveIPv6Addresses,
+			"create_reserved_addresses", template.createReservedAddresses,
+			"volumes", template.volumes)
+		return nil, nil
+	}
+
+	// try each region in turn, only moving on to the next one if there
+	// is not enough capacity in the current one
+	remaining := int(diff)
+	regionErrors := make([]error, 0, len(template.regions))
+	var createdIDs []int
+	for _, region := range template.regions {
+		created, err := t.createDropletsInRegion(
+			ctx,
+			outcome,
+			log.With(logKeyRegion, region),
+			remaining,
+			region,
+			userData,
+			template,
+		)
+		remaining -= len(created)
+		createdIDs = append(createdIDs, created...)
+		if err == nil {
+			break
+		}
+		if !isCapacityError(err) {
+			// other regions share the account's droplet limit, so there is
+			// no point trying them
+			if isDropletLimitError(err) {
+				err = &CapacityError{Err: err}
+			}
+			return createdIDs, t.rollBackScaleOut(ctx, outcome, log, template, createdIDs, err)
+		}
+		log.Warn("insufficient capacity in region",
+			logKeyRegion, region,
+			"remaining droplets", remaining,
+			"error", err)
+		regionErrors = append(regionErrors, fmt.Errorf("region %v: %w", region, err))
+	}
+	if remaining > 0 {
+		err := fmt.Errorf(
+			"failed to create %v droplets in any configured region: %w",
+			remaining,
+			&CapacityError{Regions: template.regions, Err: errors.Join(regionErrors...)},
+		)
+		return createdIDs, t.rollBackScaleOut(ctx, outcome, log, template, createdIDs, err)
+	}
+
+	log.Debug("successfully created DigitalOcean droplets")
+
+	if err := t.ensureDropletsAreStable(ctx, template, desired, "out"); err != nil {
+		return createdIDs, fmt.Errorf("failed to confirm scale out DigitalOcean droplets: %w", err)
+	}
+
+	log.Debug("scale out DigitalOcean droplets confirmed")
+
+	if template.readyCheckPort != 0 {
+		if err := t.waitForDropletsToBeReachable(ctx, template, createdIDs); err != nil {
+			return createdIDs, fmt.Errorf("failed to confirm scale out DigitalOcean droplets are reachable: %w", err)
+		}
+		log.Debug("scale out DigitalOcean droplets are reachable")
+	}
+
+	if template.nodeJoinTimeout > 0 {
+		err := t.waitForNodesToJoin(ctx, template, config, desired)
+		if err != nil {
+			return createdIDs, fmt.Errorf("failed to confirm scale out Nomad nodes: %w", err)
+		}
+		log.Debug("scale out Nomad nodes confirmed")
+	}
+
+	t.notifyScaleOut(outcome, log, template, createdIDs)
+
+	return createdIDs, nil
+}
+
+// rollBackScaleOut deletes the droplets created by a failed scale out, if
+// the template asks for it, so that the pool returns to its prior size. The
+// error of the scale out is returned, along with any error rolling back.
+func (t *TargetPlugin) rollBackScaleOut(
+	ctx context.Context,
+	outcome *scalingOutcome,
+	log hclog.Logger,
+	template *dropletTemplate,
+	createdIDs []int,
+	err error,
+) error {
+	if !template.rollbackOnFailure || len(createdIDs) == 0 {
+		return err
+	}
+	log.Warn("rolling back scale out", "droplets", createdIDs, "error", err)
+	// the droplets are deleted even if the scale out was aborted, e.g. as
+	// it ran out of time
+	ctx = context.WithoutCancel(ctx)
+	instanceIDs := make(map[string]string, len(createdIDs))
+	for _, id := range createdIDs {
+		instanceIDs[strconv.Itoa(id)] = ""
+	}
+	if rollbackErr := t.deleteDroplets(ctx, outcome, template, instanceIDs); rollbackErr != nil {
+		return errors.Join(err, fmt.Errorf("failed to roll back scale out: %w", rollbackErr))
+	}
+	return err
+}
+
+// createDropletsInRegion concurrently creates count droplets in the given
+// region. It returns the IDs of the droplets which were created, along with
+// the errors for those which were not. The provisional reservations of
+// addresses which were not assigned to a droplet are released.
+func (t *TargetPlugin) createDropletsInRegion(
+	ctx context.Context,
+	outcome *scalingOutcome,
+	log hclog.Logger,
+	count int,
+	region string,
+	userData string,
+	template *dropletTemplate,
+) ([]int, error) {
 	wg := &sync.WaitGroup{}
 	var prereservedIPV4s []string
 	var prereservedIPV6s []string
 	var err error
+	if template.reclaimOrphanedAddresses &&
+		(template.reserveIPv4Addresses || template.reserveIPv6Addresses) {
+		// addresses still assigned to droplets deleted out-of-band would
+		// otherwise never be considered available again
+		listDroplets := func(ctx context.Context) ([]godo.Droplet, error) {
+			return t.listDroplets(ctx, template)
+		}
+		if _, err := template.reservedAddressesPool.ReclaimOrphanedAddresses(ctx, template.name, listDroplets); err != nil {
+			log.Warn("cannot reclaim orphaned reserved IP addresses", "error", err)
+		}
+	}
+	// the pinned addresses which are free go to the first new droplets, and
+	// the others get whichever addresses are available
 	if template.reserveIPv4Addresses {
-		prereservedIPV4s, err = t.reservedAddressesPool.PrereserveIPs(
+		prereservedIPV4s = template.reservedAddressesPool.ReservePinnedIPs(
 			ctx,
-			int(diff),
-			template.region,
+			template.pinnedIPv4Addresses,
+			count,
+			region,
+			template.prereservationExpiry(count),
+		)
+		others, err := template.reservedAddressesPool.PrereserveIPs(
+			ctx,
+			count-len(prereservedIPV4s),
+			region,
+			template.name,
 			template.createReservedAddresses,
-			5*time.Minute,
+			template.prereservationExpiry(count),
 		)
 		if err != nil {
-			return fmt.Errorf("cannot pre-reserve %v IPv4 addresses: %w", diff, err)
+			template.reservedAddressesPool.ReleasePrereservations(prereservedIPV4s...)
+			return nil, fmt.Errorf("cannot pre-reserve %v IPv4 addresses: %w", count, err)
 		}
+		prereservedIPV4s = append(prereservedIPV4s, others...)
 	}
 	if template.reserveIPv6Addresses {
-		prereservedIPV6s, err = t.reservedAddressesPool.PrereserveIPV6s(
+		prereservedIPV6s = template.reservedAddressesPool.ReservePinnedIPs(
 			ctx,
-			int(diff),
-			template.region,
+			template.pinnedIPv6Addresses,
+			count,
+			region,
+			template.prereservationExpiry(count),
+		)
+		others, err := template.reservedAddressesPool.PrereserveIPV6s(
+			ctx,
+			count-len(prereservedIPV6s),
+			region,
+			template.name,
 			template.createReservedAddresses,
-			5*time.Minute,
+			template.prereservationExpiry(count),
 		)
 		if err != nil {
-			return fmt.Errorf("cannot pre-reserve %v IPv6 addresses: %w", diff, err)
+			template.reservedAddressesPool.ReleasePrereservations(prereservedIPV4s...)
+			template.reservedAddressesPool.ReleasePrereservations(prereservedIPV6s...)
+			return nil, fmt.Errorf("cannot pre-reserve %v IPv6 addresses: %w", count, err)
+		}
+		prereservedIPV6s = append(prereservedIPV6s, others...)
+	}
+	var volumeIDs []string
+	if len(template.volumes) != 0 {
+		volumeIDs, err = availableVolumes(ctx, template.client.Storage(), template.volumes, region)
+		if err != nil {
+			template.reservedAddressesPool.ReleasePrereservations(prereservedIPV4s...)
+			template.reservedAddressesPool.ReleasePrereservations(prereservedIPV6s...)
+			return nil, err
 		}
+		if len(volumeIDs) < count {
+			template.reservedAddressesPool.ReleasePrereservations(prereservedIPV4s...)
+			template.reservedAddressesPool.ReleasePrereservations(prereservedIPV6s...)
+			return nil, fmt.Errorf(
+				"cannot attach volumes to %v new droplets: only %v of the %v configured volumes are unattached in region %v",
+				count,
+				len(volumeIDs),
+				len(template.volumes),
+				region,
+			)
+		}
+	}
+	// the droplets are all introduced by the same backend, even if the
+	// configuration is reloaded meanwhile
+	vault := t.secrets()
+	// every droplet reports its result, as a droplet may have been created
+	// even though a later step failed
+	type creationResult struct {
+		dropletID int
+		err       error
 	}
-	errorChannel := make(chan error)
+	results := make(chan creationResult)
+	semaphore := make(chan struct{}, template.maxCreateConcurrency)
 
-	for i := int64(0); i < diff; i++ {
+	var staggerErr error
+	for i := 0; i < count; i++ {
+		// spread out the creations, if configured, to smooth the load on
+		// the API
+		if i > 0 && template.createStagger > 0 {
+			timer := template.reservedAddressesPool.clock.NewTimer(template.createStagger)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				staggerErr = fmt.Errorf("%v droplets were not created: %w", count-i, ctx.Err())
+			case <-timer.C:
+			}
+			if staggerErr != nil {
+				break
+			}
+		}
 		wg.Add(1)
-		// create each droplet concurrently. If there is a problem,
-		// return the error via the channel.
+		// create each droplet concurrently, but no more than the configured
+		// number at a time. If there is a problem, return the error via the channel.
 		go func(i int) {
+			defer wg.Done()
+			ctx, span := startSpan(ctx, "create_droplet",
+				attribute.String(logKeyRegion, region),
+				attribute.Int("index", i))
+			var dropletID int
 			err := (func() error {
-				defer wg.Done()
+				select {
+				case semaphore <- struct{}{}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				released := false
+				release := func() {
+					if !released {
+						released = true
+						<-semaphore
+					}
+				}
+				defer release()
 				randomIdentifier := uuid.Must(uuid.NewRandom())
 				createRequest := &godo.DropletCreateRequest{
-					Name:    template.name + "-" + randomIdentifier.String(),
-					Region:  template.region,
-					Size:    template.size,
+					Name:    renderDropletName(template.nameTemplate, template.name, region, randomIdentifier, i),
+					Region:  region,
 					VPCUUID: template.vpc,
 					Image: godo.DropletCreateImage{
 						ID: template.snapshotID,
 					},
-					Tags: template.tags,
-					IPv6: template.ipv6,
+					Tags:             template.dropletTags(),
+					IPv6:             template.ipv6,
+					Backups:          template.backups,
+					BackupPolicy:     template.backupPolicy,
+					Monitoring:       template.monitoring,
+					WithDropletAgent: template.dropletAgent,
 				}
 
 				if len(template.sshKeys) != 0 {
 					createRequest.SSHKeys = sshKeyMap(template.sshKeys)
 				}
 
-				if len(template.userData) != 0 {
-					content, err := os.ReadFile(template.userData)
-					if err == nil {
-						// file was found at this location, so use its content
-						createRequest.UserData = string(content)
-					} else {
-						// assume the string contains the user data
-						createRequest.UserData = template.userData
+				if len(volumeIDs) != 0 {
+					createRequest.Volumes = []godo.DropletCreateVolume{{ID: volumeIDs[i]}}
+				}
+
+				createRequest.UserData = userData
+				if template.userDataTemplate {
+					var err error
+					createRequest.UserData, err = template.renderUserData(userData, region, createRequest.Name, i)
+					if err != nil {
+						return fmt.Errorf("invalid user data: %w", err)
 					}
 				}
 
-				if template.secureIntroductionAppRole != "" &&
-					template.secureIntroductionFilename != "" {
+				if template.secureIntroduction &&
+					len(template.secureIntroductionFilenames) > 0 {
 					var allowedIPv4 string
 					var allowedIPv6 string
 					if template.reserveIPv4Addresses {
 						allowedIPv4 = prereservedIPV4s[i]
 					}
-					if template.reserveIPv4Addresses {
+					if template.reserveIPv6Addresses {
 						allowedIPv6 = prereservedIPV6s[i]
 					}
 
+					var err error
 					createRequest.UserData, err = generateUserDataForSecureIntroduction(
 						ctx,
 						log.With("droplet scale-out index", i),
@@ -137,108 +567,214 @@ func (t *TargetPlugin) scaleOut(
 						allowedIPv4,
 						allowedIPv6,
 						template,
-						t.vault,
+						vault,
 					)
 					if err != nil {
 						return err
 					}
 				}
 
-				droplet, _, err := t.client.Droplets().Create(ctx, createRequest)
+				var err error
+				createRequest.UserData, err = PrepareUserData(createRequest.UserData, template.compressUserData)
+				if err != nil {
+					return fmt.Errorf("invalid user data: %w", err)
+				}
+
+				// try each size in turn, only moving on to the next one
+				// if the current one is unavailable
+				var droplet *godo.Droplet
+				for _, size := range template.sizes {
+					createRequest.Size = size
+					droplet, _, err = template.client.Droplets().Create(ctx, createRequest)
+					if !isSizeUnavailableError(err) {
+						break
+					}
+					log.Warn("droplet size is unavailable", "size", size, "error", err)
+				}
 				if err != nil {
 					return fmt.Errorf("failed to scale out DigitalOcean droplets: %w", err)
 				}
-				log := log.With("droplet ID", strconv.Itoa(droplet.ID))
-				log.Info("Created droplet")
+				dropletID = droplet.ID
+				span.SetAttributes(attribute.Int(logKeyDropletID, droplet.ID))
+				log := log.With(logKeyDropletID, strconv.Itoa(droplet.ID))
+				log.Info("Created droplet", "size", createRequest.Size)
+				dropletsCreated.WithLabelValues(template.name).Inc()
+				outcome.dropletCreated(region)
+				if template.projectID != "" {
+					// moving a droplet between projects may conflict with its
+					// provisioning, which shows up as a 422 response
+					if err := RetryOnTransientError(ctx, log, template.name, func(ctx context.Context, cancel context.CancelCauseFunc) error {
+						_, _, err := template.client.Projects().AssignResources(ctx, template.projectID, droplet.URN())
+						return err
+					}); err != nil {
+						return fmt.Errorf(
+							"failed to assign droplet %v to project %v: %w",
+							droplet.ID,
+							template.projectID,
+							err,
+						)
+					}
+				}
+				if template.firewallID != "" {
+					// firewall membership changes often conflict with other
+					// operations on the droplet, which shows up as a 422 response
+					if err := RetryOnTransientError(ctx, log, template.name, func(ctx context.Context, cancel context.CancelCauseFunc) error {
+						_, err := template.client.Firewalls().AddDroplets(ctx, template.firewallID, droplet.ID)
+						return err
+					}); err != nil {
+						return fmt.Errorf(
+							"failed to add droplet %v to firewall %v: %w",
+							droplet.ID,
+							template.firewallID,
+							err,
+						)
+					}
+				}
+				if template.reserveIPv4Addresses || template.reserveIPv6Addresses {
+					// the droplet may not be ready for addresses to be
+					// assigned as soon as it has been created. Waiting for it
+					// does not hold up the creation of the other droplets
+					release()
+					if err := waitForDropletNetwork(ctx, log, template, droplet.ID); err != nil {
+						return err
+					}
+				}
 				if template.reserveIPv4Addresses {
-					if err := t.reservedAddressesPool.AssignIPv4(ctx, droplet.ID, prereservedIPV4s[i]); err != nil {
+					if err := template.reservedAddressesPool.AssignIPv4(ctx, droplet.ID, prereservedIPV4s[i], template.name); err != nil {
 						return fmt.Errorf(
 							"failed to assign static IPv4 to droplet %v: %w",
 							droplet.ID,
 							err,
 						)
 					}
+					reservedIPsAssigned.WithLabelValues(template.name, "ipv4").Inc()
+					outcome.reservedIPAssigned(droplet.ID, prereservedIPV4s[i])
 				}
 				if template.reserveIPv6Addresses {
-					if err := t.reservedAddressesPool.AssignIPv6(ctx, droplet.ID, prereservedIPV6s[i]); err != nil {
+					if err := template.reservedAddressesPool.AssignIPv6(ctx, droplet.ID, prereservedIPV6s[i], template.name); err != nil {
 						return fmt.Errorf(
 							"failed to assign static IPv6 to droplet %v: %w",
 							droplet.ID,
 							err,
 						)
 					}
+					reservedIPsAssigned.WithLabelValues(template.name, "ipv6").Inc()
+					outcome.reservedIPAssigned(droplet.ID, prereservedIPV6s[i])
 				}
 
-				if template.secureIntroductionAppRole != "" &&
+				if template.secureIntroduction &&
 					template.secureIntroductionTagPrefix != "" {
-					if err := generateTagForSecureIntroduction(ctx, log, template, droplet.ID, template.ipv6, t.vault, t.client.Droplets(), t.client.Tags()); err != nil {
+					if err := generateTagForSecureIntroduction(ctx, log, template, droplet.ID, template.ipv6, vault, template.client.Droplets(), template.client.Tags()); err != nil {
 						return err
 					}
 				}
 				return nil
 			})()
+			endSpan(span, err)
 			if err != nil {
 				log.Error("failed to create droplet",
 					"scale-out index", i,
 					"error", err)
-				errorChannel <- err
 			}
-		}(int(i))
+			results <- creationResult{dropletID: dropletID, err: err}
+		}(i)
 	}
 	go func() {
 		wg.Wait()
-		close(errorChannel)
+		close(results)
 	}()
+	var createdIDs []int
 	errorList := make([]error, 0)
-	for err := range errorChannel {
-		errorList = append(errorList, err)
+	for result := range results {
+		if result.dropletID != 0 {
+			createdIDs = append(createdIDs, result.dropletID)
+		}
+		if result.err != nil {
+			errorList = append(errorList, result.err)
+		}
 	}
-	if len(errorList) > 0 {
-		return errors.Join(errorList...)
+	if staggerErr != nil {
+		errorList = append(errorList, staggerErr)
 	}
-
-	log.Debug("successfully created DigitalOcean droplets")
-
-	if err := t.ensureDropletsAreStable(ctx, template, desired); err != nil {
-		return fmt.Errorf("failed to confirm scale out DigitalOcean droplets: %w", err)
+	if len(errorList) != 0 {
+		// addresses which were assigned are no longer provisionally
+		// reserved, so only those of the failed droplets are released
+		template.reservedAddressesPool.ReleasePrereservations(prereservedIPV4s...)
+		template.reservedAddressesPool.ReleasePrereservations(prereservedIPV6s...)
 	}
-
-	log.Debug("scale out DigitalOcean droplets confirmed")
-
-	return nil
+	return createdIDs, errors.Join(errorList...)
 }
 
 func (t *TargetPlugin) scaleIn(
 	ctx context.Context,
+	outcome *scalingOutcome,
 	desired, diff int64,
 	template *dropletTemplate,
 	config map[string]string,
-) error {
-	ids, err := t.clusterUtils.RunPreScaleInTasks(ctx, config, int(diff))
-	if err != nil {
-		return fmt.Errorf("failed to perform pre-scale Nomad scale in tasks: %w", err)
+) (err error) {
+	ctx, span := startSpan(ctx, "scale_in",
+		attribute.String(logKeyTag, template.name),
+		attribute.Int64("desired", desired),
+		attribute.Int64("count", diff))
+	defer func() { endSpan(span, err) }()
+
+	// the pre-scale in tasks drain the selected nodes, so they are skipped
+	// as well when only logging what would be done
+	if template.dryRun {
+		t.logger.Info("dry run: would delete droplets",
+			logKeyAction, "scale_in",
+			logKeyTag, template.name,
+			"count", diff,
+			"desired", desired,
+			"force_delete", template.forceDelete)
+		return nil
+	}
+
+	var ids []scaleutils.NodeResourceID
+	if template.scaleInStrategy == scaleInStrategyOldestFirst {
+		// only as many of the oldest droplets as are being removed are
+		// candidates, so Nomad's node selector strategy has no choice
+		oldest, err := t.oldestDropletRemoteIDs(ctx, template, int(diff))
+		if err != nil {
+			return fmt.Errorf("failed to find the oldest droplets: %w", err)
+		}
+		ids, err = t.clusterUtils.RunPreScaleInTasksWithRemoteCheck(ctx, config, oldest, int(diff))
+		if err != nil {
+			return fmt.Errorf("failed to perform pre-scale Nomad scale in tasks: %w", err)
+		}
+	} else {
+		ids, err = t.clusterUtils.RunPreScaleInTasks(ctx, config, int(diff))
+		if err != nil {
+			return fmt.Errorf("failed to perform pre-scale Nomad scale in tasks: %w", err)
+		}
 	}
 
-	// Grab the instanceIDs
-	instanceIDs := make(map[string]struct{})
+	// Grab the instanceIDs, along with the IDs of their Nomad nodes
+	instanceIDs := make(map[string]string)
 
 	for _, node := range ids {
-		instanceIDs[node.RemoteResourceID] = struct{}{}
+		instanceIDs[node.RemoteResourceID] = node.NomadNodeID
 	}
 
 	// Create a logger for this action to pre-populate useful information we
 	// would like on all log lines.
-	log := t.logger.With("action", "scale_in", "tag", template.name, "instances", ids)
+	log := t.logger.With(logKeyAction, "scale_in", logKeyTag, template.name, "instances", ids)
 
 	log.Debug("deleting DigitalOcean droplets")
 
-	if err := t.deleteDroplets(ctx, template.name, instanceIDs); err != nil {
+	// when scaling in to zero, or if asked to, the droplets are deleted
+	// together rather than one by one
+	deleteDroplets := t.deleteDroplets
+	if desired == 0 || template.bulkDelete {
+		deleteDroplets = t.bulkDeleteDroplets
+	}
+	if err := deleteDroplets(ctx, outcome, template, instanceIDs); err != nil {
 		return fmt.Errorf("failed to delete instances: %w", err)
 	}
 
 	log.Debug("successfully started deletion process")
 
-	if err := t.ensureDropletsAreStable(ctx, template, desired); err != nil {
+	if err := t.ensureDropletsAreStable(ctx, template, desired, "in"); err != nil {
 		return fmt.Errorf("failed to confirm scale in DigitalOcean droplets: %w", err)
 	}
 
@@ -249,17 +785,101 @@ func (t *TargetPlugin) scaleIn(
 		return fmt.Errorf("failed to perform post-scale Nomad scale in tasks: %w", err)
 	}
 
+	// the clean up outlives the scaling action, whose context is done as
+	// soon as it returns, so it only stops with the plugin
 	if tagPrefix := template.secureIntroductionTagPrefix; tagPrefix != "" {
-		go cleanUpUnusedTags(ctx, log, t.client, template.secureIntroductionTagPrefix)
+		go t.cleanUpTags(t.ctx, log, template.client, template.clock(), tagPrefix)
 	}
 
 	return nil
 }
 
+// taggedAccount is an account in which the tags of a secure introduction tag
+// prefix are created.
+type taggedAccount struct {
+	tagPrefix string
+	client    DigitalOceanWrapper
+	clock     quartz.Clock
+}
+
+// rememberTagPrefix records the template's secure introduction tag prefix,
+// if any, along with its account, so that the tag reaper cleans up its
+// unused tags.
+func (t *TargetPlugin) rememberTagPrefix(template *dropletTemplate) {
+	if prefix := template.secureIntroductionTagPrefix; prefix != "" {
+		t.tagPrefixes.Store(template.account+"/"+prefix, taggedAccount{
+			tagPrefix: prefix,
+			client:    template.client,
+			clock:     template.clock(),
+		})
+	}
+}
+
+// reapUnusedTags periodically cleans up the unused tags of every secure
+// introduction tag prefix seen so far, regardless of scaling activity. It
+// returns when the context is cancelled.
+func (t *TargetPlugin) reapUnusedTags(ctx context.Context, interval time.Duration) {
+	ticker := t.reservedAddressesPool.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		t.tagPrefixes.Range(func(_, value any) bool {
+			tagged := value.(taggedAccount)
+			t.cleanUpTags(
+				ctx,
+				t.logger.With("tag_prefix", tagged.tagPrefix),
+				tagged.client,
+				tagged.clock,
+				tagged.tagPrefix,
+			)
+			return ctx.Err() == nil
+		})
+	}
+}
+
+// cleanUpTags deletes the unused tags starting with the provided prefix in
+// the account of the client, unless another clean up is already running.
+func (t *TargetPlugin) cleanUpTags(
+	ctx context.Context,
+	logger hclog.Logger,
+	client DigitalOceanWrapper,
+	clock quartz.Clock,
+	tagPrefix string,
+) {
+	if !t.tagCleanupMutex.TryLock() {
+		logger.Debug("not cleaning up tags as another clean up is running")
+		return
+	}
+	defer t.tagCleanupMutex.Unlock()
+	cleanUpUnusedTags(
+		ctx,
+		logger,
+		client,
+		tagPrefix,
+		clock,
+		unusedTagGracePeriod,
+		t.tagDeleteRateLimiter,
+	)
+}
+
 // cleanUpUnusedTags will delete unused tags starting with the provided prefix.
-func cleanUpUnusedTags(ctx context.Context, logger hclog.Logger, client DigitalOceanWrapper, tagPrefix string) {
+// Only tags which already existed the given wait earlier are deleted. Tags
+// are deleted concurrently, but no faster than the rate limiter allows.
+func cleanUpUnusedTags(
+	ctx context.Context,
+	logger hclog.Logger,
+	client DigitalOceanWrapper,
+	tagPrefix string,
+	clock quartz.Clock,
+	wait time.Duration,
+	limiter *rateLimiter,
+) {
 	// record all known tags
-	initialTags := make([]string, 0, 100)
+	initialTags := make(map[string]struct{})
 	for tag, err := range Unpaginate(ctx, client.Tags().List, godo.ListOptions{}) {
 		if err != nil {
 			logger.Error("cannot retrieve tags", "error", err)
@@ -268,15 +888,22 @@ func cleanUpUnusedTags(ctx context.Context, logger hclog.Logger, client DigitalO
 		if !strings.HasPrefix(tag.Name, tagPrefix) {
 			continue
 		}
-		initialTags = append(initialTags, tag.Name)
+		initialTags[tag.Name] = struct{}{}
 	}
 
-	// wait a minute. This avoids any race conditions where a tag was created
+	// wait a while. This avoids any race conditions where a tag was created
 	// but at the time had not yet been assigned to a droplet.
-	if err := Sleep(ctx, time.Minute); err != nil {
+	timer := clock.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
 		return
+	case <-timer.C:
 	}
 
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+	semaphore := make(chan struct{}, maxTagDeleteConcurrency)
 	for tag, err := range Unpaginate(ctx, client.Tags().List, godo.ListOptions{}) {
 		if err != nil {
 			logger.Error("cannot retrieve tags", "error", err)
@@ -286,17 +913,31 @@ func cleanUpUnusedTags(ctx context.Context, logger hclog.Logger, client DigitalO
 			continue
 		}
 		if res := tag.Resources; res != nil && res.Count > 0 {
-			logger.Info("not cleaning up tag as it's still in use", "tag name", tag.Name)
+			logger.Info("not cleaning up tag as it's still in use", logKeyTag, tag.Name)
 			continue
 		}
-		if !slices.Contains(initialTags, tag.Name) {
-			logger.Info("not cleaning up tag as it was created very recently", "tag name", tag.Name)
+		if _, found := initialTags[tag.Name]; !found {
+			logger.Info("not cleaning up tag as it was created very recently", logKeyTag, tag.Name)
 			continue
 		}
-		logger.Debug("cleaning up tag as it's unused", "tag name", tag.Name)
-		if _, err := client.Tags().Delete(ctx, tag.Name); err != nil {
-			logger.Error("cannot delete the tag", "tag name", tag.Name, "error", err)
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+			return
 		}
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			limiter.Consume(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Debug("cleaning up tag as it's unused", logKeyTag, name)
+			if _, err := client.Tags().Delete(ctx, name); err != nil {
+				logger.Error("cannot delete the tag", logKeyTag, name, "error", err)
+			}
+		}(tag.Name)
 	}
 }
 
@@ -304,99 +945,316 @@ func (t *TargetPlugin) ensureDropletsAreStable(
 	ctx context.Context,
 	template *dropletTemplate,
 	desired int64,
+	direction string,
 ) error {
+	start := time.Now()
+	defer func() {
+		stableWaitDuration.WithLabelValues(template.name).Observe(time.Since(start).Seconds())
+	}()
 	return retry(
 		ctx,
 		t.logger,
-		defaultRetryInterval,
+		template.name,
+		stableRetryInterval,
 		defaultRetryLimit,
 		func(ctx context.Context, cancel context.CancelCauseFunc) error {
-			_, active, err := t.countDroplets(ctx, template)
-			if desired == active {
+			counts, err := t.countDroplets(ctx, template)
+			if err == nil && counts.isStable(desired, direction) {
+				if counts.active != desired {
+					t.logger.Warn("number of active droplets differs from the desired number",
+						"tag", template.name,
+						"direction", direction,
+						"desired", desired,
+						"active", counts.active)
+				}
 				return nil
 			}
 			if err != nil {
-				cancel(err)
+				// a request which timed out is tried again
+				if !errors.Is(err, context.DeadlineExceeded) {
+					cancel(err)
+				}
 				return err
 			} else {
 				return errors.New("waiting for droplets to become stable")
 			}
 		},
+		withBackoff(2, stableRetryMaxInterval),
 	)
 }
 
 func (t *TargetPlugin) deleteDroplets(
 	ctx context.Context,
-	tag string,
-	instanceIDs map[string]struct{},
-) error {
-	// create options. initially, these will be blank
-	var dropletsToDelete []int
-	opt := &godo.ListOptions{}
-	for {
-		droplets, resp, err := t.client.Droplets().ListByTag(ctx, tag, opt)
-		if err != nil {
+	outcome *scalingOutcome,
+	template *dropletTemplate,
+	instanceIDs map[string]string,
+) (err error) {
+	ctx, span := startSpan(ctx, "delete_droplets",
+		attribute.String(logKeyTag, template.name),
+		attribute.Int("count", len(instanceIDs)))
+	defer func() { endSpan(span, err) }()
+
+	dropletsToDelete, errorList, err := t.resolveDropletIDs(ctx, template, instanceIDs)
+	if err != nil {
+		return errors.Join(append(errorList, err)...)
+	}
+
+	semaphore := make(chan struct{}, template.maxDeleteConcurrency)
+	wg := &sync.WaitGroup{}
+	errorChannel := make(chan error, len(dropletsToDelete))
+	for dropletId, nodeID := range dropletsToDelete {
+		wg.Add(1)
+		// delete each droplet concurrently, but no more than the
+		// configured number at a time
+		go func() {
+			defer wg.Done()
+			ctx, span := startSpan(ctx, "delete_droplet", attribute.Int(logKeyDropletID, dropletId))
+			var err error
+			defer func() { endSpan(span, err) }()
+			log := t.logger.With(logKeyAction, "delete", logKeyDropletID, strconv.Itoa(dropletId))
+			select {
+			case semaphore <- struct{}{}:
+				defer func() { <-semaphore }()
+			case <-ctx.Done():
+				err = ctx.Err()
+				log.Error("error deleting droplet", "error", err)
+				errorChannel <- fmt.Errorf("droplet %v: %w", dropletId, err)
+				return
+			}
+			if nodeID != "" && t.nomadNodes != nil {
+				err = drainNode(ctx, nodeID, template.drainDeadline, t.nomadNodes, log)
+				if err != nil {
+					log.Error("error draining node", "error", err)
+					errorChannel <- fmt.Errorf("droplet %v: %w", dropletId, err)
+					return
+				}
+			}
+			err = shutdownDroplet(
+				ctx,
+				template.name,
+				dropletId,
+				template.shutdownTimeout,
+				template.requestTimeout,
+				template.statePollInterval,
+				template.statePollMaxInterval,
+				template.forceDelete,
+				template.client.Droplets(),
+				template.client.DropletActions(),
+				template.clock(),
+				log,
+			)
+			if err != nil {
+				log.Error("error deleting droplet", "error", err)
+				errorChannel <- fmt.Errorf("droplet %v: %w", dropletId, err)
+				return
+			}
+			dropletsDeleted.WithLabelValues(template.name).Inc()
+			outcome.dropletDeleted()
+		}()
+	}
+	wg.Wait()
+	close(errorChannel)
+	for err := range errorChannel {
+		errorList = append(errorList, err)
+	}
+
+	return errors.Join(errorList...)
+}
+
+// resolveDropletIDs maps the instance IDs, which may be either the names or
+// the IDs of droplets belonging to the template, to the unique IDs of the
+// droplets to delete, along with the IDs of their Nomad nodes. All droplets
+// are listed, so that a name shared by several droplets is detected rather
+// than the wrong droplet deleted. Such names are returned as errors, while
+// the other droplets are still resolved.
+func (t *TargetPlugin) resolveDropletIDs(
+	ctx context.Context,
+	template *dropletTemplate,
+	instanceIDs map[string]string,
+) (map[int]string, []error, error) {
+	listByTag := func(ctx context.Context, opt *godo.ListOptions) (droplets []godo.Droplet, resp *godo.Response, err error) {
+		err = retryRequest(ctx, t.logger, template.name, template.clock(), template.requestTimeout, func(ctx context.Context) error {
+			var err error
+			droplets, resp, err = template.client.Droplets().ListByTag(ctx, template.name, opt)
 			return err
+		})
+		return droplets, resp, err
+	}
+	byInstanceID := make(map[string][]int)
+	for d, err := range Unpaginate(ctx, listByTag, godo.ListOptions{}) {
+		if err != nil {
+			return nil, nil, err
 		}
-
-		wg := &sync.WaitGroup{}
-		for _, d := range droplets {
-			_, ok := instanceIDs[d.Name]
-			if ok {
-				wg.Add(1)
-				go func(dropletId int) {
-					defer wg.Done()
-					log := t.logger.With("action", "delete", "droplet_id", strconv.Itoa(dropletId))
-					err := shutdownDroplet(
-						ctx,
-						dropletId,
-						t.client.Droplets(),
-						t.client.DropletActions(),
-						log,
-					)
-					if err != nil {
-						log.Error("error deleting droplet", err)
-					}
-				}(d.ID)
-				dropletsToDelete = append(dropletsToDelete, d.ID)
+		for _, instanceID := range []string{d.Name, strconv.Itoa(d.ID)} {
+			if _, ok := instanceIDs[instanceID]; ok {
+				byInstanceID[instanceID] = append(byInstanceID[instanceID], d.ID)
+				break
 			}
 		}
-		wg.Wait()
+	}
 
-		// if we deleted all droplets or if we are at the last page, break out the for loop
-		if len(dropletsToDelete) == len(instanceIDs) || resp.Links == nil ||
-			resp.Links.IsLastPage() {
-			break
+	dropletIDs := make(map[int]string)
+	var errorList []error
+	for instanceID, nodeID := range instanceIDs {
+		ids := byInstanceID[instanceID]
+		switch len(ids) {
+		case 0:
+			t.logger.Warn("droplet to delete not found", "instance_id", instanceID)
+		case 1:
+			dropletIDs[ids[0]] = nodeID
+		default:
+			errorList = append(errorList, fmt.Errorf(
+				"not deleting any of droplets %v as they share the name %q",
+				ids,
+				instanceID,
+			))
 		}
+	}
+	return dropletIDs, errorList, nil
+}
 
-		page, err := resp.Links.CurrentPage()
-		if err != nil {
+// listDroplets returns all the droplets tagged with the template's name.
+func (t *TargetPlugin) listDroplets(ctx context.Context, template *dropletTemplate) ([]godo.Droplet, error) {
+	listByTag := func(ctx context.Context, opt *godo.ListOptions) (droplets []godo.Droplet, resp *godo.Response, err error) {
+		err = retryRequest(ctx, t.logger, template.name, template.clock(), template.requestTimeout, func(ctx context.Context) error {
+			var err error
+			droplets, resp, err = template.client.Droplets().ListByTag(ctx, template.name, opt)
 			return err
+		})
+		return droplets, resp, err
+	}
+	var droplets []godo.Droplet
+	for droplet, err := range Unpaginate(ctx, listByTag, godo.ListOptions{}) {
+		if err != nil {
+			return nil, err
 		}
+		droplets = append(droplets, droplet)
+	}
+	return droplets, nil
+}
 
-		// set the page we want for the next request
-		opt.Page = page + 1
+// oldestDropletRemoteIDs returns the names and IDs of the n oldest droplets
+// belonging to the template, by their creation time, so that either may be
+// matched against Nomad nodes. Droplets whose creation time cannot be
+// parsed are considered the newest.
+func (t *TargetPlugin) oldestDropletRemoteIDs(
+	ctx context.Context,
+	template *dropletTemplate,
+	n int,
+) ([]string, error) {
+	type candidate struct {
+		name    string
+		id      int
+		created time.Time
 	}
+	listByTag := func(ctx context.Context, opt *godo.ListOptions) ([]godo.Droplet, *godo.Response, error) {
+		ctx, cancel := context.WithTimeout(ctx, template.requestTimeout)
+		defer cancel()
+		return template.client.Droplets().ListByTag(ctx, template.name, opt)
+	}
+	var candidates []candidate
+	for droplet, err := range Unpaginate(ctx, listByTag, godo.ListOptions{}) {
+		if err != nil {
+			return nil, err
+		}
+		// the zero time is used if the creation time cannot be parsed
+		created, _ := time.Parse(time.RFC3339, droplet.Created)
+		candidates = append(candidates, candidate{name: droplet.Name, id: droplet.ID, created: created})
+	}
+	slices.SortStableFunc(candidates, func(a, b candidate) int {
+		if a.created.IsZero() != b.created.IsZero() {
+			if a.created.IsZero() {
+				return 1
+			}
+			return -1
+		}
+		return a.created.Compare(b.created)
+	})
+	remoteIDs := make([]string, 0, 2*n)
+	for _, c := range candidates[:min(n, len(candidates))] {
+		remoteIDs = append(remoteIDs, c.name, strconv.Itoa(c.id))
+	}
+	return remoteIDs, nil
+}
 
-	return nil
+// dropletCounts summarises the droplets belonging to a droplet template.
+type dropletCounts struct {
+	total  int64
+	active int64
+	// the number of droplets in each status, e.g. "new", "active" or "off"
+	byStatus map[string]int64
+	// creation times of the oldest and newest droplets, if there are any
+	oldest time.Time
+	newest time.Time
+}
+
+// add includes the given droplets in the counts.
+func (c *dropletCounts) add(droplets []godo.Droplet) {
+	c.total += int64(len(droplets))
+	c.active += countIf(droplets, isReady)
+	for _, droplet := range droplets {
+		c.byStatus[droplet.Status]++
+		created, err := time.Parse(time.RFC3339, droplet.Created)
+		if err != nil {
+			continue
+		}
+		if c.oldest.IsZero() || created.Before(c.oldest) {
+			c.oldest = created
+		}
+		if c.newest.IsZero() || created.After(c.newest) {
+			c.newest = created
+		}
+	}
+}
+
+// isStable reports whether the droplets have settled after scaling in the
+// given direction. Overshooting the desired number, e.g. due to a retried
+// creation, is tolerated as it would otherwise never settle.
+func (c *dropletCounts) isStable(desired int64, direction string) bool {
+	if direction == "in" {
+		// deleted droplets may linger as "off" or "archive" for a while, but
+		// they no longer count towards the desired number
+		if c.total-c.byStatus["off"]-c.byStatus["archive"] <= desired {
+			return true
+		}
+		// when scaling in to zero, no droplet is left running once none
+		// are active
+		return desired == 0 && c.active == 0
+	}
+	// new droplets only count once they have become active
+	return c.active >= desired
 }
 
 func (t *TargetPlugin) countDroplets(
 	ctx context.Context,
 	template *dropletTemplate,
-) (int64, int64, error) {
-	var total int64 = 0
-	var ready int64 = 0
+) (_ *dropletCounts, err error) {
+	ctx, span := startSpan(ctx, "count_droplets", attribute.String(logKeyTag, template.name))
+	defer func() { endSpan(span, err) }()
+
+	counts := &dropletCounts{byStatus: make(map[string]int64)}
+	// all the pages are gathered for the grace period, as the droplets which
+	// are not listed are forgotten
+	var listed []godo.Droplet
 
 	opt := &godo.ListOptions{}
 	for {
-		droplets, resp, err := t.client.Droplets().ListByTag(ctx, template.name, opt)
-		if err != nil {
-			return 0, 0, err
+		var (
+			droplets []godo.Droplet
+			resp     *godo.Response
+		)
+		if err := retryRequest(ctx, t.logger, template.name, template.clock(), template.requestTimeout, func(ctx context.Context) error {
+			var err error
+			droplets, resp, err = template.client.Droplets().ListByTag(ctx, template.name, opt)
+			return err
+		}); err != nil {
+			return nil, err
 		}
 
-		total = total + int64(len(droplets))
-		ready = ready + countIf(droplets, isReady)
+		counts.add(droplets)
+		if template.readyGracePeriod > 0 {
+			listed = append(listed, droplets...)
+		}
 
 		if resp.Links == nil || resp.Links.IsLastPage() {
 			break
@@ -404,39 +1262,137 @@ func (t *TargetPlugin) countDroplets(
 
 		page, err := resp.Links.CurrentPage()
 		if err != nil {
-			return 0, 0, err
+			return nil, err
 		}
 
 		opt.Page = page + 1
 	}
 
-	return total, ready, nil
+	if template.readyGracePeriod > 0 {
+		// droplets which only just became active are not counted as ready
+		// yet, as they may not be usable
+		counts.active -= t.activeDroplets.settling(template.poolKey(), listed, template.readyGracePeriod)
+	}
+	return counts, nil
+}
+
+// countDropletsTotal returns the number of droplets tagged with the
+// template's name. Unlike countDroplets, it reads the tag's resource summary,
+// which takes a single API call however many droplets there are, so it should
+// be preferred when no per-status breakdown is needed.
+func (t *TargetPlugin) countDropletsTotal(
+	ctx context.Context,
+	template *dropletTemplate,
+) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, template.requestTimeout)
+	defer cancel()
+	tag, _, err := template.client.Tags().Get(ctx, template.name)
+	if isNotFoundError(err) {
+		// the tag is created along with the first droplet
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if tag.Resources == nil || tag.Resources.Droplets == nil {
+		return 0, nil
+	}
+	return int64(tag.Resources.Droplets.Count), nil
 }
 
 func isReady(droplet godo.Droplet) bool {
 	return droplet.Status == "active"
 }
 
-// doDropletNodeIDMap is used to identify the DigitalOcean Droplet ID of a Nomad node using
-// the relevant attribute value.
-func doDropletNodeIDMap(n *api.Node) (string, error) {
-	val, ok := n.Attributes["unique.hostname"]
-	if !ok || val == "" {
-		return "", fmt.Errorf("attribute %q not found", "unique.hostname")
+// dropletNodeIDMap returns a function used to identify the DigitalOcean
+// Droplet of a Nomad node using the value of the given node attribute.
+func dropletNodeIDMap(attribute string) scaleutils.ClusterNodeIDLookupFunc {
+	return func(n *api.Node) (string, error) {
+		val, ok := n.Attributes[attribute]
+		if !ok || val == "" {
+			return "", fmt.Errorf("%w: %q", ErrMissingNodeAttribute, attribute)
+		}
+		return val, nil
+	}
+}
+
+// availableVolumes returns the IDs of those volumes which are in the given
+// region and not yet attached to a droplet. A volume can only be attached to
+// a single droplet, so each new droplet needs a volume of its own.
+func availableVolumes(
+	ctx context.Context,
+	storage Storage,
+	volumeIDs []string,
+	region string,
+) ([]string, error) {
+	result := make([]string, 0, len(volumeIDs))
+	for _, id := range volumeIDs {
+		volume, _, err := storage.GetVolume(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("cannot retrieve volume %v: %w", id, err)
+		}
+		if volume.Region != nil && volume.Region.Slug != region {
+			continue
+		}
+		if len(volume.DropletIDs) != 0 {
+			continue
+		}
+		result = append(result, id)
+	}
+	return result, nil
+}
+
+// sshKeyFingerprint matches MD5 and SHA256 fingerprints written as
+// colon-separated hexadecimal bytes.
+var sshKeyFingerprint = regexp.MustCompile(`^[0-9a-fA-F]{2}(:[0-9a-fA-F]{2}){15}((:[0-9a-fA-F]{2}){16})?$`)
+
+// validateSSHKeys returns an error listing the SSH keys which are neither a
+// fingerprint nor a numeric ID.
+func validateSSHKeys(keys []string) error {
+	var invalid []string
+	for _, key := range keys {
+		if id, err := strconv.Atoi(key); err == nil && id > 0 {
+			continue
+		}
+		if !sshKeyFingerprint.MatchString(key) {
+			invalid = append(invalid, strconv.Quote(key))
+		}
+	}
+	if len(invalid) != 0 {
+		return fmt.Errorf(
+			"invalid SSH keys %v: keys must be fingerprints or numeric IDs",
+			strings.Join(invalid, ", "),
+		)
 	}
-	return val, nil
+	return nil
 }
 
+// sshKeyMap converts SSH keys to the form required to create a droplet.
+// Each key may be given either as a fingerprint or as a numeric ID.
 func sshKeyMap(input []string) []godo.DropletCreateSSHKey {
 	var result []godo.DropletCreateSSHKey
 
 	for _, v := range input {
-		result = append(result, godo.DropletCreateSSHKey{Fingerprint: v})
+		if id, err := strconv.Atoi(v); err == nil && id > 0 {
+			result = append(result, godo.DropletCreateSSHKey{ID: id})
+		} else {
+			result = append(result, godo.DropletCreateSSHKey{Fingerprint: v})
+		}
 	}
 
 	return result
 }
 
+// chownSecretFile returns the indented line of the secure introduction
+// script which gives the file named by the shell variable to owner, if one is
+// configured.
+func chownSecretFile(owner, variable, indent string) string {
+	if owner == "" {
+		return ""
+	}
+	return fmt.Sprintf("%vchown \"%v\" \"$%v\"\n", indent, owner, variable)
+}
+
 func generateUserDataForSecureIntroduction(
 	ctx context.Context,
 	logger hclog.Logger,
@@ -445,30 +1401,42 @@ func generateUserDataForSecureIntroduction(
 	template *dropletTemplate,
 	vault VaultProxy,
 ) (string, error) {
-	if allowedIPv4 != "" || allowedIPv6 != "" {
+	if allowedIPv4 != "" || allowedIPv6 != "" || template.secureIntroductionPreShared {
 		// because at least one reserved IP address is being used,
 		// it is possible to generate the wrapped secret before
 		// the droplet is created, allowing it to be included in
-		// the user-data
+		// the user-data. The pre-shared token is not bound to any
+		// address, so it is always included in the user-data
 		wrappedSecretId, err := vault.GenerateSecretId(
 			ctx,
 			template.secureIntroductionAppRole,
 			allowedIPv4, allowedIPv6,
 			template.secretValidity, template.wrappedSecretValidity,
+			template.secretIdOptions()...,
 		)
 		if err != nil {
 			return "", fmt.Errorf("failed to generate wrapped secure introduction: %w", err)
 		}
-		shellScript := fmt.Sprintf(
-			`#!/bin/sh
-echo "%v" > "%v"
-`,
-			wrappedSecretId,
-			template.secureIntroductionFilename,
-		)
-		result, err := PrependShellScriptToUserData(
+		// the SecretID is written to a private temporary file alongside each
+		// destination and then renamed over it, so that the file is never
+		// seen partially written
+		shellScript := "#!/bin/sh\numask 077\n"
+		for _, filename := range template.secureIntroductionFilenames {
+			shellScript += fmt.Sprintf(strings.ReplaceAll(
+				`SECRET_TEMPFILE=@mktemp "%[2]v.XXXXXX"@
+echo "%[1]v" > "$SECRET_TEMPFILE"
+chmod 600 "$SECRET_TEMPFILE"
+%[3]vmv -f "$SECRET_TEMPFILE" "%[2]v"
+`, "@", "`"),
+				wrappedSecretId,
+				filename,
+				chownSecretFile(template.secureIntroductionFileOwner, "SECRET_TEMPFILE", ""),
+			)
+		}
+		result, err := insertShellScriptIntoUserData(
 			userData,
 			shellScript,
+			!template.secureIntroductionAppend,
 		)
 		if err == nil {
 			return result, nil
@@ -483,33 +1451,54 @@ echo "%v" > "%v"
 			   It is unlikely that the user-data script will be executed before
 			   the droplet's metadata has been updated with the tags containing
 			   the request-wrapped SecretID - but to be sure, allow a minute of
-			   retries before failing.
+			   retries before failing. The SecretID is retrieved into a temporary
+			   file for the first filename, and copied to one for each of the
+			   others, before they are all renamed into place.
 			*/
+			copies := ""
+			for _, filename := range template.secureIntroductionFilenames[1:] {
+				copies += fmt.Sprintf(strings.ReplaceAll(
+					`                SECRET_COPY=@mktemp "%[1]v.XXXXXX"@
+                cp "$SECRET_TEMPFILE" "$SECRET_COPY"
+                chmod 600 "$SECRET_COPY"
+%[2]v                mv -f "$SECRET_COPY" "%[1]v"
+`, "@", "`"),
+					filename,
+					chownSecretFile(template.secureIntroductionFileOwner, "SECRET_COPY", "                "),
+				)
+			}
 			shellScript := fmt.Sprintf(strings.ReplaceAll(
 				`#!/bin/sh
 
+umask 077
 TAGS_TEMPFILE=@mktemp@
+SECRET_TEMPFILE=@mktemp "%[2]v.XXXXXX"@
 for I in @seq 1 60@ ; do
     if curl -o "$TAGS_TEMPFILE" http://169.254.169.254/metadata/v1/tags ; then
         if [ -f "$TAGS_TEMPFILE" ] ; then
-            sed -n 's#%v##p' < "$TAGS_TEMPFILE" > "%v"
-            if [ @wc -l < "%v"@ -eq 1 ] ; then
+            sed -n 's#%[1]v##p' < "$TAGS_TEMPFILE" > "$SECRET_TEMPFILE"
+            if [ @wc -l < "$SECRET_TEMPFILE"@ -eq 1 ] ; then
                 rm "$TAGS_TEMPFILE"
+%[4]v                chmod 600 "$SECRET_TEMPFILE"
+%[3]v                mv -f "$SECRET_TEMPFILE" "%[2]v"
                 exit 0
             fi
         fi
     fi
     sleep 1
 done
+rm -f "$TAGS_TEMPFILE" "$SECRET_TEMPFILE"
 exit 1
 `, "@", "`"),
 				prefix,
-				template.secureIntroductionFilename,
-				template.secureIntroductionFilename,
+				template.secureIntroductionFilenames[0],
+				chownSecretFile(template.secureIntroductionFileOwner, "SECRET_TEMPFILE", "                "),
+				copies,
 			)
-			result, err := PrependShellScriptToUserData(
+			result, err := insertShellScriptIntoUserData(
 				userData,
 				shellScript,
+				!template.secureIntroductionAppend,
 			)
 			if err == nil {
 				return result, nil
@@ -524,6 +1513,78 @@ exit 1
 	return userData, nil
 }
 
+// secureIntroductionTag composes the tag holding a wrapped SecretID, checking
+// that DigitalOcean will accept it. Tags are limited in length, and may only
+// contain letters, numbers, colons, dashes and underscores, so the wrapping
+// token must not contain anything else either.
+func secureIntroductionTag(prefix, wrappedSecretId string) (string, error) {
+	tag := prefix + wrappedSecretId
+	if len(tag) > maxTagLength {
+		return "", fmt.Errorf(
+			"the tag would be %v characters long, but at most %v are allowed (the prefix is %v characters, the wrapping token %v)",
+			len(tag),
+			maxTagLength,
+			len(prefix),
+			len(wrappedSecretId),
+		)
+	}
+	if invalid := prohibitedCharactersInTags.FindString(tag); invalid != "" {
+		return "", fmt.Errorf("the tag would contain characters which are not allowed in tags: %q", invalid)
+	}
+	return tag, nil
+}
+
+// waitForDropletNetwork waits for a new droplet to become active and to be
+// reported with the network information of the addresses being reserved,
+// which DigitalOcean omits until the droplet has been provisioned. A droplet
+// which is neither new nor active, e.g. as it was powered off or failed to
+// be created, is not waited for.
+func waitForDropletNetwork(
+	ctx context.Context,
+	logger hclog.Logger,
+	template *dropletTemplate,
+	dropletID int,
+) error {
+	ctx, cancel := context.WithTimeout(ctx, template.reservationWaitTimeout)
+	defer cancel()
+	// the reason for still waiting is reported if the wait times out, as
+	// it says more than the deadline having passed
+	var waitingFor error
+	if err := poll(
+		ctx,
+		template.clock(),
+		template.reservationWaitInterval,
+		max(defaultStatePollMaxInterval, template.reservationWaitInterval),
+		func(ctx context.Context) (bool, error) {
+			droplet, _, err := template.client.Droplets().Get(ctx, dropletID)
+			switch {
+			case err != nil:
+				waitingFor = fmt.Errorf("cannot retrieve droplet metadata: %w", err)
+				// the droplet may be got on the next attempt
+				logger.Debug("failed to get droplet while waiting for its network", "error", err)
+				return false, nil
+			case droplet.Status == "new":
+				waitingFor = errors.New("the droplet is not yet active")
+			case droplet.Status != "active":
+				return false, fmt.Errorf("the droplet is %v", droplet.Status)
+			case template.reserveIPv4Addresses && (droplet.Networks == nil || len(droplet.Networks.V4) == 0):
+				waitingFor = errors.New("no IPv4 network information is yet available")
+			case template.reserveIPv6Addresses && (droplet.Networks == nil || len(droplet.Networks.V6) == 0):
+				waitingFor = errors.New("no IPv6 network information is yet available")
+			default:
+				return true, nil
+			}
+			return false, nil
+		},
+	); err != nil {
+		if waitingFor != nil && ctx.Err() != nil {
+			err = waitingFor
+		}
+		return fmt.Errorf("droplet %v is not ready for reserved addresses: %w", dropletID, err)
+	}
+	return nil
+}
+
 func generateTagForSecureIntroduction(
 	ctx context.Context,
 	logger hclog.Logger,
@@ -538,11 +1599,13 @@ func generateTagForSecureIntroduction(
 
 	// when a droplet is created, DO does not include any network information
 	// in the response; a polling loop is required to wait for it to become available
+	start := time.Now()
 	if err := retry(
 		ctx,
 		logger,
-		6*time.Second,
-		10,
+		template.name,
+		template.networkWaitInterval,
+		template.networkWaitAttempts,
 		func(ctx context.Context, cancel context.CancelCauseFunc) error {
 			droplet, _, err := droplets.Get(ctx, dropletID)
 			if err != nil {
@@ -562,12 +1625,16 @@ func generateTagForSecureIntroduction(
 		}); err != nil {
 		return fmt.Errorf("could not get the droplet's IP address(es): %w", err)
 	}
-	logger.Info("IP addresses have been assigned", "ipv4", ipv4, "ipv6", ipv6)
+	logger.Info("IP addresses have been assigned",
+		"ipv4", ipv4,
+		"ipv6", ipv6,
+		"elapsed", time.Since(start))
 	wrappedSecretId, err := vault.GenerateSecretId(
 		ctx,
 		template.secureIntroductionAppRole,
 		ipv4, ipv6,
 		template.secretValidity, template.wrappedSecretValidity,
+		template.secretIdOptions()...,
 	)
 	if err != nil {
 		return fmt.Errorf(
@@ -575,16 +1642,24 @@ func generateTagForSecureIntroduction(
 			dropletID,
 			err)
 	}
-	tagWithSecretID := fmt.Sprintf("%v%v", template.secureIntroductionTagPrefix, wrappedSecretId)
+	tagWithSecretID, err := secureIntroductionTag(template.secureIntroductionTagPrefix, wrappedSecretId)
+	if err != nil {
+		return fmt.Errorf("cannot store the secure introduction for droplet %v in a tag: %w", dropletID, err)
+	}
 	if _, _, err = tags.Create(ctx, &godo.TagCreateRequest{Name: tagWithSecretID}); err != nil {
 		return fmt.Errorf("could not create a new tag: %w", err)
 	}
 	// There are often conflicts if trying to set tags on a resource while another operation
 	// is in progress, so this must also be retried if a 422 response is seen
-	if err := RetryOnTransientError(ctx, logger, func(ctx context.Context, cancel context.CancelCauseFunc) error {
+	if err := RetryOnTransientError(ctx, logger, template.name, func(ctx context.Context, cancel context.CancelCauseFunc) error {
 		_, err := tags.TagResources(ctx, tagWithSecretID, &godo.TagResourcesRequest{Resources: []godo.Resource{{ID: fmt.Sprintf("%v", dropletID), Type: "droplet"}}})
 		return err
 	}, 404); err != nil {
+		// the tag holds a live wrapped SecretID, so don't leave it lying
+		// around until the unused tags are next cleaned up
+		if _, deleteErr := tags.Delete(context.WithoutCancel(ctx), tagWithSecretID); deleteErr != nil {
+			logger.Warn("failed to delete the unused secure introduction tag", "error", deleteErr)
+		}
 		return fmt.Errorf(
 			"failed to tag droplet %v with wrapped secure introduction: %w",
 			dropletID,
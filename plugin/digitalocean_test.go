@@ -2,12 +2,18 @@ package plugin
 
 import (
 	"context"
+	"fmt"
+	"maps"
+	"slices"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/coder/quartz"
+	"github.com/digitalocean/godo"
 	"github.com/google/uuid"
 	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
 	"github.com/stretchr/testify/require"
 )
 
@@ -32,9 +38,137 @@ func TestScaleOut(t *testing.T) {
 		vault:  nil,
 	}
 	template := Must(tp.createDropletTemplate(config))
-	err := tp.scaleOut(ctx, 3, 3, template, config)
+	createdIDs, err := tp.scaleOut(ctx, nil, 3, 3, template, config)
 	require.NoError(t, err)
+	require.ElementsMatch(t, slices.Collect(maps.Keys(mock.droplets)), createdIDs)
 	require.Len(t, mock.dropletUserData, 3)
+	require.Empty(t, mock.projects)
+}
+
+func TestScaleOutWithoutVPC(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	config := map[string]string{
+		"name":        "mydropletname",
+		"region":      "lon1",
+		"size":        "s1",
+		"snapshot_id": "12345",
+		"token":       "t0ken",
+		"tags":        "nomad-client",
+	}
+	tp := &TargetPlugin{
+		ctx:    ctx,
+		config: config,
+		logger: hclog.NewNullLogger(),
+		client: mock,
+	}
+	template := Must(tp.createDropletTemplate(config))
+	_, err := tp.scaleOut(ctx, nil, 2, 2, template, config)
+	require.NoError(t, err)
+	require.Len(t, mock.droplets, 2)
+	for _, droplet := range mock.droplets {
+		// DigitalOcean places the droplet in the default VPC of the region
+		require.Empty(t, droplet.VPCUUID)
+		require.Equal(t, []string{"mydropletname", "nomad-client", "autoscaler-pool:mydropletname"}, droplet.Tags)
+	}
+}
+
+func TestScaleOutWithDropletAgentAndIPv6(t *testing.T) {
+	testCases := []struct {
+		name         string
+		config       map[string]string
+		dropletAgent *bool
+		ipv6         bool
+	}{
+		{
+			name:   "defaults",
+			config: map[string]string{},
+		},
+		{
+			name:         "agent without IPv6",
+			config:       map[string]string{"droplet_agent": "true"},
+			dropletAgent: godo.PtrTo(true),
+		},
+		{
+			name:         "IPv6 without agent",
+			config:       map[string]string{"droplet_agent": "false", "ipv6": "true"},
+			dropletAgent: godo.PtrTo(false),
+			ipv6:         true,
+		},
+		{
+			name:         "agent with IPv6",
+			config:       map[string]string{"droplet_agent": "true", "ipv6": "true"},
+			dropletAgent: godo.PtrTo(true),
+			ipv6:         true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+			defer cancel()
+			mock := createMockGodo()
+			config := map[string]string{
+				"name":        "mydropletname",
+				"region":      "lon1",
+				"size":        "s1",
+				"snapshot_id": "12345",
+				"token":       "t0ken",
+			}
+			maps.Copy(config, tc.config)
+			tp := &TargetPlugin{
+				ctx:    ctx,
+				config: config,
+				logger: hclog.NewNullLogger(),
+				client: mock,
+			}
+			template := Must(tp.createDropletTemplate(config))
+			_, err := tp.scaleOut(ctx, nil, 1, 1, template, config)
+			require.NoError(t, err)
+			require.Len(t, mock.createRequests, 1)
+			for _, req := range mock.createRequests {
+				require.Equal(t, tc.dropletAgent, req.WithDropletAgent)
+				require.Equal(t, tc.ipv6, req.IPv6)
+			}
+		})
+	}
+
+	tp := &TargetPlugin{}
+	_, err := tp.createDropletTemplate(map[string]string{
+		"name":          "mydropletname",
+		"region":        "lon1",
+		"size":          "s1",
+		"snapshot_id":   "12345",
+		"droplet_agent": "sometimes",
+	})
+	require.ErrorContains(t, err, "droplet_agent")
+}
+
+func TestScaleOutWithProjectAndFirewall(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	config := map[string]string{
+		"name":        "mydropletname",
+		"region":      "lon1",
+		"size":        "s1",
+		"snapshot_id": "12345",
+		"token":       "t0ken",
+		"vpc_uuid":    uuid.New().String(),
+		"project_id":  "my-project",
+		"firewall_id": "my-firewall",
+	}
+	tp := &TargetPlugin{
+		ctx:    ctx,
+		config: config,
+		logger: hclog.NewNullLogger(),
+		client: mock,
+	}
+	template := Must(tp.createDropletTemplate(config))
+	_, err := tp.scaleOut(ctx, nil, 2, 2, template, config)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"do:droplet:1", "do:droplet:2"}, mock.projects["my-project"])
+	require.ElementsMatch(t, []int{1, 2}, mock.firewalls["my-firewall"])
 }
 
 func TestScaleOutWithSecureIntroductionInTag(t *testing.T) {
@@ -63,7 +197,7 @@ func TestScaleOutWithSecureIntroductionInTag(t *testing.T) {
 		vault:  &mockVaultProxy{},
 	}
 	template := Must(tp.createDropletTemplate(config))
-	err := tp.scaleOut(ctx, 3, 3, template, config)
+	_, err := tp.scaleOut(ctx, nil, 3, 3, template, config)
 	require.NoError(t, err)
 	require.Len(t, mock.dropletUserData, 3)
 	require.Equal(t, strings.ReplaceAll(`#cloud-config-archive
@@ -71,21 +205,1592 @@ func TestScaleOutWithSecureIntroductionInTag(t *testing.T) {
   content: |
     #!/bin/sh
 
+    umask 077
     TAGS_TEMPFILE=@mktemp@
+    SECRET_TEMPFILE=@mktemp "/run/secure-introduction.XXXXXX"@
     for I in @seq 1 60@ ; do
         if curl -o "$TAGS_TEMPFILE" http://169.254.169.254/metadata/v1/tags ; then
             if [ -f "$TAGS_TEMPFILE" ] ; then
-                sed -n 's#banana-##p' < "$TAGS_TEMPFILE" > "/run/secure-introduction"
-                if [ @wc -l < "/run/secure-introduction"@ -eq 1 ] ; then
+                sed -n 's#banana-##p' < "$TAGS_TEMPFILE" > "$SECRET_TEMPFILE"
+                if [ @wc -l < "$SECRET_TEMPFILE"@ -eq 1 ] ; then
                     rm "$TAGS_TEMPFILE"
+                    chmod 600 "$SECRET_TEMPFILE"
+                    mv -f "$SECRET_TEMPFILE" "/run/secure-introduction"
                     exit 0
                 fi
             fi
         fi
         sleep 1
     done
+    rm -f "$TAGS_TEMPFILE" "$SECRET_TEMPFILE"
     exit 1
 `, "@", "`"), mock.dropletUserData[1])
 	// "abcd" is the mock request-wrapped SecretID; "banana-" is the configured prefix
 	require.Contains(t, mock.droplets[1].Tags, "banana-abcd")
+
+	// with several filenames, the retrieved SecretID is copied to each of them
+	config["secure_introduction_filename"] = "/run/secure-introduction, /etc/agent/secret-id"
+	mock = createMockGodo()
+	tp.client = mock
+	template = Must(tp.createDropletTemplate(config))
+	_, err = tp.scaleOut(ctx, nil, 1, 1, template, config)
+	require.NoError(t, err)
+	require.Len(t, mock.dropletUserData, 1)
+	require.Equal(t, strings.ReplaceAll(`#cloud-config-archive
+- type: text/x-shellscript
+  content: |
+    #!/bin/sh
+
+    umask 077
+    TAGS_TEMPFILE=@mktemp@
+    SECRET_TEMPFILE=@mktemp "/run/secure-introduction.XXXXXX"@
+    for I in @seq 1 60@ ; do
+        if curl -o "$TAGS_TEMPFILE" http://169.254.169.254/metadata/v1/tags ; then
+            if [ -f "$TAGS_TEMPFILE" ] ; then
+                sed -n 's#banana-##p' < "$TAGS_TEMPFILE" > "$SECRET_TEMPFILE"
+                if [ @wc -l < "$SECRET_TEMPFILE"@ -eq 1 ] ; then
+                    rm "$TAGS_TEMPFILE"
+                    SECRET_COPY=@mktemp "/etc/agent/secret-id.XXXXXX"@
+                    cp "$SECRET_TEMPFILE" "$SECRET_COPY"
+                    chmod 600 "$SECRET_COPY"
+                    mv -f "$SECRET_COPY" "/etc/agent/secret-id"
+                    chmod 600 "$SECRET_TEMPFILE"
+                    mv -f "$SECRET_TEMPFILE" "/run/secure-introduction"
+                    exit 0
+                fi
+            fi
+        fi
+        sleep 1
+    done
+    rm -f "$TAGS_TEMPFILE" "$SECRET_TEMPFILE"
+    exit 1
+`, "@", "`"), mock.dropletUserData[1])
+}
+
+func TestScaleOutWithSecureIntroductionAndReservedIPv6(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	config := map[string]string{
+		"name":                                "mydropletname",
+		"region":                              "lon1",
+		"size":                                "s1",
+		"snapshot_id":                         "12345",
+		"token":                               "t0ken",
+		"vpc_uuid":                            uuid.New().String(),
+		"ipv6":                                "true",
+		"reserve_ipv6_addresses":              "true",
+		"create_reserved_addresses":           "true",
+		"secure_introduction_approle":         "droplet-approle",
+		"secure_introduction_filename":        "/run/secure-introduction",
+		"secure_introduction_secret_validity": "1h",
+		"secure_introduction_wrapped_secret_validity": "5m",
+	}
+	vault := &mockVaultProxy{}
+	tp := &TargetPlugin{
+		ctx:                   ctx,
+		config:                config,
+		logger:                hclog.NewNullLogger(),
+		client:                mock,
+		vault:                 vault,
+		reservedAddressesPool: mock.NewReservedAddressPool(hclog.NewNullLogger(), quartz.NewMock(t)),
+	}
+	template := Must(tp.createDropletTemplate(config))
+	_, err := tp.scaleOut(ctx, nil, 2, 2, template, config)
+	require.NoError(t, err)
+
+	// the secret IDs are restricted to the reserved IPv6 addresses only
+	require.Len(t, vault.allowedIPv6s, 2)
+	require.ElementsMatch(t, []string{"fe80:1::", "fe80:2::"}, vault.allowedIPv6s)
+	require.Equal(t, []string{"", ""}, vault.allowedIPv4s)
+	require.Equal(t, "approle", vault.options[0].mountPath)
+
+	// the SecretID is written to the file atomically, and privately
+	for _, userData := range mock.dropletUserData {
+		require.Contains(t, userData, strings.ReplaceAll(`    umask 077
+    SECRET_TEMPFILE=@mktemp "/run/secure-introduction.XXXXXX"@
+    echo "abcd" > "$SECRET_TEMPFILE"
+    chmod 600 "$SECRET_TEMPFILE"
+    mv -f "$SECRET_TEMPFILE" "/run/secure-introduction"
+`, "@", "`"))
+	}
+}
+
+func TestScaleOutWithSlowCreatesKeepsReservations(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	config := map[string]string{
+		"name":                      "mydropletname",
+		"region":                    "lon1",
+		"size":                      "s1",
+		"snapshot_id":               "12345",
+		"token":                     "t0ken",
+		"vpc_uuid":                  uuid.New().String(),
+		"reserve_ipv4_addresses":    "true",
+		"create_reserved_addresses": "true",
+		"max_create_concurrency":    "1",
+	}
+	scaleOut := func() (*mockGodo, error) {
+		mock := createMockGodo()
+		tp := &TargetPlugin{
+			ctx:                   ctx,
+			config:                config,
+			logger:                hclog.NewNullLogger(),
+			client:                mock,
+			reservedAddressesPool: mock.NewReservedAddressPool(hclog.NewNullLogger(), quartz.NewMock(t)),
+		}
+		// the droplets are created one at a time, each taking two minutes,
+		// so the last is only created after six minutes
+		mock.createClockDelay = 2 * time.Minute
+		template := Must(tp.createDropletTemplate(config))
+		_, err := tp.scaleOut(ctx, nil, 3, 3, template, config)
+		return mock, err
+	}
+
+	// the default expiry allows for the number of droplets
+	mock, err := scaleOut()
+	require.NoError(t, err)
+	require.Len(t, mock.droplets, 3)
+	for _, ip := range mock.reservedIPv4s {
+		require.NotNil(t, ip.Droplet)
+	}
+
+	// the last address expires before its droplet is created when the
+	// expiry is too short, as it was when it was always 5 minutes
+	config["reservation_expiry"] = "5m"
+	_, err = scaleOut()
+	require.ErrorContains(t, err, "prereserved")
+}
+
+func TestScaleOutWithPinnedReservedAddresses(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	pool := mock.NewReservedAddressPool(hclog.NewNullLogger(), quartz.NewMock(t))
+	config := map[string]string{
+		"name":                      "mydropletname",
+		"region":                    "lon1",
+		"size":                      "s1",
+		"snapshot_id":               "12345",
+		"token":                     "t0ken",
+		"vpc_uuid":                  uuid.New().String(),
+		"reserve_ipv4_addresses":    "true",
+		"pinned_reserved_addresses": "1.2.3.3, 9.9.9.9",
+	}
+	tp := &TargetPlugin{
+		ctx:                   ctx,
+		config:                config,
+		logger:                hclog.NewNullLogger(),
+		client:                mock,
+		reservedAddressesPool: pool,
+	}
+
+	// three free addresses exist, and only the last is pinned
+	addresses, err := pool.PrereserveIPs(ctx, 3, "lon1", "mydropletname", true, time.Minute)
+	require.NoError(t, err)
+	require.Contains(t, addresses, "1.2.3.3")
+	pool.ReleasePrereservations(addresses...)
+
+	template := Must(tp.createDropletTemplate(config))
+	require.Equal(t, []string{"1.2.3.3", "9.9.9.9"}, template.pinnedIPv4Addresses)
+	createdIDs, err := tp.scaleOut(ctx, nil, 1, 1, template, config)
+	require.NoError(t, err)
+	require.Len(t, createdIDs, 1)
+	require.Equal(t, "1.2.3.3", mock.GetReservedIPv4(createdIDs[0]).IP)
+
+	// once assigned, the pinned address is skipped and the other droplets
+	// get whichever addresses are free
+	createdIDs, err = tp.scaleOut(ctx, nil, 3, 2, template, config)
+	require.NoError(t, err)
+	require.Len(t, createdIDs, 2)
+	for _, dropletID := range createdIDs {
+		require.NotEqual(t, "1.2.3.3", mock.GetReservedIPv4(dropletID).IP)
+	}
+}
+
+func TestPinnedReservedAddressesValidation(t *testing.T) {
+	tp := &TargetPlugin{logger: hclog.NewNullLogger(), client: createMockGodo()}
+	config := map[string]string{
+		"name":                      "mydropletname",
+		"region":                    "lon1",
+		"size":                      "s1",
+		"snapshot_id":               "12345",
+		"token":                     "t0ken",
+		"pinned_reserved_addresses": "not an address",
+		"reserve_ipv4_addresses":    "true",
+	}
+	_, err := tp.createDropletTemplate(config)
+	require.ErrorContains(t, err, "invalid value for config param pinned_reserved_addresses")
+
+	// addresses can only be pinned if addresses of their kind are reserved
+	config["pinned_reserved_addresses"] = "fe80:1::"
+	_, err = tp.createDropletTemplate(config)
+	require.ErrorContains(t, err, "reserve_ipv6_addresses is not set")
+	config["pinned_reserved_addresses"] = "1.2.3.1"
+	config["reserve_ipv4_addresses"] = "false"
+	_, err = tp.createDropletTemplate(config)
+	require.ErrorContains(t, err, "reserve_ipv4_addresses is not set")
+}
+
+func TestPrereservationExpiry(t *testing.T) {
+	template := &dropletTemplate{maxCreateConcurrency: 10}
+	require.Equal(t, 5*time.Minute, template.prereservationExpiry(1))
+	require.Equal(t, 5*time.Minute, template.prereservationExpiry(10))
+	require.Equal(t, 15*time.Minute, template.prereservationExpiry(25))
+
+	template.createStagger = 2 * time.Second
+	require.Equal(t, 5*time.Minute+18*time.Second, template.prereservationExpiry(10))
+
+	template.reservationExpiry = time.Hour
+	require.Equal(t, time.Hour, template.prereservationExpiry(25))
+}
+
+func TestScaleOutWithUserDataTemplate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	config := map[string]string{
+		"name":        "mydropletname",
+		"region":      "lon1",
+		"size":        "s1",
+		"snapshot_id": "12345",
+		"token":       "t0ken",
+		"vpc_uuid":    uuid.New().String(),
+		"user_data":   "#!/bin/sh\necho '{{ .Name }} {{ .Region }} {{ .Size }} {{ .Index }} {{ .DropletName }}'\n",
+	}
+	scaleOut := func() (*mockGodo, error) {
+		mock := createMockGodo()
+		tp := &TargetPlugin{
+			ctx:    ctx,
+			config: config,
+			logger: hclog.NewNullLogger(),
+			client: mock,
+		}
+		template := Must(tp.createDropletTemplate(config))
+		_, err := tp.scaleOut(ctx, nil, 2, 2, template, config)
+		return mock, err
+	}
+
+	// without the flag, the user data is used as it is
+	mock, err := scaleOut()
+	require.NoError(t, err)
+	require.Equal(t, config["user_data"], mock.dropletUserData[1])
+
+	config["user_data_template"] = "true"
+	mock, err = scaleOut()
+	require.NoError(t, err)
+	var rendered []string
+	for id, droplet := range mock.droplets {
+		rendered = append(rendered, mock.dropletUserData[id])
+		require.Contains(t, mock.dropletUserData[id], "'mydropletname lon1 s1 ")
+		require.True(t, strings.HasSuffix(mock.dropletUserData[id], " "+droplet.Name+"'\n"))
+	}
+	require.ElementsMatch(t, []string{"0", "1"}, []string{
+		strings.Fields(rendered[0])[5],
+		strings.Fields(rendered[1])[5],
+	})
+
+	// a broken template is reported before any droplet is created
+	config["user_data"] = "#!/bin/sh\necho {{ .Token }}\n"
+	mock, err = scaleOut()
+	require.ErrorContains(t, err, "cannot render the user data template")
+	require.Empty(t, mock.droplets)
+}
+
+func TestScaleOutRollbackOnFailure(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	mock.failingCreates = []int{2}
+	config := map[string]string{
+		"name":                      "mydropletname",
+		"region":                    "lon1",
+		"size":                      "s1",
+		"snapshot_id":               "12345",
+		"token":                     "t0ken",
+		"vpc_uuid":                  uuid.New().String(),
+		"reserve_ipv4_addresses":    "true",
+		"create_reserved_addresses": "true",
+		"force_delete":              "true",
+		"rollback_on_failure":       "true",
+	}
+	pool := mock.NewReservedAddressPool(hclog.NewNullLogger(), quartz.NewMock(t))
+	tp := &TargetPlugin{
+		ctx:                   ctx,
+		config:                config,
+		logger:                hclog.NewNullLogger(),
+		client:                mock,
+		reservedAddressesPool: pool,
+	}
+	template := Must(tp.createDropletTemplate(config))
+
+	createdIDs, err := tp.scaleOut(ctx, nil, 3, 3, template, config)
+	require.ErrorContains(t, err, "droplet cannot be created")
+	require.NotContains(t, err.Error(), "roll back")
+	// the two droplets which were created are deleted again
+	require.Len(t, createdIDs, 2)
+	require.Equal(t, 3, mock.createCalls)
+	require.Empty(t, mock.droplets)
+	// and the address reserved for the failed droplet can be used again
+	require.Empty(t, pool.prereservedIPs)
+	ips, err := pool.PrereserveIPs(ctx, 1, "lon1", "mydropletname", false, defaultPrereservationExpiry)
+	require.NoError(t, err)
+	require.Len(t, ips, 1)
+}
+
+func TestCreateDropletsInRegionWithStagger(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	clock := quartz.NewMock(t)
+	config := map[string]string{
+		"name":           "mydropletname",
+		"region":         "lon1",
+		"size":           "s1",
+		"snapshot_id":    "12345",
+		"token":          "t0ken",
+		"vpc_uuid":       uuid.New().String(),
+		"create_stagger": "10s",
+	}
+	tp := &TargetPlugin{
+		ctx:                   ctx,
+		config:                config,
+		logger:                hclog.NewNullLogger(),
+		client:                mock,
+		reservedAddressesPool: mock.NewReservedAddressPool(hclog.NewNullLogger(), clock),
+	}
+	template := Must(tp.createDropletTemplate(config))
+	createCalls := func() int {
+		mock.mutex.Lock()
+		defer mock.mutex.Unlock()
+		return mock.createCalls
+	}
+
+	trap := clock.Trap().NewTimer()
+	defer trap.Close()
+	createCtx, cancelCreate := context.WithCancel(ctx)
+	defer cancelCreate()
+	type result struct {
+		ids []int
+		err error
+	}
+	results := make(chan result)
+	go func() {
+		ids, err := tp.createDropletsInRegion(createCtx, nil, hclog.NewNullLogger(), 3, "lon1", "", template)
+		results <- result{ids, err}
+	}()
+
+	// each droplet after the first is only created once the stagger passed
+	trap.MustWait(ctx).MustRelease(ctx)
+	require.Eventually(t, func() bool { return createCalls() == 1 }, time.Second, time.Millisecond)
+	clock.Advance(10 * time.Second).MustWait(ctx)
+	trap.MustWait(ctx).MustRelease(ctx)
+	require.Eventually(t, func() bool { return createCalls() == 2 }, time.Second, time.Millisecond)
+
+	// cancelling aborts the remaining creations without waiting
+	cancelCreate()
+	res := <-results
+	require.ErrorIs(t, res.err, context.Canceled)
+	require.ErrorContains(t, res.err, "1 droplets were not created")
+	require.Len(t, res.ids, 2)
+	require.Equal(t, 2, createCalls())
+}
+
+func TestScaleOutWithVolumes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	lon1 := &godo.Region{Slug: "lon1"}
+	mock.volumes["vol-1"] = &godo.Volume{ID: "vol-1", Region: lon1}
+	mock.volumes["vol-2"] = &godo.Volume{ID: "vol-2", Region: lon1, DropletIDs: []int{99}}
+	mock.volumes["vol-3"] = &godo.Volume{ID: "vol-3", Region: lon1}
+	config := map[string]string{
+		"name":        "mydropletname",
+		"region":      "lon1",
+		"size":        "s1",
+		"snapshot_id": "12345",
+		"token":       "t0ken",
+		"vpc_uuid":    uuid.New().String(),
+		"volumes":     "vol-1,vol-2,vol-3",
+	}
+	tp := &TargetPlugin{
+		ctx:    ctx,
+		config: config,
+		logger: hclog.NewNullLogger(),
+		client: mock,
+	}
+	template := Must(tp.createDropletTemplate(config))
+
+	// only two of the volumes are unattached
+	_, err := tp.scaleOut(ctx, nil, 3, 3, template, config)
+	require.Error(t, err)
+	require.Empty(t, mock.droplets)
+
+	_, err = tp.scaleOut(ctx, nil, 2, 2, template, config)
+	require.NoError(t, err)
+	require.Len(t, mock.volumes["vol-1"].DropletIDs, 1)
+	require.Len(t, mock.volumes["vol-3"].DropletIDs, 1)
+}
+
+func TestScaleOutRegionFailover(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	mock.unavailableRegions = []string{"lon1"}
+	config := map[string]string{
+		"name":        "mydropletname",
+		"region":      "lon1,ams3",
+		"size":        "s1",
+		"snapshot_id": "12345",
+		"token":       "t0ken",
+		"vpc_uuid":    uuid.New().String(),
+	}
+	tp := &TargetPlugin{
+		ctx:    ctx,
+		config: config,
+		logger: hclog.NewNullLogger(),
+		client: mock,
+	}
+	template := Must(tp.createDropletTemplate(config))
+	_, err := tp.scaleOut(ctx, nil, 2, 2, template, config)
+	require.NoError(t, err)
+	require.Len(t, mock.droplets, 2)
+	for _, droplet := range mock.droplets {
+		require.Equal(t, "ams3", droplet.Region.Slug)
+	}
+
+	// no region has capacity
+	mock.unavailableRegions = []string{"lon1", "ams3"}
+	_, err = tp.scaleOut(ctx, nil, 3, 1, template, config)
+	var capacityErr *CapacityError
+	require.ErrorAs(t, err, &capacityErr)
+	require.Equal(t, []string{"lon1", "ams3"}, capacityErr.Regions)
+	require.Len(t, mock.droplets, 2)
+
+	// the account's droplet limit applies to every region
+	mock.unavailableRegions = nil
+	mock.dropletLimit = 2
+	_, err = tp.scaleOut(ctx, nil, 3, 1, template, config)
+	require.ErrorAs(t, err, &capacityErr)
+	require.Empty(t, capacityErr.Regions)
+	require.ErrorContains(t, err, "droplet limit")
+}
+
+func TestScaleOutSizeFallback(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	mock.unavailableSizes = []string{"s1"}
+	config := map[string]string{
+		"name":        "mydropletname",
+		"region":      "lon1",
+		"size":        "s1,s2",
+		"snapshot_id": "12345",
+		"token":       "t0ken",
+		"vpc_uuid":    uuid.New().String(),
+	}
+	tp := &TargetPlugin{
+		ctx:    ctx,
+		config: config,
+		logger: hclog.NewNullLogger(),
+		client: mock,
+	}
+	template := Must(tp.createDropletTemplate(config))
+	_, err := tp.scaleOut(ctx, nil, 2, 2, template, config)
+	require.NoError(t, err)
+	require.Len(t, mock.droplets, 2)
+	for _, droplet := range mock.droplets {
+		require.Equal(t, "s2", droplet.SizeSlug)
+	}
+}
+
+func TestScaleOutMaxCreateConcurrency(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	mock.createDelay = 10 * time.Millisecond
+	config := map[string]string{
+		"name":                   "mydropletname",
+		"region":                 "lon1",
+		"size":                   "s1",
+		"snapshot_id":            "12345",
+		"token":                  "t0ken",
+		"vpc_uuid":               uuid.New().String(),
+		"max_create_concurrency": "3",
+	}
+	tp := &TargetPlugin{
+		ctx:    ctx,
+		config: config,
+		logger: hclog.NewNullLogger(),
+		client: mock,
+	}
+	template := Must(tp.createDropletTemplate(config))
+	_, err := tp.scaleOut(ctx, nil, 10, 10, template, config)
+	require.NoError(t, err)
+	require.Len(t, mock.droplets, 10)
+	require.LessOrEqual(t, mock.maxInFlightCreate.Load(), int32(3))
+	require.Positive(t, mock.maxInFlightCreate.Load())
+}
+
+func TestDeleteDropletsMaxDeleteConcurrency(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	mock.deleteDelay = 10 * time.Millisecond
+	config := map[string]string{
+		"name":                   "mydropletname",
+		"region":                 "lon1",
+		"size":                   "s1",
+		"snapshot_id":            "12345",
+		"token":                  "t0ken",
+		"vpc_uuid":               uuid.New().String(),
+		"force_delete":           "true",
+		"max_delete_concurrency": "2",
+	}
+	tp := &TargetPlugin{
+		ctx:    ctx,
+		config: config,
+		logger: hclog.NewNullLogger(),
+		client: mock,
+	}
+	template := Must(tp.createDropletTemplate(config))
+	_, err := tp.scaleOut(ctx, nil, 6, 6, template, config)
+	require.NoError(t, err)
+
+	instanceIDs := make(map[string]string)
+	for _, droplet := range mock.droplets {
+		instanceIDs[droplet.Name] = ""
+	}
+	require.NoError(t, tp.deleteDroplets(ctx, nil, template, instanceIDs))
+	require.Empty(t, mock.droplets)
+	require.LessOrEqual(t, mock.maxInFlightDelete.Load(), int32(2))
+	require.Positive(t, mock.maxInFlightDelete.Load())
+}
+
+func TestDeleteDropletsByID(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	config := map[string]string{
+		"name":         "mydropletname",
+		"region":       "lon1",
+		"size":         "s1",
+		"snapshot_id":  "12345",
+		"token":        "t0ken",
+		"vpc_uuid":     uuid.New().String(),
+		"force_delete": "true",
+	}
+	tp := &TargetPlugin{
+		ctx:    ctx,
+		config: config,
+		logger: hclog.NewNullLogger(),
+		client: mock,
+	}
+	template := Must(tp.createDropletTemplate(config))
+	_, err := tp.scaleOut(ctx, nil, 3, 3, template, config)
+	require.NoError(t, err)
+
+	// one droplet is identified by its ID, another by its name
+	instanceIDs := map[string]string{
+		"1":                   "",
+		mock.droplets[2].Name: "",
+	}
+	require.NoError(t, tp.deleteDroplets(ctx, nil, template, instanceIDs))
+	require.Len(t, mock.droplets, 1)
+	require.Contains(t, mock.droplets, 3)
+}
+
+func TestStuckRequestsAreRetried(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	clock := quartz.NewMock(t)
+	mock := createMockGodo()
+	config := map[string]string{
+		"name":            "mydropletname",
+		"region":          "lon1",
+		"size":            "s1",
+		"snapshot_id":     "12345",
+		"token":           "t0ken",
+		"vpc_uuid":        uuid.New().String(),
+		"force_delete":    "true",
+		"request_timeout": "10ms",
+	}
+	tp := &TargetPlugin{
+		ctx:                   ctx,
+		config:                config,
+		logger:                hclog.NewNullLogger(),
+		client:                mock,
+		activeDroplets:        newActiveDroplets(clock),
+		reservedAddressesPool: mock.NewReservedAddressPool(hclog.NewNullLogger(), clock),
+	}
+	template := Must(tp.createDropletTemplate(config))
+	_, err := tp.scaleOut(ctx, nil, 2, 2, template, config)
+	require.NoError(t, err)
+	trap := clock.Trap().NewTimer()
+	defer trap.Close()
+	retried := func() {
+		trap.MustWait(ctx).MustRelease(ctx)
+		_, w := clock.AdvanceNext()
+		w.MustWait(ctx)
+	}
+
+	// the first attempt to list the droplets hangs, and the second succeeds
+	mock.hangingLists.Store(1)
+	results := make(chan error)
+	var counts *dropletCounts
+	go func() {
+		var err error
+		counts, err = tp.countDroplets(ctx, template)
+		results <- err
+	}()
+	retried()
+	require.NoError(t, <-results)
+	require.EqualValues(t, 2, counts.total)
+
+	// likewise when deleting a droplet
+	mock.hangingDeletes.Store(1)
+	go func() {
+		results <- tp.deleteDroplets(ctx, nil, template, map[string]string{"1": ""})
+	}()
+	retried()
+	require.NoError(t, <-results)
+	require.Len(t, mock.droplets, 1)
+	require.Contains(t, mock.droplets, 2)
+}
+
+func TestDeleteDropletsWithDuplicateNames(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	config := map[string]string{
+		"name":         "mydropletname",
+		"region":       "lon1",
+		"size":         "s1",
+		"snapshot_id":  "12345",
+		"token":        "t0ken",
+		"vpc_uuid":     uuid.New().String(),
+		"force_delete": "true",
+	}
+	tp := &TargetPlugin{
+		ctx:    ctx,
+		config: config,
+		logger: hclog.NewNullLogger(),
+		client: mock,
+	}
+	template := Must(tp.createDropletTemplate(config))
+	_, err := tp.scaleOut(ctx, nil, 3, 3, template, config)
+	require.NoError(t, err)
+
+	// droplets 1 and 2 share a name, so neither may be deleted by name
+	mock.droplets[2].Name = mock.droplets[1].Name
+	instanceIDs := map[string]string{
+		mock.droplets[1].Name: "",
+		mock.droplets[3].Name: "",
+	}
+	err = tp.deleteDroplets(ctx, nil, template, instanceIDs)
+	require.ErrorContains(t, err, "share the name")
+	require.Len(t, mock.droplets, 2)
+	require.Contains(t, mock.droplets, 1)
+	require.Contains(t, mock.droplets, 2)
+
+	// they can still be deleted by their unique IDs
+	require.NoError(t, tp.deleteDroplets(ctx, nil, template, map[string]string{"1": "", "2": ""}))
+	require.Empty(t, mock.droplets)
+}
+
+func TestDeleteDropletsReturnsErrors(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	mock.undeletableDroplets = []int{2}
+	config := map[string]string{
+		"name":         "mydropletname",
+		"region":       "lon1",
+		"size":         "s1",
+		"snapshot_id":  "12345",
+		"token":        "t0ken",
+		"vpc_uuid":     uuid.New().String(),
+		"force_delete": "true",
+	}
+	tp := &TargetPlugin{
+		ctx:    ctx,
+		config: config,
+		logger: hclog.NewNullLogger(),
+		client: mock,
+	}
+	template := Must(tp.createDropletTemplate(config))
+	_, err := tp.scaleOut(ctx, nil, 3, 3, template, config)
+	require.NoError(t, err)
+
+	instanceIDs := make(map[string]string)
+	for _, droplet := range mock.droplets {
+		instanceIDs[droplet.Name] = ""
+	}
+	err = tp.deleteDroplets(ctx, nil, template, instanceIDs)
+	require.ErrorContains(t, err, "droplet 2: error deleting droplet: droplet cannot be deleted")
+	require.Len(t, mock.droplets, 1)
+	require.Contains(t, mock.droplets, 2)
+}
+
+func TestSshKeyMap(t *testing.T) {
+	require.Equal(t, []godo.DropletCreateSSHKey{
+		{Fingerprint: "3b:16:bf:e4:8b:00:8b:b8:59:8c:a9:d3:f0:19:45:fa"},
+		{ID: 512189},
+		{Fingerprint: "ab:cd:12"},
+	}, sshKeyMap([]string{
+		"3b:16:bf:e4:8b:00:8b:b8:59:8c:a9:d3:f0:19:45:fa",
+		"512189",
+		"ab:cd:12",
+	}))
+}
+
+func TestValidateSSHKeys(t *testing.T) {
+	require.NoError(t, validateSSHKeys([]string{
+		"3b:16:bf:e4:8b:00:8b:b8:59:8c:a9:d3:f0:19:45:fa",
+		"3b:16:bf:e4:8b:00:8b:b8:59:8c:a9:d3:f0:19:45:fa:3b:16:bf:e4:8b:00:8b:b8:59:8c:a9:d3:f0:19:45:fa",
+		"512189",
+	}))
+	err := validateSSHKeys([]string{"512189", "ab:cd:12", "0", "my key"})
+	require.EqualError(
+		t,
+		err,
+		`invalid SSH keys "ab:cd:12", "0", "my key": keys must be fingerprints or numeric IDs`,
+	)
+}
+
+func TestScaleOutWithInvalidImage(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	config := map[string]string{
+		"name":        "mydropletname",
+		"region":      "lon1",
+		"size":        "s1",
+		"snapshot_id": "54321",
+		"token":       "t0ken",
+		"vpc_uuid":    uuid.New().String(),
+	}
+	tp := &TargetPlugin{
+		ctx:    ctx,
+		config: config,
+		logger: hclog.NewNullLogger(),
+		client: mock,
+	}
+
+	// the image does not exist
+	template := Must(tp.createDropletTemplate(config))
+	_, err := tp.scaleOut(ctx, nil, 1, 1, template, config)
+	require.ErrorContains(t, err, "cannot retrieve image 54321")
+
+	// the image exists, but not in the region
+	config["snapshot_id"] = "12345"
+	config["region"] = "nyc1"
+	template = Must(tp.createDropletTemplate(config))
+	_, err = tp.scaleOut(ctx, nil, 1, 1, template, config)
+	require.ErrorContains(t, err, "not available in region(s) [nyc1]")
+	require.Empty(t, mock.droplets)
+}
+
+func TestScaleDryRun(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	config := map[string]string{
+		"name":                   "mydropletname",
+		"region":                 "lon1",
+		"size":                   "s1",
+		"snapshot_id":            "12345",
+		"token":                  "t0ken",
+		"vpc_uuid":               uuid.New().String(),
+		"reserve_ipv4_addresses": "true",
+		"dry_run":                "true",
+	}
+	tp := &TargetPlugin{
+		ctx:    ctx,
+		config: config,
+		logger: hclog.NewNullLogger(),
+		client: mock,
+	}
+	template := Must(tp.createDropletTemplate(config))
+	require.True(t, template.dryRun)
+
+	_, err := tp.scaleOut(ctx, nil, 3, 3, template, config)
+	require.NoError(t, err)
+	require.Empty(t, mock.droplets)
+	require.Empty(t, mock.reservedIPv4s)
+
+	// no Nomad cluster utilities are configured, so this would fail if
+	// the scale in went ahead
+	require.NoError(t, tp.scaleIn(ctx, nil, 0, 3, template, config))
+}
+
+func TestScaleInToZero(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	config := map[string]string{
+		"name":         "mydropletname",
+		"region":       "lon1",
+		"size":         "s1",
+		"snapshot_id":  "12345",
+		"token":        "t0ken",
+		"vpc_uuid":     uuid.New().String(),
+		"force_delete": "true",
+	}
+	clusterUtils := &mockClusterUtils{
+		dropletNames: []string{"mydropletname-1", "mydropletname-2"},
+	}
+	// the pre-scale in tasks did not drain one of the nodes
+	nomadNodes := &mockNomadNodes{nodes: map[string]*api.Node{
+		"mydropletname-1": {SchedulingEligibility: api.NodeSchedulingIneligible},
+		"mydropletname-2": {SchedulingEligibility: api.NodeSchedulingEligible},
+	}}
+	tp := &TargetPlugin{
+		ctx:          ctx,
+		config:       config,
+		logger:       hclog.NewNullLogger(),
+		client:       mock,
+		clusterUtils: clusterUtils,
+		nomadNodes:   nomadNodes,
+	}
+	for id, name := range clusterUtils.dropletNames {
+		mock.droplets[id] = &godo.Droplet{
+			ID:     id,
+			Name:   name,
+			Status: "active",
+			Tags:   []string{"mydropletname"},
+		}
+	}
+	template := Must(tp.createDropletTemplate(config))
+
+	require.NoError(t, tp.scaleIn(ctx, nil, 0, 2, template, config))
+	require.Empty(t, mock.droplets)
+	// scaling in to zero deletes the droplets together
+	require.Equal(t, 1, mock.deleteByTagCalls)
+	require.Len(t, clusterUtils.postScaleIn, 2)
+	require.Equal(t, []string{"mydropletname-2"}, nomadNodes.drained)
+}
+
+func TestScaleInOldestFirst(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	for _, tc := range []struct {
+		name     string
+		strategy string
+		deleted  []string
+	}{
+		{name: "nomad selection", deleted: []string{"newest", "middle"}},
+		{name: "oldest first", strategy: "oldest_first", deleted: []string{"oldest", "middle"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := createMockGodo()
+			config := map[string]string{
+				"name":              "mydropletname",
+				"region":            "lon1",
+				"size":              "s1",
+				"snapshot_id":       "12345",
+				"token":             "t0ken",
+				"vpc_uuid":          uuid.New().String(),
+				"force_delete":      "true",
+				"scale_in_strategy": tc.strategy,
+			}
+			// Nomad would select the newest droplets first
+			clusterUtils := &mockClusterUtils{
+				dropletNames: []string{"newest", "middle", "oldest", "unknown"},
+			}
+			tp := &TargetPlugin{
+				ctx:          ctx,
+				config:       config,
+				logger:       hclog.NewNullLogger(),
+				client:       mock,
+				clusterUtils: clusterUtils,
+			}
+			created := map[string]string{
+				"newest":  "2024-01-03T00:00:00Z",
+				"middle":  "2024-01-02T00:00:00Z",
+				"oldest":  "2024-01-01T00:00:00Z",
+				"unknown": "",
+			}
+			for id, name := range clusterUtils.dropletNames {
+				mock.droplets[id] = &godo.Droplet{
+					ID:      id,
+					Name:    name,
+					Status:  "active",
+					Created: created[name],
+					Tags:    []string{"mydropletname"},
+				}
+			}
+			template := Must(tp.createDropletTemplate(config))
+
+			require.NoError(t, tp.scaleIn(ctx, nil, 2, 2, template, config))
+			var deleted []string
+			for _, id := range clusterUtils.postScaleIn {
+				deleted = append(deleted, id.RemoteResourceID)
+			}
+			require.ElementsMatch(t, tc.deleted, deleted)
+			require.Len(t, mock.droplets, 2)
+		})
+	}
+}
+
+func TestDropletCountsIsStableWhenScalingInToZero(t *testing.T) {
+	// the last droplet is still being deleted
+	counts := &dropletCounts{byStatus: make(map[string]int64)}
+	counts.add([]godo.Droplet{{ID: 1, Status: "archive"}})
+	require.True(t, counts.isStable(0, "in"))
+
+	counts = &dropletCounts{byStatus: make(map[string]int64)}
+	counts.add([]godo.Droplet{{ID: 1, Status: "new"}})
+	require.True(t, counts.isStable(0, "in"))
+
+	counts = &dropletCounts{byStatus: make(map[string]int64)}
+	counts.add([]godo.Droplet{{ID: 1, Status: "active"}})
+	require.False(t, counts.isStable(0, "in"))
+}
+
+func TestCountDropletsTotal(t *testing.T) {
+	mock := createMockGodo()
+	tp := &TargetPlugin{
+		logger: hclog.NewNullLogger(),
+		client: mock,
+	}
+	template := &dropletTemplate{name: "hashi-batch", client: mock}
+
+	// no droplet was ever created with the tag
+	total, err := tp.countDropletsTotal(t.Context(), template)
+	require.NoError(t, err)
+	require.Zero(t, total)
+
+	mock.droplets[1] = &godo.Droplet{ID: 1, Status: "active", Tags: []string{"hashi-batch"}}
+	mock.droplets[2] = &godo.Droplet{ID: 2, Status: "new", Tags: []string{"hashi-batch"}}
+	mock.droplets[3] = &godo.Droplet{ID: 3, Status: "active", Tags: []string{"unrelated"}}
+	total, err = tp.countDropletsTotal(t.Context(), template)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, total)
+
+	counts, err := tp.countDroplets(t.Context(), template)
+	require.NoError(t, err)
+	require.Equal(t, counts.total, total)
+}
+
+// stuckDroplets never responds to requests listing droplets, until the
+// request's context is done.
+type stuckDroplets struct {
+	Droplets
+}
+
+func (s stuckDroplets) ListByTag(
+	ctx context.Context,
+	tag string,
+	opt *godo.ListOptions,
+) ([]godo.Droplet, *godo.Response, error) {
+	<-ctx.Done()
+	return nil, nil, ctx.Err()
+}
+
+type stuckGodo struct {
+	*mockGodo
+}
+
+func (s stuckGodo) Droplets() Droplets {
+	return stuckDroplets{s.mockGodo.Droplets()}
+}
+
+func TestStuckRequestsTimeOut(t *testing.T) {
+	mock := createMockGodo()
+	mock.droplets[1] = &godo.Droplet{ID: 1, Name: "hashi-batch-1", Tags: []string{"hashi-batch"}}
+	tp := &TargetPlugin{
+		logger: hclog.NewNullLogger(),
+		client: stuckGodo{mock},
+	}
+	template := &dropletTemplate{
+		name:           "hashi-batch",
+		client:         tp.client,
+		requestTimeout: 10 * time.Millisecond,
+	}
+
+	// requests which time out are retried until the scaling action runs out
+	// of time
+	ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+	_, err := tp.countDroplets(ctx, template)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	ctx, cancel = context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+	err = tp.deleteDroplets(ctx, nil, template, map[string]string{"hashi-batch-1": ""})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Contains(t, mock.droplets, 1)
+}
+
+func TestDropletCountsIsStable(t *testing.T) {
+	counts := &dropletCounts{byStatus: make(map[string]int64)}
+	counts.add([]godo.Droplet{
+		{ID: 1, Status: "active"},
+		{ID: 2, Status: "active"},
+		{ID: 3, Status: "new"},
+	})
+	require.False(t, counts.isStable(3, "out"))
+	require.True(t, counts.isStable(2, "out"))
+	require.True(t, counts.isStable(1, "out"))
+	require.False(t, counts.isStable(2, "in"))
+
+	counts = &dropletCounts{byStatus: make(map[string]int64)}
+	counts.add([]godo.Droplet{
+		{ID: 1, Status: "active"},
+		{ID: 2, Status: "active"},
+		{ID: 3, Status: "off"},
+	})
+	require.True(t, counts.isStable(2, "in"))
+	require.True(t, counts.isStable(3, "in"))
+	require.False(t, counts.isStable(1, "in"))
+}
+
+func TestScaleOutWithExtraDroplet(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	config := map[string]string{
+		"name":        "mydropletname",
+		"region":      "lon1",
+		"size":        "s1",
+		"snapshot_id": "12345",
+		"token":       "t0ken",
+		"vpc_uuid":    uuid.New().String(),
+	}
+	tp := &TargetPlugin{
+		ctx:    ctx,
+		config: config,
+		logger: hclog.NewNullLogger(),
+		client: mock,
+	}
+
+	// a droplet which was created twice, e.g. by a retried request
+	mock.droplets[1000] = &godo.Droplet{ID: 1000, Status: "active", Tags: []string{"mydropletname"}}
+
+	template := Must(tp.createDropletTemplate(config))
+	_, err := tp.scaleOut(ctx, nil, 2, 2, template, config)
+	require.NoError(t, err)
+	require.Len(t, mock.droplets, 3)
+}
+
+func TestSecureIntroductionTag(t *testing.T) {
+	tag, err := secureIntroductionTag("banana-", "abcd")
+	require.NoError(t, err)
+	require.Equal(t, "banana-abcd", tag)
+
+	_, err = secureIntroductionTag("banana-", strings.Repeat("a", 250))
+	require.ErrorContains(t, err, "the prefix is 7 characters, the wrapping token 250")
+
+	_, err = secureIntroductionTag("banana-", "hvs.abcd")
+	require.ErrorContains(t, err, `"."`)
+}
+
+func TestGenerateTagForSecureIntroductionCleansUpTag(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	mock.droplets[1] = &godo.Droplet{
+		ID: 1,
+		Networks: &godo.Networks{
+			V4: []godo.NetworkV4{{IPAddress: "2.2.2.1"}},
+		},
+	}
+	mock.untaggableDroplets = []int{1}
+	template := &dropletTemplate{
+		secureIntroductionAppRole:   "droplet-approle",
+		secureIntroductionTagPrefix: "banana-",
+		networkWaitInterval:         time.Millisecond,
+		networkWaitAttempts:         1,
+	}
+
+	err := generateTagForSecureIntroduction(
+		ctx,
+		hclog.NewNullLogger(),
+		template,
+		1,
+		false,
+		&mockVaultProxy{},
+		mock.Droplets(),
+		mock.Tags(),
+	)
+	require.ErrorContains(t, err, "failed to tag droplet 1")
+	// the tag holding the secret has been deleted again
+	require.Empty(t, mock.tags)
+}
+
+func TestCleanUpUnusedTags(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	clock := quartz.NewMock(t)
+	mock.tags["banana-in-use"] = struct{}{}
+	mock.tags["banana-unused"] = struct{}{}
+	mock.tags["unrelated"] = struct{}{}
+	mock.droplets[1] = &godo.Droplet{ID: 1, Tags: []string{"banana-in-use"}}
+
+	trap := clock.Trap().NewTimer()
+	defer trap.Close()
+	done := make(chan struct{})
+	go func() {
+		cleanUpUnusedTags(
+			ctx,
+			hclog.NewNullLogger(),
+			mock,
+			"banana-",
+			clock,
+			time.Minute,
+			NewRateLimiter(tagDeleteBurst, tagDeleteRechargePeriod, true, WithMockClock(clock)),
+		)
+		close(done)
+	}()
+
+	// nothing is deleted until the wait is over
+	call := trap.MustWait(ctx)
+	require.Equal(t, time.Minute, call.Duration)
+	call.MustRelease(ctx)
+	require.Len(t, mock.tags, 3)
+
+	// a tag created in the meantime is not deleted either
+	mock.mutex.Lock()
+	mock.tags["banana-new"] = struct{}{}
+	mock.mutex.Unlock()
+
+	clock.Advance(time.Minute).MustWait(ctx)
+	<-done
+	require.Equal(t, map[string]struct{}{
+		"banana-in-use": {},
+		"banana-new":    {},
+		"unrelated":     {},
+	}, mock.tags)
+}
+
+func TestCleanUpManyUnusedTags(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	clock := quartz.NewMock(t)
+	for i := range 2 * tagDeleteBurst {
+		mock.tags[fmt.Sprintf("banana-%v", i)] = struct{}{}
+	}
+
+	waitTrap := clock.Trap().NewTimer()
+	done := make(chan struct{})
+	go func() {
+		cleanUpUnusedTags(
+			ctx,
+			hclog.NewNullLogger(),
+			mock,
+			"banana-",
+			clock,
+			time.Minute,
+			NewRateLimiter(tagDeleteBurst, tagDeleteRechargePeriod, true, WithMockClock(clock)),
+		)
+		close(done)
+	}()
+	call := waitTrap.MustWait(ctx)
+	call.MustRelease(ctx)
+	waitTrap.Close()
+	clock.Advance(time.Minute).MustWait(ctx)
+
+	// the first burst of tags is deleted straight away, and the rest
+	// as the rate limiter recharges
+	for {
+		select {
+		case <-done:
+			require.Empty(t, mock.tags)
+			require.GreaterOrEqual(t, clock.Since(call.Time.Add(time.Minute)), time.Duration(tagDeleteBurst-1)*tagDeleteRechargePeriod)
+			return
+		case <-ctx.Done():
+			t.Fatal("tags were not cleaned up")
+		case <-time.After(time.Millisecond):
+			clock.Advance(tagDeleteRechargePeriod / 10)
+		}
+	}
+}
+
+func TestReapUnusedTags(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	clock := quartz.NewMock(t)
+	mock.tags["banana-unused"] = struct{}{}
+	mock.tags["apple-unused"] = struct{}{}
+	mock.tags["unrelated"] = struct{}{}
+	tp := &TargetPlugin{
+		ctx:                   ctx,
+		logger:                hclog.NewNullLogger(),
+		client:                mock,
+		reservedAddressesPool: mock.NewReservedAddressPool(hclog.NewNullLogger(), clock),
+		tagDeleteRateLimiter:  NewRateLimiter(tagDeleteBurst, tagDeleteRechargePeriod, true, WithMockClock(clock)),
+	}
+	for _, prefix := range []string{"banana-", "apple-", ""} {
+		tp.rememberTagPrefix(&dropletTemplate{
+			client:                      mock,
+			reservedAddressesPool:       tp.reservedAddressesPool,
+			secureIntroductionTagPrefix: prefix,
+		})
+	}
+
+	tickerTrap := clock.Trap().NewTicker()
+	defer tickerTrap.Close()
+	timerTrap := clock.Trap().NewTimer()
+	defer timerTrap.Close()
+	go tp.reapUnusedTags(ctx, time.Hour)
+	tickerTrap.MustWait(ctx).MustRelease(ctx)
+
+	// each prefix is cleaned up in turn once the interval has passed
+	clock.Advance(time.Hour).MustWait(ctx)
+	for range 2 {
+		timerTrap.MustWait(ctx).MustRelease(ctx)
+		clock.Advance(time.Minute).MustWait(ctx)
+	}
+	require.Eventually(t, func() bool {
+		mock.mutex.Lock()
+		defer mock.mutex.Unlock()
+		return len(mock.tags) == 1
+	}, time.Second, time.Millisecond)
+	require.Contains(t, mock.tags, "unrelated")
+}
+
+func TestCleanUpTagsWhileAnotherCleanUpIsRunning(t *testing.T) {
+	mock := createMockGodo()
+	mock.tags["banana-unused"] = struct{}{}
+	tp := &TargetPlugin{
+		client:                mock,
+		reservedAddressesPool: mock.NewReservedAddressPool(hclog.NewNullLogger(), quartz.NewMock(t)),
+	}
+	tp.tagCleanupMutex.Lock()
+	tp.cleanUpTags(t.Context(), hclog.NewNullLogger(), mock, quartz.NewMock(t), "banana-")
+	require.Contains(t, mock.tags, "banana-unused")
+}
+
+func TestReapUnusedTagsOfPolicyWithOwnToken(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	otherMock := createMockGodo()
+	clock := quartz.NewMock(t)
+	mock.tags["banana-unused"] = struct{}{}
+	otherMock.tags["banana-unused"] = struct{}{}
+	tp := &TargetPlugin{
+		ctx:                   ctx,
+		config:                map[string]string{"token": "t0ken"},
+		logger:                hclog.NewNullLogger(),
+		client:                mock,
+		reservedAddressesPool: mock.NewReservedAddressPool(hclog.NewNullLogger(), clock),
+		tagDeleteRateLimiter:  NewRateLimiter(tagDeleteBurst, tagDeleteRechargePeriod, true, WithMockClock(clock)),
+		accounts: map[string]*account{
+			"0th3r": {
+				id:                    accountID("0th3r"),
+				client:                otherMock,
+				reservedAddressesPool: otherMock.NewReservedAddressPool(hclog.NewNullLogger(), clock),
+			},
+		},
+	}
+	template := Must(tp.createDropletTemplate(map[string]string{
+		"name":                           "mydropletname",
+		"region":                         "lon1",
+		"size":                           "s1",
+		"snapshot_id":                    "12345",
+		"token":                          "0th3r",
+		"secure_introduction_tag_prefix": "banana-",
+	}))
+	tp.rememberTagPrefix(template)
+
+	tickerTrap := clock.Trap().NewTicker()
+	defer tickerTrap.Close()
+	timerTrap := clock.Trap().NewTimer()
+	defer timerTrap.Close()
+	go tp.reapUnusedTags(ctx, time.Hour)
+	tickerTrap.MustWait(ctx).MustRelease(ctx)
+	clock.Advance(time.Hour).MustWait(ctx)
+	timerTrap.MustWait(ctx).MustRelease(ctx)
+	clock.Advance(time.Minute).MustWait(ctx)
+
+	// the tags are cleaned up in the policy's account, not the plugin's
+	require.Eventually(t, func() bool {
+		otherMock.mutex.Lock()
+		defer otherMock.mutex.Unlock()
+		return len(otherMock.tags) == 0
+	}, time.Second, time.Millisecond)
+	require.Contains(t, mock.tags, "banana-unused")
+}
+
+func TestDropletNodeIDMap(t *testing.T) {
+	node := &api.Node{
+		Attributes: map[string]string{
+			"unique.hostname":                 "hashi-batch-1",
+			"unique.platform.digitalocean.id": "123",
+		},
+	}
+	id, err := dropletNodeIDMap("unique.hostname")(node)
+	require.NoError(t, err)
+	require.Equal(t, "hashi-batch-1", id)
+
+	id, err = dropletNodeIDMap("unique.platform.digitalocean.id")(node)
+	require.NoError(t, err)
+	require.Equal(t, "123", id)
+
+	_, err = dropletNodeIDMap("unique.hostname")(&api.Node{Attributes: map[string]string{}})
+	require.ErrorIs(t, err, ErrMissingNodeAttribute)
+	require.ErrorContains(t, err, "unique.hostname")
+}
+
+func TestScaleOutWaitsForNetworkBeforeReservingAddresses(t *testing.T) {
+	testCases := []struct {
+		name              string
+		networklessGets   int
+		provisionedStatus string
+		ipv6Only          bool
+		neverReady        bool
+		expectedError     string
+	}{
+		{
+			name:            "network information becomes available",
+			networklessGets: 2,
+		},
+		{
+			name:            "IPv6 network information becomes available",
+			networklessGets: 2,
+			ipv6Only:        true,
+		},
+		{
+			name:            "network information never becomes available",
+			networklessGets: 1000,
+			neverReady:      true,
+			expectedError:   "is not ready for reserved addresses: the droplet is not yet active",
+		},
+		{
+			name:              "the droplet is powered off",
+			networklessGets:   2,
+			provisionedStatus: "off",
+			expectedError:     "is not ready for reserved addresses: the droplet is off",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+			defer cancel()
+			clock := quartz.NewMock(t)
+			mock := createMockGodo()
+			mock.networklessGets = tc.networklessGets
+			mock.provisionedStatus = tc.provisionedStatus
+			config := map[string]string{
+				"name":                      "mydropletname",
+				"region":                    "lon1",
+				"size":                      "s1",
+				"snapshot_id":               "12345",
+				"token":                     "t0ken",
+				"vpc_uuid":                  uuid.New().String(),
+				"reserve_ipv4_addresses":    "true",
+				"create_reserved_addresses": "true",
+				"reservation_wait_interval": "1ms",
+				"reservation_wait_timeout":  "100ms",
+			}
+			if !tc.neverReady {
+				// only the droplets which never become ready wait out the
+				// timeout
+				config["reservation_wait_timeout"] = "5s"
+			}
+			if tc.ipv6Only {
+				config["ipv6"] = "true"
+				config["reserve_ipv4_addresses"] = "false"
+				config["reserve_ipv6_addresses"] = "true"
+			}
+			tp := &TargetPlugin{
+				ctx:                   ctx,
+				config:                config,
+				logger:                hclog.NewNullLogger(),
+				client:                mock,
+				reservedAddressesPool: mock.NewReservedAddressPool(hclog.NewNullLogger(), clock),
+			}
+			template := Must(tp.createDropletTemplate(config))
+
+			// the droplets are polled on the pool's clock, which moves on
+			// as soon as they wait, unless they are never to become ready
+			if !tc.neverReady {
+				trap := clock.Trap().NewTimer()
+				defer trap.Close()
+				driven := make(chan struct{})
+				defer func() { <-driven }()
+				defer cancel()
+				go func() {
+					defer close(driven)
+					for {
+						call, err := trap.Wait(ctx)
+						if err != nil || call.Release(ctx) != nil {
+							return
+						}
+						_, w := clock.AdvanceNext()
+						if w.Wait(ctx) != nil {
+							return
+						}
+					}
+				}()
+			}
+			createdIDs, err := tp.scaleOut(ctx, nil, 2, 2, template, config)
+			if tc.expectedError != "" {
+				require.ErrorContains(t, err, tc.expectedError)
+				// no address was assigned to a droplet which was not ready
+				for _, ip := range mock.reservedIPv4s {
+					require.Nil(t, ip.Droplet)
+				}
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, createdIDs, 2)
+			for _, dropletID := range createdIDs {
+				require.Greater(t, mock.dropletGets[dropletID], tc.networklessGets)
+			}
+			assigned := 0
+			for _, ip := range mock.reservedIPv4s {
+				if ip.Droplet != nil {
+					assigned++
+				}
+			}
+			for _, ip := range mock.reservedIPv6s {
+				if ip.Droplet != nil {
+					assigned++
+				}
+			}
+			require.Equal(t, 2, assigned)
+		})
+	}
+}
+
+func TestScaleOutCreatesDropletsWhileOthersWaitForNetwork(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	clock := quartz.NewMock(t)
+	mock := createMockGodo()
+	mock.networklessGets = 1000
+	config := map[string]string{
+		"name":                      "mydropletname",
+		"region":                    "lon1",
+		"size":                      "s1",
+		"snapshot_id":               "12345",
+		"token":                     "t0ken",
+		"vpc_uuid":                  uuid.New().String(),
+		"reserve_ipv4_addresses":    "true",
+		"create_reserved_addresses": "true",
+		"max_create_concurrency":    "1",
+	}
+	tp := &TargetPlugin{
+		ctx:                   ctx,
+		config:                config,
+		logger:                hclog.NewNullLogger(),
+		client:                mock,
+		reservedAddressesPool: mock.NewReservedAddressPool(hclog.NewNullLogger(), clock),
+	}
+	template := Must(tp.createDropletTemplate(config))
+	trap := clock.Trap().NewTimer()
+	defer trap.Close()
+
+	type result struct {
+		createdIDs []int
+		err        error
+	}
+	results := make(chan result)
+	go func() {
+		createdIDs, err := tp.scaleOut(ctx, nil, 2, 2, template, config)
+		results <- result{createdIDs, err}
+	}()
+
+	// only one droplet is created at a time, but both wait for their
+	// network at once
+	calls := []*quartz.Call{trap.MustWait(ctx), trap.MustWait(ctx)}
+	mock.mutex.Lock()
+	require.Equal(t, 2, mock.createCalls)
+	mock.networklessGets = 0
+	mock.mutex.Unlock()
+	for _, call := range calls {
+		call.MustRelease(ctx)
+	}
+	for range calls {
+		_, w := clock.AdvanceNext()
+		w.MustWait(ctx)
+	}
+	r := <-results
+	require.NoError(t, r.err)
+	require.Len(t, r.createdIDs, 2)
+}
+
+func TestSecureIntroductionFileOwner(t *testing.T) {
+	template := &dropletTemplate{
+		secureIntroductionAppRole:   "droplet-approle",
+		secureIntroductionFilenames: []string{"/run/secure-introduction"},
+		secureIntroductionFileOwner: "vault:vault",
+		secureIntroductionTagPrefix: "banana-",
+	}
+	// the SecretID is embedded in the user data when a reserved address is
+	// known, and otherwise read from a tag
+	for _, allowedIPv4 := range []string{"1.2.3.4", ""} {
+		userData, err := generateUserDataForSecureIntroduction(
+			t.Context(),
+			hclog.NewNullLogger(),
+			"",
+			allowedIPv4, "",
+			template,
+			&mockVaultProxy{},
+		)
+		require.NoError(t, err)
+		require.Regexp(t,
+			`chmod 600 "\$SECRET_TEMPFILE"\n *chown "vault:vault" "\$SECRET_TEMPFILE"\n *mv -f "\$SECRET_TEMPFILE" "/run/secure-introduction"\n`,
+			userData)
+	}
+
+	template.secureIntroductionFileOwner = ""
+	userData, err := generateUserDataForSecureIntroduction(
+		t.Context(),
+		hclog.NewNullLogger(),
+		"",
+		"1.2.3.4", "",
+		template,
+		&mockVaultProxy{},
+	)
+	require.NoError(t, err)
+	require.NotContains(t, userData, "chown")
+
+	config := map[string]string{
+		"name":                                "mydropletname",
+		"region":                              "lon1",
+		"size":                                "s1",
+		"snapshot_id":                         "12345",
+		"secure_introduction_approle":         "droplet-approle",
+		"secure_introduction_filename":        "/run/secure-introduction",
+		"secure_introduction_file_owner":      "1000:1000",
+		"secure_introduction_tag_prefix":      "banana-",
+		"secure_introduction_secret_validity": "1h",
+		"secure_introduction_wrapped_secret_validity": "5m",
+	}
+	tp := &TargetPlugin{}
+	parsed := Must(tp.createDropletTemplate(config))
+	require.Equal(t, "1000:1000", parsed.secureIntroductionFileOwner)
+	config["secure_introduction_file_owner"] = `vault"; rm -rf /`
+	_, err = tp.createDropletTemplate(config)
+	require.ErrorContains(t, err, "secure_introduction_file_owner")
+}
+
+func TestParseFilenames(t *testing.T) {
+	filenames, err := parseFilenames("/run/secure-introduction")
+	require.NoError(t, err)
+	require.Equal(t, []string{"/run/secure-introduction"}, filenames)
+
+	filenames, err = parseFilenames(" /run/secure-introduction , /etc/agent/secret-id")
+	require.NoError(t, err)
+	require.Equal(t, []string{"/run/secure-introduction", "/etc/agent/secret-id"}, filenames)
+
+	for _, invalid := range []string{
+		"",
+		"/run/a,,/run/b",
+		"secret-id",
+		"/run/",
+		`/run/"secret"`,
+		"/run/$HOME",
+		"/run/`id`",
+		"/run/a,/run/a",
+	} {
+		_, err := parseFilenames(invalid)
+		require.Error(t, err, invalid)
+	}
 }
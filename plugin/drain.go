@@ -0,0 +1,60 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+)
+
+// defaultDrainDeadline matches the default deadline of the drain run by the
+// pre-scale in tasks.
+const defaultDrainDeadline = 15 * time.Minute
+
+// NomadNodes is the subset of the Nomad API used to drain nodes, and to
+// check that new nodes joined the cluster.
+type NomadNodes interface {
+	List(*api.QueryOptions) ([]*api.NodeListStub, *api.QueryMeta, error)
+	Info(string, *api.QueryOptions) (*api.Node, *api.QueryMeta, error)
+	UpdateDrainOpts(string, *api.DrainOptions, *api.WriteOptions) (*api.NodeDrainUpdateResponse, error)
+	MonitorDrain(context.Context, string, uint64, bool) <-chan *api.MonitorMessage
+}
+
+// drainNode drains the Nomad node with the given ID, and waits for the drain
+// to complete. Nodes which are already ineligible for scheduling, e.g. as
+// they were drained by the pre-scale in tasks, are left alone.
+func drainNode(
+	ctx context.Context,
+	nodeID string,
+	deadline time.Duration,
+	nodes NomadNodes,
+	log hclog.Logger,
+) error {
+	node, _, err := nodes.Info(nodeID, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("error reading Nomad node: %w", err)
+	}
+	if node.SchedulingEligibility == api.NodeSchedulingIneligible {
+		log.Debug("Not draining node as it is already ineligible", "node_id", nodeID)
+		return nil
+	}
+
+	log.Info("Draining node...", "node_id", nodeID, "deadline", deadline)
+	resp, err := nodes.UpdateDrainOpts(
+		nodeID,
+		&api.DrainOptions{DrainSpec: &api.DrainSpec{Deadline: deadline}},
+		(&api.WriteOptions{}).WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("error draining node: %w", err)
+	}
+	for msg := range nodes.MonitorDrain(ctx, nodeID, resp.LastIndex, false) {
+		if msg.Level == api.MonitorMsgLevelError {
+			return fmt.Errorf("error draining node: %s", msg.Message)
+		}
+		log.Debug("received node drain message", "node_id", nodeID, "msg", msg.Message)
+	}
+	return ctx.Err()
+}
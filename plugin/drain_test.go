@@ -0,0 +1,35 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDrainNode(t *testing.T) {
+	nodes := &mockNomadNodes{nodes: map[string]*api.Node{
+		"eligible":   {ID: "eligible", SchedulingEligibility: api.NodeSchedulingEligible},
+		"ineligible": {ID: "ineligible", SchedulingEligibility: api.NodeSchedulingIneligible},
+	}}
+
+	require.NoError(t, drainNode(t.Context(), "eligible", time.Minute, nodes, hclog.NewNullLogger()))
+	require.NoError(t, drainNode(t.Context(), "ineligible", time.Minute, nodes, hclog.NewNullLogger()))
+	require.Equal(t, []string{"eligible"}, nodes.drained)
+	require.Equal(t, api.NodeSchedulingIneligible, nodes.nodes["eligible"].SchedulingEligibility)
+
+	require.Error(t, drainNode(t.Context(), "missing", time.Minute, nodes, hclog.NewNullLogger()))
+}
+
+func TestDrainNodeFails(t *testing.T) {
+	nodes := &mockNomadNodes{
+		nodes: map[string]*api.Node{
+			"eligible": {ID: "eligible", SchedulingEligibility: api.NodeSchedulingEligible},
+		},
+		drainError: "deadline reached",
+	}
+	err := drainNode(t.Context(), "eligible", time.Minute, nodes, hclog.NewNullLogger())
+	require.ErrorContains(t, err, "deadline reached")
+}
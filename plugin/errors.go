@@ -0,0 +1,104 @@
+package plugin
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/digitalocean/godo"
+)
+
+// ErrMissingNodeAttribute is returned when a Nomad node lacks the attribute
+// identifying its droplet, e.g. as the node has not finished starting up.
+var ErrMissingNodeAttribute = errors.New("node attribute not found")
+
+// CapacityError is returned by a scale-out which could not create droplets
+// for lack of capacity: either in every configured region, which are then
+// listed, or in the account, whose droplet limit has been reached. Retrying
+// straight away is unlikely to succeed.
+type CapacityError struct {
+	// Regions lists the regions without capacity; it is empty if the
+	// account's droplet limit was reached instead.
+	Regions []string
+	Err     error
+}
+
+func (e *CapacityError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CapacityError) Unwrap() error {
+	return e.Err
+}
+
+// isCapacityError reports whether DigitalOcean rejected a request because
+// there is insufficient capacity in a region, including for the requested
+// size. If err joins several errors, all of them must be capacity errors.
+func isCapacityError(err error) bool {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs := joined.Unwrap()
+		if len(errs) == 0 {
+			return false
+		}
+		for _, err := range errs {
+			if !isCapacityError(err) {
+				return false
+			}
+		}
+		return true
+	}
+
+	respErr := &godo.ErrorResponse{}
+	if !errors.As(err, &respErr) {
+		return false
+	}
+	message := strings.ToLower(respErr.Message)
+	return strings.Contains(message, "capacity") ||
+		(strings.Contains(message, "region") && isUnavailableMessage(message)) ||
+		isSizeUnavailableError(err)
+}
+
+// isSizeUnavailableError reports whether DigitalOcean rejected a request
+// because the requested droplet size is not available.
+func isSizeUnavailableError(err error) bool {
+	respErr := &godo.ErrorResponse{}
+	if !errors.As(err, &respErr) {
+		return false
+	}
+	message := strings.ToLower(respErr.Message)
+	return strings.Contains(message, "size") && isUnavailableMessage(message)
+}
+
+// isDropletLimitError reports whether DigitalOcean rejected a request
+// because it would exceed the account's droplet limit.
+func isDropletLimitError(err error) bool {
+	respErr := &godo.ErrorResponse{}
+	if !errors.As(err, &respErr) {
+		return false
+	}
+	return strings.Contains(strings.ToLower(respErr.Message), "droplet limit")
+}
+
+// isNotFoundError reports whether DigitalOcean rejected a request because
+// the resource does not exist.
+func isNotFoundError(err error) bool {
+	respErr := &godo.ErrorResponse{}
+	return errors.As(err, &respErr) &&
+		respErr.Response != nil &&
+		respErr.Response.StatusCode == http.StatusNotFound
+}
+
+// isAlreadyPoweredOffError reports whether DigitalOcean rejected a request
+// to power off a droplet because it is already off.
+func isAlreadyPoweredOffError(err error) bool {
+	respErr := &godo.ErrorResponse{}
+	return errors.As(err, &respErr) &&
+		respErr.Response != nil &&
+		respErr.Response.StatusCode == http.StatusUnprocessableEntity &&
+		strings.Contains(strings.ToLower(respErr.Message), "already powered off")
+}
+
+func isUnavailableMessage(message string) bool {
+	return strings.Contains(message, "unavailable") ||
+		strings.Contains(message, "not available")
+}
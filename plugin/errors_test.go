@@ -0,0 +1,98 @@
+package plugin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/digitalocean/godo"
+	"github.com/stretchr/testify/require"
+)
+
+// doError returns the error godo makes of a DigitalOcean API error response.
+func doError(t *testing.T, status int, body string) error {
+	t.Helper()
+	err := godo.CheckResponse(&http.Response{
+		StatusCode: status,
+		Body:       io.NopCloser(bytes.NewBufferString(body)),
+		Request:    &http.Request{Method: http.MethodPost},
+	})
+	require.Error(t, err)
+	return err
+}
+
+func TestErrorClassification(t *testing.T) {
+	testCases := []struct {
+		name            string
+		status          int
+		body            string
+		capacity        bool
+		sizeUnavailable bool
+		dropletLimit    bool
+		notFound        bool
+	}{
+		{
+			name:     "region out of capacity",
+			status:   http.StatusUnprocessableEntity,
+			body:     `{"id": "unprocessable_entity", "message": "The region is temporarily out of capacity."}`,
+			capacity: true,
+		},
+		{
+			name:     "region unavailable",
+			status:   http.StatusUnprocessableEntity,
+			body:     `{"id": "unprocessable_entity", "message": "Region is not available for new droplets."}`,
+			capacity: true,
+		},
+		{
+			name:            "size unavailable",
+			status:          http.StatusUnprocessableEntity,
+			body:            `{"id": "unprocessable_entity", "message": "Size is not available in this region."}`,
+			capacity:        true,
+			sizeUnavailable: true,
+		},
+		{
+			name:         "droplet limit",
+			status:       http.StatusUnprocessableEntity,
+			body:         `{"id": "forbidden", "message": "creating this/these droplet(s) will exceed your droplet limit"}`,
+			dropletLimit: true,
+		},
+		{
+			name:   "invalid image",
+			status: http.StatusUnprocessableEntity,
+			body:   `{"id": "unprocessable_entity", "message": "You specified an invalid image for Droplet creation."}`,
+		},
+		{
+			name:   "rate limited",
+			status: http.StatusTooManyRequests,
+			body:   `{"id": "too_many_requests", "message": "API Rate limit exceeded."}`,
+		},
+		{
+			name:     "not found",
+			status:   http.StatusNotFound,
+			body:     `{"id": "not_found", "message": "The resource you requested could not be found."}`,
+			notFound: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := fmt.Errorf("failed to scale out DigitalOcean droplets: %w", doError(t, tc.status, tc.body))
+			require.Equal(t, tc.capacity, isCapacityError(err))
+			require.Equal(t, tc.sizeUnavailable, isSizeUnavailableError(err))
+			require.Equal(t, tc.dropletLimit, isDropletLimitError(err))
+			require.Equal(t, tc.notFound, isNotFoundError(err))
+		})
+	}
+}
+
+func TestIsCapacityErrorJoined(t *testing.T) {
+	capacity := doError(t, http.StatusUnprocessableEntity, `{"message": "The region is temporarily out of capacity."}`)
+	other := errors.New("droplet cannot be created")
+	require.True(t, isCapacityError(errors.Join(capacity, capacity)))
+	// a droplet which failed for another reason must not be retried in
+	// another region
+	require.False(t, isCapacityError(errors.Join(capacity, other)))
+	require.False(t, isCapacityError(errors.Join()))
+}
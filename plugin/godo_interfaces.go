@@ -16,14 +16,17 @@ type ReservedIPs interface {
 		context.Context,
 		*godo.ReservedIPCreateRequest,
 	) (*godo.ReservedIP, *godo.Response, error)
+	Delete(context.Context, string) (*godo.Response, error)
 }
 
 type ReservedIPActions interface {
 	Assign(context.Context, string, int) (*godo.Action, *godo.Response, error)
+	Unassign(context.Context, string) (*godo.Action, *godo.Response, error)
 }
 
 type ReservedIPV6Actions interface {
 	Assign(context.Context, string, int) (*godo.Action, *godo.Response, error)
+	Unassign(context.Context, string) (*godo.Action, *godo.Response, error)
 }
 
 type ReservedIPV6s interface {
@@ -32,6 +35,7 @@ type ReservedIPV6s interface {
 		context.Context,
 		*godo.ReservedIPV6CreateRequest,
 	) (*godo.ReservedIPV6, *godo.Response, error)
+	Delete(context.Context, string) (*godo.Response, error)
 }
 
 type Droplets interface {
@@ -39,20 +43,44 @@ type Droplets interface {
 	Create(context.Context, *godo.DropletCreateRequest) (*godo.Droplet, *godo.Response, error)
 	Get(context.Context, int) (*godo.Droplet, *godo.Response, error)
 	Delete(context.Context, int) (*godo.Response, error)
+	DeleteByTag(context.Context, string) (*godo.Response, error)
 }
 
 type DropletActions interface {
 	PowerOff(context.Context, int) (*godo.Action, *godo.Response, error)
+	PowerOffByTag(context.Context, string) ([]godo.Action, *godo.Response, error)
 }
 
 type Tags interface {
 	UntagResources(context.Context, string, *godo.UntagResourcesRequest) (*godo.Response, error)
 	TagResources(context.Context, string, *godo.TagResourcesRequest) (*godo.Response, error)
 	Create(context.Context, *godo.TagCreateRequest) (*godo.Tag, *godo.Response, error)
+	Get(context.Context, string) (*godo.Tag, *godo.Response, error)
 	List(context.Context, *godo.ListOptions) ([]godo.Tag, *godo.Response, error)
 	Delete(context.Context, string) (*godo.Response, error)
 }
 
+type Storage interface {
+	GetVolume(context.Context, string) (*godo.Volume, *godo.Response, error)
+}
+
+type Projects interface {
+	AssignResources(context.Context, string, ...interface{}) ([]godo.ProjectResource, *godo.Response, error)
+}
+
+type Firewalls interface {
+	AddDroplets(context.Context, string, ...int) (*godo.Response, error)
+}
+
+type Images interface {
+	GetByID(context.Context, int) (*godo.Image, *godo.Response, error)
+	ListUser(context.Context, *godo.ListOptions) ([]godo.Image, *godo.Response, error)
+}
+
+type VPCs interface {
+	List(context.Context, *godo.ListOptions) ([]*godo.VPC, *godo.Response, error)
+}
+
 func Unpaginate[T any](ctx context.Context, f func(ctx context.Context, opt *godo.ListOptions) ([]T, *godo.Response, error), opt godo.ListOptions) iter.Seq2[T, error] {
 	return func(yield func(T, error) bool) {
 		var buffer T
@@ -91,6 +119,11 @@ type DigitalOceanWrapper interface {
 	Droplets() Droplets
 	DropletActions() DropletActions
 	Tags() Tags
+	Storage() Storage
+	Projects() Projects
+	Firewalls() Firewalls
+	Images() Images
+	VPCs() VPCs
 }
 
 // GodoWrapper is a simple wrapper around the real godo client, implementing
@@ -127,3 +160,23 @@ func (g *GodoWrapper) DropletActions() DropletActions {
 func (g *GodoWrapper) Tags() Tags {
 	return g.Client.Tags
 }
+
+func (g *GodoWrapper) Storage() Storage {
+	return g.Client.Storage
+}
+
+func (g *GodoWrapper) Projects() Projects {
+	return g.Client.Projects
+}
+
+func (g *GodoWrapper) Firewalls() Firewalls {
+	return g.Client.Firewalls
+}
+
+func (g *GodoWrapper) Images() Images {
+	return g.Client.Images
+}
+
+func (g *GodoWrapper) VPCs() VPCs {
+	return g.Client.VPCs
+}
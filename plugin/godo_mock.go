@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"net/url"
 	"regexp"
 	"slices"
 	"strconv"
@@ -15,19 +17,154 @@ import (
 	"github.com/coder/quartz"
 	"github.com/digitalocean/godo"
 	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/scaleutils"
+	"github.com/hashicorp/nomad/api"
 )
 
-type mockVaultProxy struct{}
+type mockVaultProxy struct {
+	mutex sync.Mutex
+	// the addresses each secret ID was restricted to
+	allowedIPv4s []string
+	allowedIPv6s []string
+	// the options each secret ID was generated with
+	options []secretIdOptions
+}
 
 func (v *mockVaultProxy) GenerateSecretId(
 	ctx context.Context,
 	appRole string,
 	allowedIPv4, allowedIPv6 string,
 	secretValidity, wrapperValidity time.Duration,
+	options ...SecretIdOption,
 ) (string, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.options = append(v.options, newSecretIdOptions(options...))
+	v.allowedIPv4s = append(v.allowedIPv4s, allowedIPv4)
+	v.allowedIPv6s = append(v.allowedIPv6s, allowedIPv6)
 	return "abcd", nil
 }
 
+// mockClusterUtils selects the droplets with the given names for scale in,
+// as if they were Nomad nodes, and records the nodes post scale in tasks
+// were run for.
+type mockClusterUtils struct {
+	dropletNames []string
+	postScaleIn  []scaleutils.NodeResourceID
+}
+
+func (m *mockClusterUtils) IsPoolReady(config map[string]string) (bool, error) {
+	return true, nil
+}
+
+func (m *mockClusterUtils) RunPreScaleInTasks(
+	ctx context.Context,
+	config map[string]string,
+	num int,
+) ([]scaleutils.NodeResourceID, error) {
+	if num > len(m.dropletNames) {
+		return nil, errors.New("not enough nodes to scale in")
+	}
+	ids := make([]scaleutils.NodeResourceID, 0, num)
+	for _, name := range m.dropletNames[:num] {
+		ids = append(ids, scaleutils.NodeResourceID{NomadNodeID: name, RemoteResourceID: name})
+	}
+	return ids, nil
+}
+
+func (m *mockClusterUtils) RunPreScaleInTasksWithRemoteCheck(
+	ctx context.Context,
+	config map[string]string,
+	remoteIDs []string,
+	num int,
+) ([]scaleutils.NodeResourceID, error) {
+	ids := make([]scaleutils.NodeResourceID, 0, num)
+	for _, name := range m.dropletNames {
+		if len(ids) < num && slices.Contains(remoteIDs, name) {
+			ids = append(ids, scaleutils.NodeResourceID{NomadNodeID: name, RemoteResourceID: name})
+		}
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("no nodes identified for scaling in action")
+	}
+	return ids, nil
+}
+
+func (m *mockClusterUtils) RunPostScaleInTasks(
+	ctx context.Context,
+	config map[string]string,
+	ids []scaleutils.NodeResourceID,
+) error {
+	m.postScaleIn = append(m.postScaleIn, ids...)
+	return nil
+}
+
+// mockNomadNodes drains Nomad nodes immediately, unless drainError is set.
+type mockNomadNodes struct {
+	mutex      sync.Mutex
+	nodes      map[string]*api.Node
+	drained    []string
+	drainError string
+}
+
+func (m *mockNomadNodes) List(q *api.QueryOptions) ([]*api.NodeListStub, *api.QueryMeta, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var stubs []*api.NodeListStub
+	for _, node := range m.nodes {
+		stubs = append(stubs, &api.NodeListStub{
+			ID:                    node.ID,
+			Datacenter:            node.Datacenter,
+			NodeClass:             node.NodeClass,
+			NodePool:              node.NodePool,
+			Status:                node.Status,
+			SchedulingEligibility: node.SchedulingEligibility,
+		})
+	}
+	return stubs, &api.QueryMeta{}, nil
+}
+
+func (m *mockNomadNodes) Info(
+	nodeID string,
+	q *api.QueryOptions,
+) (*api.Node, *api.QueryMeta, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	node, exists := m.nodes[nodeID]
+	if !exists {
+		return nil, nil, errors.New("node not found")
+	}
+	return node, &api.QueryMeta{}, nil
+}
+
+func (m *mockNomadNodes) UpdateDrainOpts(
+	nodeID string,
+	opts *api.DrainOptions,
+	q *api.WriteOptions,
+) (*api.NodeDrainUpdateResponse, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.nodes[nodeID].SchedulingEligibility = api.NodeSchedulingIneligible
+	m.drained = append(m.drained, nodeID)
+	return &api.NodeDrainUpdateResponse{}, nil
+}
+
+func (m *mockNomadNodes) MonitorDrain(
+	ctx context.Context,
+	nodeID string,
+	index uint64,
+	ignoreSys bool,
+) <-chan *api.MonitorMessage {
+	messages := make(chan *api.MonitorMessage, 1)
+	if m.drainError != "" {
+		messages <- &api.MonitorMessage{Level: api.MonitorMsgLevelError, Message: m.drainError}
+	} else {
+		messages <- &api.MonitorMessage{Level: api.MonitorMsgLevelInfo, Message: "drain complete"}
+	}
+	close(messages)
+	return messages
+}
+
 type mockGodo struct {
 	counterDropletID atomic.Int32
 	counterV4        atomic.Int32
@@ -38,8 +175,126 @@ type mockGodo struct {
 	reservedIPv6s   []godo.ReservedIPV6
 	droplets        map[int]*godo.Droplet
 	dropletUserData map[int]string
+	createRequests  map[int]godo.DropletCreateRequest
 	dropletTags     map[int][]string
-	mutex           *sync.Mutex
+	volumes         map[string]*godo.Volume
+	projects        map[string][]string
+	firewalls       map[string][]int
+	images          map[int]*godo.Image
+	tags            map[string]struct{}
+	vpcs            []*godo.VPC
+	// droplets cannot be created in these regions, due to a lack of capacity
+	unavailableRegions []string
+	// droplets of these sizes cannot be created
+	unavailableSizes []string
+	// if set, no more droplets than this can exist in the account
+	dropletLimit int
+	// if set, the IPv4 address of every droplet
+	dropletIPv4 string
+	// each droplet is reported without network information by this many
+	// calls to get it, as DigitalOcean does while it is being provisioned
+	networklessGets int
+	// this many calls to list droplets by tag, and to delete a droplet, hang
+	// until their context is done, as stuck requests do
+	hangingLists   atomic.Int32
+	hangingDeletes atomic.Int32
+	// this many calls to power off, and to delete a droplet, take effect
+	// but then hang until their context is done, as requests whose
+	// responses are lost do
+	lostPowerOffs atomic.Int32
+	lostDeletes   atomic.Int32
+	// if set, droplets are reported with this status once provisioned
+	provisionedStatus string
+	dropletGets       map[int]int
+	// these calls to create a droplet, counting from 1, fail
+	failingCreates []int
+	// each reserved IPv4 address takes this long to create, during which
+	// the number created at once is tracked
+	reservedIPCreateDelay       time.Duration
+	inFlightReservedIPCreates   atomic.Int32
+	maxInFlightReservedIPCreate atomic.Int32
+	// each droplet takes this long to create, on the clock of the reserved
+	// addresses pool
+	createClockDelay time.Duration
+	clock            *quartz.Mock
+	createCalls      int
+	// how long each droplet creation takes, and how many were in flight at once
+	createDelay       time.Duration
+	inFlightCreates   atomic.Int32
+	maxInFlightCreate atomic.Int32
+	// these droplets cannot be deleted
+	undeletableDroplets []int
+	// how many times droplets were deleted by tag
+	deleteByTagCalls int
+	// these droplets cannot be tagged
+	untaggableDroplets []int
+	// how long each droplet deletion takes, and how many were in flight at once
+	deleteDelay       time.Duration
+	inFlightDeletes   atomic.Int32
+	maxInFlightDelete atomic.Int32
+	// if set, assigning a reserved address waits until this is closed,
+	// and the number of assignments waiting is tracked
+	assignBlock    chan struct{}
+	blockedAssigns atomic.Int32
+	// if set, the next blockingLists listings of droplets by tag wait until
+	// listBlock is closed before returning what they listed, and the number
+	// of listings waiting is tracked
+	listBlock     chan struct{}
+	blockingLists atomic.Int32
+	blockedLists  atomic.Int32
+	// the same as above for listings of reserved IPv4 addresses
+	reservedIPListBlock     chan struct{}
+	blockingReservedIPLists atomic.Int32
+	blockedReservedIPLists  atomic.Int32
+	mutex                   *sync.Mutex
+}
+
+// hang blocks until the context is done if any of the hanging calls are
+// left, as a stuck request would.
+func hang(ctx context.Context, hangingCalls *atomic.Int32) error {
+	if hangingCalls.Add(-1) < 0 {
+		hangingCalls.Add(1)
+		return nil
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// waitToList holds up returning a listing of droplets until the listBlock
+// channel is closed, if any of the blocking listings are left.
+func (m *mockGodo) waitToList(ctx context.Context) error {
+	return waitOnBlock(ctx, m.listBlock, &m.blockingLists, &m.blockedLists)
+}
+
+// waitOnBlock holds up a call until the block channel is closed, if any of
+// the blocking calls are left, and tracks the number of calls waiting.
+func waitOnBlock(ctx context.Context, block chan struct{}, blocking, blocked *atomic.Int32) error {
+	if blocking.Add(-1) < 0 {
+		blocking.Add(1)
+		return nil
+	}
+	blocked.Add(1)
+	defer blocked.Add(-1)
+	select {
+	case <-block:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// waitToAssign holds up assigning a reserved address until the assignBlock
+// channel is closed, if it is set.
+func (m *mockGodo) waitToAssign(ctx context.Context) {
+	if m.assignBlock == nil {
+		return
+	}
+	m.blockedAssigns.Add(1)
+	defer m.blockedAssigns.Add(-1)
+	select {
+	case <-m.assignBlock:
+	case <-ctx.Done():
+	}
 }
 
 func (m *mockGodo) DropletActions() DropletActions {
@@ -51,7 +306,27 @@ func (m *mockGodo) Droplets() Droplets {
 }
 
 func (m *mockGodo) Tags() Tags {
-	return &mockTags{mock: m, tags: make(map[string]struct{})}
+	return &mockTags{mock: m}
+}
+
+func (m *mockGodo) Storage() Storage {
+	return &mockStorage{mock: m}
+}
+
+func (m *mockGodo) Projects() Projects {
+	return &mockProjects{mock: m}
+}
+
+func (m *mockGodo) Firewalls() Firewalls {
+	return &mockFirewalls{mock: m}
+}
+
+func (m *mockGodo) Images() Images {
+	return &mockImages{mock: m}
+}
+
+func (m *mockGodo) VPCs() VPCs {
+	return &mockVPCs{mock: m}
 }
 
 func (m *mockGodo) ReservedIPs() ReservedIPs {
@@ -97,7 +372,14 @@ func (m *mockReservedIPs) List(
 	ctx context.Context,
 	lo *godo.ListOptions,
 ) ([]godo.ReservedIP, *godo.Response, error) {
-	return m.mock.reservedIPv4s, &godo.Response{}, nil
+	m.mock.mutex.Lock()
+	reservedIPs := slices.Clone(m.mock.reservedIPv4s)
+	m.mock.mutex.Unlock()
+	err := waitOnBlock(ctx, m.mock.reservedIPListBlock, &m.mock.blockingReservedIPLists, &m.mock.blockedReservedIPLists)
+	if err != nil {
+		return nil, nil, err
+	}
+	return reservedIPs, &godo.Response{}, nil
 }
 
 func (m *mockReservedIPs) Create(
@@ -110,9 +392,13 @@ func (m *mockReservedIPs) Create(
 	if req.Region == "" {
 		panic("only supporting region assignment in this mock")
 	}
+	defer trackInFlight(&m.mock.inFlightReservedIPCreates, &m.mock.maxInFlightReservedIPCreate)()
+	time.Sleep(m.mock.reservedIPCreateDelay)
+	m.mock.mutex.Lock()
+	defer m.mock.mutex.Unlock()
 	ipv4 := fmt.Sprintf("1.2.3.%v", m.mock.counterV4.Add(1))
 	// TODO: verify not already in reservedIPv4
-	r := godo.Region{Name: req.Region}
+	r := godo.Region{Slug: req.Region, Name: req.Region}
 	result := godo.ReservedIP{Region: &r, IP: ipv4}
 	m.mock.reservedIPv4s = append(m.mock.reservedIPv4s, result)
 	/*
@@ -124,6 +410,22 @@ func (m *mockReservedIPs) Create(
 	return &result, nil, nil
 }
 
+func (m *mockReservedIPs) Delete(
+	ctx context.Context,
+	ip string,
+) (*godo.Response, error) {
+	m.mock.mutex.Lock()
+	defer m.mock.mutex.Unlock()
+	before := len(m.mock.reservedIPv4s)
+	m.mock.reservedIPv4s = slices.DeleteFunc(m.mock.reservedIPv4s, func(r godo.ReservedIP) bool {
+		return r.IP == ip
+	})
+	if len(m.mock.reservedIPv4s) == before {
+		return nil, errors.New("reserved IP does not exist")
+	}
+	return &godo.Response{}, nil
+}
+
 type mockDropletActions struct {
 	mock *mockGodo
 }
@@ -133,13 +435,48 @@ func (m *mockDropletActions) PowerOff(
 	dropletID int,
 ) (*godo.Action, *godo.Response, error) {
 	m.mock.mutex.Lock()
-	defer m.mock.mutex.Unlock()
-	if droplet, exists := m.mock.droplets[dropletID]; exists {
-		droplet.Status = "powered off"
-		return nil, nil, nil
-	} else {
+	droplet, exists := m.mock.droplets[dropletID]
+	switch {
+	case !exists:
+		m.mock.mutex.Unlock()
 		return nil, nil, errors.New("no such droplet")
+	case droplet.Status == "off":
+		m.mock.mutex.Unlock()
+		return nil, nil, &godo.ErrorResponse{
+			Response: &http.Response{StatusCode: http.StatusUnprocessableEntity},
+			Message:  "Droplet is already powered off.",
+		}
 	}
+	droplet.Status = "off"
+	m.mock.mutex.Unlock()
+	return nil, nil, hang(ctx, &m.mock.lostPowerOffs)
+}
+
+func (m *mockDropletActions) PowerOffByTag(
+	ctx context.Context,
+	tag string,
+) ([]godo.Action, *godo.Response, error) {
+	m.mock.mutex.Lock()
+	for _, droplet := range m.mock.droplets {
+		if slices.Contains(droplet.Tags, tag) {
+			droplet.Status = "off"
+		}
+	}
+	m.mock.mutex.Unlock()
+	return nil, nil, hang(ctx, &m.mock.lostPowerOffs)
+}
+
+// trackInFlight records the start of an operation, updating the maximum
+// number in flight at once. The returned function records its completion.
+func trackInFlight(inFlight, maxInFlight *atomic.Int32) func() {
+	current := inFlight.Add(1)
+	for {
+		previous := maxInFlight.Load()
+		if current <= previous || maxInFlight.CompareAndSwap(previous, current) {
+			break
+		}
+	}
+	return func() { inFlight.Add(-1) }
 }
 
 type mockDroplets struct {
@@ -147,14 +484,55 @@ type mockDroplets struct {
 }
 
 func (m *mockDroplets) Delete(ctx context.Context, dropletID int) (*godo.Response, error) {
+	defer trackInFlight(&m.mock.inFlightDeletes, &m.mock.maxInFlightDelete)()
+	time.Sleep(m.mock.deleteDelay)
+	if err := hang(ctx, &m.mock.hangingDeletes); err != nil {
+		return nil, err
+	}
+
 	m.mock.mutex.Lock()
-	defer m.mock.mutex.Unlock()
-	if _, exists := m.mock.droplets[dropletID]; exists {
-		delete(m.mock.droplets, dropletID)
-		return nil, nil
-	} else {
-		return nil, errors.New("no such droplet")
+	_, exists := m.mock.droplets[dropletID]
+	switch {
+	case slices.Contains(m.mock.undeletableDroplets, dropletID):
+		m.mock.mutex.Unlock()
+		return nil, errors.New("droplet cannot be deleted")
+	case !exists:
+		m.mock.mutex.Unlock()
+		return nil, &godo.ErrorResponse{
+			Response: &http.Response{StatusCode: http.StatusNotFound},
+			Message:  "The resource you were accessing could not be found.",
+		}
 	}
+	delete(m.mock.droplets, dropletID)
+	m.mock.mutex.Unlock()
+	return nil, hang(ctx, &m.mock.lostDeletes)
+}
+
+func (m *mockDroplets) DeleteByTag(ctx context.Context, tag string) (*godo.Response, error) {
+	m.mock.mutex.Lock()
+	m.mock.deleteByTagCalls++
+	var tagged []int
+	for id, droplet := range m.mock.droplets {
+		if slices.Contains(droplet.Tags, tag) {
+			if slices.Contains(m.mock.undeletableDroplets, id) {
+				m.mock.mutex.Unlock()
+				return nil, errors.New("droplet cannot be deleted")
+			}
+			tagged = append(tagged, id)
+		}
+	}
+	if _, exists := m.mock.tags[tag]; !exists {
+		m.mock.mutex.Unlock()
+		return nil, &godo.ErrorResponse{
+			Response: &http.Response{StatusCode: http.StatusNotFound},
+			Message:  "The resource you were accessing could not be found.",
+		}
+	}
+	for _, id := range tagged {
+		delete(m.mock.droplets, id)
+	}
+	m.mock.mutex.Unlock()
+	return nil, hang(ctx, &m.mock.lostDeletes)
 }
 
 func (m *mockDroplets) Get(
@@ -164,9 +542,24 @@ func (m *mockDroplets) Get(
 	m.mock.mutex.Lock()
 	defer m.mock.mutex.Unlock()
 	if droplet, exists := m.mock.droplets[dropletID]; exists {
+		m.mock.dropletGets[dropletID]++
+		if m.mock.dropletGets[dropletID] <= m.mock.networklessGets {
+			networkless := *droplet
+			networkless.Networks = &godo.Networks{}
+			networkless.Status = "new"
+			return &networkless, nil, nil
+		}
+		if m.mock.provisionedStatus != "" {
+			provisioned := *droplet
+			provisioned.Status = m.mock.provisionedStatus
+			return &provisioned, nil, nil
+		}
 		return droplet, nil, nil
 	} else {
-		return nil, nil, errors.New("no such droplet")
+		return nil, nil, &godo.ErrorResponse{
+			Response: &http.Response{StatusCode: http.StatusNotFound},
+			Message:  "The resource you were accessing could not be found.",
+		}
 	}
 }
 
@@ -174,9 +567,40 @@ func (m *mockDroplets) Create(
 	ctx context.Context,
 	req *godo.DropletCreateRequest,
 ) (*godo.Droplet, *godo.Response, error) {
+	defer trackInFlight(&m.mock.inFlightCreates, &m.mock.maxInFlightCreate)()
+	time.Sleep(m.mock.createDelay)
+	if m.mock.createClockDelay > 0 {
+		m.mock.clock.Advance(m.mock.createClockDelay)
+	}
+
 	m.mock.mutex.Lock()
 	defer m.mock.mutex.Unlock()
-	region := godo.Region{Name: req.Region}
+	m.mock.createCalls++
+	if slices.Contains(m.mock.failingCreates, m.mock.createCalls) {
+		return nil, nil, errors.New("droplet cannot be created")
+	}
+	if slices.Contains(m.mock.unavailableRegions, req.Region) {
+		return nil, nil, &godo.ErrorResponse{
+			Response: &http.Response{StatusCode: http.StatusUnprocessableEntity},
+			Message:  "There is not enough capacity in this region to create the droplet",
+		}
+	}
+	if m.mock.dropletLimit != 0 && len(m.mock.droplets) >= m.mock.dropletLimit {
+		return nil, nil, &godo.ErrorResponse{
+			Response: &http.Response{
+				StatusCode: http.StatusUnprocessableEntity,
+				Request:    &http.Request{Method: http.MethodPost, URL: &url.URL{Path: "/v2/droplets"}},
+			},
+			Message: "creating this/these droplet(s) will exceed your droplet limit",
+		}
+	}
+	if slices.Contains(m.mock.unavailableSizes, req.Size) {
+		return nil, nil, &godo.ErrorResponse{
+			Response: &http.Response{StatusCode: http.StatusUnprocessableEntity},
+			Message:  "This size is not available in this region",
+		}
+	}
+	region := godo.Region{Name: req.Region, Slug: req.Region}
 	id := int(m.mock.counterDropletID.Add(1))
 	networks := &godo.Networks{
 		V4: []godo.NetworkV4{
@@ -188,16 +612,31 @@ func (m *mockDroplets) Create(
 		},
 		V6: []godo.NetworkV6{},
 	}
+	if req.IPv6 {
+		networks.V6 = append(networks.V6, godo.NetworkV6{IPAddress: fmt.Sprintf("2001:db8::%x", id)})
+	}
+	if m.mock.dropletIPv4 != "" {
+		networks.V4[0].IPAddress = m.mock.dropletIPv4
+	}
 	// network.V4[0].
 	droplet := &godo.Droplet{
 		ID:       id,
 		Name:     req.Name,
 		Region:   &region,
 		Tags:     req.Tags,
+		SizeSlug: req.Size,
+		VPCUUID:  req.VPCUUID,
 		Status:   "active",
 		Networks: networks,
+		Created:  time.Now().UTC().Format(time.RFC3339),
+	}
+	for _, v := range req.Volumes {
+		if volume, exists := m.mock.volumes[v.ID]; exists {
+			volume.DropletIDs = append(volume.DropletIDs, id)
+		}
 	}
 	m.mock.dropletUserData[droplet.ID] = req.UserData
+	m.mock.createRequests[droplet.ID] = *req
 	m.mock.droplets[droplet.ID] = droplet
 	return droplet, nil, nil
 }
@@ -207,10 +646,12 @@ func (m *mockDroplets) ListByTag(
 	tag string,
 	options *godo.ListOptions,
 ) ([]godo.Droplet, *godo.Response, error) {
+	if err := hang(ctx, &m.mock.hangingLists); err != nil {
+		return nil, nil, err
+	}
 	m.mock.mutex.Lock()
-	defer m.mock.mutex.Unlock()
 	response := godo.Response{}
-	return slices.Collect(func(yield func(godo.Droplet) bool) {
+	droplets := slices.Collect(func(yield func(godo.Droplet) bool) {
 		for _, d := range m.mock.droplets {
 			if d.Tags != nil && slices.Contains(d.Tags, tag) {
 				if !yield(*d) {
@@ -218,22 +659,28 @@ func (m *mockDroplets) ListByTag(
 				}
 			}
 		}
-	}), &response, nil
+	})
+	m.mock.mutex.Unlock()
+	if err := m.mock.waitToList(ctx); err != nil {
+		return nil, nil, err
+	}
+	return droplets, &response, nil
 }
 
 type mockTags struct {
 	mock *mockGodo
-	tags map[string]struct{}
 }
 
 func (m *mockTags) Delete(
 	ctx context.Context,
 	name string,
 ) (*godo.Response, error) {
-	if _, exists := m.tags[name]; !exists {
+	m.mock.mutex.Lock()
+	defer m.mock.mutex.Unlock()
+	if _, exists := m.mock.tags[name]; !exists {
 		return nil, errors.New("tag does not exist")
 	}
-	delete(m.tags, name)
+	delete(m.mock.tags, name)
 	return &godo.Response{}, nil
 }
 
@@ -241,25 +688,68 @@ func (m *mockTags) List(
 	ctx context.Context,
 	req *godo.ListOptions,
 ) ([]godo.Tag, *godo.Response, error) {
-	result := make([]godo.Tag, 0, 10)
-	for k := range m.tags {
-		result = append(result, godo.Tag{Name: k})
+	m.mock.mutex.Lock()
+	defer m.mock.mutex.Unlock()
+	result := make([]godo.Tag, 0, len(m.mock.tags))
+	for k := range m.mock.tags {
+		// count the droplets with this tag
+		count := 0
+		for _, droplet := range m.mock.droplets {
+			if slices.Contains(droplet.Tags, k) {
+				count++
+			}
+		}
+		result = append(result, godo.Tag{
+			Name:      k,
+			Resources: &godo.TaggedResources{Count: count},
+		})
 	}
 	return result, &godo.Response{}, nil
 }
 
+func (m *mockTags) Get(
+	ctx context.Context,
+	name string,
+) (*godo.Tag, *godo.Response, error) {
+	m.mock.mutex.Lock()
+	defer m.mock.mutex.Unlock()
+	// like DigitalOcean, tags are created implicitly when tagging droplets
+	_, exists := m.mock.tags[name]
+	count := 0
+	for _, droplet := range m.mock.droplets {
+		if slices.Contains(droplet.Tags, name) {
+			exists = true
+			count++
+		}
+	}
+	if !exists {
+		return nil, nil, &godo.ErrorResponse{
+			Response: &http.Response{StatusCode: http.StatusNotFound},
+			Message:  "The resource you were accessing could not be found.",
+		}
+	}
+	return &godo.Tag{
+		Name: name,
+		Resources: &godo.TaggedResources{
+			Count:    count,
+			Droplets: &godo.TaggedDropletsResources{Count: count},
+		},
+	}, &godo.Response{}, nil
+}
+
 func (m *mockTags) Create(
 	ctx context.Context,
 	req *godo.TagCreateRequest,
 ) (*godo.Tag, *godo.Response, error) {
+	m.mock.mutex.Lock()
+	defer m.mock.mutex.Unlock()
 	valid := regexp.MustCompile(`^[a-zA-Z0-9_\-\:]+$`)
 	if !valid.MatchString(req.Name) {
 		return nil, nil, errors.New("invalid tag name")
 	}
-	if _, exists := m.tags[req.Name]; exists {
-		return nil, nil, errors.New("tag name already exists")
-	}
-	m.tags[req.Name] = struct{}{}
+	// the mock vault hands out the same wrapped token every time, so the
+	// same tag may be created more than once
+	m.mock.tags[req.Name] = struct{}{}
 	return nil, nil, nil
 }
 
@@ -270,23 +760,32 @@ func (m *mockTags) TagResources(
 ) (*godo.Response, error) {
 	m.mock.mutex.Lock()
 	defer m.mock.mutex.Unlock()
-	if len(req.Resources) != 1 {
-		return nil, errors.New("expected exactly one resource")
+	if len(req.Resources) == 0 {
+		return nil, errors.New("expected at least one resource")
 	}
-	res := req.Resources[0]
-	if res.Type != "droplet" {
-		return nil, errors.New("only support droplets for now")
-	}
-	dropletID, err := strconv.Atoi(res.ID)
-	if err != nil {
-		return nil, errors.New("droplet ID is not an integer")
+	// either all the resources are tagged, or none are
+	droplets := make([]*godo.Droplet, 0, len(req.Resources))
+	for _, res := range req.Resources {
+		if res.Type != "droplet" {
+			return nil, errors.New("only support droplets for now")
+		}
+		dropletID, err := strconv.Atoi(res.ID)
+		if err != nil {
+			return nil, errors.New("droplet ID is not an integer")
+		}
+		if slices.Contains(m.mock.untaggableDroplets, dropletID) {
+			return nil, errors.New("droplet cannot be tagged")
+		}
+		droplet, exists := m.mock.droplets[dropletID]
+		if !exists {
+			return nil, errors.New("droplet does not exist")
+		}
+		droplets = append(droplets, droplet)
 	}
-	if droplet, exists := m.mock.droplets[dropletID]; exists {
+	for _, droplet := range droplets {
 		droplet.Tags = append(droplet.Tags, tag)
-		return nil, nil
-	} else {
-		return nil, errors.New("droplet does not exist")
 	}
+	return nil, nil
 }
 
 func (m *mockTags) UntagResources(
@@ -322,6 +821,110 @@ loop1:
 	return nil, nil
 }
 
+type mockStorage struct {
+	mock *mockGodo
+}
+
+func (m *mockStorage) GetVolume(
+	ctx context.Context,
+	id string,
+) (*godo.Volume, *godo.Response, error) {
+	m.mock.mutex.Lock()
+	defer m.mock.mutex.Unlock()
+	if volume, exists := m.mock.volumes[id]; exists {
+		return volume, &godo.Response{}, nil
+	}
+	return nil, nil, errors.New("no such volume")
+}
+
+type mockProjects struct {
+	mock *mockGodo
+}
+
+func (m *mockProjects) AssignResources(
+	ctx context.Context,
+	projectID string,
+	resources ...interface{},
+) ([]godo.ProjectResource, *godo.Response, error) {
+	m.mock.mutex.Lock()
+	defer m.mock.mutex.Unlock()
+	result := make([]godo.ProjectResource, 0, len(resources))
+	for _, resource := range resources {
+		urn, ok := resource.(string)
+		if !ok {
+			return nil, nil, errors.New("only supporting URNs in this mock")
+		}
+		m.mock.projects[projectID] = append(m.mock.projects[projectID], urn)
+		result = append(result, godo.ProjectResource{URN: urn})
+	}
+	return result, &godo.Response{}, nil
+}
+
+type mockFirewalls struct {
+	mock *mockGodo
+}
+
+func (m *mockFirewalls) AddDroplets(
+	ctx context.Context,
+	firewallID string,
+	dropletIDs ...int,
+) (*godo.Response, error) {
+	m.mock.mutex.Lock()
+	defer m.mock.mutex.Unlock()
+	for _, dropletID := range dropletIDs {
+		if _, exists := m.mock.droplets[dropletID]; !exists {
+			return nil, errors.New("droplet does not exist")
+		}
+	}
+	m.mock.firewalls[firewallID] = append(m.mock.firewalls[firewallID], dropletIDs...)
+	return &godo.Response{}, nil
+}
+
+type mockVPCs struct {
+	mock *mockGodo
+}
+
+func (m *mockVPCs) List(
+	ctx context.Context,
+	opt *godo.ListOptions,
+) ([]*godo.VPC, *godo.Response, error) {
+	m.mock.mutex.Lock()
+	defer m.mock.mutex.Unlock()
+	return slices.Clone(m.mock.vpcs), &godo.Response{}, nil
+}
+
+type mockImages struct {
+	mock *mockGodo
+}
+
+func (m *mockImages) GetByID(
+	ctx context.Context,
+	id int,
+) (*godo.Image, *godo.Response, error) {
+	m.mock.mutex.Lock()
+	defer m.mock.mutex.Unlock()
+	if image, exists := m.mock.images[id]; exists {
+		return image, &godo.Response{}, nil
+	}
+	return nil, nil, &godo.ErrorResponse{
+		Response: &http.Response{StatusCode: http.StatusNotFound},
+		Message:  "The resource you were accessing could not be found.",
+	}
+}
+
+func (m *mockImages) ListUser(
+	ctx context.Context,
+	opt *godo.ListOptions,
+) ([]godo.Image, *godo.Response, error) {
+	m.mock.mutex.Lock()
+	defer m.mock.mutex.Unlock()
+	images := make([]godo.Image, 0, len(m.mock.images))
+	for _, image := range m.mock.images {
+		images = append(images, *image)
+	}
+	return images, &godo.Response{}, nil
+}
+
 type mockReservedIPActions struct {
 	mock *mockGodo
 }
@@ -331,6 +934,7 @@ func (m *mockReservedIPActions) Assign(
 	ip string,
 	dropletID int,
 ) (*godo.Action, *godo.Response, error) {
+	m.mock.waitToAssign(ctx)
 	m.mock.mutex.Lock()
 	defer m.mock.mutex.Unlock()
 	if droplet := m.mock.GetReservedIPv4(dropletID); droplet != nil {
@@ -338,18 +942,42 @@ func (m *mockReservedIPActions) Assign(
 	}
 	if droplet, exists := m.mock.droplets[dropletID]; exists {
 		for i, reservedIP := range m.mock.reservedIPv4s {
-			if reservedIP.Droplet == nil {
-				reservedIP.Droplet = droplet
-				m.mock.reservedIPv4s[i] = reservedIP
-				return nil, nil, nil
+			if reservedIP.IP != ip {
+				continue
+			}
+			if reservedIP.Droplet != nil {
+				return nil, nil, fmt.Errorf("IP is already assigned")
 			}
+			reservedIP.Droplet = droplet
+			m.mock.reservedIPv4s[i] = reservedIP
+			return nil, nil, nil
 		}
-		return nil, nil, fmt.Errorf("no IPs are available")
+		return nil, nil, fmt.Errorf("IP does not exist")
 	} else {
 		return nil, nil, fmt.Errorf("droplet does not exist")
 	}
 }
 
+func (m *mockReservedIPActions) Unassign(
+	ctx context.Context,
+	ip string,
+) (*godo.Action, *godo.Response, error) {
+	m.mock.mutex.Lock()
+	defer m.mock.mutex.Unlock()
+	for i, reservedIP := range m.mock.reservedIPv4s {
+		if reservedIP.IP != ip {
+			continue
+		}
+		if reservedIP.Droplet == nil {
+			return nil, nil, fmt.Errorf("IP is not assigned")
+		}
+		reservedIP.Droplet = nil
+		m.mock.reservedIPv4s[i] = reservedIP
+		return nil, nil, nil
+	}
+	return nil, nil, fmt.Errorf("IP does not exist")
+}
+
 type mockReservedIPV6s struct {
 	clock quartz.Clock
 	mock  *mockGodo
@@ -361,7 +989,7 @@ func (m *mockReservedIPV6s) List(
 ) ([]godo.ReservedIPV6, *godo.Response, error) {
 	m.mock.mutex.Lock()
 	defer m.mock.mutex.Unlock()
-	return m.mock.reservedIPv6s, &godo.Response{}, nil
+	return slices.Clone(m.mock.reservedIPv6s), &godo.Response{}, nil
 }
 
 func (m *mockReservedIPV6s) Create(
@@ -389,6 +1017,22 @@ func (m *mockReservedIPV6s) Create(
 	return &result, nil, nil
 }
 
+func (m *mockReservedIPV6s) Delete(
+	ctx context.Context,
+	ip string,
+) (*godo.Response, error) {
+	m.mock.mutex.Lock()
+	defer m.mock.mutex.Unlock()
+	before := len(m.mock.reservedIPv6s)
+	m.mock.reservedIPv6s = slices.DeleteFunc(m.mock.reservedIPv6s, func(r godo.ReservedIPV6) bool {
+		return r.IP == ip
+	})
+	if len(m.mock.reservedIPv6s) == before {
+		return nil, errors.New("reserved IP does not exist")
+	}
+	return &godo.Response{}, nil
+}
+
 type mockReservedIPV6Actions struct {
 	mock *mockGodo
 }
@@ -398,6 +1042,7 @@ func (m *mockReservedIPV6Actions) Assign(
 	ip string,
 	dropletID int,
 ) (*godo.Action, *godo.Response, error) {
+	m.mock.waitToAssign(ctx)
 	m.mock.mutex.Lock()
 	defer m.mock.mutex.Unlock()
 	if droplet := m.mock.GetReservedIPv6(dropletID); droplet != nil {
@@ -405,22 +1050,47 @@ func (m *mockReservedIPV6Actions) Assign(
 	}
 	if droplet, exists := m.mock.droplets[dropletID]; exists {
 		for i, reservedIP := range m.mock.reservedIPv6s {
-			if reservedIP.Droplet == nil {
-				reservedIP.Droplet = droplet
-				m.mock.reservedIPv6s[i] = reservedIP
-				return nil, nil, nil
+			if reservedIP.IP != ip {
+				continue
 			}
+			if reservedIP.Droplet != nil {
+				return nil, nil, fmt.Errorf("IP is already assigned")
+			}
+			reservedIP.Droplet = droplet
+			m.mock.reservedIPv6s[i] = reservedIP
+			return nil, nil, nil
 		}
-		return nil, nil, fmt.Errorf("no IPs are available")
+		return nil, nil, fmt.Errorf("IP does not exist")
 	} else {
 		return nil, nil, fmt.Errorf("droplet does not exist")
 	}
 }
 
+func (m *mockReservedIPV6Actions) Unassign(
+	ctx context.Context,
+	ip string,
+) (*godo.Action, *godo.Response, error) {
+	m.mock.mutex.Lock()
+	defer m.mock.mutex.Unlock()
+	for i, reservedIP := range m.mock.reservedIPv6s {
+		if reservedIP.IP != ip {
+			continue
+		}
+		if reservedIP.Droplet == nil {
+			return nil, nil, fmt.Errorf("IP is not assigned")
+		}
+		reservedIP.Droplet = nil
+		m.mock.reservedIPv6s[i] = reservedIP
+		return nil, nil, nil
+	}
+	return nil, nil, fmt.Errorf("IP does not exist")
+}
+
 func (m *mockGodo) NewReservedAddressPool(
 	logger hclog.Logger,
 	clock *quartz.Mock,
 ) *ReservedAddressesPool {
+	m.clock = clock
 	return CreateReservedAddressesPool(
 		logger,
 		WithClock(clock),
@@ -440,7 +1110,17 @@ func createMockGodo() *mockGodo {
 		reservedIPv6s:   make([]godo.ReservedIPV6, 0, 20),
 		droplets:        make(map[int]*godo.Droplet),
 		dropletUserData: make(map[int]string),
+		createRequests:  make(map[int]godo.DropletCreateRequest),
 		dropletTags:     make(map[int][]string),
-		mutex:           new(sync.Mutex),
+		dropletGets:     make(map[int]int),
+		volumes:         make(map[string]*godo.Volume),
+		projects:        make(map[string][]string),
+		firewalls:       make(map[string][]int),
+		tags:            make(map[string]struct{}),
+		images: map[int]*godo.Image{
+			// the snapshot used throughout the tests
+			12345: {ID: 12345, Status: "available", Regions: []string{"lon1", "ams3"}},
+		},
+		mutex: new(sync.Mutex),
 	}
 }
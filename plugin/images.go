@@ -0,0 +1,61 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/digitalocean/godo"
+)
+
+// resolveImage finds the newest user image (snapshot or custom image) with
+// the given name.
+func resolveImage(ctx context.Context, images Images, name string) (*godo.Image, error) {
+	var (
+		newest        *godo.Image
+		newestCreated time.Time
+	)
+	for image, err := range Unpaginate(ctx, images.ListUser, godo.ListOptions{PerPage: 200}) {
+		if err != nil {
+			return nil, fmt.Errorf("cannot list images: %w", err)
+		}
+		if image.Name != name {
+			continue
+		}
+		created, err := time.Parse(time.RFC3339, image.Created)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse creation time of image %v: %w", image.ID, err)
+		}
+		if newest == nil || created.After(newestCreated) {
+			newest = &image
+			newestCreated = created
+		}
+	}
+	if newest == nil {
+		return nil, fmt.Errorf("no image named %q found", name)
+	}
+	return newest, nil
+}
+
+// validateImage confirms the image exists and can be used to create
+// droplets in all of the given regions.
+func validateImage(ctx context.Context, images Images, imageID int, regions []string) error {
+	image, _, err := images.GetByID(ctx, imageID)
+	if err != nil {
+		return fmt.Errorf("cannot retrieve image %v: %w", imageID, err)
+	}
+	if image.Status != "" && image.Status != "available" {
+		return fmt.Errorf("image %v is not available, its status is %q", imageID, image.Status)
+	}
+	missing := make([]string, 0, len(regions))
+	for _, region := range regions {
+		if !slices.Contains(image.Regions, region) {
+			missing = append(missing, region)
+		}
+	}
+	if len(missing) != 0 {
+		return fmt.Errorf("image %v is not available in region(s) %v", imageID, missing)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package plugin
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// Field names of the log lines about scaling actions, which are kept stable
+// so that the plugin's events can be correlated by log pipelines.
+const (
+	logKeyAction    = "action"
+	logKeyDropletID = "droplet_id"
+	logKeyIPAddress = "ip_address"
+	logKeyRegion    = "region"
+	logKeyTag       = "tag"
+)
+
+const (
+	logFormatJSON = "json"
+	logFormatText = "text"
+)
+
+// validateLogFormat checks that the format is one newLogger supports.
+func validateLogFormat(format string) error {
+	if format != logFormatJSON && format != logFormatText {
+		return fmt.Errorf("config param %s must be %q or %q", configKeyLogFormat, logFormatJSON, logFormatText)
+	}
+	return nil
+}
+
+// newLogger builds a logger in the given format, at the level and with the
+// name of base. Lines are appended to the file at path if set, otherwise
+// they are written to standard error; the returned output can be reopened
+// at another path without replacing the logger.
+func newLogger(base hclog.Logger, format, path string) (hclog.Logger, *logOutput, error) {
+	if err := validateLogFormat(format); err != nil {
+		return nil, nil, err
+	}
+	output := &logOutput{writer: os.Stderr}
+	if err := output.reopen(path); err != nil {
+		return nil, nil, err
+	}
+	return hclog.New(&hclog.LoggerOptions{
+		Name:       base.Name(),
+		Level:      base.GetLevel(),
+		Output:     output,
+		JSONFormat: format == logFormatJSON,
+	}), output, nil
+}
+
+// logOutput is the output of a logger built by newLogger. The file it writes
+// to can be swapped while the logger is in use, as the logger is kept by
+// everything created with it.
+type logOutput struct {
+	mu     sync.Mutex
+	writer io.Writer
+	file   *os.File
+}
+
+func (o *logOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.writer.Write(p)
+}
+
+// reopen switches the output to the file at path, or to standard error if
+// path is empty, and closes the file written to before, if any.
+func (o *logOutput) reopen(path string) error {
+	var writer io.Writer = os.Stderr
+	var file *os.File
+	if path != "" {
+		var err error
+		file, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+		if err != nil {
+			return fmt.Errorf("cannot open %s: %w", configKeyLogFile, err)
+		}
+		writer = file
+	}
+
+	o.mu.Lock()
+	previous := o.file
+	o.writer, o.file = writer, file
+	o.mu.Unlock()
+
+	if previous != nil {
+		return previous.Close()
+	}
+	return nil
+}
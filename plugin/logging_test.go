@@ -0,0 +1,103 @@
+package plugin
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewLogger(t *testing.T) {
+	base := hclog.New(&hclog.LoggerOptions{Name: "do-droplets", Level: hclog.Info})
+	path := filepath.Join(t.TempDir(), "plugin.log")
+
+	_, _, err := newLogger(base, "xml", path)
+	require.ErrorContains(t, err, "config param log_format must be")
+	_, _, err = newLogger(base, logFormatJSON, filepath.Join(path, "missing", "plugin.log"))
+	require.ErrorContains(t, err, "cannot open log_file")
+
+	logger, _, err := newLogger(base, logFormatJSON, path)
+	require.NoError(t, err)
+	logger.Debug("not logged below the level of the base logger")
+	logger.With(logKeyAction, "scale_out").Info("Created droplet", logKeyDropletID, "123")
+
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var line map[string]any
+	require.NoError(t, json.Unmarshal(contents, &line))
+	require.Equal(t, "do-droplets", line["@module"])
+	require.Equal(t, "Created droplet", line["@message"])
+	require.Equal(t, "scale_out", line["action"])
+	require.Equal(t, "123", line["droplet_id"])
+}
+
+func TestLogOutputReopen(t *testing.T) {
+	base := hclog.New(&hclog.LoggerOptions{Name: "do-droplets", Level: hclog.Info})
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "first.log"), filepath.Join(dir, "second.log")
+
+	logger, output, err := newLogger(base, logFormatText, first)
+	require.NoError(t, err)
+	previous := output.file
+	logger.Info("to the first file")
+
+	// a file that cannot be opened keeps the current one
+	require.ErrorContains(t, output.reopen(filepath.Join(first, "plugin.log")), "cannot open log_file")
+	require.Same(t, previous, output.file)
+
+	require.NoError(t, output.reopen(second))
+	logger.Info("to the second file")
+	_, err = previous.WriteString("after closing")
+	require.ErrorIs(t, err, os.ErrClosed)
+
+	contents, err := os.ReadFile(first)
+	require.NoError(t, err)
+	require.Contains(t, string(contents), "to the first file")
+	require.NotContains(t, string(contents), "to the second file")
+	contents, err = os.ReadFile(second)
+	require.NoError(t, err)
+	require.Contains(t, string(contents), "to the second file")
+
+	require.NoError(t, output.reopen(""))
+	require.Nil(t, output.file)
+}
+
+func TestSetConfigReplacesLoggerOnce(t *testing.T) {
+	base := hclog.New(&hclog.LoggerOptions{Name: "do-droplets", Level: hclog.Info})
+	plugin := NewDODropletsPlugin(t.Context(), base, nil)
+	config := map[string]string{
+		"token":      "t0ken",
+		"log_format": "xml",
+		"log_file":   filepath.Join(t.TempDir(), "plugin.log"),
+	}
+
+	// an invalid format does not use up the replacement
+	require.ErrorContains(t, plugin.SetConfig(config), "config param log_format must be")
+	require.Same(t, base, plugin.logger)
+
+	config["log_format"] = logFormatJSON
+	require.NoError(t, plugin.SetConfig(config))
+	replaced := plugin.logger
+	require.NotSame(t, base, replaced)
+
+	// the format is still checked after the logger has been replaced, but
+	// the logger is kept
+	config["log_format"] = "xml"
+	require.ErrorContains(t, plugin.SetConfig(config), "config param log_format must be")
+	config["log_format"] = logFormatText
+	require.NoError(t, plugin.SetConfig(config))
+	require.Same(t, replaced, plugin.logger)
+
+	// the logger is kept when the file changes, but writes to the new file
+	rotated := filepath.Join(t.TempDir(), "rotated.log")
+	config["log_file"] = rotated
+	require.NoError(t, plugin.SetConfig(config))
+	require.Same(t, replaced, plugin.logger)
+	plugin.logger.Info("after the reload")
+	contents, err := os.ReadFile(rotated)
+	require.NoError(t, err)
+	require.Contains(t, string(contents), "after the reload")
+}
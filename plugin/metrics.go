@@ -0,0 +1,92 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "do_droplets"
+
+// metricsRegistry holds all metrics reported by this plugin. A dedicated
+// registry is used so that only the plugin's own metrics are exposed.
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	dropletsCreated = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "droplets_created_total",
+			Help:      "Number of droplets created during scale-out.",
+		},
+		[]string{"name"},
+	)
+	dropletsDeleted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "droplets_deleted_total",
+			Help:      "Number of droplets deleted during scale-in.",
+		},
+		[]string{"name"},
+	)
+	reservedIPsAssigned = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "reserved_ips_assigned_total",
+			Help:      "Number of reserved IP addresses assigned to new droplets.",
+		},
+		[]string{"name", "family"},
+	)
+	retriedAttempts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "retry_attempts_total",
+			Help:      "Number of failed attempts which were subsequently retried.",
+		},
+		[]string{"name"},
+	)
+	stableWaitDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "stable_wait_seconds",
+			Help:      "Time spent waiting for droplets to become stable after a scaling action.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+		},
+		[]string{"name"},
+	)
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		dropletsCreated,
+		dropletsDeleted,
+		reservedIPsAssigned,
+		retriedAttempts,
+		stableWaitDuration,
+	)
+}
+
+// serveMetrics exposes the plugin's metrics in the Prometheus format on
+// the /metrics path of the given address, until the context is cancelled.
+func serveMetrics(ctx context.Context, logger hclog.Logger, address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	server := &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	logger.Info("serving metrics", "address", address)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("metrics server failed", "error", err)
+	}
+}
@@ -0,0 +1,70 @@
+package plugin
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// defaultNameTemplate names droplets after their pool, with a random
+	// suffix to keep the names unique.
+	defaultNameTemplate = "{name}-{uuid}"
+
+	// maxDropletNameLength is the longest droplet name DigitalOcean accepts.
+	maxDropletNameLength = 255
+)
+
+var (
+	namePlaceholder  = regexp.MustCompile(`\{[^{}]*\}`)
+	namePlaceholders = []string{"{name}", "{region}", "{uuid}", "{short}", "{index}"}
+	// droplet names are used as hostnames
+	dropletNameCharacters = regexp.MustCompile(`^[a-zA-Z0-9.\-]+$`)
+)
+
+// renderDropletName names a new droplet after the template, by replacing
+// its placeholders: {name} by the pool's name, {region} by the droplet's
+// region, {uuid} by a random UUID, {short} by the first 8 characters of that
+// UUID and {index} by the droplet's index within the scale-out.
+func renderDropletName(nameTemplate, name, region string, id uuid.UUID, index int) string {
+	return strings.NewReplacer(
+		"{name}", name,
+		"{region}", region,
+		"{uuid}", id.String(),
+		"{short}", id.String()[:8],
+		"{index}", strconv.Itoa(index),
+	).Replace(nameTemplate)
+}
+
+// validateNameTemplate returns an error unless every droplet name rendered
+// from the template would be unique, within DigitalOcean's length limit and
+// made only of characters which are legal in hostnames.
+func validateNameTemplate(nameTemplate, name string, regions []string, maxCount int64) error {
+	for _, placeholder := range namePlaceholder.FindAllString(nameTemplate, -1) {
+		if !slices.Contains(namePlaceholders, placeholder) {
+			return fmt.Errorf("unknown placeholder %v", placeholder)
+		}
+	}
+	// scaling in finds droplets by name, so names must not be shared
+	if !strings.Contains(nameTemplate, "{uuid}") && !strings.Contains(nameTemplate, "{short}") {
+		return fmt.Errorf("%q must contain {uuid} or {short} for droplet names to be unique", nameTemplate)
+	}
+	// the longest names are those of the longest region and the highest
+	// index
+	longestRegion := slices.MaxFunc(regions, func(a, b string) int { return len(a) - len(b) })
+	rendered := renderDropletName(nameTemplate, name, longestRegion, uuid.Nil, int(maxCount))
+	switch {
+	case len(rendered) > maxDropletNameLength:
+		return fmt.Errorf("droplet names such as %q are longer than %v characters", rendered, maxDropletNameLength)
+	case !dropletNameCharacters.MatchString(rendered):
+		return fmt.Errorf(
+			"droplet names such as %q may only contain letters, numbers, dots and dashes",
+			rendered,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package plugin
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderDropletName(t *testing.T) {
+	id := uuid.MustParse("0b6f8b52-3d1c-4f5e-9d38-5c8f1e4c2a71")
+	require.Equal(t,
+		"pool-0b6f8b52-3d1c-4f5e-9d38-5c8f1e4c2a71",
+		renderDropletName(defaultNameTemplate, "pool", "lon1", id, 0))
+	require.Equal(t,
+		"pool-lon1-0b6f8b52-3",
+		renderDropletName("{name}-{region}-{short}-{index}", "pool", "lon1", id, 3))
+}
+
+func TestValidateNameTemplate(t *testing.T) {
+	testCases := []struct {
+		name          string
+		nameTemplate  string
+		poolName      string
+		expectedError string
+	}{
+		{
+			name:         "default template",
+			nameTemplate: defaultNameTemplate,
+			poolName:     "pool",
+		},
+		{
+			name:         "all placeholders",
+			nameTemplate: "{name}.{region}-{short}-{index}-{uuid}",
+			poolName:     "pool",
+		},
+		{
+			name:          "unknown placeholder",
+			nameTemplate:  "{name}-{zone}-{uuid}",
+			poolName:      "pool",
+			expectedError: "unknown placeholder {zone}",
+		},
+		{
+			name:          "names would not be unique",
+			nameTemplate:  "{name}-{region}-{index}",
+			poolName:      "pool",
+			expectedError: "must contain {uuid} or {short}",
+		},
+		{
+			name:          "illegal hostname characters",
+			nameTemplate:  "{name}-{short}",
+			poolName:      "nomad:pool",
+			expectedError: "may only contain letters, numbers, dots and dashes",
+		},
+		{
+			name:          "names would be too long",
+			nameTemplate:  "{name}-{uuid}",
+			poolName:      strings.Repeat("a", 220),
+			expectedError: "longer than 255 characters",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateNameTemplate(tc.nameTemplate, tc.poolName, []string{"lon1", "ams3"}, 10)
+			if tc.expectedError == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, tc.expectedError)
+			}
+		})
+	}
+}
+
+func TestScaleOutWithNameTemplate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	config := map[string]string{
+		"name":          "mydropletname",
+		"region":        "lon1",
+		"size":          "s1",
+		"snapshot_id":   "12345",
+		"token":         "t0ken",
+		"name_template": "{name}-{region}-{short}",
+	}
+	tp := &TargetPlugin{
+		ctx:    ctx,
+		config: config,
+		logger: hclog.NewNullLogger(),
+		client: mock,
+	}
+	template := Must(tp.createDropletTemplate(config))
+	_, err := tp.scaleOut(ctx, nil, 2, 2, template, config)
+	require.NoError(t, err)
+	require.Len(t, mock.droplets, 2)
+	for _, droplet := range mock.droplets {
+		require.Regexp(t, `^mydropletname-lon1-[0-9a-f]{8}$`, droplet.Name)
+	}
+
+	config["name_template"] = "{name}-{index}"
+	_, err = tp.createDropletTemplate(config)
+	require.ErrorContains(t, err, "name_template")
+}
@@ -0,0 +1,123 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// defaultScaleOutNotifyTimeout is how long a scale-out notification may take
+// before it is given up on.
+const defaultScaleOutNotifyTimeout = 10 * time.Second
+
+// scaleOutNotification is the payload posted to scale_out_notify_url after a
+// successful scale-out.
+type scaleOutNotification struct {
+	Name     string            `json:"name"`
+	Droplets []notifiedDroplet `json:"droplets"`
+}
+
+type notifiedDroplet struct {
+	ID          int      `json:"id"`
+	Region      string   `json:"region,omitempty"`
+	PublicIPv4  string   `json:"public_ipv4,omitempty"`
+	PublicIPv6  string   `json:"public_ipv6,omitempty"`
+	ReservedIPs []string `json:"reserved_ips,omitempty"`
+}
+
+// notifyScaleOut posts the droplets created by a scale-out to the template's
+// notification URL, if one is configured. Notifying is best effort, so
+// failures are only logged rather than failing the scale-out, and the
+// notification is sent in the background, so that a slow endpoint does not
+// hold up scaling. It is sent through the template's notification proxy, or
+// the one given by the standard environment variables, rather than the proxy
+// for the DigitalOcean API, as the endpoint is usually elsewhere.
+func (t *TargetPlugin) notifyScaleOut(
+	outcome *scalingOutcome,
+	log hclog.Logger,
+	template *dropletTemplate,
+	createdIDs []int,
+) {
+	if template.scaleOutNotifyURL == "" {
+		return
+	}
+	client := newHTTPClient(template.scaleOutNotifyProxy, template.scaleOutNotifyTimeout)
+	notification := scaleOutNotification{
+		Name:     template.name,
+		Droplets: make([]notifiedDroplet, 0, len(createdIDs)),
+	}
+	for _, dropletID := range createdIDs {
+		notification.Droplets = append(notification.Droplets, notifiedDroplet{
+			ID:          dropletID,
+			ReservedIPs: outcome.reservedIPsOf(dropletID),
+		})
+	}
+	// the scaling action's context is done once it returns, so the
+	// notification only stops with the plugin
+	go t.sendScaleOutNotification(t.ctx, log, template, client, notification)
+}
+
+// sendScaleOutNotification looks up the addresses of the notified droplets
+// and posts the notification, logging any failure.
+func (t *TargetPlugin) sendScaleOutNotification(
+	ctx context.Context,
+	log hclog.Logger,
+	template *dropletTemplate,
+	client *http.Client,
+	notification scaleOutNotification,
+) {
+	for i := range notification.Droplets {
+		notified := &notification.Droplets[i]
+		dropletID := notified.ID
+		// the droplet is fetched again, as its addresses are only known once
+		// it is active
+		reqCtx, cancel := context.WithTimeout(ctx, template.requestTimeout)
+		droplet, _, err := template.client.Droplets().Get(reqCtx, dropletID)
+		cancel()
+		if err != nil {
+			log.Warn("cannot describe droplet for the scale-out notification",
+				logKeyDropletID, strconv.Itoa(dropletID),
+				"error", err)
+		} else {
+			if droplet.Region != nil {
+				notified.Region = droplet.Region.Slug
+			}
+			notified.PublicIPv4, _ = droplet.PublicIPv4()
+			notified.PublicIPv6, _ = droplet.PublicIPv6()
+		}
+	}
+	if err := postNotification(ctx, client, template.scaleOutNotifyURL, notification); err != nil {
+		log.Warn("cannot send the scale-out notification", "error", err)
+		return
+	}
+	log.Debug("sent the scale-out notification", "droplets", len(notification.Droplets))
+}
+
+// postNotification posts the payload as JSON to the URL with the client,
+// failing unless the response is successful.
+func postNotification(ctx context.Context, client *http.Client, url string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("cannot encode the notification: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status %v", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScaleOutNotification(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	notifications := make(chan scaleOutNotification, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var notification scaleOutNotification
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&notification))
+		notifications <- notification
+	}))
+	defer server.Close()
+	mock := createMockGodo()
+	config := map[string]string{
+		"name":                 "mydropletname",
+		"region":               "lon1",
+		"size":                 "s1",
+		"snapshot_id":          "12345",
+		"token":                "t0ken",
+		"scale_out_notify_url": server.URL,
+	}
+	tp := &TargetPlugin{
+		ctx:    ctx,
+		config: config,
+		logger: hclog.NewNullLogger(),
+		client: mock,
+	}
+	template := Must(tp.createDropletTemplate(config))
+	createdIDs, err := tp.scaleOut(ctx, nil, 2, 2, template, config)
+	require.NoError(t, err)
+	notification := <-notifications
+	require.Equal(t, "mydropletname", notification.Name)
+	require.Len(t, notification.Droplets, 2)
+	for i, droplet := range notification.Droplets {
+		require.Equal(t, createdIDs[i], droplet.ID)
+		require.Equal(t, "lon1", droplet.Region)
+	}
+}
+
+func TestScaleOutNotificationFailure(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	mock := createMockGodo()
+	config := map[string]string{
+		"name":                     "mydropletname",
+		"region":                   "lon1",
+		"size":                     "s1",
+		"snapshot_id":              "12345",
+		"token":                    "t0ken",
+		"scale_out_notify_url":     server.URL,
+		"scale_out_notify_timeout": "1s",
+	}
+	tp := &TargetPlugin{
+		ctx:    ctx,
+		config: config,
+		logger: hclog.NewNullLogger(),
+		client: mock,
+	}
+	template := Must(tp.createDropletTemplate(config))
+	require.Equal(t, time.Second, template.scaleOutNotifyTimeout)
+	// the scale-out succeeds even though the notification is rejected
+	_, err := tp.scaleOut(ctx, nil, 2, 2, template, config)
+	require.NoError(t, err)
+	require.Len(t, mock.droplets, 2)
+}
+
+func TestScaleOutNotificationThroughProxy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	// the proxy is sent the request for the notification URL, and holds it
+	// up until released
+	release := make(chan struct{})
+	requested := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- r.URL.String()
+		<-release
+	}))
+	defer proxy.Close()
+	defer close(release)
+	// the proxy for the DigitalOcean API is not used for notifications
+	apiProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- "through the API proxy"
+	}))
+	defer apiProxy.Close()
+	mock := createMockGodo()
+	config := map[string]string{
+		"name":                   "mydropletname",
+		"region":                 "lon1",
+		"size":                   "s1",
+		"snapshot_id":            "12345",
+		"token":                  "t0ken",
+		"https_proxy":            apiProxy.URL,
+		"scale_out_notify_proxy": proxy.URL,
+		"scale_out_notify_url":   "http://hooks.example.com/scaled",
+	}
+	tp := &TargetPlugin{
+		ctx:    ctx,
+		config: config,
+		logger: hclog.NewNullLogger(),
+		client: mock,
+	}
+	template := Must(tp.createDropletTemplate(config))
+
+	// the scale-out does not wait for the notification
+	_, err := tp.scaleOut(ctx, nil, 2, 2, template, config)
+	require.NoError(t, err)
+	select {
+	case url := <-requested:
+		require.Equal(t, "http://hooks.example.com/scaled", url)
+	case <-ctx.Done():
+		require.FailNow(t, "the notification was not sent through the proxy")
+	}
+}
+
+func TestScaleOutNotifyURLValidation(t *testing.T) {
+	tp := &TargetPlugin{logger: hclog.NewNullLogger(), client: createMockGodo()}
+	config := map[string]string{
+		"name":                 "mydropletname",
+		"region":               "lon1",
+		"size":                 "s1",
+		"snapshot_id":          "12345",
+		"token":                "t0ken",
+		"scale_out_notify_url": "example.com/hook",
+	}
+	_, err := tp.createDropletTemplate(config)
+	require.ErrorContains(t, err, "scale_out_notify_url")
+
+	config["scale_out_notify_url"] = "https://hooks.example.com/scaled"
+	config["scale_out_notify_proxy"] = "proxy.example.com:3128"
+	_, err = tp.createDropletTemplate(config)
+	require.ErrorContains(t, err, "config param scale_out_notify_proxy must be")
+}
@@ -0,0 +1,88 @@
+package plugin
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// scalingOutcome records what a scaling action achieved, so that a single
+// summary can be logged once it completes. The methods do nothing on a nil
+// outcome, so that scaling works the same when none is being recorded.
+type scalingOutcome struct {
+	mutex   sync.Mutex
+	created int
+	deleted int
+	regions []string
+	// reservedIPs holds the reserved addresses assigned to each droplet
+	reservedIPs map[int][]string
+}
+
+func (o *scalingOutcome) dropletCreated(region string) {
+	if o == nil {
+		return
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.created++
+	if !slices.Contains(o.regions, region) {
+		o.regions = append(o.regions, region)
+	}
+}
+
+func (o *scalingOutcome) dropletDeleted() {
+	if o == nil {
+		return
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.deleted++
+}
+
+func (o *scalingOutcome) reservedIPAssigned(dropletID int, ip string) {
+	if o == nil {
+		return
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.reservedIPs == nil {
+		o.reservedIPs = make(map[int][]string)
+	}
+	o.reservedIPs[dropletID] = append(o.reservedIPs[dropletID], ip)
+}
+
+// reservedIPsOf returns the reserved addresses assigned to the droplet.
+func (o *scalingOutcome) reservedIPsOf(dropletID int) []string {
+	if o == nil {
+		return nil
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return slices.Clone(o.reservedIPs[dropletID])
+}
+
+// logFields returns the fields of the summary of a scaling action which
+// started from current droplets, took the given duration and ended with err.
+func (o *scalingOutcome) logFields(current int64, duration time.Duration, err error) []any {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	var reservedIPs []string
+	for _, dropletID := range slices.Sorted(maps.Keys(o.reservedIPs)) {
+		reservedIPs = append(reservedIPs, o.reservedIPs[dropletID]...)
+	}
+	fields := []any{
+		"current_count", current,
+		"achieved_count", current + int64(o.created-o.deleted),
+		"created", o.created,
+		"deleted", o.deleted,
+		"regions", slices.Clone(o.regions),
+		"reserved_ips_assigned", len(reservedIPs),
+		"reserved_ips", reservedIPs,
+		"duration", duration,
+	}
+	if err != nil {
+		fields = append(fields, "error", err)
+	}
+	return fields
+}
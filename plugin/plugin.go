@@ -4,11 +4,18 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
+	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/coder/quartz"
 	"github.com/digitalocean/godo"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/nomad-autoscaler/plugins"
@@ -17,6 +24,7 @@ import (
 	"github.com/hashicorp/nomad-autoscaler/sdk"
 	"github.com/hashicorp/nomad-autoscaler/sdk/helper/nomad"
 	"github.com/hashicorp/nomad-autoscaler/sdk/helper/scaleutils"
+	"github.com/hashicorp/nomad/api"
 	"github.com/mitchellh/go-homedir"
 )
 
@@ -24,30 +32,114 @@ const (
 	// pluginName is the unique name of the this plugin amongst Target plugins.
 	pluginName = "do-droplets"
 
+	configKeyAPIRetryMax                             = "api_retry_max"
+	configKeyAPITimeout                              = "api_timeout"
+	configKeyAdoptDroplets                           = "adopt_droplets"
+	configKeyAPIURL                                  = "api_url"
+	configKeyBackups                                 = "backups"
+	configKeyBulkDelete                              = "bulk_delete"
+	configKeyBackupDay                               = "backup_day"
+	configKeyBackupHour                              = "backup_hour"
+	configKeyCompressUserData                        = "compress_user_data"
+	configKeyCountCacheTTL                           = "count_cache_ttl"
 	configKeyCreateReservedAddresses                 = "create_reserved_addresses"
+	configKeyCreateStagger                           = "create_stagger"
+	configKeyPinnedReservedAddresses                 = "pinned_reserved_addresses"
 	configKeyReserveIPv4Addresses                    = "reserve_ipv4_addresses"
 	configKeyReserveIPv6Addresses                    = "reserve_ipv6_addresses"
+	configKeySecureIntroductionAppend                = "secure_introduction_append"
 	configKeySecureIntroductionAppRole               = "secure_introduction_approle"
+	configKeySecureIntroductionBackend               = "secure_introduction_backend"
+	configKeySecureIntroductionBindSecretIdCidrs     = "secure_introduction_bind_secret_id_cidrs"
 	configKeySecureIntroductionTagPrefix             = "secure_introduction_tag_prefix"
 	configKeySecureIntroductionFilename              = "secure_introduction_filename"
+	configKeySecureIntroductionFileOwner             = "secure_introduction_file_owner"
+	configKeySecureIntroductionNetworkWaitAttempts   = "secure_introduction_network_wait_attempts"
+	configKeySecureIntroductionNetworkWaitInterval   = "secure_introduction_network_wait_interval"
+	configKeySecureIntroductionPreSharedToken        = "secure_introduction_pre_shared_token"
+	configKeySecureIntroductionSecretNumUses         = "secure_introduction_secret_num_uses"
 	configKeySecureIntroductionSecretValidity        = "secure_introduction_secret_validity"
 	configKeySecureIntroductionWrappedSecretValidity = "secure_introduction_wrapped_secret_validity"
+	configKeyDropletAgent                            = "droplet_agent"
+	configKeyDryRun                                  = "dry_run"
+	configKeyFirewallID                              = "firewall_id"
+	configKeyForceDelete                             = "force_delete"
+	configKeyHTTPSProxy                              = "https_proxy"
 	configKeyIPv6                                    = "ipv6"
+	configKeyMonitoring                              = "monitoring"
+	configKeyMaxCount                                = "max_count"
+	configKeyMaxCreateConcurrency                    = "max_create_concurrency"
+	configKeyMaxDeleteConcurrency                    = "max_delete_concurrency"
+	configKeyLogFile                                 = "log_file"
+	configKeyLogFormat                               = "log_format"
+	configKeyMetricsAddress                          = "metrics_address"
+	configKeyMinCount                                = "min_count"
+	configKeyNodeIDAttribute                         = "node_id_attribute"
+	configKeyNodeJoinTimeout                         = "node_join_timeout"
 	configKeyName                                    = "name"
+	configKeyNameTemplate                            = "name_template"
+	configKeyProjectID                               = "project_id"
+	configKeyReadyCheckPort                          = "ready_check_port"
+	configKeyReadyCheckTimeout                       = "ready_check_timeout"
+	configKeyReadyGracePeriod                        = "ready_grace_period"
+	configKeyReclaimOrphanedAddresses                = "reclaim_orphaned_addresses"
 	configKeyRegion                                  = "region"
+	configKeyRequestTimeout                          = "request_timeout"
+	configKeyReservationExpiry                       = "reservation_expiry"
+	configKeyReservationWaitInterval                 = "reservation_wait_interval"
+	configKeyReservationWaitTimeout                  = "reservation_wait_timeout"
+	configKeyRollbackOnFailure                       = "rollback_on_failure"
+	configKeyScaleActionTimeout                      = "scale_action_timeout"
+	configKeyScaleInStrategy                         = "scale_in_strategy"
+	configKeyScaleOutNotifyProxy                     = "scale_out_notify_proxy"
+	configKeyScaleOutNotifyTimeout                   = "scale_out_notify_timeout"
+	configKeyScaleOutNotifyURL                       = "scale_out_notify_url"
+	configKeyShutdownTimeout                         = "shutdown_timeout"
+	configKeyShutdownPollInterval                    = "shutdown_poll_interval"
+	configKeyShutdownPollMaxInterval                 = "shutdown_poll_max_interval"
 	configKeySize                                    = "size"
 	configKeySnapshotID                              = "snapshot_id"
+	configKeyImage                                   = "image"
 	configKeySshKeys                                 = "ssh_keys"
+	configKeyTagNodeMetadata                         = "tag_node_metadata"
+	configKeyTagReaperInterval                       = "tag_reaper_interval"
 	configKeyTags                                    = "tags"
 	configKeyToken                                   = "token"
 	configKeyUserData                                = "user_data"
+	configKeyUserDataTemplate                        = "user_data_template"
+	configKeyVaultAppRoleMount                       = "vault_approle_mount"
+	configKeyVolumes                                 = "volumes"
+	configKeyVpcName                                 = "vpc_name"
 	configKeyVpcUUID                                 = "vpc_uuid"
 )
 
+const (
+	// statusMetaKeyDropletsPrefix prefixes the number of droplets in each
+	// status, e.g. "droplets_active", in the meta of the target status.
+	statusMetaKeyDropletsPrefix = "droplets_"
+	statusMetaKeyOldestDroplet  = "oldest_droplet_created"
+	statusMetaKeyNewestDroplet  = "newest_droplet_created"
+
+	// statusMetaKeyAvailableIPv4s and statusMetaKeyAvailableIPv6s hold the
+	// number of reserved addresses left for new droplets, when they are not
+	// created as required.
+	statusMetaKeyAvailableIPv4s = "reserved_ipv4_addresses_available"
+	statusMetaKeyAvailableIPv6s = "reserved_ipv6_addresses_available"
+	statusMetaKeyWarning        = "warning"
+)
+
+// fileOwner matches the owner of a file as given to chown, e.g. "nomad" or
+// "vault:vault".
+var fileOwner = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]*(:[a-zA-Z0-9_][a-zA-Z0-9_.-]*)?$`)
+
 var (
 	PluginConfig = &plugins.InternalPluginConfig{
 		Factory: func(l hclog.Logger) interface{} {
-			return NewDODropletsPlugin(context.Background(), l, Must(NewVault()))
+			// an internal plugin lives as long as the autoscaler itself
+			ctx := context.Background()
+			vault := Must(NewVault())
+			vault.StartRenewingToken(ctx, l)
+			return NewDODropletsPlugin(ctx, l, vault)
 		},
 	}
 
@@ -60,6 +152,15 @@ var (
 // Assert that TargetPlugin meets the target.Target interface.
 var _ target.Target = (*TargetPlugin)(nil)
 
+// clusterScaleUtils is the subset of scaleutils.ClusterScaleUtils used by
+// the plugin.
+type clusterScaleUtils interface {
+	IsPoolReady(config map[string]string) (bool, error)
+	RunPreScaleInTasks(ctx context.Context, config map[string]string, num int) ([]scaleutils.NodeResourceID, error)
+	RunPreScaleInTasksWithRemoteCheck(ctx context.Context, config map[string]string, remoteIDs []string, num int) ([]scaleutils.NodeResourceID, error)
+	RunPostScaleInTasks(ctx context.Context, config map[string]string, ids []scaleutils.NodeResourceID) error
+}
+
 // TargetPlugin is the DigitalOcean implementation of the target.Target interface.
 type TargetPlugin struct {
 	ctx    context.Context
@@ -68,24 +169,125 @@ type TargetPlugin struct {
 
 	client DigitalOceanWrapper
 	vault  VaultProxy
+	// injectedVault is the VaultProxy the plugin was created with, which is
+	// used unless the configuration selects another secure introduction
+	// backend.
+	injectedVault VaultProxy
+	// vaultChecked records whether the connection of the VaultProxy has been
+	// checked successfully, so that it is only checked once.
+	vaultChecked bool
+	// vaultMutex guards vault and vaultChecked, as the configuration may be
+	// reloaded while scaling.
+	vaultMutex sync.Mutex
+
+	// httpClient is used for requests to the DigitalOcean API if set,
+	// rather than one built from the config.
+	httpClient *http.Client
 
 	// clusterUtils provides general cluster scaling utilities for querying the
 	// state of nodes pools and performing scaling tasks.
-	clusterUtils *scaleutils.ClusterScaleUtils
+	clusterUtils clusterScaleUtils
+
+	// nomadNodes is used to drain nodes right before their droplets are
+	// shut down, and to check that new droplets joined the cluster.
+	nomadNodes NomadNodes
 
 	reservedAddressesPool *ReservedAddressesPool
+
+	// tagDeleteRateLimiter limits how quickly unused tags are deleted, so
+	// that scaling is left enough of the API rate limit.
+	tagDeleteRateLimiter *rateLimiter
+
+	// dropletCounts briefly caches the droplet counts of each policy.
+	dropletCounts *dropletCountsCache
+
+	// activeDroplets tracks how long droplets have been active, for the
+	// policies with a ready grace period.
+	activeDroplets *activeDroplets
+
+	// logOutput is the output of the logger once it has been replaced. The
+	// logger is only replaced once, but its file is reopened whenever the
+	// configuration is reloaded.
+	logOutput *logOutput
+
+	// metricsOnce ensures the metrics endpoint is only started once, even if
+	// the configuration is reloaded.
+	metricsOnce sync.Once
+
+	// tagPrefixes holds the secure introduction tag prefixes of all the
+	// policies seen so far, along with the accounts their tags are created
+	// in, so that the tag reaper knows what to clean up.
+	tagPrefixes sync.Map
+	// tagCleanupMutex ensures only one clean up of unused tags runs at a time.
+	tagCleanupMutex sync.Mutex
+	// tagReaperOnce ensures the tag reaper is only started once, even if the
+	// configuration is reloaded.
+	tagReaperOnce sync.Once
+
+	// resolvedVPCs caches the IDs of the VPCs given by name, by account.
+	resolvedVPCs resolvedNamesCache[string]
+	// resolvedImages caches the IDs of the images given by name, by account.
+	resolvedImages resolvedNamesCache[int64]
+
+	// adoptedDroplets holds the droplets which have been adopted into each
+	// pool, so that they are not checked again.
+	adoptedDroplets sync.Map
+
+	// accounts caches the accounts of policies which have their own token,
+	// by the token's contents.
+	accounts      map[string]*account
+	accountsMutex sync.Mutex
 }
 
 // NewDODropletsPlugin returns the DO Droplets implementation of the target.Target
 // interface.
 func NewDODropletsPlugin(ctx context.Context, log hclog.Logger, vault VaultProxy) *TargetPlugin {
 	return &TargetPlugin{
-		ctx:    ctx,
-		logger: log,
-		vault:  vault,
+		ctx:            ctx,
+		logger:         log,
+		vault:          vault,
+		injectedVault:  vault,
+		dropletCounts:  newDropletCountsCache(quartz.NewReal()),
+		activeDroplets: newActiveDroplets(quartz.NewReal()),
 	}
 }
 
+// checkVault checks the connection of the VaultProxy, if it supports being
+// checked, until a check succeeds.
+func (t *TargetPlugin) checkVault(ctx context.Context) error {
+	t.vaultMutex.Lock()
+	defer t.vaultMutex.Unlock()
+	if t.vaultChecked {
+		return nil
+	}
+	if checker, ok := t.vault.(connectionChecker); ok {
+		if err := checker.CheckConnection(ctx); err != nil {
+			return fmt.Errorf("secure introduction is enabled, but its secrets cannot be generated: %w", err)
+		}
+	}
+	t.vaultChecked = true
+	return nil
+}
+
+// secrets returns the VaultProxy of the configured secure introduction
+// backend.
+func (t *TargetPlugin) secrets() VaultProxy {
+	t.vaultMutex.Lock()
+	defer t.vaultMutex.Unlock()
+	return t.vault
+}
+
+// configuresSecureIntroduction returns whether any secure introduction
+// setting is present in the configuration.
+func configuresSecureIntroduction(config map[string]string) bool {
+	for key := range config {
+		if strings.HasPrefix(key, "secure_introduction_") {
+			return true
+		}
+	}
+	return false
+}
+
 // PluginInfo satisfies the PluginInfo function on the base.Base interface.
 func (t *TargetPlugin) PluginInfo() (*base.PluginInfo, error) {
 	return pluginInfo, nil
@@ -95,25 +297,49 @@ func (t *TargetPlugin) PluginInfo() (*base.PluginInfo, error) {
 func (t *TargetPlugin) SetConfig(config map[string]string) error {
 	t.config = config
 
-	token, ok := config[configKeyToken]
-
-	if ok {
-		contents, err := pathOrContents(token)
-		if err != nil {
-			return fmt.Errorf("failed to read token: %w", err)
+	// the logger is replaced before anything is created with it, but the
+	// format is checked and the file reopened on every reload
+	if format, ok := config[configKeyLogFormat]; ok && format != "" {
+		if err := validateLogFormat(format); err != nil {
+			return err
 		}
-		t.client = &GodoWrapper{Client: godo.NewFromToken(contents)}
-	} else {
-		tokenFromEnv := getEnv("DIGITALOCEAN_TOKEN", "DIGITALOCEAN_ACCESS_TOKEN")
-		if len(tokenFromEnv) == 0 {
-			return fmt.Errorf("unable to find DigitalOcean token")
+		if t.logOutput == nil {
+			logger, output, err := newLogger(t.logger, format, config[configKeyLogFile])
+			if err != nil {
+				return err
+			}
+			t.logger = logger
+			t.logOutput = output
+		} else if err := t.logOutput.reopen(config[configKeyLogFile]); err != nil {
+			return err
 		}
-		t.client = &GodoWrapper{Client: godo.NewFromToken(tokenFromEnv)}
 	}
-	t.reservedAddressesPool = CreateReservedAddressesPool(
-		t.logger,
-		WithDigitalOceanWrapper(t.client),
-	)
+
+	token, err := t.pluginToken()
+	if err != nil {
+		return err
+	}
+	client, err := t.newGodoClient(token)
+	if err != nil {
+		return err
+	}
+	t.client = client
+	if err := t.rebuildAccounts(token); err != nil {
+		return err
+	}
+	// the pool is kept if the configuration is reloaded, so that provisional
+	// reservations and the rate limiter's budget persist
+	if t.reservedAddressesPool == nil {
+		t.reservedAddressesPool = CreateReservedAddressesPool(
+			t.logger,
+			WithDigitalOceanWrapper(t.client),
+		)
+	} else {
+		t.reservedAddressesPool.setClient(t.client)
+	}
+	if t.tagDeleteRateLimiter == nil {
+		t.tagDeleteRateLimiter = NewRateLimiter(tagDeleteBurst, tagDeleteRechargePeriod, true)
+	}
 
 	clusterUtils, err := scaleutils.NewClusterScaleUtils(
 		nomad.ConfigFromNamespacedMap(config),
@@ -124,8 +350,71 @@ func (t *TargetPlugin) SetConfig(config map[string]string) error {
 	}
 
 	// Store and set the remote ID callback function.
+	nodeIDAttribute, ok := config[configKeyNodeIDAttribute]
+	if !ok || nodeIDAttribute == "" {
+		nodeIDAttribute = defaultNodeIDAttribute
+	}
+	clusterUtils.ClusterNodeIDLookupFunc = dropletNodeIDMap(nodeIDAttribute)
 	t.clusterUtils = clusterUtils
-	t.clusterUtils.ClusterNodeIDLookupFunc = doDropletNodeIDMap
+
+	nomadClient, err := api.NewClient(nomad.ConfigFromNamespacedMap(config))
+	if err != nil {
+		return fmt.Errorf("failed to instantiate Nomad client: %w", err)
+	}
+	t.nomadNodes = nomadClient.Nodes()
+
+	vault := t.injectedVault
+	switch backend := config[configKeySecureIntroductionBackend]; backend {
+	case "", secretBackendVault:
+	case secretBackendPreSharedToken:
+		token, err := pathOrContents(config[configKeySecureIntroductionPreSharedToken])
+		if err != nil {
+			return fmt.Errorf("failed to read the pre-shared token: %w", err)
+		}
+		proxy, err := NewPreSharedToken(strings.TrimSpace(token))
+		if err != nil {
+			return fmt.Errorf("invalid value for config param %s: %w", configKeySecureIntroductionPreSharedToken, err)
+		}
+		vault = proxy
+	default:
+		return fmt.Errorf(
+			"config param %s must be %q or %q",
+			configKeySecureIntroductionBackend,
+			secretBackendVault,
+			secretBackendPreSharedToken,
+		)
+	}
+	t.vaultMutex.Lock()
+	t.vault = vault
+	t.vaultChecked = false
+	t.vaultMutex.Unlock()
+	// a misconfigured vault is reported as soon as secure introduction is
+	// configured, unless it does not use vault
+	backend := config[configKeySecureIntroductionBackend]
+	if (backend == "" || backend == secretBackendVault) && config[configKeySecureIntroductionAppRole] != "mock" &&
+		configuresSecureIntroduction(config) {
+		if err := t.checkVault(t.ctx); err != nil {
+			return err
+		}
+	}
+
+	if address, ok := config[configKeyMetricsAddress]; ok && address != "" {
+		t.metricsOnce.Do(func() {
+			go serveMetrics(t.ctx, t.logger, address)
+		})
+	}
+
+	if intervalS, ok := config[configKeyTagReaperInterval]; ok && intervalS != "" {
+		interval, err := time.ParseDuration(intervalS)
+		if err != nil || interval < 0 {
+			return fmt.Errorf("invalid value for config param %s", configKeyTagReaperInterval)
+		}
+		if interval > 0 {
+			t.tagReaperOnce.Do(func() {
+				go t.reapUnusedTags(t.ctx, interval)
+			})
+		}
+	}
 
 	return nil
 }
@@ -141,25 +430,75 @@ func (t *TargetPlugin) Scale(action sdk.ScalingAction, config map[string]string)
 	if err != nil {
 		return err
 	}
+	t.rememberTagPrefix(template)
 
+	desired := template.clampCount(action.Count)
+	if desired != action.Count {
+		t.logger.Warn("clamping the desired number of droplets",
+			logKeyTag, template.name,
+			"strategy_count", action.Count,
+			"desired", desired,
+			"min_count", template.minCount,
+			"max_count", template.maxCount)
+	}
+
+	start := template.clock().Now()
+	outcome := &scalingOutcome{}
 	ctx := t.ctx
+	if template.scaleActionTimeout > 0 {
+		// a stuck action is aborted, rather than blocking the policy for
+		// good. Addresses prereserved for droplets which were not created
+		// are released as with any other failure.
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, template.scaleActionTimeout, fmt.Errorf(
+			"scaling action did not complete within its %s of %v: %w",
+			configKeyScaleActionTimeout,
+			template.scaleActionTimeout,
+			context.DeadlineExceeded,
+		))
+		defer cancel()
+	}
 
-	total, _, err := t.countDroplets(ctx, template)
-	if err != nil {
-		return fmt.Errorf("failed to describe DigitalOcedroplets: %w", err)
+	var total int64
+	if counts, _, ok := t.dropletCounts.get(template.poolKey()); ok {
+		total = counts.total
+	} else {
+		total, err = t.countDropletsTotal(ctx, template)
+		if err != nil {
+			return fmt.Errorf("failed to describe DigitalOcedroplets: %w", err)
+		}
 	}
 
-	diff, direction := t.calculateDirection(total, action.Count)
+	diff, direction := t.calculateDirection(total, desired)
 
+	var createdIDs []int
 	switch direction {
 	case "in":
-		err = t.scaleIn(ctx, action.Count, diff, template, config)
+		err = t.scaleIn(ctx, outcome, desired, diff, template, config)
 	case "out":
-		err = t.scaleOut(ctx, action.Count, diff, template, config)
-	default:
-		t.logger.Debug("scaling not required", "tag", template.name,
-			"current_count", total, "strategy_count", action.Count)
-		return nil
+		createdIDs, err = t.scaleOut(ctx, outcome, desired, diff, template, config)
+	}
+	if direction != "" {
+		// even a failed scaling action may have changed the droplets
+		t.dropletCounts.invalidate(template.poolKey())
+	}
+	if err != nil && ctx.Err() != nil {
+		// say why the action was aborted, e.g. as it ran out of time
+		err = fmt.Errorf("%w: %w", context.Cause(ctx), err)
+	}
+
+	// a lack of capacity needs the operator's attention rather than a retry,
+	// so it is called out on its own
+	var capacityErr *CapacityError
+	if errors.As(err, &capacityErr) {
+		if len(capacityErr.Regions) == 0 {
+			t.logger.Warn("cannot create droplets as the account's droplet limit has been reached",
+				logKeyTag, template.name)
+		} else {
+			t.logger.Warn("cannot create droplets as no configured region has enough capacity",
+				logKeyTag, template.name,
+				"regions", capacityErr.Regions)
+		}
 	}
 
 	// If we received an error while scaling, format this with an outer message
@@ -167,6 +506,25 @@ func (t *TargetPlugin) Scale(action sdk.ScalingAction, config map[string]string)
 	if err != nil {
 		err = fmt.Errorf("failed to perform scaling action: %w", err)
 	}
+
+	// summarise the action in a single line, whatever its outcome
+	summary := "scaling action completed"
+	switch {
+	case err != nil:
+		summary = "scaling action failed"
+	case direction == "":
+		direction = "none"
+		summary = "scaling not required"
+	}
+	t.logger.Info(summary,
+		append([]any{
+			logKeyTag, template.name,
+			"direction", direction,
+			"strategy_count", action.Count,
+			"desired", desired,
+			"dry_run", template.dryRun,
+			"droplet_ids", createdIDs,
+		}, outcome.logFields(total, template.clock().Since(start), err)...)...)
 	return err
 }
 
@@ -187,21 +545,130 @@ func (t *TargetPlugin) Status(config map[string]string) (*sdk.TargetStatus, erro
 	if err != nil {
 		return nil, err
 	}
+	t.rememberTagPrefix(template)
 
-	total, active, err := t.countDroplets(t.ctx, template)
-	if err != nil {
-		return nil, fmt.Errorf("failed to describe DigitalOcean droplets: %w", err)
+	// a misconfigured vault is reported before scaling out relies on it; the
+	// mock approle does not use vault
+	if appRole := template.secureIntroductionAppRole; appRole != "" && appRole != "mock" {
+		if err := t.checkVault(t.ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	// existing droplets are adopted before counting, so that they are
+	// counted straight away. A droplet which cannot be adopted must not stop
+	// the pool from scaling, so the failure is only logged.
+	if len(template.adoptDropletIDs) != 0 {
+		if err := t.adoptDroplets(t.ctx, template); err != nil {
+			t.logger.Error("failed to adopt droplets", logKeyTag, template.name, "error", err)
+		}
+	}
+
+	counts, generation, ok := t.dropletCounts.get(template.poolKey())
+	if !ok {
+		counts, err = t.countDropletsForStatus(t.ctx, template, generation)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe DigitalOcean droplets: %w", err)
+		}
 	}
 
 	resp := &sdk.TargetStatus{
-		Ready: total == active,
-		Count: total,
-		Meta:  make(map[string]string),
+		Ready: counts.total == counts.active,
+		Count: counts.total,
+		Meta:  statusMeta(counts),
 	}
+	t.addReservedAddressesMeta(t.ctx, template, counts.total, resp.Meta)
 
 	return resp, nil
 }
 
+// countDropletsForStatus counts the droplets of the pool for Status. The
+// readiness and meta of the target need the droplets' statuses, so the
+// droplets are listed, unless they were all ready when they were last listed
+// not long ago and the tag's resource summary still counts as many of them.
+func (t *TargetPlugin) countDropletsForStatus(
+	ctx context.Context,
+	template *dropletTemplate,
+	generation uint64,
+) (*dropletCounts, error) {
+	if settled, ok := t.dropletCounts.getSettled(template.poolKey(), settledCountsMaxAge); ok {
+		total, err := t.countDropletsTotal(ctx, template)
+		if err == nil && total == settled.total {
+			return settled, nil
+		}
+	}
+	counts, err := t.countDroplets(ctx, template)
+	if err != nil {
+		return nil, err
+	}
+	t.dropletCounts.put(template.poolKey(), generation, counts, template.countCacheTTL)
+	return counts, nil
+}
+
+// addReservedAddressesMeta adds the number of reserved addresses available
+// to new droplets to the meta of a target status, unless addresses are
+// created as required. When none are left, a warning is logged and added to
+// the meta so that more can be reserved before the next scale-out fails.
+func (t *TargetPlugin) addReservedAddressesMeta(
+	ctx context.Context,
+	template *dropletTemplate,
+	count int64,
+	meta map[string]string,
+) {
+	if template.createReservedAddresses {
+		return
+	}
+	families := []struct {
+		enabled   bool
+		family    string
+		metaKey   string
+		available func(context.Context, []string) (int, error)
+	}{
+		{template.reserveIPv4Addresses, "IPv4", statusMetaKeyAvailableIPv4s, template.reservedAddressesPool.AvailableIPs},
+		{template.reserveIPv6Addresses, "IPv6", statusMetaKeyAvailableIPv6s, template.reservedAddressesPool.AvailableIPV6s},
+	}
+	var warnings []string
+	for _, f := range families {
+		if !f.enabled {
+			continue
+		}
+		available, err := f.available(ctx, template.regions)
+		if err != nil {
+			t.logger.Warn("cannot count available reserved IP addresses",
+				"name", template.name, "family", f.family, "error", err)
+			continue
+		}
+		meta[f.metaKey] = strconv.Itoa(available)
+		if available == 0 && count < template.maxCount {
+			warning := fmt.Sprintf(
+				"no reserved %v addresses are available for new droplets in %v",
+				f.family,
+				strings.Join(template.regions, ","),
+			)
+			t.logger.Warn(warning, "name", template.name, "droplets", count)
+			warnings = append(warnings, warning)
+		}
+	}
+	if len(warnings) != 0 {
+		meta[statusMetaKeyWarning] = strings.Join(warnings, "; ")
+	}
+}
+
+// statusMeta describes the droplets in the meta of a target status.
+func statusMeta(counts *dropletCounts) map[string]string {
+	meta := make(map[string]string, len(counts.byStatus)+2)
+	for status, count := range counts.byStatus {
+		meta[statusMetaKeyDropletsPrefix+status] = strconv.FormatInt(count, 10)
+	}
+	if !counts.oldest.IsZero() {
+		meta[statusMetaKeyOldestDroplet] = counts.oldest.Format(time.RFC3339)
+	}
+	if !counts.newest.IsZero() {
+		meta[statusMetaKeyNewestDroplet] = counts.newest.Format(time.RFC3339)
+	}
+	return meta
+}
+
 func (t *TargetPlugin) createDropletTemplate(config map[string]string) (*dropletTemplate, error) {
 	// We cannot scale droplets without knowing the name.
 	name, ok := t.getValue(config, configKeyName)
@@ -209,32 +676,50 @@ func (t *TargetPlugin) createDropletTemplate(config map[string]string) (*droplet
 		return nil, fmt.Errorf("required config param %s not found", configKeyName)
 	}
 
-	// We cannot scale droplets without knowing the region.
+	// We cannot scale droplets without knowing the region. Multiple regions
+	// may be given in order of preference.
 	region, ok := t.getValue(config, configKeyRegion)
 	if !ok {
 		return nil, fmt.Errorf("required config param %s not found", configKeyRegion)
 	}
+	regions := strings.Split(region, ",")
 
-	// We cannot scale droplets without knowing the size.
+	// We cannot scale droplets without knowing the size. Multiple sizes
+	// may be given in order of preference.
 	size, ok := t.getValue(config, configKeySize)
 	if !ok {
 		return nil, fmt.Errorf("required config param %s not found", configKeySize)
 	}
+	sizes := strings.Split(size, ",")
 
-	// We cannot scale droplets without knowing the target VPC.
-	vpc, ok := t.getValue(config, configKeyVpcUUID)
-	if !ok {
-		return nil, fmt.Errorf("required config param %s not found", configKeyVpcUUID)
+	account, err := t.accountFor(config)
+	if err != nil {
+		return nil, err
 	}
 
-	// We cannot scale droplets without knowing the snapshot id.
-	snapshot, ok := t.getValue(config, configKeySnapshotID)
-	if !ok {
-		return nil, fmt.Errorf("required config param %s not found", configKeySnapshotID)
+	// The target VPC may be given directly, or as the name of a VPC to
+	// resolve. Without either, droplets are placed in the default VPC of
+	// their region.
+	vpc, ok := t.getValue(config, configKeyVpcUUID)
+	if vpcName, hasName := t.getValue(config, configKeyVpcName); !ok && hasName {
+		key := account.id + "/" + vpcName + "/" + strings.Join(regions, ",")
+		vpc, err = t.resolvedVPCs.resolve(key, func() (string, error) {
+			vpc, err := resolveVPC(t.ctx, account.client.VPCs(), vpcName, regions)
+			if err == nil {
+				t.logger.Debug("resolved VPC", "name", vpcName, "id", vpc)
+			}
+			return vpc, err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for config param %s: %w", configKeyVpcName, err)
+		}
 	}
-	snapshotID, err := strconv.ParseInt(snapshot, 10, 0)
+
+	// We cannot scale droplets without knowing the snapshot id. It may be
+	// given directly, or as the name of an image to resolve.
+	snapshotID, err := t.getSnapshotID(config, account)
 	if err != nil {
-		return nil, fmt.Errorf("invalid value for config param %s", configKeySnapshotID)
+		return nil, err
 	}
 
 	// enable IPv6 addresses?
@@ -247,6 +732,40 @@ func (t *TargetPlugin) createDropletTemplate(config map[string]string) (*droplet
 		return nil, fmt.Errorf("invalid value for config param %s", configKeyIPv6)
 	}
 
+	backupsS, ok := t.getValue(config, configKeyBackups)
+	if !ok {
+		backupsS = "false"
+	}
+	backups, err := strconv.ParseBool(backupsS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for config param %s", configKeyBackups)
+	}
+
+	backupPolicy, err := t.createBackupPolicy(config, backups)
+	if err != nil {
+		return nil, err
+	}
+
+	// install the DigitalOcean monitoring agent?
+	monitoringS, ok := t.getValue(config, configKeyMonitoring)
+	if !ok {
+		monitoringS = "false"
+	}
+	monitoring, err := strconv.ParseBool(monitoringS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for config param %s", configKeyMonitoring)
+	}
+
+	// unless given, DigitalOcean decides whether to install the agent
+	var dropletAgent *bool
+	if dropletAgentS, ok := t.getValue(config, configKeyDropletAgent); ok {
+		value, err := strconv.ParseBool(dropletAgentS)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for config param %s", configKeyDropletAgent)
+		}
+		dropletAgent = &value
+	}
+
 	createReservedAddressesS, ok := t.getValue(config, configKeyCreateReservedAddresses)
 	if !ok {
 		createReservedAddressesS = "false"
@@ -259,6 +778,18 @@ func (t *TargetPlugin) createDropletTemplate(config map[string]string) (*droplet
 		)
 	}
 
+	reclaimOrphanedAddressesS, ok := t.getValue(config, configKeyReclaimOrphanedAddresses)
+	if !ok {
+		reclaimOrphanedAddressesS = "false"
+	}
+	reclaimOrphanedAddresses, err := strconv.ParseBool(reclaimOrphanedAddressesS)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"config param %s is not parseable as a boolean",
+			configKeyReclaimOrphanedAddresses,
+		)
+	}
+
 	reserveIPv4AddressesS, ok := t.getValue(config, configKeyReserveIPv4Addresses)
 	if !ok {
 		reserveIPv4AddressesS = "false"
@@ -271,6 +802,42 @@ func (t *TargetPlugin) createDropletTemplate(config map[string]string) (*droplet
 		)
 	}
 
+	// without a configured expiry, it is derived from the size of each batch
+	var reservationExpiry time.Duration
+	if reservationExpiryS, ok := t.getValue(config, configKeyReservationExpiry); ok {
+		reservationExpiry, err = time.ParseDuration(reservationExpiryS)
+		if err != nil || reservationExpiry <= 0 {
+			return nil, fmt.Errorf(
+				"config param %s must be a positive duration",
+				configKeyReservationExpiry,
+			)
+		}
+	}
+
+	reservationWaitIntervalS, ok := t.getValue(config, configKeyReservationWaitInterval)
+	if !ok {
+		reservationWaitIntervalS = defaultStatePollInterval.String()
+	}
+	reservationWaitInterval, err := time.ParseDuration(reservationWaitIntervalS)
+	if err != nil || reservationWaitInterval <= 0 {
+		return nil, fmt.Errorf(
+			"config param %s must be a positive duration",
+			configKeyReservationWaitInterval,
+		)
+	}
+
+	reservationWaitTimeoutS, ok := t.getValue(config, configKeyReservationWaitTimeout)
+	if !ok {
+		reservationWaitTimeoutS = defaultReservationWaitTimeout.String()
+	}
+	reservationWaitTimeout, err := time.ParseDuration(reservationWaitTimeoutS)
+	if err != nil || reservationWaitTimeout <= 0 {
+		return nil, fmt.Errorf(
+			"config param %s must be a positive duration",
+			configKeyReservationWaitTimeout,
+		)
+	}
+
 	reserveIPv6AddressesS, ok := t.getValue(config, configKeyReserveIPv6Addresses)
 	if !ok {
 		reserveIPv6AddressesS = "false"
@@ -283,22 +850,114 @@ func (t *TargetPlugin) createDropletTemplate(config map[string]string) (*droplet
 		)
 	}
 
+	pinnedAddressesS, _ := t.getValue(config, configKeyPinnedReservedAddresses)
+	pinnedIPv4Addresses, pinnedIPv6Addresses, err := parsePinnedAddresses(
+		pinnedAddressesS,
+		reserveIPv4Addresses,
+		reserveIPv6Addresses,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for config param %s: %w", configKeyPinnedReservedAddresses, err)
+	}
+
 	secureIntroductionAppRole, _ := t.getValue(config, configKeySecureIntroductionAppRole)
 
 	secureIntroductionTagPrefix, _ := t.getValue(config, configKeySecureIntroductionTagPrefix)
+	if prohibitedCharactersInTags.MatchString(secureIntroductionTagPrefix) {
+		return nil, fmt.Errorf(
+			"config param %s may only contain letters, numbers, colons, dashes and underscores",
+			configKeySecureIntroductionTagPrefix,
+		)
+	}
 
-	if secureIntroductionAppRole != "" && secureIntroductionTagPrefix == "" &&
+	// secure introduction is enabled by an approle, or, as the pre-shared
+	// token needs no approle, by a file to write the token to
+	_, hasFilename := t.getValue(config, configKeySecureIntroductionFilename)
+	preSharedToken := t.config[configKeySecureIntroductionBackend] == secretBackendPreSharedToken
+	secureIntroduction := secureIntroductionAppRole != "" || (preSharedToken && hasFilename)
+
+	// the pre-shared token is not bound to the droplet's addresses, so it
+	// is written into the user data whether or not addresses are reserved
+	if secureIntroduction && !preSharedToken && secureIntroductionTagPrefix == "" &&
 		!reserveIPv4Addresses &&
 		!reserveIPv6Addresses {
 		return nil, errors.New(
-			"a secure introduction approle has been specified but neither reserved IP addresses nor a tag prefix are configured",
+			"secure introduction is enabled but neither reserved IP addresses nor a tag prefix are configured",
+		)
+	}
+	// the pre-shared token is a long-lived credential shared by every
+	// droplet, so it is never written into a tag which anyone who can read
+	// the account could see
+	if secureIntroduction && preSharedToken && secureIntroductionTagPrefix != "" {
+		return nil, fmt.Errorf(
+			"config param %s cannot be used with the %s secure introduction backend, as the token would be visible in a tag",
+			configKeySecureIntroductionTagPrefix,
+			secretBackendPreSharedToken,
 		)
 	}
 
-	secureIntroductionFilename, ok := t.getValue(config, configKeySecureIntroductionFilename)
+	secureIntroductionAppendS, ok := t.getValue(config, configKeySecureIntroductionAppend)
+	if !ok {
+		secureIntroductionAppendS = "false"
+	}
+	secureIntroductionAppend, err := strconv.ParseBool(secureIntroductionAppendS)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"config param %s is not parseable as a boolean",
+			configKeySecureIntroductionAppend,
+		)
+	}
+
+	secureIntroductionBindSecretIdCidrsS, ok := t.getValue(config, configKeySecureIntroductionBindSecretIdCidrs)
+	if !ok {
+		secureIntroductionBindSecretIdCidrsS = "true"
+	}
+	secureIntroductionBindSecretIdCidrs, err := strconv.ParseBool(secureIntroductionBindSecretIdCidrsS)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"config param %s is not parseable as a boolean",
+			configKeySecureIntroductionBindSecretIdCidrs,
+		)
+	}
+
+	secureIntroductionFilenameS, ok := t.getValue(config, configKeySecureIntroductionFilename)
 	if !ok && secureIntroductionAppRole != "" {
 		return nil, fmt.Errorf("%q is required when %q is set", configKeySecureIntroductionFilename, configKeySecureIntroductionAppRole)
 	}
+	var secureIntroductionFilenames []string
+	if ok {
+		secureIntroductionFilenames, err = parseFilenames(secureIntroductionFilenameS)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for config param %s: %w", configKeySecureIntroductionFilename, err)
+		}
+	}
+
+	// the owner is written into a shell script, so only the characters of
+	// user and group names are allowed
+	secureIntroductionFileOwner, _ := t.getValue(config, configKeySecureIntroductionFileOwner)
+	if secureIntroductionFileOwner != "" && !fileOwner.MatchString(secureIntroductionFileOwner) {
+		return nil, fmt.Errorf(
+			"config param %s must be a user name or ID, optionally followed by a colon and a group name or ID",
+			configKeySecureIntroductionFileOwner,
+		)
+	}
+
+	secureIntroductionSecretNumUsesS, ok := t.getValue(config, configKeySecureIntroductionSecretNumUses)
+	if !ok {
+		secureIntroductionSecretNumUsesS = "1"
+	}
+	secureIntroductionSecretNumUses, err := strconv.ParseInt(secureIntroductionSecretNumUsesS, 10, 32)
+	if err != nil || secureIntroductionSecretNumUses < 0 {
+		return nil, fmt.Errorf(
+			"config param %s must be a non-negative integer",
+			configKeySecureIntroductionSecretNumUses,
+		)
+	}
+
+	vaultAppRoleMount, ok := t.getValue(config, configKeyVaultAppRoleMount)
+	if !ok {
+		vaultAppRoleMount = defaultAppRoleMountPath
+	}
 
 	secureIntroductionWrappedSecretValidityS, ok := t.getValue(
 		config,
@@ -341,13 +1000,325 @@ func (t *TargetPlugin) createDropletTemplate(config map[string]string) (*droplet
 		)
 	}
 
+	networkWaitIntervalS, ok := t.getValue(config, configKeySecureIntroductionNetworkWaitInterval)
+	if !ok {
+		networkWaitIntervalS = defaultNetworkWaitInterval.String()
+	}
+	networkWaitInterval, err := time.ParseDuration(networkWaitIntervalS)
+	if err != nil || networkWaitInterval <= 0 {
+		return nil, fmt.Errorf(
+			"config param %s must be a positive duration",
+			configKeySecureIntroductionNetworkWaitInterval,
+		)
+	}
+
+	networkWaitAttemptsS, ok := t.getValue(config, configKeySecureIntroductionNetworkWaitAttempts)
+	if !ok {
+		networkWaitAttemptsS = strconv.Itoa(defaultNetworkWaitAttempts)
+	}
+	networkWaitAttempts, err := strconv.Atoi(networkWaitAttemptsS)
+	if err != nil || networkWaitAttempts < 1 {
+		return nil, fmt.Errorf(
+			"config param %s must be a positive integer",
+			configKeySecureIntroductionNetworkWaitAttempts,
+		)
+	}
+
+	countCacheTTLS, ok := t.getValue(config, configKeyCountCacheTTL)
+	if !ok {
+		countCacheTTLS = defaultCountCacheTTL.String()
+	}
+	countCacheTTL, err := time.ParseDuration(countCacheTTLS)
+	if err != nil || countCacheTTL < 0 {
+		return nil, fmt.Errorf("invalid value for config param %s", configKeyCountCacheTTL)
+	}
+
+	scaleInStrategy, _ := t.getValue(config, configKeyScaleInStrategy)
+	if scaleInStrategy != "" && scaleInStrategy != scaleInStrategyOldestFirst {
+		return nil, fmt.Errorf("invalid value for config param %s", configKeyScaleInStrategy)
+	}
+
+	requestTimeoutS, ok := t.getValue(config, configKeyRequestTimeout)
+	if !ok {
+		requestTimeoutS = defaultRequestTimeout.String()
+	}
+	requestTimeout, err := time.ParseDuration(requestTimeoutS)
+	if err != nil || requestTimeout <= 0 {
+		return nil, fmt.Errorf(
+			"config param %s must be a positive duration",
+			configKeyRequestTimeout,
+		)
+	}
+
+	scaleActionTimeoutS, ok := t.getValue(config, configKeyScaleActionTimeout)
+	if !ok {
+		scaleActionTimeoutS = "0s"
+	}
+	scaleActionTimeout, err := time.ParseDuration(scaleActionTimeoutS)
+	if err != nil || scaleActionTimeout < 0 {
+		return nil, fmt.Errorf("invalid value for config param %s", configKeyScaleActionTimeout)
+	}
+
+	drainDeadlineS, ok := t.getValue(config, sdk.TargetConfigKeyDrainDeadline)
+	if !ok {
+		drainDeadlineS = defaultDrainDeadline.String()
+	}
+	drainDeadline, err := time.ParseDuration(drainDeadlineS)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"config param %s is not parseable as a duration: %w",
+			sdk.TargetConfigKeyDrainDeadline,
+			err,
+		)
+	}
+
+	statePollIntervalS, ok := t.getValue(config, configKeyShutdownPollInterval)
+	if !ok {
+		statePollIntervalS = defaultStatePollInterval.String()
+	}
+	statePollInterval, err := time.ParseDuration(statePollIntervalS)
+	if err != nil || statePollInterval <= 0 {
+		return nil, fmt.Errorf(
+			"config param %s must be a positive duration",
+			configKeyShutdownPollInterval,
+		)
+	}
+
+	statePollMaxIntervalS, ok := t.getValue(config, configKeyShutdownPollMaxInterval)
+	if !ok {
+		statePollMaxIntervalS = max(defaultStatePollMaxInterval, statePollInterval).String()
+	}
+	statePollMaxInterval, err := time.ParseDuration(statePollMaxIntervalS)
+	if err != nil || statePollMaxInterval < statePollInterval {
+		return nil, fmt.Errorf(
+			"config param %s must be a duration no shorter than %s",
+			configKeyShutdownPollMaxInterval,
+			configKeyShutdownPollInterval,
+		)
+	}
+
+	nodeJoinTimeoutS, ok := t.getValue(config, configKeyNodeJoinTimeout)
+	if !ok {
+		nodeJoinTimeoutS = "0s"
+	}
+	nodeJoinTimeout, err := time.ParseDuration(nodeJoinTimeoutS)
+	if err != nil || nodeJoinTimeout < 0 {
+		return nil, fmt.Errorf("invalid value for config param %s", configKeyNodeJoinTimeout)
+	}
+
+	readyCheckPortS, ok := t.getValue(config, configKeyReadyCheckPort)
+	if !ok {
+		readyCheckPortS = "0"
+	}
+	readyCheckPort, err := strconv.Atoi(readyCheckPortS)
+	if err != nil || readyCheckPort < 0 || readyCheckPort > 65535 {
+		return nil, fmt.Errorf("config param %s must be a port number", configKeyReadyCheckPort)
+	}
+
+	readyCheckTimeoutS, ok := t.getValue(config, configKeyReadyCheckTimeout)
+	if !ok {
+		readyCheckTimeoutS = defaultReadyCheckTimeout.String()
+	}
+	readyCheckTimeout, err := time.ParseDuration(readyCheckTimeoutS)
+	if err != nil || readyCheckTimeout <= 0 {
+		return nil, fmt.Errorf(
+			"config param %s must be a positive duration",
+			configKeyReadyCheckTimeout,
+		)
+	}
+
+	readyGracePeriodS, ok := t.getValue(config, configKeyReadyGracePeriod)
+	if !ok {
+		readyGracePeriodS = "0s"
+	}
+	readyGracePeriod, err := time.ParseDuration(readyGracePeriodS)
+	if err != nil || readyGracePeriod < 0 {
+		return nil, fmt.Errorf("invalid value for config param %s", configKeyReadyGracePeriod)
+	}
+
+	shutdownTimeoutS, ok := t.getValue(config, configKeyShutdownTimeout)
+	if !ok {
+		shutdownTimeoutS = defaultShutdownTimeout.String()
+	}
+	shutdownTimeout, err := time.ParseDuration(shutdownTimeoutS)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"config param %s is not parseable as a duration: %w",
+			configKeyShutdownTimeout,
+			err,
+		)
+	}
+
+	forceDeleteS, ok := t.getValue(config, configKeyForceDelete)
+	if !ok {
+		forceDeleteS = "false"
+	}
+	forceDelete, err := strconv.ParseBool(forceDeleteS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for config param %s", configKeyForceDelete)
+	}
+
+	bulkDeleteS, ok := t.getValue(config, configKeyBulkDelete)
+	if !ok {
+		bulkDeleteS = "false"
+	}
+	bulkDelete, err := strconv.ParseBool(bulkDeleteS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for config param %s", configKeyBulkDelete)
+	}
+
+	rollbackOnFailureS, ok := t.getValue(config, configKeyRollbackOnFailure)
+	if !ok {
+		rollbackOnFailureS = "false"
+	}
+	rollbackOnFailure, err := strconv.ParseBool(rollbackOnFailureS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for config param %s", configKeyRollbackOnFailure)
+	}
+
+	scaleOutNotifyURL, _ := t.getValue(config, configKeyScaleOutNotifyURL)
+	if scaleOutNotifyURL != "" {
+		u, err := url.Parse(scaleOutNotifyURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf(
+				"config param %s must be an absolute http or https URL",
+				configKeyScaleOutNotifyURL,
+			)
+		}
+	}
+
+	scaleOutNotifyProxyS, _ := t.getValue(config, configKeyScaleOutNotifyProxy)
+	scaleOutNotifyProxy, err := parseProxyURL(configKeyScaleOutNotifyProxy, scaleOutNotifyProxyS)
+	if err != nil {
+		return nil, err
+	}
+
+	scaleOutNotifyTimeoutS, ok := t.getValue(config, configKeyScaleOutNotifyTimeout)
+	if !ok {
+		scaleOutNotifyTimeoutS = defaultScaleOutNotifyTimeout.String()
+	}
+	scaleOutNotifyTimeout, err := time.ParseDuration(scaleOutNotifyTimeoutS)
+	if err != nil || scaleOutNotifyTimeout <= 0 {
+		return nil, fmt.Errorf(
+			"config param %s must be a positive duration",
+			configKeyScaleOutNotifyTimeout,
+		)
+	}
+
+	dryRunS, ok := t.getValue(config, configKeyDryRun)
+	if !ok {
+		dryRunS = "false"
+	}
+	dryRun, err := strconv.ParseBool(dryRunS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for config param %s", configKeyDryRun)
+	}
+
+	compressUserDataS, ok := t.getValue(config, configKeyCompressUserData)
+	if !ok {
+		compressUserDataS = "false"
+	}
+	compressUserData, err := strconv.ParseBool(compressUserDataS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for config param %s", configKeyCompressUserData)
+	}
+
+	userDataTemplateS, ok := t.getValue(config, configKeyUserDataTemplate)
+	if !ok {
+		userDataTemplateS = "false"
+	}
+	userDataTemplate, err := strconv.ParseBool(userDataTemplateS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for config param %s", configKeyUserDataTemplate)
+	}
+
+	minCount, maxCount, err := t.getCountLimits(config)
+	if err != nil {
+		return nil, err
+	}
+
+	nameTemplate, ok := t.getValue(config, configKeyNameTemplate)
+	if !ok {
+		nameTemplate = defaultNameTemplate
+	}
+	if err := validateNameTemplate(nameTemplate, name, regions, maxCount); err != nil {
+		return nil, fmt.Errorf("invalid value for config param %s: %w", configKeyNameTemplate, err)
+	}
+
+	maxCreateConcurrencyS, ok := t.getValue(config, configKeyMaxCreateConcurrency)
+	if !ok {
+		maxCreateConcurrencyS = strconv.Itoa(defaultMaxCreateConcurrency)
+	}
+	maxCreateConcurrency, err := strconv.Atoi(maxCreateConcurrencyS)
+	if err != nil || maxCreateConcurrency < 1 {
+		return nil, fmt.Errorf(
+			"config param %s must be a positive integer",
+			configKeyMaxCreateConcurrency,
+		)
+	}
+
+	createStaggerS, ok := t.getValue(config, configKeyCreateStagger)
+	if !ok {
+		createStaggerS = "0s"
+	}
+	createStagger, err := time.ParseDuration(createStaggerS)
+	if err != nil || createStagger < 0 {
+		return nil, fmt.Errorf("invalid value for config param %s", configKeyCreateStagger)
+	}
+
+	maxDeleteConcurrencyS, ok := t.getValue(config, configKeyMaxDeleteConcurrency)
+	if !ok {
+		maxDeleteConcurrencyS = strconv.Itoa(defaultMaxDeleteConcurrency)
+	}
+	maxDeleteConcurrency, err := strconv.Atoi(maxDeleteConcurrencyS)
+	if err != nil || maxDeleteConcurrency < 1 {
+		return nil, fmt.Errorf(
+			"config param %s must be a positive integer",
+			configKeyMaxDeleteConcurrency,
+		)
+	}
+
 	sshKeyFingerprintAsString, _ := t.getValue(config, configKeySshKeys)
 	tagsAsString, _ := t.getValue(config, configKeyTags)
+	firewallID, _ := t.getValue(config, configKeyFirewallID)
+	projectID, _ := t.getValue(config, configKeyProjectID)
 	userData, _ := t.getValue(config, configKeyUserData)
+	volumesAsString, _ := t.getValue(config, configKeyVolumes)
 
 	tags := []string{name}
 	if len(tagsAsString) != 0 {
-		tags = append(tags, strings.Split(tagsAsString, ",")...)
+		for _, tag := range strings.Split(tagsAsString, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag != "" && !slices.Contains(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	for _, tag := range tags {
+		if _, _, err := ParseTag(tag); err != nil {
+			return nil, fmt.Errorf("invalid value for config param %s: %w", configKeyTags, err)
+		}
+	}
+
+	tagNodeMetadataS, ok := t.getValue(config, configKeyTagNodeMetadata)
+	if !ok {
+		tagNodeMetadataS = "false"
+	}
+	tagNodeMetadata, err := strconv.ParseBool(tagNodeMetadataS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for config param %s", configKeyTagNodeMetadata)
+	}
+	if tagNodeMetadata {
+		if nodePool, ok := config[sdk.TargetConfigKeyNodePool]; ok && nodePool != "" {
+			if tag := SanitizeTag(nodePoolTagPrefix + nodePool); !slices.Contains(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+		if datacenter, ok := config[sdk.TargetConfigKeyDatacenter]; ok && datacenter != "" {
+			if tag := SanitizeTag("nomad-datacenter:" + datacenter); !slices.Contains(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
 	}
 
 	sshKeyFingerprints := []string{}
@@ -356,28 +1327,165 @@ func (t *TargetPlugin) createDropletTemplate(config map[string]string) (*droplet
 			sshKeyFingerprints,
 			strings.Split(sshKeyFingerprintAsString, ",")...)
 	}
+	if err := validateSSHKeys(sshKeyFingerprints); err != nil {
+		return nil, fmt.Errorf("invalid value for config param %s: %w", configKeySshKeys, err)
+	}
+
+	volumes := []string{}
+	if len(volumesAsString) != 0 {
+		volumes = append(volumes, strings.Split(volumesAsString, ",")...)
+	}
+
+	adoptDropletIDsS, _ := t.getValue(config, configKeyAdoptDroplets)
+	adoptDropletIDs, err := parseDropletIDs(adoptDropletIDsS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for config param %s: %w", configKeyAdoptDroplets, err)
+	}
 
 	return &dropletTemplate{
-		createReservedAddresses:     createReservedAddresses,
-		ipv6:                        ipv6,
-		name:                        name,
-		region:                      region,
-		reserveIPv4Addresses:        reserveIPv4Addresses,
-		reserveIPv6Addresses:        reserveIPv6Addresses,
-		secretValidity:              secureIntroductionSecretValidity,
-		secureIntroductionAppRole:   secureIntroductionAppRole,
-		secureIntroductionFilename:  secureIntroductionFilename,
-		secureIntroductionTagPrefix: secureIntroductionTagPrefix,
-		size:                        size,
-		snapshotID:                  int(snapshotID),
-		sshKeys:                     sshKeyFingerprints,
-		tags:                        tags,
-		userData:                    userData,
-		vpc:                         vpc,
-		wrappedSecretValidity:       secureIntroductionWrappedSecretValidity,
+		account:                             account.id,
+		adoptDropletIDs:                     adoptDropletIDs,
+		backupPolicy:                        backupPolicy,
+		client:                              account.client,
+		reservedAddressesPool:               account.reservedAddressesPool,
+		backups:                             backups,
+		bulkDelete:                          bulkDelete,
+		compressUserData:                    compressUserData,
+		userDataTemplate:                    userDataTemplate,
+		countCacheTTL:                       countCacheTTL,
+		createReservedAddresses:             createReservedAddresses,
+		drainDeadline:                       drainDeadline,
+		dropletAgent:                        dropletAgent,
+		dryRun:                              dryRun,
+		firewallID:                          firewallID,
+		forceDelete:                         forceDelete,
+		ipv6:                                ipv6,
+		maxCount:                            maxCount,
+		maxCreateConcurrency:                maxCreateConcurrency,
+		createStagger:                       createStagger,
+		maxDeleteConcurrency:                maxDeleteConcurrency,
+		minCount:                            minCount,
+		monitoring:                          monitoring,
+		name:                                name,
+		nameTemplate:                        nameTemplate,
+		nodeJoinTimeout:                     nodeJoinTimeout,
+		projectID:                           projectID,
+		readyCheckPort:                      readyCheckPort,
+		readyCheckTimeout:                   readyCheckTimeout,
+		readyGracePeriod:                    readyGracePeriod,
+		requestTimeout:                      requestTimeout,
+		reclaimOrphanedAddresses:            reclaimOrphanedAddresses,
+		reservationExpiry:                   reservationExpiry,
+		reservationWaitInterval:             reservationWaitInterval,
+		reservationWaitTimeout:              reservationWaitTimeout,
+		rollbackOnFailure:                   rollbackOnFailure,
+		scaleActionTimeout:                  scaleActionTimeout,
+		scaleInStrategy:                     scaleInStrategy,
+		scaleOutNotifyProxy:                 scaleOutNotifyProxy,
+		scaleOutNotifyTimeout:               scaleOutNotifyTimeout,
+		scaleOutNotifyURL:                   scaleOutNotifyURL,
+		regions:                             regions,
+		reserveIPv4Addresses:                reserveIPv4Addresses,
+		reserveIPv6Addresses:                reserveIPv6Addresses,
+		pinnedIPv4Addresses:                 pinnedIPv4Addresses,
+		pinnedIPv6Addresses:                 pinnedIPv6Addresses,
+		networkWaitAttempts:                 networkWaitAttempts,
+		networkWaitInterval:                 networkWaitInterval,
+		secretNumUses:                       int(secureIntroductionSecretNumUses),
+		secretValidity:                      secureIntroductionSecretValidity,
+		secureIntroductionAppend:            secureIntroductionAppend,
+		secureIntroduction:                  secureIntroduction,
+		secureIntroductionAppRole:           secureIntroductionAppRole,
+		secureIntroductionPreShared:         preSharedToken,
+		secureIntroductionBindSecretIdCidrs: secureIntroductionBindSecretIdCidrs,
+		secureIntroductionFilenames:         secureIntroductionFilenames,
+		secureIntroductionFileOwner:         secureIntroductionFileOwner,
+		secureIntroductionTagPrefix:         secureIntroductionTagPrefix,
+		shutdownTimeout:                     shutdownTimeout,
+		sizes:                               sizes,
+		snapshotID:                          int(snapshotID),
+		sshKeys:                             sshKeyFingerprints,
+		statePollInterval:                   statePollInterval,
+		statePollMaxInterval:                statePollMaxInterval,
+		tags:                                tags,
+		userData:                            userData,
+		vaultAppRoleMount:                   vaultAppRoleMount,
+		volumes:                             volumes,
+		vpc:                                 vpc,
+		wrappedSecretValidity:               secureIntroductionWrappedSecretValidity,
 	}, nil
 }
 
+// getCountLimits returns the optional bounds on the number of droplets. If
+// unset, the minimum is zero and there is no maximum.
+func (t *TargetPlugin) getCountLimits(config map[string]string) (int64, int64, error) {
+	minCount, maxCount := int64(0), int64(math.MaxInt64)
+	if minCountS, ok := t.getValue(config, configKeyMinCount); ok {
+		var err error
+		minCount, err = strconv.ParseInt(minCountS, 10, 64)
+		if err != nil || minCount < 0 {
+			return 0, 0, fmt.Errorf("invalid value for config param %s", configKeyMinCount)
+		}
+	}
+	if maxCountS, ok := t.getValue(config, configKeyMaxCount); ok {
+		var err error
+		maxCount, err = strconv.ParseInt(maxCountS, 10, 64)
+		if err != nil || maxCount < 0 {
+			return 0, 0, fmt.Errorf("invalid value for config param %s", configKeyMaxCount)
+		}
+	}
+	if minCount > maxCount {
+		return 0, 0, fmt.Errorf("%q must not be greater than %q", configKeyMinCount, configKeyMaxCount)
+	}
+	return minCount, maxCount, nil
+}
+
+// createBackupPolicy builds the optional backup policy for new droplets. A
+// backup_day selects a weekly plan, otherwise a backup_hour alone selects a
+// daily plan. If neither is set, DigitalOcean's default policy is used.
+func (t *TargetPlugin) createBackupPolicy(
+	config map[string]string,
+	backups bool,
+) (*godo.DropletBackupPolicyRequest, error) {
+	backupDay, hasDay := t.getValue(config, configKeyBackupDay)
+	backupHourS, hasHour := t.getValue(config, configKeyBackupHour)
+	if !hasDay && !hasHour {
+		return nil, nil
+	}
+	if !backups {
+		return nil, fmt.Errorf(
+			"%q and %q require %q to be enabled",
+			configKeyBackupDay,
+			configKeyBackupHour,
+			configKeyBackups,
+		)
+	}
+
+	policy := &godo.DropletBackupPolicyRequest{Plan: "daily"}
+	if hasDay {
+		day := strings.ToUpper(strings.TrimSpace(backupDay))
+		if !slices.Contains([]string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}, day) {
+			return nil, fmt.Errorf(
+				"invalid value for config param %s: expected one of SUN, MON, TUE, WED, THU, FRI or SAT",
+				configKeyBackupDay,
+			)
+		}
+		policy.Plan = "weekly"
+		policy.Weekday = day
+	}
+	if hasHour {
+		hour, err := strconv.Atoi(backupHourS)
+		if err != nil || hour < 0 || hour > 20 || hour%4 != 0 {
+			return nil, fmt.Errorf(
+				"invalid value for config param %s: expected one of 0, 4, 8, 12, 16 or 20",
+				configKeyBackupHour,
+			)
+		}
+		policy.Hour = &hour
+	}
+	return policy, nil
+}
+
 func (t *TargetPlugin) calculateDirection(target, desired int64) (int64, string) {
 	if desired < target {
 		return target - desired, "in"
@@ -388,6 +1496,42 @@ func (t *TargetPlugin) calculateDirection(target, desired int64) (int64, string)
 	return 0, ""
 }
 
+// getSnapshotID returns the ID of the image to create droplets from, either
+// from the snapshot_id config param or by resolving the image config param to
+// the newest user image with that name.
+func (t *TargetPlugin) getSnapshotID(config map[string]string, account *account) (int64, error) {
+	snapshot, hasSnapshot := t.getValue(config, configKeySnapshotID)
+	image, hasImage := t.getValue(config, configKeyImage)
+	switch {
+	case hasSnapshot && hasImage:
+		return 0, fmt.Errorf("only one of %s and %s may be given", configKeySnapshotID, configKeyImage)
+	case hasSnapshot:
+		snapshotID, err := strconv.ParseInt(snapshot, 10, 0)
+		if err != nil {
+			return 0, fmt.Errorf("invalid value for config param %s", configKeySnapshotID)
+		}
+		return snapshotID, nil
+	case hasImage:
+		if snapshotID, err := strconv.ParseInt(image, 10, 0); err == nil {
+			return snapshotID, nil
+		}
+		snapshotID, err := t.resolvedImages.resolve(account.id+"/"+image, func() (int64, error) {
+			resolved, err := resolveImage(t.ctx, account.client.Images(), image)
+			if err != nil {
+				return 0, err
+			}
+			t.logger.Debug("resolved image", "name", image, "id", resolved.ID, "created", resolved.Created)
+			return int64(resolved.ID), nil
+		})
+		if err != nil {
+			return 0, fmt.Errorf("invalid value for config param %s: %w", configKeyImage, err)
+		}
+		return snapshotID, nil
+	default:
+		return 0, fmt.Errorf("required config param %s or %s not found", configKeySnapshotID, configKeyImage)
+	}
+}
+
 func (t *TargetPlugin) getValue(config map[string]string, name string) (string, bool) {
 	v, ok := config[name]
 	if ok {
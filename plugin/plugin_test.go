@@ -1,9 +1,18 @@
 package plugin
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"testing"
+	"time"
 
+	"github.com/coder/quartz"
+	"github.com/digitalocean/godo"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestTargetPlugin_calculateDirection(t *testing.T) {
@@ -65,6 +74,32 @@ func TestTargetPlugin_createDropletTemplate(t *testing.T) {
 	assert.Equal(t, []string{}, dropletTemplate.sshKeys)
 	assert.Equal(t, "hashi-batch", dropletTemplate.name)
 	assert.Equal(t, []string{"hashi-batch"}, dropletTemplate.tags)
+	assert.Equal(t, 5*time.Minute, dropletTemplate.shutdownTimeout)
+	assert.Equal(t, 6*time.Second, dropletTemplate.networkWaitInterval)
+	assert.Equal(t, 10, dropletTemplate.networkWaitAttempts)
+	assert.Equal(t, 5*time.Second, dropletTemplate.countCacheTTL)
+	assert.Equal(t, 30*time.Second, dropletTemplate.requestTimeout)
+	assert.Equal(t, 3*time.Second, dropletTemplate.statePollInterval)
+	assert.Equal(t, 30*time.Second, dropletTemplate.statePollMaxInterval)
+
+	input["shutdown_timeout"] = "10m"
+	dropletTemplate, err = plugin.createDropletTemplate(input)
+	assert.Nil(t, err)
+	assert.Equal(t, 10*time.Minute, dropletTemplate.shutdownTimeout)
+
+	input["shutdown_timeout"] = "ten minutes"
+	_, err = plugin.createDropletTemplate(input)
+	assert.Error(t, err)
+	delete(input, "shutdown_timeout")
+
+	input["count_cache_ttl"] = "0s"
+	dropletTemplate, err = plugin.createDropletTemplate(input)
+	assert.Nil(t, err)
+	assert.Zero(t, dropletTemplate.countCacheTTL)
+
+	input["count_cache_ttl"] = "-1s"
+	_, err = plugin.createDropletTemplate(input)
+	assert.Error(t, err)
 }
 
 func TestTargetPlugin_createDropletTemplateWithMultipleTags(t *testing.T) {
@@ -84,3 +119,707 @@ func TestTargetPlugin_createDropletTemplateWithMultipleTags(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, []string{"hashi-batch", "tag1", "tag2"}, dropletTemplate.tags)
 }
+
+func TestTargetPlugin_createDropletTemplateWithDuplicateTags(t *testing.T) {
+	input := map[string]string{
+		"name":        "hashi-batch",
+		"region":      "ny1",
+		"size":        "s-1vcpu-1gb",
+		"vpc_uuid":    "b6ac51f4-dc83-11e8-a3da-3cfdfea9f0d8",
+		"snapshot_id": "123",
+		"tags":        "tag1, hashi-batch,tag1,,tag2",
+	}
+
+	plugin := TargetPlugin{}
+	dropletTemplate, err := plugin.createDropletTemplate(input)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"hashi-batch", "tag1", "tag2"}, dropletTemplate.tags)
+
+	input["tags"] = "tag1,tag 2"
+	_, err = plugin.createDropletTemplate(input)
+	assert.ErrorContains(t, err, `tag "tag 2" may only contain`)
+
+	input["tags"] = "tag1"
+	input["name"] = "hashi.batch"
+	_, err = plugin.createDropletTemplate(input)
+	assert.ErrorContains(t, err, `tag "hashi.batch" may only contain`)
+
+	input["name"] = "hashi-batch"
+	input["tags"] = "env:prod,team:payments"
+	dropletTemplate, err = plugin.createDropletTemplate(input)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"hashi-batch", "env:prod", "team:payments"}, dropletTemplate.tags)
+
+	input["tags"] = "env:prod,team:"
+	_, err = plugin.createDropletTemplate(input)
+	assert.ErrorContains(t, err, `tag "team:" has an empty value`)
+}
+
+func TestTargetPlugin_createDropletTemplateWithBackups(t *testing.T) {
+	input := map[string]string{
+		"name":        "hashi-batch",
+		"region":      "ny1",
+		"size":        "s-1vcpu-1gb",
+		"vpc_uuid":    "b6ac51f4-dc83-11e8-a3da-3cfdfea9f0d8",
+		"snapshot_id": "123",
+		"backups":     "true",
+		"backup_day":  "sun",
+		"backup_hour": "8",
+	}
+
+	plugin := TargetPlugin{}
+	dropletTemplate, err := plugin.createDropletTemplate(input)
+
+	assert.Nil(t, err)
+	assert.True(t, dropletTemplate.backups)
+	assert.Equal(t, "weekly", dropletTemplate.backupPolicy.Plan)
+	assert.Equal(t, "SUN", dropletTemplate.backupPolicy.Weekday)
+	assert.Equal(t, 8, *dropletTemplate.backupPolicy.Hour)
+
+	input["backups"] = "nope"
+	_, err = plugin.createDropletTemplate(input)
+	assert.Error(t, err)
+
+	input["backups"] = "false"
+	_, err = plugin.createDropletTemplate(input)
+	assert.Error(t, err)
+
+	input["backups"] = "true"
+	input["backup_hour"] = "7"
+	_, err = plugin.createDropletTemplate(input)
+	assert.Error(t, err)
+}
+
+func TestTargetPlugin_createDropletTemplateWithNodeMetadataTags(t *testing.T) {
+	input := map[string]string{
+		"name":              "hashi-batch",
+		"region":            "ny1",
+		"size":              "s-1vcpu-1gb",
+		"vpc_uuid":          "b6ac51f4-dc83-11e8-a3da-3cfdfea9f0d8",
+		"snapshot_id":       "123",
+		"node_pool":         "batch",
+		"datacenter":        "dc 1",
+		"tag_node_metadata": "true",
+	}
+
+	plugin := TargetPlugin{}
+	dropletTemplate, err := plugin.createDropletTemplate(input)
+
+	assert.Nil(t, err)
+	assert.Equal(
+		t,
+		[]string{"hashi-batch", "nomad-node-pool:batch", "nomad-datacenter:dc_1"},
+		dropletTemplate.tags,
+	)
+}
+
+func TestTargetPlugin_createDropletTemplateWithImage(t *testing.T) {
+	input := map[string]string{
+		"name":     "hashi-batch",
+		"region":   "ny1",
+		"size":     "s-1vcpu-1gb",
+		"vpc_uuid": "b6ac51f4-dc83-11e8-a3da-3cfdfea9f0d8",
+		"image":    "nomad-client",
+	}
+
+	mock := createMockGodo()
+	mock.images[1] = &godo.Image{ID: 1, Name: "nomad-client", Created: "2024-01-01T00:00:00Z"}
+	mock.images[2] = &godo.Image{ID: 2, Name: "nomad-client", Created: "2024-02-01T00:00:00Z"}
+	mock.images[3] = &godo.Image{ID: 3, Name: "nomad-server", Created: "2024-03-01T00:00:00Z"}
+	clock := quartz.NewMock(t)
+	plugin := TargetPlugin{
+		ctx:            t.Context(),
+		logger:         hclog.NewNullLogger(),
+		client:         mock,
+		resolvedImages: resolvedNamesCache[int64]{clock: clock},
+	}
+	dropletTemplate, err := plugin.createDropletTemplate(input)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, dropletTemplate.snapshotID)
+
+	// a newer image is only picked up once the resolution expires
+	mock.images[4] = &godo.Image{ID: 4, Name: "nomad-client", Created: "2024-04-01T00:00:00Z"}
+	dropletTemplate, err = plugin.createDropletTemplate(input)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, dropletTemplate.snapshotID)
+	clock.Advance(resolvedNameTTL)
+	dropletTemplate, err = plugin.createDropletTemplate(input)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, dropletTemplate.snapshotID)
+
+	input["image"] = "123"
+	dropletTemplate, err = plugin.createDropletTemplate(input)
+	assert.Nil(t, err)
+	assert.Equal(t, 123, dropletTemplate.snapshotID)
+
+	input["image"] = "nomad-unknown"
+	_, err = plugin.createDropletTemplate(input)
+	assert.ErrorContains(t, err, `no image named "nomad-unknown" found`)
+
+	input["snapshot_id"] = "123"
+	_, err = plugin.createDropletTemplate(input)
+	assert.Error(t, err)
+}
+
+func TestTargetPlugin_createDropletTemplateWithVPCName(t *testing.T) {
+	input := map[string]string{
+		"name":        "hashi-batch",
+		"region":      "ny1,ams3",
+		"size":        "s-1vcpu-1gb",
+		"snapshot_id": "123",
+		"vpc_name":    "nomad",
+	}
+
+	mock := createMockGodo()
+	mock.vpcs = []*godo.VPC{
+		{ID: "vpc-1", Name: "nomad", RegionSlug: "lon1"},
+		{ID: "vpc-2", Name: "nomad", RegionSlug: "ams3"},
+		{ID: "vpc-3", Name: "default-ams3", RegionSlug: "ams3"},
+	}
+	clock := quartz.NewMock(t)
+	plugin := TargetPlugin{
+		ctx:          t.Context(),
+		logger:       hclog.NewNullLogger(),
+		client:       mock,
+		resolvedVPCs: resolvedNamesCache[string]{clock: clock},
+	}
+	dropletTemplate, err := plugin.createDropletTemplate(input)
+	assert.Nil(t, err)
+	assert.Equal(t, "vpc-2", dropletTemplate.vpc)
+
+	// the VPC is not looked up again until its resolution expires
+	mock.vpcs[1] = &godo.VPC{ID: "vpc-4", Name: "nomad", RegionSlug: "ams3"}
+	dropletTemplate, err = plugin.createDropletTemplate(input)
+	assert.Nil(t, err)
+	assert.Equal(t, "vpc-2", dropletTemplate.vpc)
+	clock.Advance(resolvedNameTTL)
+	dropletTemplate, err = plugin.createDropletTemplate(input)
+	assert.Nil(t, err)
+	assert.Equal(t, "vpc-4", dropletTemplate.vpc)
+
+	// the UUID wins over the name
+	input["vpc_uuid"] = "b6ac51f4-dc83-11e8-a3da-3cfdfea9f0d8"
+	dropletTemplate, err = plugin.createDropletTemplate(input)
+	assert.Nil(t, err)
+	assert.Equal(t, "b6ac51f4-dc83-11e8-a3da-3cfdfea9f0d8", dropletTemplate.vpc)
+	delete(input, "vpc_uuid")
+
+	input["region"] = "ny1"
+	_, err = plugin.createDropletTemplate(input)
+	assert.ErrorContains(t, err, `no VPC named "nomad" found`)
+
+	input["region"] = "lon1,ams3"
+	_, err = plugin.createDropletTemplate(input)
+	assert.ErrorContains(t, err, `2 VPCs named "nomad" found`)
+
+	// without either, the default VPC of the region is used
+	delete(input, "vpc_name")
+	dropletTemplate, err = plugin.createDropletTemplate(input)
+	assert.Nil(t, err)
+	assert.Empty(t, dropletTemplate.vpc)
+}
+
+func TestStatusMeta(t *testing.T) {
+	counts := &dropletCounts{byStatus: make(map[string]int64)}
+	assert.Empty(t, statusMeta(counts))
+
+	counts.add([]godo.Droplet{
+		{ID: 1, Status: "active", Created: "2024-01-02T00:00:00Z"},
+		{ID: 2, Status: "new", Created: "2024-01-03T00:00:00Z"},
+		{ID: 3, Status: "active", Created: "2024-01-01T00:00:00Z"},
+		{ID: 4, Status: "off"},
+	})
+	assert.Equal(t, int64(4), counts.total)
+	assert.Equal(t, int64(2), counts.active)
+	assert.Equal(t, map[string]string{
+		"droplets_active":        "2",
+		"droplets_new":           "1",
+		"droplets_off":           "1",
+		"oldest_droplet_created": "2024-01-01T00:00:00Z",
+		"newest_droplet_created": "2024-01-03T00:00:00Z",
+	}, statusMeta(counts))
+}
+
+func TestAddReservedAddressesMeta(t *testing.T) {
+	ctx := t.Context()
+	mock := createMockGodo()
+	clock := quartz.NewMock(t)
+	pool := mock.NewReservedAddressPool(hclog.NewNullLogger(), clock)
+	plugin := TargetPlugin{logger: hclog.NewNullLogger()}
+	template := &dropletTemplate{
+		name:                  "hashi-batch",
+		regions:               []string{"mel1"},
+		maxCount:              3,
+		reserveIPv4Addresses:  true,
+		reservedAddressesPool: pool,
+	}
+
+	_, err := pool.PrereserveIPs(ctx, 2, "mel1", template.name, true, time.Minute)
+	require.NoError(t, err)
+	_, err = pool.PrereserveIPs(ctx, 1, "ams3", template.name, true, time.Minute)
+	require.NoError(t, err)
+
+	// all the addresses in the region are provisionally reserved
+	meta := make(map[string]string)
+	plugin.addReservedAddressesMeta(ctx, template, 1, meta)
+	assert.Equal(t, map[string]string{
+		"reserved_ipv4_addresses_available": "0",
+		"warning":                           "no reserved IPv4 addresses are available for new droplets in mel1",
+	}, meta)
+
+	// there is no need for more addresses at the maximum count
+	meta = make(map[string]string)
+	plugin.addReservedAddressesMeta(ctx, template, 3, meta)
+	assert.Equal(t, map[string]string{"reserved_ipv4_addresses_available": "0"}, meta)
+
+	require.NoError(t, clock.Advance(2*time.Minute).Wait(ctx))
+	meta = make(map[string]string)
+	plugin.addReservedAddressesMeta(ctx, template, 1, meta)
+	assert.Equal(t, map[string]string{"reserved_ipv4_addresses_available": "2"}, meta)
+
+	// nothing is reported when addresses are created as required
+	template.createReservedAddresses = true
+	meta = make(map[string]string)
+	plugin.addReservedAddressesMeta(ctx, template, 1, meta)
+	assert.Empty(t, meta)
+}
+
+func TestTargetPlugin_SetConfigKeepsReservedAddressesPool(t *testing.T) {
+	plugin := NewDODropletsPlugin(t.Context(), hclog.NewNullLogger(), nil)
+	assert.Nil(t, plugin.SetConfig(map[string]string{"token": "t0ken"}))
+	pool := plugin.reservedAddressesPool
+	assert.NotNil(t, pool)
+
+	assert.Nil(t, plugin.SetConfig(map[string]string{"token": "an0ther"}))
+	assert.Same(t, pool, plugin.reservedAddressesPool)
+	assert.Same(t, plugin.client.ReservedIPs(), pool.reservedIPs)
+}
+
+func TestTargetPlugin_createDropletTemplateWithCountLimits(t *testing.T) {
+	input := map[string]string{
+		"name":        "hashi-batch",
+		"region":      "ny1",
+		"size":        "s-1vcpu-1gb",
+		"vpc_uuid":    "b6ac51f4-dc83-11e8-a3da-3cfdfea9f0d8",
+		"snapshot_id": "123",
+	}
+	plugin := TargetPlugin{}
+
+	// no clamping when unset
+	dropletTemplate, err := plugin.createDropletTemplate(input)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), dropletTemplate.clampCount(0))
+	assert.Equal(t, int64(1000), dropletTemplate.clampCount(1000))
+
+	input["min_count"] = "2"
+	input["max_count"] = "5"
+	dropletTemplate, err = plugin.createDropletTemplate(input)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), dropletTemplate.clampCount(0))
+	assert.Equal(t, int64(3), dropletTemplate.clampCount(3))
+	assert.Equal(t, int64(5), dropletTemplate.clampCount(1000))
+
+	input["min_count"] = "6"
+	_, err = plugin.createDropletTemplate(input)
+	assert.ErrorContains(t, err, "min_count")
+
+	input["min_count"] = "-1"
+	_, err = plugin.createDropletTemplate(input)
+	assert.ErrorContains(t, err, "min_count")
+}
+
+func TestTargetPlugin_ScaleClampsCount(t *testing.T) {
+	mock := createMockGodo()
+	config := map[string]string{
+		"name":         "hashi-batch",
+		"region":       "lon1",
+		"size":         "s1",
+		"snapshot_id":  "12345",
+		"vpc_uuid":     "b6ac51f4-dc83-11e8-a3da-3cfdfea9f0d8",
+		"force_delete": "true",
+		"min_count":    "1",
+		"max_count":    "3",
+	}
+	clusterUtils := &mockClusterUtils{
+		dropletNames: []string{"hashi-batch-1", "hashi-batch-2"},
+	}
+	plugin := &TargetPlugin{
+		ctx:           t.Context(),
+		logger:        hclog.NewNullLogger(),
+		client:        mock,
+		clusterUtils:  clusterUtils,
+		dropletCounts: newDropletCountsCache(quartz.NewMock(t)),
+	}
+	// the IDs are distinct from those of droplets created by the mock
+	for i, name := range clusterUtils.dropletNames {
+		id := 100 + i
+		mock.droplets[id] = &godo.Droplet{
+			ID:     id,
+			Name:   name,
+			Status: "active",
+			Tags:   []string{"hashi-batch"},
+		}
+	}
+
+	// only one droplet is deleted rather than the whole pool
+	assert.Nil(t, plugin.Scale(sdk.ScalingAction{Count: 0}, config))
+	assert.Len(t, mock.droplets, 1)
+
+	// and only two are created rather than 99
+	assert.Nil(t, plugin.Scale(sdk.ScalingAction{Count: 100}, config))
+	assert.Len(t, mock.droplets, 3)
+}
+
+func TestTargetPlugin_ScaleInCleansUpTagsAfterReturning(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	clock := quartz.NewMock(t)
+	config := map[string]string{
+		"name":                           "hashi-batch",
+		"region":                         "lon1",
+		"size":                           "s1",
+		"snapshot_id":                    "12345",
+		"vpc_uuid":                       "b6ac51f4-dc83-11e8-a3da-3cfdfea9f0d8",
+		"force_delete":                   "true",
+		"scale_action_timeout":           "1m",
+		"secure_introduction_tag_prefix": "banana-",
+	}
+	clusterUtils := &mockClusterUtils{
+		dropletNames: []string{"hashi-batch-1", "hashi-batch-2"},
+	}
+	plugin := &TargetPlugin{
+		ctx:                   ctx,
+		logger:                hclog.NewNullLogger(),
+		client:                mock,
+		clusterUtils:          clusterUtils,
+		dropletCounts:         newDropletCountsCache(quartz.NewMock(t)),
+		reservedAddressesPool: mock.NewReservedAddressPool(hclog.NewNullLogger(), clock),
+		tagDeleteRateLimiter:  NewRateLimiter(tagDeleteBurst, tagDeleteRechargePeriod, true, WithMockClock(clock)),
+	}
+	for i, name := range clusterUtils.dropletNames {
+		id := 100 + i
+		mock.droplets[id] = &godo.Droplet{
+			ID:     id,
+			Name:   name,
+			Status: "active",
+			Tags:   []string{"hashi-batch"},
+		}
+	}
+	mock.tags["banana-unused"] = struct{}{}
+
+	trap := clock.Trap().NewTimer()
+	defer trap.Close()
+	require.NoError(t, plugin.Scale(sdk.ScalingAction{Count: 1}, config))
+
+	// the clean up waits for its grace period after the scaling action's
+	// context is done, and still deletes the unused tag
+	trap.MustWait(ctx).MustRelease(ctx)
+	clock.Advance(unusedTagGracePeriod).MustWait(ctx)
+	require.Eventually(t, func() bool {
+		mock.mutex.Lock()
+		defer mock.mutex.Unlock()
+		_, found := mock.tags["banana-unused"]
+		return !found
+	}, time.Second, time.Millisecond)
+}
+
+func TestTargetPlugin_StatusDoesNotCacheCountsFromBeforeScale(t *testing.T) {
+	mock := createMockGodo()
+	config := map[string]string{
+		"name":        "hashi-batch",
+		"region":      "lon1",
+		"size":        "s1",
+		"snapshot_id": "12345",
+		"vpc_uuid":    "b6ac51f4-dc83-11e8-a3da-3cfdfea9f0d8",
+	}
+	plugin := &TargetPlugin{
+		ctx:           t.Context(),
+		logger:        hclog.NewNullLogger(),
+		client:        mock,
+		clusterUtils:  &mockClusterUtils{},
+		dropletCounts: newDropletCountsCache(quartz.NewMock(t)),
+	}
+
+	// the status lists the droplets before the pool is scaled out, but only
+	// returns once it has been
+	mock.listBlock = make(chan struct{})
+	mock.blockingLists.Store(1)
+	type result struct {
+		status *sdk.TargetStatus
+		err    error
+	}
+	results := make(chan result, 1)
+	go func() {
+		status, err := plugin.Status(config)
+		results <- result{status, err}
+	}()
+	require.Eventually(t, func() bool {
+		return mock.blockedLists.Load() == 1
+	}, time.Second, time.Millisecond)
+
+	require.NoError(t, plugin.Scale(sdk.ScalingAction{Count: 2}, config))
+	close(mock.listBlock)
+	stale := <-results
+	require.NoError(t, stale.err)
+	require.Equal(t, int64(0), stale.status.Count)
+
+	// the counts from before the scaling action are not cached
+	status, err := plugin.Status(config)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), status.Count)
+}
+
+func TestTargetPlugin_StatusCountsSettledPoolFromTag(t *testing.T) {
+	mock := createMockGodo()
+	clock := quartz.NewMock(t)
+	config := map[string]string{
+		"name":        "hashi-batch",
+		"region":      "lon1",
+		"size":        "s1",
+		"snapshot_id": "12345",
+		"vpc_uuid":    "b6ac51f4-dc83-11e8-a3da-3cfdfea9f0d8",
+	}
+	plugin := &TargetPlugin{
+		ctx:           t.Context(),
+		logger:        hclog.NewNullLogger(),
+		client:        mock,
+		clusterUtils:  &mockClusterUtils{},
+		dropletCounts: newDropletCountsCache(clock),
+	}
+	for id := range 2 {
+		mock.droplets[id] = &godo.Droplet{ID: id, Status: "active", Tags: []string{"hashi-batch"}}
+	}
+	status, err := plugin.Status(config)
+	require.NoError(t, err)
+	require.True(t, status.Ready)
+
+	// once the cached counts expire, the droplets are not listed again as
+	// long as the tag still counts as many, so a droplet which was powered
+	// off outside of a scaling action goes unnoticed for a while
+	mock.mutex.Lock()
+	mock.droplets[0].Status = "off"
+	mock.mutex.Unlock()
+	clock.Advance(defaultCountCacheTTL)
+	status, err = plugin.Status(config)
+	require.NoError(t, err)
+	require.True(t, status.Ready)
+	require.EqualValues(t, 2, status.Count)
+
+	// until the counts are too old
+	clock.Advance(settledCountsMaxAge)
+	status, err = plugin.Status(config)
+	require.NoError(t, err)
+	require.False(t, status.Ready)
+
+	// the droplets are listed straight away if the tag counts differently
+	mock.mutex.Lock()
+	mock.droplets[0].Status = "active"
+	mock.mutex.Unlock()
+	clock.Advance(defaultCountCacheTTL)
+	status, err = plugin.Status(config)
+	require.NoError(t, err)
+	require.True(t, status.Ready)
+	mock.mutex.Lock()
+	mock.droplets[2] = &godo.Droplet{ID: 2, Status: "new", Tags: []string{"hashi-batch"}}
+	mock.mutex.Unlock()
+	clock.Advance(defaultCountCacheTTL)
+	status, err = plugin.Status(config)
+	require.NoError(t, err)
+	require.False(t, status.Ready)
+	require.EqualValues(t, 3, status.Count)
+}
+
+func TestTargetPlugin_ScaleLogsSummary(t *testing.T) {
+	mock := createMockGodo()
+	config := map[string]string{
+		"name":                      "hashi-batch",
+		"region":                    "lon1",
+		"size":                      "s1",
+		"snapshot_id":               "12345",
+		"vpc_uuid":                  "b6ac51f4-dc83-11e8-a3da-3cfdfea9f0d8",
+		"reserve_ipv4_addresses":    "true",
+		"create_reserved_addresses": "true",
+	}
+	var output bytes.Buffer
+	plugin := &TargetPlugin{
+		ctx: t.Context(),
+		logger: hclog.New(&hclog.LoggerOptions{
+			Output:     &output,
+			Level:      hclog.Info,
+			JSONFormat: true,
+		}),
+		client:                mock,
+		reservedAddressesPool: mock.NewReservedAddressPool(hclog.NewNullLogger(), quartz.NewMock(t)),
+		dropletCounts:         newDropletCountsCache(quartz.NewMock(t)),
+	}
+	summaries := func() []map[string]any {
+		var lines []map[string]any
+		decoder := json.NewDecoder(&output)
+		for decoder.More() {
+			var line map[string]any
+			require.NoError(t, decoder.Decode(&line))
+			if _, ok := line["achieved_count"]; ok {
+				lines = append(lines, line)
+			}
+		}
+		return lines
+	}
+
+	assert.Nil(t, plugin.Scale(sdk.ScalingAction{Count: 2}, config))
+	lines := summaries()
+	require.Len(t, lines, 1)
+	assert.Equal(t, "scaling action completed", lines[0]["@message"])
+	assert.Equal(t, "out", lines[0]["direction"])
+	assert.Equal(t, float64(2), lines[0]["desired"])
+	assert.Equal(t, float64(0), lines[0]["current_count"])
+	assert.Equal(t, float64(2), lines[0]["achieved_count"])
+	assert.Equal(t, []any{"lon1"}, lines[0]["regions"])
+	assert.Equal(t, float64(2), lines[0]["reserved_ips_assigned"])
+	assert.Len(t, lines[0]["reserved_ips"], 2)
+	assert.Len(t, lines[0]["droplet_ids"], 2)
+	// the action is timed with the pool's clock, which has not moved
+	assert.Equal(t, float64(0), lines[0]["duration"])
+	assert.NotContains(t, lines[0], "error")
+
+	// a summary is logged even when nothing needs to change
+	assert.Nil(t, plugin.Scale(sdk.ScalingAction{Count: 2}, config))
+	lines = summaries()
+	require.Len(t, lines, 1)
+	assert.Equal(t, "scaling not required", lines[0]["@message"])
+	assert.Equal(t, "none", lines[0]["direction"])
+	assert.Equal(t, float64(2), lines[0]["achieved_count"])
+	assert.Equal(t, float64(0), lines[0]["created"])
+}
+
+func TestTargetPlugin_SetConfigWithInvalidTagReaperInterval(t *testing.T) {
+	plugin := NewDODropletsPlugin(t.Context(), hclog.NewNullLogger(), nil)
+	assert.ErrorContains(t, plugin.SetConfig(map[string]string{
+		"token":               "t0ken",
+		"tag_reaper_interval": "often",
+	}), "tag_reaper_interval")
+}
+
+func TestTargetPlugin_createDropletTemplateWithVaultAppRoleMount(t *testing.T) {
+	input := map[string]string{
+		"name":        "hashi-batch",
+		"region":      "ny1",
+		"size":        "s-1vcpu-1gb",
+		"vpc_uuid":    "b6ac51f4-dc83-11e8-a3da-3cfdfea9f0d8",
+		"snapshot_id": "123",
+	}
+
+	plugin := TargetPlugin{}
+	dropletTemplate, err := plugin.createDropletTemplate(input)
+	assert.Nil(t, err)
+	assert.Equal(t, "approle", dropletTemplate.vaultAppRoleMount)
+
+	input["vault_approle_mount"] = "approle-droplets"
+	dropletTemplate, err = plugin.createDropletTemplate(input)
+	assert.Nil(t, err)
+	assert.Equal(t, "approle-droplets", dropletTemplate.vaultAppRoleMount)
+	assert.Equal(t, "approle-droplets", newSecretIdOptions(dropletTemplate.secretIdOptions()...).mountPath)
+}
+
+func TestTargetPlugin_createDropletTemplateWithSecretNumUses(t *testing.T) {
+	input := map[string]string{
+		"name":        "hashi-batch",
+		"region":      "ny1",
+		"size":        "s-1vcpu-1gb",
+		"vpc_uuid":    "b6ac51f4-dc83-11e8-a3da-3cfdfea9f0d8",
+		"snapshot_id": "123",
+	}
+
+	plugin := TargetPlugin{}
+	dropletTemplate, err := plugin.createDropletTemplate(input)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, dropletTemplate.secretNumUses)
+
+	input["secure_introduction_secret_num_uses"] = "0"
+	dropletTemplate, err = plugin.createDropletTemplate(input)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, dropletTemplate.secretNumUses)
+
+	input["secure_introduction_secret_num_uses"] = "-1"
+	_, err = plugin.createDropletTemplate(input)
+	assert.Error(t, err)
+}
+
+func TestTargetPlugin_createDropletTemplateWithInvalidTagPrefix(t *testing.T) {
+	input := map[string]string{
+		"name":                                "hashi-batch",
+		"region":                              "ny1",
+		"size":                                "s-1vcpu-1gb",
+		"vpc_uuid":                            "b6ac51f4-dc83-11e8-a3da-3cfdfea9f0d8",
+		"snapshot_id":                         "123",
+		"secure_introduction_approle":         "droplet-approle",
+		"secure_introduction_filename":        "/run/secure-introduction",
+		"secure_introduction_secret_validity": "1h",
+		"secure_introduction_wrapped_secret_validity": "5m",
+		"secure_introduction_tag_prefix":              "secure.introduction-",
+	}
+
+	plugin := TargetPlugin{}
+	_, err := plugin.createDropletTemplate(input)
+	assert.Error(t, err)
+}
+
+func TestTargetPlugin_createDropletTemplateWithNetworkWait(t *testing.T) {
+	input := map[string]string{
+		"name":        "hashi-batch",
+		"region":      "ny1",
+		"size":        "s-1vcpu-1gb",
+		"vpc_uuid":    "b6ac51f4-dc83-11e8-a3da-3cfdfea9f0d8",
+		"snapshot_id": "123",
+		"secure_introduction_network_wait_interval": "10s",
+		"secure_introduction_network_wait_attempts": "30",
+	}
+
+	plugin := TargetPlugin{}
+	dropletTemplate, err := plugin.createDropletTemplate(input)
+	assert.Nil(t, err)
+	assert.Equal(t, 10*time.Second, dropletTemplate.networkWaitInterval)
+	assert.Equal(t, 30, dropletTemplate.networkWaitAttempts)
+
+	input["secure_introduction_network_wait_attempts"] = "0"
+	_, err = plugin.createDropletTemplate(input)
+	assert.Error(t, err)
+}
+
+func TestTargetPlugin_ScaleActionTimeout(t *testing.T) {
+	mock := createMockGodo()
+	// droplets take longer to create than the whole action may take
+	mock.createDelay = 200 * time.Millisecond
+	config := map[string]string{
+		"name":                      "hashi-batch",
+		"region":                    "lon1",
+		"size":                      "s1",
+		"snapshot_id":               "12345",
+		"vpc_uuid":                  "b6ac51f4-dc83-11e8-a3da-3cfdfea9f0d8",
+		"reserve_ipv4_addresses":    "true",
+		"create_reserved_addresses": "true",
+		"scale_action_timeout":      "50ms",
+	}
+	pool := mock.NewReservedAddressPool(hclog.NewNullLogger(), quartz.NewMock(t))
+	plugin := &TargetPlugin{
+		ctx:                   t.Context(),
+		logger:                hclog.NewNullLogger(),
+		client:                mock,
+		reservedAddressesPool: pool,
+		dropletCounts:         newDropletCountsCache(quartz.NewMock(t)),
+	}
+
+	start := time.Now()
+	err := plugin.Scale(sdk.ScalingAction{Count: 2}, config)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.ErrorContains(t, err, "scaling action did not complete within its scale_action_timeout of 50ms")
+	// the action only waited for the requests already in flight
+	require.Less(t, time.Since(start), 2*time.Second)
+	// and the addresses reserved for the droplets were released
+	require.Empty(t, pool.prereservedIPs)
+
+	config["scale_action_timeout"] = "-1s"
+	_, err = plugin.createDropletTemplate(config)
+	require.ErrorContains(t, err, "scale_action_timeout")
+}
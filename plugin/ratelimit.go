@@ -90,3 +90,16 @@ func (r *rateLimiter) Consume(ctx context.Context) {
 		return // ctx.Err()
 	}
 }
+
+// Observe updates the rate limiter from the budget reported by the API,
+// e.g. in its RateLimit-Remaining and RateLimit-Reset headers. The reported
+// budget can only lower the number of available tokens; once it is
+// exhausted, no tokens are recharged until it resets.
+func (r *rateLimiter) Observe(remaining uint32, reset time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.current = min(r.current, remaining)
+	if remaining == 0 && reset.After(r.nextCheck) {
+		r.nextCheck = reset
+	}
+}
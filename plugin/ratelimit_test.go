@@ -63,3 +63,32 @@ func TestRateLimiter(t *testing.T) {
 	// .. which should be 2 seconds later
 	assert.Equal(t, clock.Now(), initialTime.Add(2*time.Second))
 }
+
+func TestRateLimiterObserve(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), 2*time.Second)
+	defer cancel()
+	clock := quartz.NewMock(t)
+	initialTime := clock.Now()
+
+	// burst of 2, 5 second recharge, starting full
+	rl := plugin.NewRateLimiter(2, 5*time.Second, true, plugin.WithMockClock(clock))
+
+	// the API reports only one more request is possible
+	rl.Observe(1, initialTime.Add(time.Minute))
+	rl.Consume(ctx)
+	assert.Equal(t, clock.Now(), initialTime)
+
+	// the API reports the budget is exhausted until 30 seconds from now
+	rl.Observe(0, initialTime.Add(30*time.Second))
+
+	trap := clock.Trap().NewTimer()
+	defer trap.Close()
+	go rl.Consume(ctx)
+	call := trap.MustWait(ctx)
+	call.MustRelease(ctx)
+
+	// the next token is only available once the budget has reset
+	_, w := clock.AdvanceNext()
+	w.MustWait(ctx)
+	assert.Equal(t, clock.Now(), initialTime.Add(30*time.Second))
+}
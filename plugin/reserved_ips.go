@@ -2,18 +2,36 @@ package plugin
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/coder/quartz"
 	"github.com/digitalocean/godo"
 	"github.com/hashicorp/go-hclog"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// defaultPrereservationExpiry is how long addresses are provisionally reserved
+// for a new droplet.
+const defaultPrereservationExpiry = 5 * time.Minute
+
+// pendingExpiryTime is the expiry time of the provisional reservations which
+// are still being made, such as those of a batch whose other addresses are
+// being created. It is never reached, so that the addresses cannot be taken
+// by another caller before their expiry time is set.
+var pendingExpiryTime = time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)
+
 type PrereservedIP struct {
 	expiryTime time.Time
 	reservedIP *godo.ReservedIP
+	// assigning is set while the address is being assigned to a droplet
+	assigning bool
 }
 
 func (p *PrereservedIP) String() string {
@@ -23,10 +41,29 @@ func (p *PrereservedIP) String() string {
 type PrereservedIPV6 struct {
 	expiryTime time.Time
 	reservedIP *godo.ReservedIPV6
+	// assigning is set while the address is being assigned to a droplet
+	assigning bool
+}
+
+// AddressOwner records which droplet pool a reserved address was created
+// for, as DigitalOcean cannot tag reserved addresses.
+type AddressOwner struct {
+	Pool    string
+	Created time.Time
 }
 
 type ReservedAddressesPool struct {
-	mutex               *sync.RWMutex
+	// mutex guards the provisional reservations and the owners. It is not
+	// held during requests to the API, so that slow requests do not hold up
+	// other callers.
+	mutex *sync.RWMutex
+	// clientMutex guards the clients, which are replaced when the
+	// configuration is reloaded.
+	clientMutex sync.RWMutex
+	// reclaimMutex ensures only one reclaim of orphaned addresses runs at a
+	// time.
+	reclaimMutex sync.Mutex
+
 	clock               quartz.Clock
 	reservedIPs         ReservedIPs
 	reservedIPActions   ReservedIPActions
@@ -39,8 +76,24 @@ type ReservedAddressesPool struct {
 
 	prereservedIPs   map[string]PrereservedIP
 	prereservedIPV6s map[string]PrereservedIPV6
+
+	// owners holds the owners of the addresses created by the pool
+	owners map[string]AddressOwner
+
+	// listings counts the lists of reserved addresses which were started
+	// in order to hand out addresses, and openListings holds those which
+	// are still to be acted on. recentlyAssigned holds the addresses which
+	// were assigned while any were open, along with the last listing
+	// started by then, as those lists may still show the addresses as
+	// unassigned once their provisional reservations are gone.
+	listings         listing
+	openListings     map[listing]struct{}
+	recentlyAssigned map[string]listing
 }
 
+// listing identifies a list of reserved addresses by when it was started.
+type listing uint64
+
 // type Client interface{}
 
 type reservedAddressesPoolOption func(*ReservedAddressesPool)
@@ -95,6 +148,9 @@ func CreateReservedAddressesPool(
 
 		prereservedIPs:   make(map[string]PrereservedIP),
 		prereservedIPV6s: make(map[string]PrereservedIPV6),
+		owners:           make(map[string]AddressOwner),
+		openListings:     make(map[listing]struct{}),
+		recentlyAssigned: make(map[string]listing),
 	}
 	for _, option := range options {
 		option(result)
@@ -103,6 +159,14 @@ func CreateReservedAddressesPool(
 	return result
 }
 
+// setClient replaces the client used by the pool, keeping all provisional
+// reservations.
+func (r *ReservedAddressesPool) setClient(wrapper DigitalOceanWrapper) {
+	r.clientMutex.Lock()
+	defer r.clientMutex.Unlock()
+	WithDigitalOceanWrapper(wrapper)(r)
+}
+
 func (r *ReservedAddressesPool) getReservedIPs(
 	ctx context.Context,
 ) (map[string]*godo.ReservedIP, error) {
@@ -111,8 +175,8 @@ func (r *ReservedAddressesPool) getReservedIPs(
 		return nil, fmt.Errorf("cannot enumerate reserved IPs: %w", err)
 	}
 	reservations := make(map[string]*godo.ReservedIP)
-	for _, ip := range ips {
-		reservations[ip.IP] = &ip
+	for i := range ips {
+		reservations[ips[i].IP] = &ips[i]
 	}
 	return reservations, nil
 }
@@ -125,12 +189,94 @@ func (r *ReservedAddressesPool) getReservedIPV6s(
 		return nil, fmt.Errorf("cannot enumerate reserved IPV6s: %w", err)
 	}
 	reservationsV6 := make(map[string]*godo.ReservedIPV6)
-	for _, ip := range ipV6s {
-		reservationsV6[ip.IP] = &ip
+	for i := range ipV6s {
+		reservationsV6[ipV6s[i].IP] = &ipV6s[i]
 	}
 	return reservationsV6, nil
 }
 
+// listReservedIPs lists the reserved IPv4 addresses in order to hand some
+// out. The caller must call finishListing with the returned listing once it
+// holds the mutex, and skip the addresses it returns.
+func (r *ReservedAddressesPool) listReservedIPs(
+	ctx context.Context,
+) (map[string]*godo.ReservedIP, listing, error) {
+	l := r.startListing()
+	reservedV4s, err := r.getReservedIPs(ctx)
+	if err != nil {
+		r.mutex.Lock()
+		_ = r.finishListing(l)
+		r.mutex.Unlock()
+		return nil, 0, err
+	}
+	return reservedV4s, l, nil
+}
+
+// listReservedIPV6s is the same as listReservedIPs for IPv6 addresses.
+func (r *ReservedAddressesPool) listReservedIPV6s(
+	ctx context.Context,
+) (map[string]*godo.ReservedIPV6, listing, error) {
+	l := r.startListing()
+	reservedV6s, err := r.getReservedIPV6s(ctx)
+	if err != nil {
+		r.mutex.Lock()
+		_ = r.finishListing(l)
+		r.mutex.Unlock()
+		return nil, 0, err
+	}
+	return reservedV6s, l, nil
+}
+
+func (r *ReservedAddressesPool) startListing() listing {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.listings++
+	r.openListings[r.listings] = struct{}{}
+	return r.listings
+}
+
+// finishListing records that the list is being acted on, and returns the
+// addresses which were assigned after it was started, as it may not show
+// them as assigned. The assignments which no open list was started before
+// are forgotten. The caller must hold the mutex.
+func (r *ReservedAddressesPool) finishListing(l listing) map[string]bool {
+	assignedSince := make(map[string]bool)
+	for ip, assigned := range r.recentlyAssigned {
+		if l <= assigned {
+			assignedSince[ip] = true
+		}
+	}
+	delete(r.openListings, l)
+	oldest := r.listings + 1
+	for open := range r.openListings {
+		oldest = min(oldest, open)
+	}
+	maps.DeleteFunc(r.recentlyAssigned, func(_ string, assigned listing) bool {
+		return assigned < oldest
+	})
+	return assignedSince
+}
+
+// rememberAssigned records that the address has been assigned, if there are
+// open lists which may not show it. The caller must hold the mutex.
+func (r *ReservedAddressesPool) rememberAssigned(ip string) {
+	if len(r.openListings) != 0 {
+		r.recentlyAssigned[ip] = r.listings
+	}
+}
+
+// removeExpiredPrereservations forgets all provisional reservations which
+// have expired. The caller must hold the mutex.
+func (r *ReservedAddressesPool) removeExpiredPrereservations() {
+	now := r.clock.Now()
+	maps.DeleteFunc(r.prereservedIPs, func(_ string, p PrereservedIP) bool {
+		return now.After(p.expiryTime)
+	})
+	maps.DeleteFunc(r.prereservedIPV6s, func(_ string, p PrereservedIPV6) bool {
+		return now.After(p.expiryTime)
+	})
+}
+
 // PrereserveIPs will find and return the specified number
 // of reserved IP addresses. They will be provisionally reserved,
 // meaning subsequent calls to this function will not return the
@@ -139,76 +285,509 @@ func (r *ReservedAddressesPool) PrereserveIPs(
 	ctx context.Context,
 	count int,
 	region string,
+	owner string,
 	createIfRequired bool,
 	expiry time.Duration,
-) ([]string, error) {
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
+) (_ []string, err error) {
+	ctx, span := startSpan(ctx, "prereserve_ips",
+		attribute.String(logKeyRegion, region),
+		attribute.String(logKeyTag, owner),
+		attribute.Int("count", count))
+	defer func() { endSpan(span, err) }()
 
-	addresses := make(map[string]*godo.ReservedIP)
+	r.clientMutex.RLock()
+	defer r.clientMutex.RUnlock()
 
 	// work out which droplets currently have IPv4 reservations, and
-	// which unassigned reserved addresses we have
-	reservedV4s, err := r.getReservedIPs(ctx)
+	// which unassigned reserved addresses we have in the region, as
+	// addresses cannot be assigned to droplets in other regions
+	reservedV4s, l, err := r.listReservedIPs(ctx)
 	if err != nil {
 		return nil, err
 	}
-	for _, reserved := range reservedV4s {
-		if droplet := reserved.Droplet; droplet == nil {
-			if prereservation, found := r.prereservedIPs[reserved.IP]; !found ||
-				r.clock.Now().After(prereservation.expiryTime) {
-				addresses[reserved.IP] = reserved
-				if len(addresses) == count {
-					break
-				}
-			}
+	// the addresses are claimed as soon as they are found or created, so
+	// that no other caller can take them while the rest are being created
+	result := make([]string, 0, count)
+	r.mutex.Lock()
+	assignedSince := r.finishListing(l)
+	r.removeExpiredPrereservations()
+	for ip, reserved := range reservedV4s {
+		if len(result) == count {
+			break
+		}
+		if reserved.Region == nil || reserved.Region.Slug != region || reserved.Droplet != nil || assignedSince[ip] {
+			continue
+		}
+		if _, found := r.prereservedIPs[ip]; !found {
+			r.prereservedIPs[ip] = PrereservedIP{expiryTime: pendingExpiryTime, reservedIP: reserved}
+			result = append(result, ip)
 		}
 	}
-	for len(addresses) != count {
-		if createIfRequired {
-			r.rateLimiter.Consume(ctx)
-			if reservedV4, _, err := r.reservedIPs.Create(ctx, &godo.ReservedIPCreateRequest{Region: region}); err != nil {
-				return nil, fmt.Errorf(
-					"cannot create a new IPv4 address for region %v: %w",
-					region,
-					err,
-				)
-			} else {
-				r.logger.Info("created (new) reserved IP addresses", "IPv4 address", reservedV4.IP)
-				addresses[reservedV4.IP] = reservedV4
-			}
-		} else {
+	r.mutex.Unlock()
+	for len(result) != count {
+		if !createIfRequired {
+			r.ReleasePrereservations(result...)
 			return nil, fmt.Errorf("insufficient reserved IPv4 addresses")
 		}
+		r.rateLimiter.Consume(ctx)
+		reservedV4, resp, err := r.reservedIPs.Create(ctx, &godo.ReservedIPCreateRequest{Region: region})
+		r.observeRateLimit(resp)
+		if err != nil {
+			r.ReleasePrereservations(result...)
+			return nil, fmt.Errorf(
+				"cannot create a new IPv4 address for region %v: %w",
+				region,
+				err,
+			)
+		}
+		r.logger.Info("created (new) reserved IP addresses", logKeyIPAddress, reservedV4.IP, "owner", owner)
+		r.mutex.Lock()
+		r.owners[reservedV4.IP] = AddressOwner{Pool: owner, Created: r.clock.Now()}
+		// another caller may have found the new address and claimed it first
+		if _, found := r.prereservedIPs[reservedV4.IP]; !found {
+			r.prereservedIPs[reservedV4.IP] = PrereservedIP{expiryTime: pendingExpiryTime, reservedIP: reservedV4}
+			result = append(result, reservedV4.IP)
+		}
+		r.mutex.Unlock()
 	}
 
-	result := make([]string, 0, count)
-	for ip, reservation := range addresses {
-		result = append(result, ip)
+	// the reservations expire from when all the addresses are available
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	expiryTime := r.clock.Now().Add(expiry)
+	for _, ip := range result {
+		prereservation := r.prereservedIPs[ip]
+		prereservation.expiryTime = expiryTime
+		r.prereservedIPs[ip] = prereservation
+	}
+	return result, nil
+}
+
+// observeRateLimit updates the rate limiter from the rate-limit headers of
+// the response, if there are any.
+func (r *ReservedAddressesPool) observeRateLimit(resp *godo.Response) {
+	if resp == nil || resp.Rate.Reset.IsZero() {
+		return
+	}
+	r.rateLimiter.Observe(uint32(max(resp.Rate.Remaining, 0)), resp.Rate.Reset.Time)
+}
+
+// ReserveSpecificIP provisionally reserves the given reserved IPv4 or IPv6
+// address in the region, so that it may be assigned to a new droplet. An
+// error is returned if the address is already assigned to a droplet or is
+// provisionally reserved.
+func (r *ReservedAddressesPool) ReserveSpecificIP(
+	ctx context.Context,
+	ip string,
+	region string,
+) error {
+	return r.reserveSpecificIP(ctx, ip, region, defaultPrereservationExpiry)
+}
+
+// ReservePinnedIPs provisionally reserves up to count of the given reserved
+// IPv4 or IPv6 addresses in the region for the expiry, in order, so that they
+// are assigned to the first of the new droplets. The addresses which cannot
+// be reserved, such as those still assigned to a droplet or in another
+// region, are skipped. The reserved addresses are returned.
+func (r *ReservedAddressesPool) ReservePinnedIPs(
+	ctx context.Context,
+	ips []string,
+	count int,
+	region string,
+	expiry time.Duration,
+) []string {
+	var reserved []string
+	for _, ip := range ips {
+		if len(reserved) == count {
+			break
+		}
+		if err := r.reserveSpecificIP(ctx, ip, region, expiry); err != nil {
+			r.logger.Debug("pinned reserved IP address is not available",
+				logKeyIPAddress, ip,
+				logKeyRegion, region,
+				"reason", err)
+			continue
+		}
+		reserved = append(reserved, ip)
+	}
+	return reserved
+}
+
+func (r *ReservedAddressesPool) reserveSpecificIP(
+	ctx context.Context,
+	ip string,
+	region string,
+	expiry time.Duration,
+) error {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return fmt.Errorf("invalid IP address %q", ip)
+	}
+
+	r.clientMutex.RLock()
+	defer r.clientMutex.RUnlock()
+
+	if parsed.To4() != nil {
+		reservedV4s, l, err := r.listReservedIPs(ctx)
+		if err != nil {
+			return err
+		}
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		assignedSince := r.finishListing(l)
+		r.removeExpiredPrereservations()
+		reserved, found := reservedV4s[ip]
+		switch {
+		case !found || reserved.Region == nil || reserved.Region.Slug != region:
+			return fmt.Errorf("%v is not a reserved IPv4 address in region %v", ip, region)
+		case reserved.Droplet != nil:
+			return fmt.Errorf("reserved IPv4 address %v is already assigned to droplet %v", ip, reserved.Droplet.ID)
+		case assignedSince[ip]:
+			return fmt.Errorf("reserved IPv4 address %v has just been assigned", ip)
+		}
+		if _, found := r.prereservedIPs[ip]; found {
+			return fmt.Errorf("reserved IPv4 address %v is already provisionally reserved", ip)
+		}
 		r.prereservedIPs[ip] = PrereservedIP{
 			expiryTime: r.clock.Now().Add(expiry),
-			reservedIP: reservation,
+			reservedIP: reserved,
 		}
+		return nil
 	}
 
-	return result, nil
+	reservedV6s, l, err := r.listReservedIPV6s(ctx)
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	assignedSince := r.finishListing(l)
+	r.removeExpiredPrereservations()
+	reserved, found := reservedV6s[ip]
+	switch {
+	case !found || reserved.RegionSlug != region:
+		return fmt.Errorf("%v is not a reserved IPv6 address in region %v", ip, region)
+	case reserved.Droplet != nil:
+		return fmt.Errorf("reserved IPv6 address %v is already assigned to droplet %v", ip, reserved.Droplet.ID)
+	case assignedSince[ip]:
+		return fmt.Errorf("reserved IPv6 address %v has just been assigned", ip)
+	}
+	if _, found := r.prereservedIPV6s[ip]; found {
+		return fmt.Errorf("reserved IPv6 address %v is already provisionally reserved", ip)
+	}
+	r.prereservedIPV6s[ip] = PrereservedIPV6{
+		expiryTime: r.clock.Now().Add(expiry),
+		reservedIP: reserved,
+	}
+	return nil
+}
+
+// parsePinnedAddresses splits the comma-separated pinned reserved addresses
+// into the IPv4 and IPv6 ones, which are only allowed if addresses of their
+// kind are being reserved.
+func parsePinnedAddresses(s string, reserveIPv4, reserveIPv6 bool) (ipv4s, ipv6s []string, err error) {
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		ip := net.ParseIP(field)
+		switch {
+		case ip == nil:
+			return nil, nil, fmt.Errorf("%q is not an IP address", field)
+		case ip.To4() != nil && !reserveIPv4:
+			return nil, nil, fmt.Errorf("%v is an IPv4 address, but %s is not set", field, configKeyReserveIPv4Addresses)
+		case ip.To4() == nil && !reserveIPv6:
+			return nil, nil, fmt.Errorf("%v is an IPv6 address, but %s is not set", field, configKeyReserveIPv6Addresses)
+		case ip.To4() != nil:
+			if !slices.Contains(ipv4s, field) {
+				ipv4s = append(ipv4s, field)
+			}
+		default:
+			if !slices.Contains(ipv6s, field) {
+				ipv6s = append(ipv6s, field)
+			}
+		}
+	}
+	return ipv4s, ipv6s, nil
+}
+
+// AvailableIPs returns the number of reserved IPv4 addresses in the given
+// regions which are neither assigned to a droplet nor provisionally reserved.
+func (r *ReservedAddressesPool) AvailableIPs(ctx context.Context, regions []string) (int, error) {
+	r.clientMutex.RLock()
+	defer r.clientMutex.RUnlock()
+	reservedV4s, l, err := r.listReservedIPs(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	assignedSince := r.finishListing(l)
+	r.removeExpiredPrereservations()
+	available := 0
+	for ip, reserved := range reservedV4s {
+		if _, found := r.prereservedIPs[ip]; found || reserved.Droplet != nil || assignedSince[ip] {
+			continue
+		}
+		if reserved.Region != nil && slices.Contains(regions, reserved.Region.Slug) {
+			available++
+		}
+	}
+	return available, nil
+}
+
+// AvailableIPV6s returns the number of reserved IPv6 addresses in the given
+// regions which are neither assigned to a droplet nor provisionally reserved.
+func (r *ReservedAddressesPool) AvailableIPV6s(ctx context.Context, regions []string) (int, error) {
+	r.clientMutex.RLock()
+	defer r.clientMutex.RUnlock()
+	reservedV6s, l, err := r.listReservedIPV6s(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	assignedSince := r.finishListing(l)
+	r.removeExpiredPrereservations()
+	available := 0
+	for ip, reserved := range reservedV6s {
+		if _, found := r.prereservedIPV6s[ip]; found || reserved.Droplet != nil || assignedSince[ip] {
+			continue
+		}
+		if slices.Contains(regions, reserved.RegionSlug) {
+			available++
+		}
+	}
+	return available, nil
+}
+
+// ReleasePrereservations forgets the provisional reservations of the given
+// addresses, so that they can be assigned to other droplets straight away
+// rather than once the reservations expire.
+func (r *ReservedAddressesPool) ReleasePrereservations(ips ...string) {
+	if len(ips) == 0 {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, ip := range ips {
+		delete(r.prereservedIPs, ip)
+		delete(r.prereservedIPV6s, ip)
+	}
+}
+
+// DeleteReservation deletes the given reserved IPv4 or IPv6 address, so that
+// it is no longer billed. An error is returned if the address is assigned to
+// a droplet or is provisionally reserved.
+func (r *ReservedAddressesPool) DeleteReservation(ctx context.Context, ip string) error {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return fmt.Errorf("invalid IP address %q", ip)
+	}
+
+	r.clientMutex.RLock()
+	defer r.clientMutex.RUnlock()
+
+	// the address is claimed while it is being deleted, so that no other
+	// caller takes it in the meantime
+	var deleteIP func(context.Context, string) (*godo.Response, error)
+	if parsed.To4() != nil {
+		reservedV4s, l, err := r.listReservedIPs(ctx)
+		if err != nil {
+			return err
+		}
+		r.mutex.Lock()
+		assignedSince := r.finishListing(l)
+		reserved, found := reservedV4s[ip]
+		switch {
+		case !found:
+			r.mutex.Unlock()
+			return fmt.Errorf("%v is not a reserved IPv4 address", ip)
+		case reserved.Droplet != nil:
+			r.mutex.Unlock()
+			return fmt.Errorf("reserved IPv4 address %v is assigned to droplet %v", ip, reserved.Droplet.ID)
+		case assignedSince[ip]:
+			r.mutex.Unlock()
+			return fmt.Errorf("reserved IPv4 address %v has just been assigned", ip)
+		}
+		r.removeExpiredPrereservations()
+		if _, found := r.prereservedIPs[ip]; found {
+			r.mutex.Unlock()
+			return fmt.Errorf("reserved IPv4 address %v is provisionally reserved", ip)
+		}
+		r.prereservedIPs[ip] = PrereservedIP{expiryTime: pendingExpiryTime, reservedIP: reserved}
+		r.mutex.Unlock()
+		deleteIP = r.reservedIPs.Delete
+	} else {
+		reservedV6s, l, err := r.listReservedIPV6s(ctx)
+		if err != nil {
+			return err
+		}
+		r.mutex.Lock()
+		assignedSince := r.finishListing(l)
+		reserved, found := reservedV6s[ip]
+		switch {
+		case !found:
+			r.mutex.Unlock()
+			return fmt.Errorf("%v is not a reserved IPv6 address", ip)
+		case reserved.Droplet != nil:
+			r.mutex.Unlock()
+			return fmt.Errorf("reserved IPv6 address %v is assigned to droplet %v", ip, reserved.Droplet.ID)
+		case assignedSince[ip]:
+			r.mutex.Unlock()
+			return fmt.Errorf("reserved IPv6 address %v has just been assigned", ip)
+		}
+		r.removeExpiredPrereservations()
+		if _, found := r.prereservedIPV6s[ip]; found {
+			r.mutex.Unlock()
+			return fmt.Errorf("reserved IPv6 address %v is provisionally reserved", ip)
+		}
+		r.prereservedIPV6s[ip] = PrereservedIPV6{expiryTime: pendingExpiryTime, reservedIP: reserved}
+		r.mutex.Unlock()
+		deleteIP = r.reservedIPV6s.Delete
+	}
+	defer r.ReleasePrereservations(ip)
+
+	// the address is only known to belong to a pool if it was created by it
+	r.mutex.RLock()
+	owner := r.owners[ip].Pool
+	r.mutex.RUnlock()
+	if err := RetryOnTransientError(ctx, r.logger, owner,
+		func(ctx context.Context, cancel context.CancelCauseFunc) error {
+			_, err := deleteIP(ctx, ip)
+			return err
+		}); err != nil {
+		return fmt.Errorf("cannot delete reserved IP address %v: %w", ip, err)
+	}
+	r.mutex.Lock()
+	delete(r.owners, ip)
+	r.mutex.Unlock()
+	r.logger.Info("deleted reserved IP address", logKeyIPAddress, ip)
+	return nil
+}
+
+// ReclaimOrphanedAddresses unassigns the reserved IPv4 and IPv6 addresses
+// which are still assigned to droplets with the given tag that no longer
+// exist, such as droplets deleted out-of-band, so that they can be assigned
+// to new droplets. The droplets which still exist are found with a single
+// listing of the tag's droplets, which is only made once the addresses are
+// listed, so that droplets created in the meantime are not mistaken for
+// deleted ones. It returns the addresses which were reclaimed.
+func (r *ReservedAddressesPool) ReclaimOrphanedAddresses(
+	ctx context.Context,
+	tag string,
+	listDroplets func(context.Context) ([]godo.Droplet, error),
+) ([]string, error) {
+	r.clientMutex.RLock()
+	defer r.clientMutex.RUnlock()
+	r.reclaimMutex.Lock()
+	defer r.reclaimMutex.Unlock()
+
+	reservedV4s, err := r.getReservedIPs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reservedV6s, err := r.getReservedIPV6s(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// the listed addresses embed their droplet as it was when they were
+	// assigned, so only those of the tag's droplets are candidates
+	type candidate struct {
+		dropletID int
+		unassign  func(context.Context, string) (*godo.Action, *godo.Response, error)
+	}
+	candidates := make(map[string]candidate)
+	for ip, reserved := range reservedV4s {
+		if reserved.Droplet != nil && slices.Contains(reserved.Droplet.Tags, tag) {
+			candidates[ip] = candidate{reserved.Droplet.ID, r.reservedIPActions.Unassign}
+		}
+	}
+	for ip, reserved := range reservedV6s {
+		if reserved.Droplet != nil && slices.Contains(reserved.Droplet.Tags, tag) {
+			candidates[ip] = candidate{reserved.Droplet.ID, r.reservedIPV6Actions.Unassign}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	droplets, err := listDroplets(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list droplets tagged %v: %w", tag, err)
+	}
+	exists := make(map[int]bool, len(droplets))
+	for _, droplet := range droplets {
+		exists[droplet.ID] = true
+	}
+
+	var reclaimed []string
+	var errs []error
+	for ip, orphan := range candidates {
+		if exists[orphan.dropletID] {
+			continue
+		}
+		if err := RetryOnTransientError(ctx, r.logger, tag,
+			func(ctx context.Context, cancel context.CancelCauseFunc) error {
+				_, _, err := orphan.unassign(ctx, ip)
+				return err
+			}); err != nil {
+			errs = append(errs, fmt.Errorf("cannot unassign reserved IP address %v: %w", ip, err))
+			continue
+		}
+		r.logger.Warn("reclaimed reserved IP address assigned to a deleted droplet",
+			logKeyIPAddress, ip, logKeyDropletID, orphan.dropletID)
+		reclaimed = append(reclaimed, ip)
+	}
+	return reclaimed, errors.Join(errs...)
 }
 
+// Owners returns the owners of the reserved addresses which were created by
+// the pool and not deleted since, by address. Addresses created before the
+// plugin started are not included.
+func (r *ReservedAddressesPool) Owners() map[string]AddressOwner {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return maps.Clone(r.owners)
+}
+
+// AssignIPv4 assigns the prereserved IPv4 address to the droplet of the
+// pool with the given owner name.
 func (r *ReservedAddressesPool) AssignIPv4(
 	ctx context.Context,
 	dropletID int,
 	ipv4 string,
+	owner string,
 ) error {
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
+	r.clientMutex.RLock()
+	defer r.clientMutex.RUnlock()
 
+	// the provisional reservation is used up by the attempt to assign the
+	// address, whether or not it succeeds. It is kept until the attempt
+	// is over, as the address is listed as unassigned until then and
+	// would otherwise be handed out again
+	r.mutex.Lock()
 	prereservation, found := r.prereservedIPs[ipv4]
-	if !found || r.clock.Now().After(prereservation.expiryTime) {
+	if !found || prereservation.assigning || r.clock.Now().After(prereservation.expiryTime) {
+		r.mutex.Unlock()
 		return fmt.Errorf("trying to assign a IPv4 address which was not prereserved")
 	}
-	defer delete(r.prereservedIPs, ipv4)
-
-	if err := RetryOnTransientError(ctx, r.logger,
+	prereservation.assigning = true
+	prereservation.expiryTime = pendingExpiryTime
+	r.prereservedIPs[ipv4] = prereservation
+	r.mutex.Unlock()
+	defer func() {
+		r.mutex.Lock()
+		delete(r.prereservedIPs, ipv4)
+		r.rememberAssigned(ipv4)
+		r.mutex.Unlock()
+	}()
+
+	if err := RetryOnTransientError(ctx, r.logger, owner,
 		func(ctx context.Context, cancel context.CancelCauseFunc) error {
 			_, _, err := r.reservedIPActions.Assign(ctx, ipv4, dropletID)
 			return err
@@ -219,7 +798,7 @@ func (r *ReservedAddressesPool) AssignIPv4(
 			dropletID,
 			err)
 	}
-	r.logger.Debug("assigned reserved IPv4 address", "IPv4 address", ipv4)
+	r.logger.Debug("assigned reserved IPv4 address", logKeyIPAddress, ipv4, logKeyDropletID, dropletID)
 
 	return nil
 }
@@ -232,76 +811,116 @@ func (r *ReservedAddressesPool) PrereserveIPV6s(
 	ctx context.Context,
 	count int,
 	region string,
+	owner string,
 	createIfRequired bool,
 	expiry time.Duration,
-) ([]string, error) {
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
-
-	addresses := make(map[string]*godo.ReservedIPV6)
-
-	// work out which droplets currently have IPv4 reservations, and
-	// which unassigned reserved addresses we have
-	reservedV6s, err := r.getReservedIPV6s(ctx)
+) (_ []string, err error) {
+	ctx, span := startSpan(ctx, "prereserve_ipv6s",
+		attribute.String(logKeyRegion, region),
+		attribute.String(logKeyTag, owner),
+		attribute.Int("count", count))
+	defer func() { endSpan(span, err) }()
+
+	r.clientMutex.RLock()
+	defer r.clientMutex.RUnlock()
+
+	// work out which droplets currently have IPv6 reservations, and
+	// which unassigned reserved addresses we have in the region
+	reservedV6s, l, err := r.listReservedIPV6s(ctx)
 	if err != nil {
 		return nil, err
 	}
-	for _, reserved := range reservedV6s {
-		if droplet := reserved.Droplet; droplet == nil {
-			if prereservation, found := r.prereservedIPV6s[reserved.IP]; !found ||
-				r.clock.Now().After(prereservation.expiryTime) {
-				addresses[reserved.IP] = reserved
-				if len(addresses) == count {
-					break
-				}
-			}
+	// the addresses are claimed as soon as they are found or created, so
+	// that no other caller can take them while the rest are being created
+	result := make([]string, 0, count)
+	r.mutex.Lock()
+	assignedSince := r.finishListing(l)
+	r.removeExpiredPrereservations()
+	for ip, reserved := range reservedV6s {
+		if len(result) == count {
+			break
 		}
-	}
-	for len(addresses) != count {
-		if createIfRequired {
-			r.rateLimiter.Consume(ctx)
-			if reservedV6, _, err := r.reservedIPV6s.Create(ctx, &godo.ReservedIPV6CreateRequest{Region: region}); err != nil {
-				return nil, fmt.Errorf(
-					"cannot create a new IPv6 address for region %v: %w",
-					region,
-					err,
-				)
-			} else {
-				r.logger.Info("created (new) reserved IP addresses", "IPv6 address", reservedV6.IP)
-				addresses[reservedV6.IP] = reservedV6
-			}
-		} else {
-			return nil, fmt.Errorf("insufficient reserved IPv4 addresses")
+		if reserved.RegionSlug != region || reserved.Droplet != nil || assignedSince[ip] {
+			continue
+		}
+		if _, found := r.prereservedIPV6s[ip]; !found {
+			r.prereservedIPV6s[ip] = PrereservedIPV6{expiryTime: pendingExpiryTime, reservedIP: reserved}
+			result = append(result, ip)
 		}
 	}
-
-	result := make([]string, 0, count)
-	for ip, reservation := range addresses {
-		result = append(result, ip)
-		r.prereservedIPV6s[ip] = PrereservedIPV6{
-			expiryTime: r.clock.Now().Add(expiry),
-			reservedIP: reservation,
+	r.mutex.Unlock()
+	for len(result) != count {
+		if !createIfRequired {
+			r.ReleasePrereservations(result...)
+			return nil, fmt.Errorf("insufficient reserved IPv6 addresses")
 		}
+		r.rateLimiter.Consume(ctx)
+		reservedV6, resp, err := r.reservedIPV6s.Create(ctx, &godo.ReservedIPV6CreateRequest{Region: region})
+		r.observeRateLimit(resp)
+		if err != nil {
+			r.ReleasePrereservations(result...)
+			return nil, fmt.Errorf(
+				"cannot create a new IPv6 address for region %v: %w",
+				region,
+				err,
+			)
+		}
+		r.logger.Info("created (new) reserved IP addresses", logKeyIPAddress, reservedV6.IP, "owner", owner)
+		r.mutex.Lock()
+		r.owners[reservedV6.IP] = AddressOwner{Pool: owner, Created: r.clock.Now()}
+		// another caller may have found the new address and claimed it first
+		if _, found := r.prereservedIPV6s[reservedV6.IP]; !found {
+			r.prereservedIPV6s[reservedV6.IP] = PrereservedIPV6{expiryTime: pendingExpiryTime, reservedIP: reservedV6}
+			result = append(result, reservedV6.IP)
+		}
+		r.mutex.Unlock()
 	}
 
+	// the reservations expire from when all the addresses are available
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	expiryTime := r.clock.Now().Add(expiry)
+	for _, ip := range result {
+		prereservation := r.prereservedIPV6s[ip]
+		prereservation.expiryTime = expiryTime
+		r.prereservedIPV6s[ip] = prereservation
+	}
 	return result, nil
 }
 
+// AssignIPv6 assigns the prereserved IPv6 address to the droplet of the
+// pool with the given owner name.
 func (r *ReservedAddressesPool) AssignIPv6(
 	ctx context.Context,
 	dropletID int,
 	ipv6 string,
+	owner string,
 ) error {
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
+	r.clientMutex.RLock()
+	defer r.clientMutex.RUnlock()
 
+	// the provisional reservation is used up by the attempt to assign the
+	// address, whether or not it succeeds. It is kept until the attempt
+	// is over, as the address is listed as unassigned until then and
+	// would otherwise be handed out again
+	r.mutex.Lock()
 	prereservation, found := r.prereservedIPV6s[ipv6]
-	if !found || r.clock.Now().After(prereservation.expiryTime) {
+	if !found || prereservation.assigning || r.clock.Now().After(prereservation.expiryTime) {
+		r.mutex.Unlock()
 		return fmt.Errorf("trying to assign a IPv6 address (%v) which was not prereserved", ipv6)
 	}
-	defer delete(r.prereservedIPV6s, ipv6)
-
-	if err := RetryOnTransientError(ctx, r.logger,
+	prereservation.assigning = true
+	prereservation.expiryTime = pendingExpiryTime
+	r.prereservedIPV6s[ipv6] = prereservation
+	r.mutex.Unlock()
+	defer func() {
+		r.mutex.Lock()
+		delete(r.prereservedIPV6s, ipv6)
+		r.rememberAssigned(ipv6)
+		r.mutex.Unlock()
+	}()
+
+	if err := RetryOnTransientError(ctx, r.logger, owner,
 		func(ctx context.Context, cancel context.CancelCauseFunc) error {
 			_, _, err := r.reservedIPV6Actions.Assign(ctx, ipv6, dropletID)
 			return err
@@ -312,7 +931,7 @@ func (r *ReservedAddressesPool) AssignIPv6(
 			dropletID,
 			err)
 	}
-	r.logger.Debug("assigned reserved IPv6 address", "IPv6 address", ipv6, "droplet ID", dropletID)
+	r.logger.Debug("assigned reserved IPv6 address", logKeyIPAddress, ipv6, logKeyDropletID, dropletID)
 
 	return nil
 }
@@ -1,12 +1,17 @@
 package plugin
 
 import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/coder/quartz"
 	"github.com/digitalocean/godo"
 	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -20,11 +25,11 @@ func TestReserveIPv4(t *testing.T) {
 	}), clock)
 
 	// request 2 IPv4 addresses without allowing creation. This should fail.
-	_, err := pool.PrereserveIPs(ctx, 2, "mel1", false, time.Minute)
+	_, err := pool.PrereserveIPs(ctx, 2, "mel1", "mydropletname", false, time.Minute)
 	require.Error(t, err)
 
 	// request 2, allowing creation
-	preservedV4s, err := pool.PrereserveIPs(ctx, 2, "mel1", true, time.Minute)
+	preservedV4s, err := pool.PrereserveIPs(ctx, 2, "mel1", "mydropletname", true, time.Minute)
 	require.NoError(t, err)
 	require.NotNil(t, preservedV4s)
 	require.Len(t, preservedV4s, 2)
@@ -37,21 +42,21 @@ func TestReserveIPv4(t *testing.T) {
 	mock.droplets[2] = &godo.Droplet{ID: 2}
 
 	// try to assign one of these addresses to a droplet and assert it fails
-	require.Error(t, pool.AssignIPv4(ctx, mock.droplets[1].ID, preservedV4s[0]))
-	require.Error(t, pool.AssignIPv4(ctx, mock.droplets[2].ID, preservedV4s[1]))
+	require.Error(t, pool.AssignIPv4(ctx, mock.droplets[1].ID, preservedV4s[0], "mydropletname"))
+	require.Error(t, pool.AssignIPv4(ctx, mock.droplets[2].ID, preservedV4s[1], "mydropletname"))
 
 	// request 2 without allowing creation, which should succeed
-	preservedV4s, err = pool.PrereserveIPs(ctx, 2, "mel1", false, time.Minute)
+	preservedV4s, err = pool.PrereserveIPs(ctx, 2, "mel1", "mydropletname", false, time.Minute)
 	require.NoError(t, err)
 
 	// assign one to a droplet, which should succeed
-	require.NoError(t, pool.AssignIPv4(ctx, mock.droplets[1].ID, preservedV4s[0]))
+	require.NoError(t, pool.AssignIPv4(ctx, mock.droplets[1].ID, preservedV4s[0], "mydropletname"))
 
 	// assign the same one to a different droplet (should fail)
-	require.Error(t, pool.AssignIPv4(ctx, mock.droplets[2].ID, preservedV4s[0]))
+	require.Error(t, pool.AssignIPv4(ctx, mock.droplets[2].ID, preservedV4s[0], "mydropletname"))
 
 	// assign the second one to a second droplet
-	require.NoError(t, pool.AssignIPv4(ctx, mock.droplets[2].ID, preservedV4s[1]))
+	require.NoError(t, pool.AssignIPv4(ctx, mock.droplets[2].ID, preservedV4s[1], "mydropletname"))
 }
 
 func TestReserveIPv6(t *testing.T) {
@@ -64,11 +69,11 @@ func TestReserveIPv6(t *testing.T) {
 	}), clock)
 
 	// request 2 IPv6 addresses without allowing creation. This should fail.
-	_, err := pool.PrereserveIPV6s(ctx, 2, "mel1", false, time.Minute)
+	_, err := pool.PrereserveIPV6s(ctx, 2, "mel1", "mydropletname", false, time.Minute)
 	require.Error(t, err)
 
 	// request 2, allowing creation
-	preservedV6s, err := pool.PrereserveIPV6s(ctx, 2, "mel1", true, time.Minute)
+	preservedV6s, err := pool.PrereserveIPV6s(ctx, 2, "mel1", "mydropletname", true, time.Minute)
 	require.NoError(t, err)
 	require.NotNil(t, preservedV6s)
 	require.Len(t, preservedV6s, 2)
@@ -81,19 +86,413 @@ func TestReserveIPv6(t *testing.T) {
 	mock.droplets[2] = &godo.Droplet{ID: 2}
 
 	// try to assign one of these addresses to a droplet and assert it fails
-	require.Error(t, pool.AssignIPv6(ctx, mock.droplets[1].ID, preservedV6s[0]))
-	require.Error(t, pool.AssignIPv6(ctx, mock.droplets[2].ID, preservedV6s[1]))
+	require.Error(t, pool.AssignIPv6(ctx, mock.droplets[1].ID, preservedV6s[0], "mydropletname"))
+	require.Error(t, pool.AssignIPv6(ctx, mock.droplets[2].ID, preservedV6s[1], "mydropletname"))
 
 	// request 2 without allowing creation, which should succeed
-	preservedV6s, err = pool.PrereserveIPV6s(ctx, 2, "mel1", false, time.Minute)
+	preservedV6s, err = pool.PrereserveIPV6s(ctx, 2, "mel1", "mydropletname", false, time.Minute)
 	require.NoError(t, err)
 
 	// assign one to a droplet, which should succeed
-	require.NoError(t, pool.AssignIPv6(ctx, mock.droplets[1].ID, preservedV6s[0]))
+	require.NoError(t, pool.AssignIPv6(ctx, mock.droplets[1].ID, preservedV6s[0], "mydropletname"))
 
 	// assign the same one to a different droplet (should fail)
-	require.Error(t, pool.AssignIPv6(ctx, mock.droplets[2].ID, preservedV6s[0]))
+	require.Error(t, pool.AssignIPv6(ctx, mock.droplets[2].ID, preservedV6s[0], "mydropletname"))
 
 	// assign the second one to a second droplet
-	require.NoError(t, pool.AssignIPv6(ctx, mock.droplets[2].ID, preservedV6s[1]))
+	require.NoError(t, pool.AssignIPv6(ctx, mock.droplets[2].ID, preservedV6s[1], "mydropletname"))
+}
+
+func TestPrereserveIPsBackToBack(t *testing.T) {
+	ctx := t.Context()
+	mock := createMockGodo()
+	clock := quartz.NewMock(t)
+	pool := mock.NewReservedAddressPool(hclog.NewNullLogger(), clock)
+
+	first, err := pool.PrereserveIPs(ctx, 2, "mel1", "mydropletname", true, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, first, 2)
+
+	// the first addresses are still provisionally reserved, so new ones
+	// have to be created
+	second, err := pool.PrereserveIPs(ctx, 2, "mel1", "mydropletname", true, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, second, 2)
+	for _, ip := range second {
+		require.NotContains(t, first, ip)
+	}
+	require.Len(t, mock.reservedIPv4s, 4)
+}
+
+func TestPrereservationsExpire(t *testing.T) {
+	ctx := t.Context()
+	mock := createMockGodo()
+	clock := quartz.NewMock(t)
+	pool := mock.NewReservedAddressPool(hclog.NewNullLogger(), clock)
+
+	_, err := pool.PrereserveIPs(ctx, 2, "mel1", "mydropletname", true, time.Minute)
+	require.NoError(t, err)
+	_, err = pool.PrereserveIPV6s(ctx, 2, "mel1", "mydropletname", true, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, pool.prereservedIPs, 2)
+	require.Len(t, pool.prereservedIPV6s, 2)
+
+	// once expired, the provisional reservations are removed by the next call
+	require.NoError(t, clock.Advance(2*time.Minute).Wait(ctx))
+	_, err = pool.PrereserveIPs(ctx, 1, "mel1", "mydropletname", false, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, pool.prereservedIPs, 1)
+	require.Empty(t, pool.prereservedIPV6s)
+}
+
+func TestGetReservedIPs(t *testing.T) {
+	ctx := t.Context()
+	mock := createMockGodo()
+	clock := quartz.NewMock(t)
+	pool := mock.NewReservedAddressPool(hclog.NewNullLogger(), clock)
+
+	_, err := pool.PrereserveIPs(ctx, 3, "mel1", "mydropletname", true, time.Minute)
+	require.NoError(t, err)
+	_, err = pool.PrereserveIPV6s(ctx, 3, "mel1", "mydropletname", true, time.Minute)
+	require.NoError(t, err)
+
+	// each entry must refer to its own reservation
+	reservedV4s, err := pool.getReservedIPs(ctx)
+	require.NoError(t, err)
+	require.Len(t, reservedV4s, 3)
+	for ip, reservation := range reservedV4s {
+		require.Equal(t, ip, reservation.IP)
+	}
+	reservedV6s, err := pool.getReservedIPV6s(ctx)
+	require.NoError(t, err)
+	require.Len(t, reservedV6s, 3)
+	for ip, reservation := range reservedV6s {
+		require.Equal(t, ip, reservation.IP)
+	}
+}
+
+func TestReserveSpecificIP(t *testing.T) {
+	ctx := t.Context()
+	mock := createMockGodo()
+	clock := quartz.NewMock(t)
+	pool := mock.NewReservedAddressPool(hclog.NewNullLogger(), clock)
+
+	// create some reserved addresses, and let their provisional
+	// reservations expire
+	_, err := pool.PrereserveIPs(ctx, 2, "mel1", "mydropletname", true, time.Minute)
+	require.NoError(t, err)
+	_, err = pool.PrereserveIPV6s(ctx, 1, "mel1", "mydropletname", true, time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, clock.Advance(2*time.Minute).Wait(ctx))
+
+	// unknown addresses, or those in another region, cannot be reserved
+	require.Error(t, pool.ReserveSpecificIP(ctx, "9.9.9.9", "mel1"))
+	require.Error(t, pool.ReserveSpecificIP(ctx, "1.2.3.1", "lon1"))
+	require.Error(t, pool.ReserveSpecificIP(ctx, "not an address", "mel1"))
+
+	// a free address can be reserved, but only once
+	require.NoError(t, pool.ReserveSpecificIP(ctx, "1.2.3.1", "mel1"))
+	require.Error(t, pool.ReserveSpecificIP(ctx, "1.2.3.1", "mel1"))
+	require.NoError(t, pool.ReserveSpecificIP(ctx, "fe80:1::", "mel1"))
+	require.Error(t, pool.ReserveSpecificIP(ctx, "fe80:1::", "mel1"))
+
+	// the other address is still handed out as normal
+	prereservedV4s, err := pool.PrereserveIPs(ctx, 1, "mel1", "mydropletname", false, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.2.3.2"}, prereservedV4s)
+
+	// the specific address can be assigned to a droplet, after which
+	// it cannot be reserved again
+	mock.droplets[1] = &godo.Droplet{ID: 1}
+	require.NoError(t, pool.AssignIPv4(ctx, 1, "1.2.3.1", "mydropletname"))
+	require.ErrorContains(t, pool.ReserveSpecificIP(ctx, "1.2.3.1", "mel1"), "already assigned")
+}
+
+func TestDeleteReservation(t *testing.T) {
+	ctx := t.Context()
+	mock := createMockGodo()
+	clock := quartz.NewMock(t)
+	pool := mock.NewReservedAddressPool(hclog.NewNullLogger(), clock)
+
+	_, err := pool.PrereserveIPs(ctx, 2, "mel1", "mydropletname", true, time.Minute)
+	require.NoError(t, err)
+	_, err = pool.PrereserveIPV6s(ctx, 1, "mel1", "mydropletname", true, time.Minute)
+	require.NoError(t, err)
+
+	// provisionally reserved addresses cannot be deleted
+	require.ErrorContains(t, pool.DeleteReservation(ctx, "1.2.3.1"), "provisionally reserved")
+	require.NoError(t, clock.Advance(2*time.Minute).Wait(ctx))
+
+	// nor can unknown or assigned addresses
+	require.Error(t, pool.DeleteReservation(ctx, "9.9.9.9"))
+	require.Error(t, pool.DeleteReservation(ctx, "not an address"))
+	require.NoError(t, pool.ReserveSpecificIP(ctx, "1.2.3.2", "mel1"))
+	mock.droplets[1] = &godo.Droplet{ID: 1}
+	require.NoError(t, pool.AssignIPv4(ctx, 1, "1.2.3.2", "mydropletname"))
+	require.ErrorContains(t, pool.DeleteReservation(ctx, "1.2.3.2"), "assigned to droplet")
+
+	require.NoError(t, pool.DeleteReservation(ctx, "1.2.3.1"))
+	require.NoError(t, pool.DeleteReservation(ctx, "fe80:1::"))
+	require.Len(t, mock.reservedIPv4s, 1)
+	require.Empty(t, mock.reservedIPv6s)
+}
+
+func TestReservedAddressOwners(t *testing.T) {
+	ctx := t.Context()
+	mock := createMockGodo()
+	clock := quartz.NewMock(t)
+	pool := mock.NewReservedAddressPool(hclog.NewNullLogger(), clock)
+	created := clock.Now()
+
+	_, err := pool.PrereserveIPs(ctx, 1, "mel1", "batch", true, time.Minute)
+	require.NoError(t, err)
+	_, err = pool.PrereserveIPV6s(ctx, 1, "mel1", "service", true, time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, clock.Advance(2*time.Minute).Wait(ctx))
+
+	// reusing an existing address doesn't change its owner
+	_, err = pool.PrereserveIPs(ctx, 1, "mel1", "service", true, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, map[string]AddressOwner{
+		"1.2.3.1":  {Pool: "batch", Created: created},
+		"fe80:1::": {Pool: "service", Created: created},
+	}, pool.Owners())
+
+	require.NoError(t, pool.DeleteReservation(ctx, "fe80:1::"))
+	require.Equal(t, map[string]AddressOwner{
+		"1.2.3.1": {Pool: "batch", Created: created},
+	}, pool.Owners())
+}
+
+func TestReclaimOrphanedAddresses(t *testing.T) {
+	ctx := t.Context()
+	mock := createMockGodo()
+	clock := quartz.NewMock(t)
+	pool := mock.NewReservedAddressPool(hclog.NewNullLogger(), clock)
+	// the pool's droplets are listed at most once per reclaim, rather than
+	// being looked up one by one
+	listings := 0
+	listDroplets := func(ctx context.Context) ([]godo.Droplet, error) {
+		listings++
+		mock.mutex.Lock()
+		defer mock.mutex.Unlock()
+		var droplets []godo.Droplet
+		for _, droplet := range mock.droplets {
+			if slices.Contains(droplet.Tags, "mydropletname") {
+				droplets = append(droplets, *droplet)
+			}
+		}
+		return droplets, nil
+	}
+
+	// nothing is listed when no address is assigned to the pool's droplets
+	reclaimed, err := pool.ReclaimOrphanedAddresses(ctx, "mydropletname", listDroplets)
+	require.NoError(t, err)
+	require.Empty(t, reclaimed)
+	require.Zero(t, listings)
+
+	_, err = pool.PrereserveIPs(ctx, 3, "mel1", "mydropletname", true, time.Minute)
+	require.NoError(t, err)
+	_, err = pool.PrereserveIPV6s(ctx, 1, "mel1", "mydropletname", true, time.Minute)
+	require.NoError(t, err)
+	mock.droplets[1] = &godo.Droplet{ID: 1, Tags: []string{"mydropletname"}}
+	mock.droplets[2] = &godo.Droplet{ID: 2, Tags: []string{"mydropletname"}}
+	mock.droplets[3] = &godo.Droplet{ID: 3, Tags: []string{"otherpool"}}
+	require.NoError(t, pool.AssignIPv4(ctx, 1, "1.2.3.1", "mydropletname"))
+	require.NoError(t, pool.AssignIPv4(ctx, 2, "1.2.3.2", "mydropletname"))
+	require.NoError(t, pool.AssignIPv4(ctx, 3, "1.2.3.3", "mydropletname"))
+	require.NoError(t, pool.AssignIPv6(ctx, 1, "fe80:1::", "mydropletname"))
+
+	// nothing is reclaimed while the droplets exist
+	reclaimed, err = pool.ReclaimOrphanedAddresses(ctx, "mydropletname", listDroplets)
+	require.NoError(t, err)
+	require.Empty(t, reclaimed)
+	require.Equal(t, 1, listings)
+
+	// once a droplet is deleted out-of-band, its addresses are still
+	// assigned to it and cannot be prereserved
+	delete(mock.droplets, 1)
+	delete(mock.droplets, 3)
+	_, err = pool.PrereserveIPs(ctx, 1, "mel1", "mydropletname", false, time.Minute)
+	require.Error(t, err)
+
+	// the address of the other pool's droplet is left for that pool to
+	// reclaim
+	reclaimed, err = pool.ReclaimOrphanedAddresses(ctx, "mydropletname", listDroplets)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"1.2.3.1", "fe80:1::"}, reclaimed)
+	require.Equal(t, 2, listings)
+	require.Nil(t, mock.GetReservedIPv4(1))
+	require.Nil(t, mock.GetReservedIPv6(1))
+	require.NotNil(t, mock.GetReservedIPv4(2))
+	require.NotNil(t, mock.GetReservedIPv4(3))
+
+	preservedV4s, err := pool.PrereserveIPs(ctx, 1, "mel1", "mydropletname", false, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.2.3.1"}, preservedV4s)
+	preservedV6s, err := pool.PrereserveIPV6s(ctx, 1, "mel1", "mydropletname", false, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, []string{"fe80:1::"}, preservedV6s)
+
+	// a failed listing reclaims nothing
+	delete(mock.droplets, 2)
+	reclaimed, err = pool.ReclaimOrphanedAddresses(ctx, "mydropletname", func(ctx context.Context) ([]godo.Droplet, error) {
+		return nil, errors.New("listing failed")
+	})
+	require.ErrorContains(t, err, "listing failed")
+	require.Empty(t, reclaimed)
+	require.NotNil(t, mock.GetReservedIPv4(2))
+}
+
+func TestPrereserveIPsInRegion(t *testing.T) {
+	ctx := t.Context()
+	mock := createMockGodo()
+	clock := quartz.NewMock(t)
+	pool := mock.NewReservedAddressPool(hclog.NewNullLogger(), clock)
+
+	nyc1V4s, err := pool.PrereserveIPs(ctx, 2, "nyc1", "mydropletname", true, time.Minute)
+	require.NoError(t, err)
+	lon1V4s, err := pool.PrereserveIPs(ctx, 1, "lon1", "mydropletname", true, time.Minute)
+	require.NoError(t, err)
+	nyc1V6s, err := pool.PrereserveIPV6s(ctx, 1, "nyc1", "mydropletname", true, time.Minute)
+	require.NoError(t, err)
+	lon1V6s, err := pool.PrereserveIPV6s(ctx, 1, "lon1", "mydropletname", true, time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, clock.Advance(2*time.Minute).Wait(ctx))
+
+	// only the free addresses in the requested region are selected
+	_, err = pool.PrereserveIPs(ctx, 2, "lon1", "mydropletname", false, time.Minute)
+	require.ErrorContains(t, err, "insufficient reserved IPv4 addresses")
+	preservedV4s, err := pool.PrereserveIPs(ctx, 1, "lon1", "mydropletname", false, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, lon1V4s, preservedV4s)
+	preservedV4s, err = pool.PrereserveIPs(ctx, 2, "nyc1", "mydropletname", false, time.Minute)
+	require.NoError(t, err)
+	require.ElementsMatch(t, nyc1V4s, preservedV4s)
+
+	preservedV6s, err := pool.PrereserveIPV6s(ctx, 1, "lon1", "mydropletname", false, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, lon1V6s, preservedV6s)
+	preservedV6s, err = pool.PrereserveIPV6s(ctx, 1, "nyc1", "mydropletname", false, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, nyc1V6s, preservedV6s)
+}
+
+func TestPrereserveIPsConcurrently(t *testing.T) {
+	ctx := t.Context()
+	mock := createMockGodo()
+	pool := mock.NewReservedAddressPool(hclog.NewNullLogger(), quartz.NewMock(t))
+
+	// some unassigned addresses exist already
+	existing, err := pool.PrereserveIPs(ctx, 3, "mel1", "mydropletname", true, time.Minute)
+	require.NoError(t, err)
+	pool.ReleasePrereservations(existing...)
+
+	mock.reservedIPCreateDelay = 200 * time.Millisecond
+	results := make([][]string, 3)
+	wg := &sync.WaitGroup{}
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := pool.PrereserveIPs(ctx, 3, "mel1", "mydropletname", true, time.Minute)
+			assert.NoError(t, err)
+			results[i] = result
+		}()
+	}
+
+	// the pool is not held up while addresses are being created
+	require.Eventually(t, func() bool {
+		return mock.inFlightReservedIPCreates.Load() > 0
+	}, time.Second, time.Millisecond)
+	start := time.Now()
+	_, err = pool.AvailableIPs(ctx, []string{"mel1"})
+	require.NoError(t, err)
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+	wg.Wait()
+
+	// addresses are created concurrently, and none is given to two callers
+	require.Greater(t, mock.maxInFlightReservedIPCreate.Load(), int32(1))
+	var all []string
+	for _, result := range results {
+		require.Len(t, result, 3)
+		all = append(all, result...)
+	}
+	slices.Sort(all)
+	require.Len(t, slices.Compact(all), 9)
+	require.Len(t, mock.reservedIPv4s, 9)
+}
+
+func TestAssignKeepsAddressClaimed(t *testing.T) {
+	ctx := t.Context()
+	mock := createMockGodo()
+	pool := mock.NewReservedAddressPool(hclog.NewNullLogger(), quartz.NewMock(t))
+	mock.droplets[1] = &godo.Droplet{ID: 1}
+
+	prereservedV4s, err := pool.PrereserveIPs(ctx, 1, "mel1", "mydropletname", true, time.Minute)
+	require.NoError(t, err)
+	prereservedV6s, err := pool.PrereserveIPV6s(ctx, 1, "mel1", "mydropletname", true, time.Minute)
+	require.NoError(t, err)
+
+	// the addresses are still listed as unassigned while they are being
+	// assigned, but no other caller may take them
+	mock.assignBlock = make(chan struct{})
+	errs := make(chan error, 2)
+	go func() { errs <- pool.AssignIPv4(ctx, 1, prereservedV4s[0], "mydropletname") }()
+	go func() { errs <- pool.AssignIPv6(ctx, 1, prereservedV6s[0], "mydropletname") }()
+	require.Eventually(t, func() bool {
+		return mock.blockedAssigns.Load() == 2
+	}, time.Second, time.Millisecond)
+
+	_, err = pool.PrereserveIPs(ctx, 1, "mel1", "mydropletname", false, time.Minute)
+	require.Error(t, err)
+	_, err = pool.PrereserveIPV6s(ctx, 1, "mel1", "mydropletname", false, time.Minute)
+	require.Error(t, err)
+	require.Error(t, pool.AssignIPv4(ctx, 1, prereservedV4s[0], "mydropletname"))
+	require.Error(t, pool.AssignIPv6(ctx, 1, prereservedV6s[0], "mydropletname"))
+
+	close(mock.assignBlock)
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+	require.Equal(t, prereservedV4s[0], mock.GetReservedIPv4(1).IP)
+	require.Equal(t, prereservedV6s[0], mock.GetReservedIPv6(1).IP)
+
+	// once assigned, the addresses are no longer provisionally reserved
+	pool.mutex.RLock()
+	defer pool.mutex.RUnlock()
+	require.Empty(t, pool.prereservedIPs)
+	require.Empty(t, pool.prereservedIPV6s)
+}
+
+func TestStaleListDoesNotClaimAssignedAddress(t *testing.T) {
+	ctx := t.Context()
+	mock := createMockGodo()
+	pool := mock.NewReservedAddressPool(hclog.NewNullLogger(), quartz.NewMock(t))
+	mock.droplets[1] = &godo.Droplet{ID: 1}
+
+	prereservedV4s, err := pool.PrereserveIPs(ctx, 1, "mel1", "mydropletname", true, time.Minute)
+	require.NoError(t, err)
+
+	// a list taken before the assignment still shows the address as
+	// unassigned once its provisional reservation is gone
+	mock.reservedIPListBlock = make(chan struct{})
+	mock.blockingReservedIPLists.Store(1)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := pool.PrereserveIPs(ctx, 1, "mel1", "otherdropletname", false, time.Minute)
+		errs <- err
+	}()
+	require.Eventually(t, func() bool {
+		return mock.blockedReservedIPLists.Load() == 1
+	}, time.Second, time.Millisecond)
+
+	require.NoError(t, pool.AssignIPv4(ctx, 1, prereservedV4s[0], "mydropletname"))
+	close(mock.reservedIPListBlock)
+	require.ErrorContains(t, <-errs, "insufficient reserved IPv4 addresses")
+
+	// once no list taken before it is left, the assignment is forgotten
+	pool.mutex.RLock()
+	defer pool.mutex.RUnlock()
+	require.Empty(t, pool.recentlyAssigned)
+	require.Empty(t, pool.openListings)
 }
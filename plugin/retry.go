@@ -5,29 +5,67 @@ import (
 	"errors"
 	"fmt"
 	"math/rand/v2"
+	"net/http"
 	"slices"
+	"strconv"
 	"time"
 
+	"github.com/coder/quartz"
 	"github.com/digitalocean/godo"
 	"github.com/hashicorp/go-hclog"
 )
 
+// maxRetryAfter caps how long a Retry-After header may delay the next attempt.
+const maxRetryAfter = 2 * time.Minute
+
 // retryFunc is the function signature for a function which is retryable.
 // A returned error is not considered fatal, but if the context is cancelled
 // (or times out), that error will be returned
 type retryFunc func(ctx context.Context, cancel context.CancelCauseFunc) error
 
+// retryOptions holds the optional behaviour of retry.
+type retryOptions struct {
+	// the interval is multiplied by this after each attempt, up to
+	// maxInterval. A multiplier of 1 keeps the interval fixed.
+	multiplier  float64
+	maxInterval time.Duration
+	clock       quartz.Clock
+}
+
+type retryOption func(*retryOptions)
+
+// withBackoff makes the interval between attempts grow exponentially by
+// the given multiplier, until it reaches maxInterval.
+func withBackoff(multiplier float64, maxInterval time.Duration) retryOption {
+	return func(o *retryOptions) {
+		o.multiplier = multiplier
+		o.maxInterval = maxInterval
+	}
+}
+
+// withRetryClock sets the clock used to wait between attempts.
+func withRetryClock(clock quartz.Clock) retryOption {
+	return func(o *retryOptions) {
+		o.clock = clock
+	}
+}
+
 // retry will retry the passed function f until any of the following conditions
 // are met:
 //   - the function return with err=nil
 //   - the retryAttempts limit is reached
 //   - the context is cancelled
+//
+// By default, attempts are retryInterval apart; see withBackoff. The failed
+// attempts are counted in the metrics of the pool with the given name.
 func retry(
 	ctx context.Context,
 	logger hclog.Logger,
+	name string,
 	retryInterval time.Duration,
 	retryAttempts int,
 	f retryFunc,
+	options ...retryOption,
 ) error {
 	var (
 		retryCount    int
@@ -36,12 +74,18 @@ func retry(
 	if err := ctx.Err(); err != nil {
 		return err
 	}
+	opts := retryOptions{
+		multiplier: 1,
+		clock:      quartz.NewReal(),
+	}
+	for _, option := range options {
+		option(&opts)
+	}
 	ctx, cancel := context.WithCancelCause(ctx)
-	jitter := time.Duration(rand.Int64N(int64(retryInterval)))
 
 	// randomly add/subtract up to 10% of the retry interval
-	ticker := time.NewTicker(retryInterval + jitter/5 - retryInterval/10)
-	defer ticker.Stop()
+	jitter := 0.9 + rand.Float64()/5
+	interval := retryInterval
 
 	for {
 		err := f(ctx, cancel)
@@ -57,6 +101,10 @@ func retry(
 		}
 
 		if cerr = ctx.Err(); cerr != nil {
+			// f gives up by cancelling with its error as the cause
+			if errors.Is(context.Cause(ctx), err) {
+				return err
+			}
 			break
 		}
 		lastErr = err
@@ -67,14 +115,19 @@ func retry(
 		)
 
 		retryCount++
+		retriedAttempts.WithLabelValues(name).Inc()
 
 		if retryCount == retryAttempts {
 			return errors.New("reached retry limit")
 		}
+		timer := opts.clock.NewTimer(time.Duration(float64(interval) * jitter))
 		select {
 		case <-ctx.Done():
-			break
-		case <-ticker.C:
+			timer.Stop()
+		case <-timer.C:
+		}
+		if opts.multiplier != 1 {
+			interval = min(time.Duration(float64(interval)*opts.multiplier), opts.maxInterval)
 		}
 	}
 	return fmt.Errorf(
@@ -89,20 +142,61 @@ func retry(
 // which might just require some time to resolve.
 // godo already handles rate-limiting, but HTTP 422s have been observed
 // when trying to do things like conccurently assign multiple reserved IP addresses.
+// HTTP 429s are also retried; if the response carries a Retry-After header,
+// the next attempt is delayed accordingly.
+// A request which timed out on its own, rather than as the context of the
+// retries is done, is retried too.
+// The failed attempts are counted in the metrics of the pool with the given
+// name.
 // If an unrecognise error is returned, this will exit as normal, immediately.
 func RetryOnTransientError(
 	ctx context.Context,
 	logger hclog.Logger,
+	name string,
 	f func(ctx context.Context, cancel context.CancelCauseFunc) error,
 	extraCodes ...int,
 ) error {
-	return retry(ctx, logger, 10*time.Second, 30,
+	return retryOnTransientError(ctx, logger, name, quartz.NewReal(), f, extraCodes...)
+}
+
+// retryRequest makes a request with f, giving each attempt up to timeout to
+// complete, and retries it like RetryOnTransientError, waiting on the given
+// clock. An attempt which times out is retried, as a stuck request is likely
+// to succeed when it is sent again.
+func retryRequest(
+	ctx context.Context,
+	logger hclog.Logger,
+	name string,
+	clock quartz.Clock,
+	timeout time.Duration,
+	f func(ctx context.Context) error,
+) error {
+	return retryOnTransientError(ctx, logger, name, clock,
+		func(ctx context.Context, cancel context.CancelCauseFunc) error {
+			reqCtx, cancelReq := context.WithTimeout(ctx, timeout)
+			defer cancelReq()
+			return f(reqCtx)
+		})
+}
+
+func retryOnTransientError(
+	ctx context.Context,
+	logger hclog.Logger,
+	name string,
+	clock quartz.Clock,
+	f func(ctx context.Context, cancel context.CancelCauseFunc) error,
+	extraCodes ...int,
+) error {
+	return retry(ctx, logger, name, 10*time.Second, 30,
 		func(ctx context.Context, cancel context.CancelCauseFunc) error {
 			err := f(ctx, cancel)
 			if err == nil {
 				// success
 				return nil
 			}
+			if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+				return err
+			}
 
 			respErr := &godo.ErrorResponse{}
 			if errors.As(err, &respErr) && respErr.Response != nil {
@@ -111,12 +205,16 @@ func RetryOnTransientError(
 					"response",
 					fmt.Sprintf("%+v", respErr.Response),
 				)
-				if respErr.Response.StatusCode == 422 {
-					// try again
-					return err
-				}
-				if slices.Contains(extraCodes, respErr.Response.StatusCode) {
-					// one of the other codes we will retry on
+				if respErr.Response.StatusCode == 422 ||
+					respErr.Response.StatusCode == http.StatusTooManyRequests ||
+					slices.Contains(extraCodes, respErr.Response.StatusCode) {
+					// try again, but not before the server asked us to
+					if delay := retryAfter(respErr.Response, time.Now()); delay > 0 {
+						logger.Debug("waiting as requested by Retry-After", "delay", delay)
+						if err := Sleep(ctx, delay); err != nil {
+							return err
+						}
+					}
 					return err
 				}
 			}
@@ -124,5 +222,23 @@ func RetryOnTransientError(
 			// do not retry
 			cancel(err)
 			return err
-		})
+		},
+		withRetryClock(clock))
+}
+
+// retryAfter returns how long the Retry-After header of the response asks the
+// client to wait, capped to maxRetryAfter. Both the delay-seconds and the
+// HTTP-date forms are supported. Zero is returned if there is no usable header.
+func retryAfter(resp *http.Response, now time.Time) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		delay = date.Sub(now)
+	}
+	return min(max(delay, 0), maxRetryAfter)
 }
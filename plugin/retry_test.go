@@ -3,10 +3,13 @@ package plugin
 import (
 	"context"
 	"errors"
+	"net/http"
 	"testing"
 	"time"
 
+	"github.com/coder/quartz"
 	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -17,7 +20,9 @@ func Test_retry(t *testing.T) {
 		inputRetry     int
 		inputFunc      retryFunc
 		expectedOutput error
-		name           string
+		// the failed attempts are counted against the test case's name
+		expectedRetried float64
+		name            string
 	}{
 		{
 			inputContext:  t.Context(),
@@ -36,8 +41,9 @@ func Test_retry(t *testing.T) {
 			inputFunc: func(ctx context.Context, cancel context.CancelCauseFunc) error {
 				return errors.New("error")
 			},
-			expectedOutput: errors.New("reached retry limit"),
-			name:           "function never successful and reaches retry limit",
+			expectedOutput:  errors.New("reached retry limit"),
+			expectedRetried: 1,
+			name:            "function never successful and reaches retry limit",
 		},
 	}
 
@@ -47,11 +53,103 @@ func Test_retry(t *testing.T) {
 			actualOutput := retry(
 				tc.inputContext,
 				logger,
+				tc.name,
 				tc.inputInterval,
 				tc.inputRetry,
 				tc.inputFunc,
 			)
 			assert.Equal(t, tc.expectedOutput, actualOutput, tc.name)
+			assert.Equal(t, tc.expectedRetried, testutil.ToFloat64(retriedAttempts.WithLabelValues(tc.name)), tc.name)
+		})
+	}
+}
+
+func Test_retryAfter(t *testing.T) {
+	now := time.Date(2025, time.July, 1, 12, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		header         string
+		expectedOutput time.Duration
+		name           string
+	}{
+		{
+			header:         "",
+			expectedOutput: 0,
+			name:           "no header",
+		},
+		{
+			header:         "30",
+			expectedOutput: 30 * time.Second,
+			name:           "delay in seconds",
+		},
+		{
+			header:         "3600",
+			expectedOutput: maxRetryAfter,
+			name:           "delay in seconds is capped",
+		},
+		{
+			header:         now.Add(45 * time.Second).Format(http.TimeFormat),
+			expectedOutput: 45 * time.Second,
+			name:           "HTTP date",
+		},
+		{
+			header:         now.Add(-time.Minute).Format(http.TimeFormat),
+			expectedOutput: 0,
+			name:           "HTTP date in the past",
+		},
+		{
+			header:         "soon",
+			expectedOutput: 0,
+			name:           "unparseable value",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}}
+			if tc.header != "" {
+				resp.Header.Set("Retry-After", tc.header)
+			}
+			assert.Equal(t, tc.expectedOutput, retryAfter(resp, now), tc.name)
 		})
 	}
 }
+
+func Test_retryWithBackoff(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), 2*time.Second)
+	defer cancel()
+	clock := quartz.NewMock(t)
+	trap := clock.Trap().NewTimer()
+	defer trap.Close()
+
+	attempts := 0
+	result := make(chan error, 1)
+	go func() {
+		result <- retry(
+			ctx,
+			hclog.NewNullLogger(),
+			"mydropletname",
+			time.Second,
+			6,
+			func(ctx context.Context, cancel context.CancelCauseFunc) error {
+				attempts++
+				return errors.New("error")
+			},
+			withBackoff(2, 5*time.Second),
+			withRetryClock(clock),
+		)
+	}()
+
+	// the interval doubles after each attempt, but is capped; each wait
+	// is within the 10% jitter of the interval
+	for _, interval := range []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second,
+	} {
+		call := trap.MustWait(ctx)
+		assert.InDelta(t, interval, call.Duration, float64(interval)/10)
+		call.MustRelease(ctx)
+		clock.Advance(call.Duration).MustWait(ctx)
+	}
+
+	assert.Equal(t, errors.New("reached retry limit"), <-result)
+	assert.Equal(t, 6, attempts)
+}
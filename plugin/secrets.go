@@ -0,0 +1,54 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// The secure introduction backends which can be selected with the
+// secure_introduction_backend config param.
+const (
+	// secretBackendVault generates a request-wrapped SecretID for each
+	// droplet with the VaultProxy the plugin was created with.
+	secretBackendVault = "vault"
+	// secretBackendPreSharedToken hands every droplet the same token.
+	secretBackendPreSharedToken = "pre_shared_token"
+)
+
+// preSharedToken is a VaultProxy for secrets systems other than Vault, which
+// introduces every droplet with the same pre-shared token, instead of a
+// SecretID of its own. The token is written to the droplet in the same way
+// as a wrapped SecretID embedded in user data, so the droplet's own tooling
+// must exchange it for whatever credentials it needs. Being long-lived and
+// shared, it is never stored in a tag. It stays readable from the metadata
+// service by anything on the droplet for as long as the droplet exists, as
+// the user data does.
+type preSharedToken struct {
+	token string
+}
+
+// NewPreSharedToken returns a VaultProxy which always provides the token. As
+// the token is written into a shell script in the droplet's user data, it
+// may only contain the characters allowed in tags.
+func NewPreSharedToken(token string) (*preSharedToken, error) {
+	if token == "" {
+		return nil, fmt.Errorf("the pre-shared token is empty")
+	}
+	if invalid := prohibitedCharactersInTags.FindString(token); invalid != "" {
+		return nil, fmt.Errorf("the pre-shared token contains characters which are not allowed in tags: %q", invalid)
+	}
+	return &preSharedToken{token: token}, nil
+}
+
+// GenerateSecretId returns the pre-shared token, whatever the droplet and
+// approle.
+func (p *preSharedToken) GenerateSecretId(
+	ctx context.Context,
+	appRole string,
+	allowedIPv4, allowedIPv6 string,
+	secretValidity, wrapperValidity time.Duration,
+	options ...SecretIdOption,
+) (string, error) {
+	return p.token, nil
+}
@@ -0,0 +1,111 @@
+package plugin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coder/quartz"
+	"github.com/google/uuid"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPreSharedToken(t *testing.T) {
+	proxy, err := NewPreSharedToken("s3cret:token_1-2")
+	require.NoError(t, err)
+	token, err := proxy.GenerateSecretId(t.Context(), "droplet-approle", "", "", time.Hour, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, "s3cret:token_1-2", token)
+
+	_, err = NewPreSharedToken("")
+	require.Error(t, err)
+	_, err = NewPreSharedToken(`s3cret"; reboot`)
+	require.ErrorContains(t, err, "not allowed")
+}
+
+func TestTargetPlugin_SetConfigSelectsSecretBackend(t *testing.T) {
+	vault := &mockVaultProxy{}
+	plugin := NewDODropletsPlugin(t.Context(), hclog.NewNullLogger(), vault)
+	require.NoError(t, plugin.SetConfig(map[string]string{"token": "t0ken"}))
+	require.Same(t, vault, plugin.vault)
+
+	// the token may be read from a file
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("s3cret\n"), 0o600))
+	require.NoError(t, plugin.SetConfig(map[string]string{
+		"token":                                "t0ken",
+		"secure_introduction_backend":          "pre_shared_token",
+		"secure_introduction_pre_shared_token": tokenFile,
+	}))
+	require.Equal(t, &preSharedToken{token: "s3cret"}, plugin.vault)
+
+	// the injected proxy is restored when the configuration selects it again
+	require.NoError(t, plugin.SetConfig(map[string]string{
+		"token":                       "t0ken",
+		"secure_introduction_backend": "vault",
+	}))
+	require.Same(t, vault, plugin.vault)
+
+	require.ErrorContains(t, plugin.SetConfig(map[string]string{
+		"token":                       "t0ken",
+		"secure_introduction_backend": "pre_shared_token",
+	}), "secure_introduction_pre_shared_token")
+	require.ErrorContains(t, plugin.SetConfig(map[string]string{
+		"token":                       "t0ken",
+		"secure_introduction_backend": "keyring",
+	}), "secure_introduction_backend")
+}
+
+func TestScaleOutWithPreSharedToken(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	config := map[string]string{
+		"name":                         "mydropletname",
+		"region":                       "lon1",
+		"size":                         "s1",
+		"snapshot_id":                  "12345",
+		"vpc_uuid":                     uuid.New().String(),
+		"secure_introduction_backend":  "pre_shared_token",
+		"secure_introduction_filename": "/run/secure-introduction",
+		"reserve_ipv4_addresses":       "true",
+		"create_reserved_addresses":    "true",
+	}
+	tp := &TargetPlugin{
+		ctx:                   ctx,
+		config:                config,
+		logger:                hclog.NewNullLogger(),
+		client:                mock,
+		vault:                 Must(NewPreSharedToken("s3cret")),
+		reservedAddressesPool: mock.NewReservedAddressPool(hclog.NewNullLogger(), quartz.NewMock(t)),
+	}
+	// no approle is needed to enable secure introduction
+	template := Must(tp.createDropletTemplate(config))
+	_, err := tp.scaleOut(ctx, nil, 2, 2, template, config)
+	require.NoError(t, err)
+	require.Len(t, mock.droplets, 2)
+	for id, droplet := range mock.droplets {
+		require.Contains(t, mock.dropletUserData[id], "s3cret")
+		for _, tag := range droplet.Tags {
+			require.NotContains(t, tag, "s3cret")
+		}
+	}
+
+	// the token is never stored in a tag
+	config["secure_introduction_tag_prefix"] = "banana-"
+	_, err = tp.createDropletTemplate(config)
+	require.ErrorContains(t, err, "secure_introduction_tag_prefix cannot be used with the pre_shared_token")
+	delete(config, "secure_introduction_tag_prefix")
+
+	// the token is not bound to any address, so it is written into the
+	// user data of droplets without reserved addresses as well
+	config["reserve_ipv4_addresses"] = "false"
+	template = Must(tp.createDropletTemplate(config))
+	createdIDs, err := tp.scaleOut(ctx, nil, 1, 1, template, config)
+	require.NoError(t, err)
+	require.Len(t, createdIDs, 1)
+	require.Contains(t, mock.dropletUserData[createdIDs[0]], "s3cret")
+}
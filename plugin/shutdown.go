@@ -5,32 +5,67 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/coder/quartz"
 	"github.com/hashicorp/go-hclog"
 )
 
 func shutdownDroplet(
 	ctx context.Context,
+	name string,
 	dropletId int,
+	shutdownTimeout time.Duration,
+	requestTimeout time.Duration,
+	pollInterval, maxPollInterval time.Duration,
+	forceDelete bool,
 	droplets Droplets,
 	dropletActions DropletActions,
+	clock quartz.Clock,
 	log hclog.Logger,
 ) error {
-	// Gracefully power off the droplet.
-	log.Debug("Gracefully shutting down droplet...")
-	_, _, err := dropletActions.PowerOff(ctx, dropletId)
-	if err != nil {
-		return fmt.Errorf("error shutting down droplet: %w", err)
-	}
+	if !forceDelete {
+		// Gracefully power off the droplet.
+		log.Debug("Gracefully shutting down droplet...")
+		// an earlier attempt may have powered the droplet off without its
+		// response arriving, which is as good as this one succeeding
+		err := retryRequest(ctx, log, name, clock, requestTimeout, func(ctx context.Context) error {
+			_, _, err := dropletActions.PowerOff(ctx, dropletId)
+			if isAlreadyPoweredOffError(err) {
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("error shutting down droplet: %w", err)
+		}
 
-	ctxWaitForDropletState, cancel := context.WithTimeout(ctx, 5*time.Minute)
-	defer cancel()
-	err = waitForDropletState(ctxWaitForDropletState, "off", dropletId, droplets, log)
-	if err != nil {
-		log.Warn("Timeout while waiting to for droplet to become 'off'", "error", err)
+		ctxWaitForDropletState, cancel := context.WithTimeout(ctx, shutdownTimeout)
+		defer cancel()
+		err = waitForDropletState(
+			ctxWaitForDropletState,
+			"off",
+			dropletId,
+			droplets,
+			pollInterval,
+			maxPollInterval,
+			clock,
+			log,
+		)
+		if err != nil {
+			log.Warn("Timeout while waiting to for droplet to become 'off'", "error", err)
+		}
 	}
 
 	log.Debug("Deleting Droplet...")
-	_, err = droplets.Delete(ctx, dropletId)
+	// likewise, an earlier attempt may have deleted the droplet
+	retrying := false
+	err := retryRequest(ctx, log, name, clock, requestTimeout, func(ctx context.Context) error {
+		_, err := droplets.Delete(ctx, dropletId)
+		if retrying && isNotFoundError(err) {
+			return nil
+		}
+		retrying = true
+		return err
+	})
 	if err != nil {
 		return fmt.Errorf("error deleting droplet: %w", err)
 	}
@@ -0,0 +1,98 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coder/quartz"
+	"github.com/digitalocean/godo"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdownDroplet(t *testing.T) {
+	ctx := t.Context()
+	mock := createMockGodo()
+	mock.droplets[1] = &godo.Droplet{ID: 1, Status: "active"}
+
+	err := shutdownDroplet(
+		ctx,
+		"mydropletname",
+		1,
+		time.Second,
+		time.Second,
+		time.Millisecond,
+		time.Millisecond,
+		false,
+		mock.Droplets(),
+		mock.DropletActions(),
+		quartz.NewReal(),
+		hclog.NewNullLogger(),
+	)
+	require.NoError(t, err)
+	require.NotContains(t, mock.droplets, 1)
+}
+
+func TestShutdownDropletForceDelete(t *testing.T) {
+	ctx := t.Context()
+	mock := createMockGodo()
+	mock.droplets[1] = &godo.Droplet{ID: 1, Status: "active"}
+
+	// no droplet actions are provided, as the droplet must not be powered off
+	err := shutdownDroplet(
+		ctx,
+		"mydropletname",
+		1,
+		time.Second,
+		time.Second,
+		time.Millisecond,
+		time.Millisecond,
+		true,
+		mock.Droplets(),
+		nil,
+		quartz.NewReal(),
+		hclog.NewNullLogger(),
+	)
+	require.NoError(t, err)
+	require.NotContains(t, mock.droplets, 1)
+}
+
+func TestShutdownDropletWithLostResponses(t *testing.T) {
+	ctx := t.Context()
+	mock := createMockGodo()
+	clock := quartz.NewMock(t)
+	mock.droplets[1] = &godo.Droplet{ID: 1, Status: "active"}
+	trap := clock.Trap().NewTimer()
+	defer trap.Close()
+	retried := func() {
+		trap.MustWait(ctx).MustRelease(ctx)
+		_, w := clock.AdvanceNext()
+		w.MustWait(ctx)
+	}
+
+	// the first attempts to power off and to delete the droplet take effect,
+	// but time out, so the retries find it already off and then gone
+	mock.lostPowerOffs.Store(1)
+	mock.lostDeletes.Store(1)
+	result := make(chan error)
+	go func() {
+		result <- shutdownDroplet(
+			ctx,
+			"mydropletname",
+			1,
+			time.Minute,
+			10*time.Millisecond,
+			time.Millisecond,
+			time.Millisecond,
+			false,
+			mock.Droplets(),
+			mock.DropletActions(),
+			clock,
+			hclog.NewNullLogger(),
+		)
+	}()
+	retried()
+	retried()
+	require.NoError(t, <-result)
+	require.NotContains(t, mock.droplets, 1)
+}
@@ -0,0 +1,61 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestScaleOutSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	mock.failingCreates = []int{2}
+	config := map[string]string{
+		"name":        "mydropletname",
+		"region":      "lon1",
+		"size":        "s1",
+		"snapshot_id": "12345",
+		"token":       "t0ken",
+		"vpc_uuid":    uuid.New().String(),
+	}
+	tp := &TargetPlugin{
+		ctx:    ctx,
+		config: config,
+		logger: hclog.NewNullLogger(),
+		client: mock,
+	}
+	template := Must(tp.createDropletTemplate(config))
+	_, err := tp.scaleOut(ctx, nil, 2, 2, template, config)
+	require.Error(t, err)
+
+	spans := make(map[string][]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = append(spans[span.Name()], span)
+	}
+	require.Len(t, spans["scale_out"], 1)
+	scaleOut := spans["scale_out"][0]
+	require.Equal(t, codes.Error, scaleOut.Status().Code)
+
+	// each droplet is created in a child span, recording its own failure
+	require.Len(t, spans["create_droplet"], 2)
+	failed := 0
+	for _, span := range spans["create_droplet"] {
+		require.Equal(t, scaleOut.SpanContext().SpanID(), span.Parent().SpanID())
+		if span.Status().Code == codes.Error {
+			failed++
+		}
+	}
+	require.Equal(t, 1, failed)
+}
@@ -2,11 +2,86 @@ package plugin
 
 import (
 	"context"
+	"fmt"
 	"iter"
+	"path"
+	"regexp"
 	"slices"
+	"strings"
 	"time"
 )
 
+// maxTagLength is the longest tag name DigitalOcean accepts.
+const maxTagLength = 255
+
+var prohibitedCharactersInTags = regexp.MustCompile(`[^a-zA-Z0-9_\-\:]+`)
+
+// SanitizeTag replaces any characters which DigitalOcean does not allow in
+// tag names with underscores, and truncates the result to the maximum length.
+func SanitizeTag(tag string) string {
+	tag = prohibitedCharactersInTags.ReplaceAllLiteralString(tag, "_")
+	if len(tag) > maxTagLength {
+		tag = tag[:maxTagLength]
+	}
+	return tag
+}
+
+// ValidateTag returns an error if DigitalOcean would not accept the tag
+// name, e.g. as it contains prohibited characters.
+func ValidateTag(tag string) error {
+	switch {
+	case tag == "":
+		return fmt.Errorf("tag names cannot be empty")
+	case len(tag) > maxTagLength:
+		return fmt.Errorf("tag %q is longer than %v characters", tag, maxTagLength)
+	case prohibitedCharactersInTags.MatchString(tag):
+		return fmt.Errorf(
+			"tag %q may only contain letters, numbers, colons, dashes and underscores",
+			tag,
+		)
+	}
+	return nil
+}
+
+// ParseTag validates the tag name and splits a "key:value" tag into its key
+// and value. Tags without a colon are returned as a key with an empty value.
+// Only the first colon separates the key, so values may contain colons.
+func ParseTag(tag string) (key, value string, err error) {
+	if err := ValidateTag(tag); err != nil {
+		return "", "", err
+	}
+	key, value, found := strings.Cut(tag, ":")
+	switch {
+	case found && key == "":
+		return "", "", fmt.Errorf("tag %q has an empty key before its colon", tag)
+	case found && value == "":
+		return "", "", fmt.Errorf("tag %q has an empty value after its colon", tag)
+	}
+	return key, value, nil
+}
+
+// parseFilenames parses a comma-separated list of absolute filenames. The
+// names are written into shell scripts between double quotes, so characters
+// which the shell would interpret there are not allowed.
+func parseFilenames(s string) ([]string, error) {
+	var filenames []string
+	for _, field := range strings.Split(s, ",") {
+		filename := strings.TrimSpace(field)
+		switch {
+		case filename == "":
+			return nil, fmt.Errorf("%q contains an empty filename", s)
+		case !path.IsAbs(filename) || strings.HasSuffix(filename, "/"):
+			return nil, fmt.Errorf("%q is not an absolute filename", filename)
+		case strings.ContainsAny(filename, "\"$`\\\n"):
+			return nil, fmt.Errorf("%q contains characters which are not allowed in filenames", filename)
+		case slices.Contains(filenames, filename):
+			return nil, fmt.Errorf("%q is listed more than once", filename)
+		}
+		filenames = append(filenames, filename)
+	}
+	return filenames, nil
+}
+
 // CollectError returns a slice of []K elements, gathered from
 // a iter.Seq2 collection of [*K, error] pairs.
 // If any element's error is non-nil, the slice will be nil,
@@ -0,0 +1,110 @@
+package plugin_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Aiven-Open/nomad-droplets-autoscaler/plugin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitizeTag(t *testing.T) {
+	testCases := []struct {
+		input          string
+		expectedOutput string
+		name           string
+	}{
+		{
+			input:          "nomad-node-pool:batch_1",
+			expectedOutput: "nomad-node-pool:batch_1",
+			name:           "valid tag is unchanged",
+		},
+		{
+			input:          "nomad-datacenter:eu west/1",
+			expectedOutput: "nomad-datacenter:eu_west_1",
+			name:           "prohibited characters are replaced",
+		},
+		{
+			input:          "a.. b",
+			expectedOutput: "a_b",
+			name:           "runs of prohibited characters are replaced once",
+		},
+		{
+			input:          strings.Repeat("a", 300),
+			expectedOutput: strings.Repeat("a", 255),
+			name:           "long tags are truncated",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expectedOutput, plugin.SanitizeTag(tc.input), tc.name)
+		})
+	}
+}
+
+func TestValidateTag(t *testing.T) {
+	assert.NoError(t, plugin.ValidateTag("nomad-node-pool:batch_1"))
+	assert.Error(t, plugin.ValidateTag(""))
+	assert.Error(t, plugin.ValidateTag("eu west"))
+	assert.Error(t, plugin.ValidateTag("a/b"))
+	assert.Error(t, plugin.ValidateTag(strings.Repeat("a", 256)))
+	// sanitized tags are always valid
+	assert.NoError(t, plugin.ValidateTag(plugin.SanitizeTag("nomad-datacenter:eu west/1")))
+}
+
+func TestParseTag(t *testing.T) {
+	testCases := []struct {
+		input         string
+		expectedKey   string
+		expectedValue string
+		expectedError string
+		name          string
+	}{
+		{
+			input:       "nomad-client",
+			expectedKey: "nomad-client",
+			name:        "plain tag is a key without a value",
+		},
+		{
+			input:         "env:prod",
+			expectedKey:   "env",
+			expectedValue: "prod",
+			name:          "key:value tag is split",
+		},
+		{
+			input:         "url:host:8080",
+			expectedKey:   "url",
+			expectedValue: "host:8080",
+			name:          "only the first colon separates the key",
+		},
+		{
+			input:         "env:",
+			expectedError: "empty value",
+			name:          "empty value is rejected",
+		},
+		{
+			input:         ":prod",
+			expectedError: "empty key",
+			name:          "empty key is rejected",
+		},
+		{
+			input:         "team:pay ments",
+			expectedError: "may only contain",
+			name:          "prohibited characters are rejected",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			key, value, err := plugin.ParseTag(tc.input)
+			if tc.expectedError != "" {
+				assert.ErrorContains(t, err, tc.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedKey, key)
+			assert.Equal(t, tc.expectedValue, value)
+		})
+	}
+}
@@ -4,13 +4,24 @@ import (
 	"context"
 	"fmt"
 	"net"
-	"regexp"
+	"os"
+	"sync"
 	"time"
 
+	"github.com/coder/quartz"
+	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault-client-go"
 	"github.com/hashicorp/vault-client-go/schema"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// defaultAppRoleMountPath is where the approle auth method is mounted by default.
+const defaultAppRoleMountPath = "approle"
+
+// VaultProxy generates the secrets with which new droplets are securely
+// introduced. Despite its name, it need not be backed by Vault: any
+// implementation can be given to NewDODropletsPlugin, and NewPreSharedToken
+// provides one which needs no secrets system at all.
 type VaultProxy interface {
 	// GenerateSecretId creates a new vault secretID for the approle which can only be accessed from the specified IP addresses.
 	// Returns the wrapping token to be used to retrieve the SecretID
@@ -19,19 +30,277 @@ type VaultProxy interface {
 		appRole string,
 		allowedIPv4, allowedIPv6 string,
 		secretValidity, wrapperValidity time.Duration,
+		options ...SecretIdOption,
 	) (string, error)
 }
 
+// connectionChecker is implemented by the VaultProxy implementations which
+// can check that they are able to generate secrets before any is needed, so
+// that a misconfiguration is reported up front rather than while scaling.
+type connectionChecker interface {
+	CheckConnection(ctx context.Context) error
+}
+
+// secretIdOptions holds the optional settings for generating a SecretID.
+type secretIdOptions struct {
+	mountPath string
+	// whether the SecretID itself, rather than only the tokens issued for
+	// it, is restricted to the allowed IP addresses
+	bindSecretIdCidrs bool
+	// how many times the SecretID may be used; 0 means unlimited
+	numUses int
+}
+
+type SecretIdOption func(*secretIdOptions)
+
+// WithAppRoleMountPath sets the path the approle auth method is mounted at.
+func WithAppRoleMountPath(mountPath string) SecretIdOption {
+	return func(o *secretIdOptions) {
+		o.mountPath = mountPath
+	}
+}
+
+// WithSecretIdCidrs sets whether the SecretID itself may only be used from
+// the allowed IP addresses. Tokens issued for it always are.
+func WithSecretIdCidrs(bind bool) SecretIdOption {
+	return func(o *secretIdOptions) {
+		o.bindSecretIdCidrs = bind
+	}
+}
+
+// WithNumUses sets how many times the SecretID may be used to log in.
+// Zero means it may be used an unlimited number of times.
+func WithNumUses(numUses int) SecretIdOption {
+	return func(o *secretIdOptions) {
+		o.numUses = numUses
+	}
+}
+
+func newSecretIdOptions(options ...SecretIdOption) secretIdOptions {
+	result := secretIdOptions{
+		mountPath:         defaultAppRoleMountPath,
+		bindSecretIdCidrs: true,
+		numUses:           1,
+	}
+	for _, option := range options {
+		option(&result)
+	}
+	return result
+}
+
+const (
+	// minTokenRenewalInterval stops the token from being renewed too often,
+	// if its lease is very short.
+	minTokenRenewalInterval = 10 * time.Second
+	// tokenRenewalRetryInterval is how long to wait after failing to renew
+	// the token before trying again.
+	tokenRenewalRetryInterval = 30 * time.Second
+	// connectionCheckTimeout is how long checking the connection to vault may
+	// take.
+	connectionCheckTimeout = 10 * time.Second
+)
+
+// vaultClient is the subset of the vault client used by vaultProxy.
+type vaultClient interface {
+	AppRoleWriteSecretId(
+		ctx context.Context,
+		roleName string,
+		request schema.AppRoleWriteSecretIdRequest,
+		options ...vault.RequestOption,
+	) (*vault.Response[schema.AppRoleWriteSecretIdResponse], error)
+	TokenRenewSelf(
+		ctx context.Context,
+		request schema.TokenRenewSelfRequest,
+		options ...vault.RequestOption,
+	) (*vault.Response[map[string]interface{}], error)
+	TokenLookUpSelf(
+		ctx context.Context,
+		options ...vault.RequestOption,
+	) (*vault.Response[map[string]interface{}], error)
+	JwtLogin(
+		ctx context.Context,
+		request schema.JwtLoginRequest,
+		options ...vault.RequestOption,
+	) (*vault.Response[map[string]interface{}], error)
+	AppRoleLogin(
+		ctx context.Context,
+		request schema.AppRoleLoginRequest,
+		options ...vault.RequestOption,
+	) (*vault.Response[map[string]interface{}], error)
+	SetToken(token string) error
+}
+
+type vaultClientWrapper struct {
+	*vault.Client
+}
+
+func (w *vaultClientWrapper) AppRoleWriteSecretId(
+	ctx context.Context,
+	roleName string,
+	request schema.AppRoleWriteSecretIdRequest,
+	options ...vault.RequestOption,
+) (*vault.Response[schema.AppRoleWriteSecretIdResponse], error) {
+	return w.Auth.AppRoleWriteSecretId(ctx, roleName, request, options...)
+}
+
+func (w *vaultClientWrapper) TokenRenewSelf(
+	ctx context.Context,
+	request schema.TokenRenewSelfRequest,
+	options ...vault.RequestOption,
+) (*vault.Response[map[string]interface{}], error) {
+	return w.Auth.TokenRenewSelf(ctx, request, options...)
+}
+
+func (w *vaultClientWrapper) TokenLookUpSelf(
+	ctx context.Context,
+	options ...vault.RequestOption,
+) (*vault.Response[map[string]interface{}], error) {
+	return w.Auth.TokenLookUpSelf(ctx, options...)
+}
+
+func (w *vaultClientWrapper) JwtLogin(
+	ctx context.Context,
+	request schema.JwtLoginRequest,
+	options ...vault.RequestOption,
+) (*vault.Response[map[string]interface{}], error) {
+	return w.Auth.JwtLogin(ctx, request, options...)
+}
+
+func (w *vaultClientWrapper) AppRoleLogin(
+	ctx context.Context,
+	request schema.AppRoleLoginRequest,
+	options ...vault.RequestOption,
+) (*vault.Response[map[string]interface{}], error) {
+	return w.Auth.AppRoleLogin(ctx, request, options...)
+}
+
 type vaultProxy struct {
-	client *vault.Client
+	client vaultClient
+	clock  quartz.Clock
+	// whether a token was provided by the environment, or is obtained by
+	// logging in
+	hasToken bool
+
+	auth vaultAuth
+	// loggedIn records whether a token has been obtained by logging in, and
+	// loginRenewable whether it can be renewed. A token which cannot be
+	// renewed but expires is replaced from loginRefreshAt.
+	loggedIn       bool
+	loginRenewable bool
+	loginRefreshAt time.Time
+	loginMutex     sync.Mutex
 }
 
-func NewVault() (*vaultProxy, error) {
+// NewVault returns a VaultProxy for the vault configured by the environment.
+// It authenticates with the method given by VAULT_AUTH_METHOD, unless an
+// option sets another, and by default with the token in VAULT_TOKEN.
+func NewVault(options ...VaultOption) (*vaultProxy, error) {
 	client, err := vault.New(vault.WithEnvironment())
 	if err != nil {
 		return nil, err
 	}
-	return &vaultProxy{client: client}, nil
+	auth, err := vaultAuthFromEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	for _, option := range options {
+		option(&auth)
+	}
+	return &vaultProxy{
+		client:   &vaultClientWrapper{Client: client},
+		clock:    quartz.NewReal(),
+		hasToken: auth.usesLogin() || os.Getenv("VAULT_TOKEN") != "",
+		auth:     auth,
+	}, nil
+}
+
+// RenewToken keeps the vault token alive until the context is cancelled, by
+// renewing it once two thirds of its lease have elapsed. This stops a
+// long-running autoscaler from outliving its token. It returns straight away
+// if there is no token, and once the token is found not to be renewable,
+// e.g. because it never expires. A token obtained by logging in is instead
+// replaced by logging in again when it cannot be renewed.
+func (v *vaultProxy) RenewToken(ctx context.Context, logger hclog.Logger) {
+	if !v.hasToken {
+		return
+	}
+	for {
+		wait := tokenRenewalRetryInterval
+		if err := v.ensureLoggedIn(ctx); err != nil {
+			logger.Warn("failed to log in to vault", "error", err)
+		} else if renewable, refreshAt := v.loginToken(); v.auth.usesLogin() && !renewable {
+			if refreshAt.IsZero() {
+				logger.Debug("the vault token does not expire")
+				return
+			}
+			// the token is replaced by logging in again before it expires
+			wait = max(refreshAt.Sub(v.clock.Now()), minTokenRenewalInterval)
+		} else {
+			resp, err := v.client.TokenRenewSelf(ctx, schema.TokenRenewSelfRequest{})
+			switch {
+			case err != nil:
+				logger.Warn("failed to renew the vault token", "error", err)
+				// a token obtained by logging in may have reached the end of
+				// its lifetime, so another one is obtained
+				v.logOut()
+			case resp.Auth == nil || !resp.Auth.Renewable || resp.Auth.LeaseDuration == 0:
+				logger.Debug("the vault token is not renewable")
+				return
+			default:
+				lease := time.Duration(resp.Auth.LeaseDuration) * time.Second
+				wait = max(lease*2/3, minTokenRenewalInterval)
+				logger.Debug("renewed the vault token", "lease", lease)
+			}
+		}
+		timer := v.clock.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// StartRenewingToken renews the vault token in the background with
+// RenewToken until the context is done, which should be the plugin's own, if
+// the token needs renewing. A token obtained by logging in always does, and
+// one given by the environment only if it is renewable. If the token cannot
+// be looked up, it is renewed anyway, as RenewToken stops once it finds that
+// the token is not renewable.
+func (v *vaultProxy) StartRenewingToken(ctx context.Context, logger hclog.Logger) {
+	if !v.hasToken {
+		return
+	}
+	if !v.auth.usesLogin() {
+		lookUpCtx, cancel := context.WithTimeout(ctx, connectionCheckTimeout)
+		resp, err := v.client.TokenLookUpSelf(lookUpCtx)
+		cancel()
+		if err == nil {
+			if renewable, _ := resp.Data["renewable"].(bool); !renewable {
+				logger.Debug("the vault token is not renewable")
+				return
+			}
+		}
+	}
+	go v.RenewToken(ctx, logger)
+}
+
+// CheckConnection checks that vault can be reached and that the token is
+// valid, by looking the token up.
+func (v *vaultProxy) CheckConnection(ctx context.Context) error {
+	if !v.hasToken {
+		return fmt.Errorf("VAULT_TOKEN is not set")
+	}
+	if err := v.ensureLoggedIn(ctx); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, connectionCheckTimeout)
+	defer cancel()
+	if _, err := v.client.TokenLookUpSelf(ctx); err != nil {
+		return fmt.Errorf("cannot look up the vault token: %w", err)
+	}
+	return nil
 }
 
 func (v *vaultProxy) GenerateSecretId(
@@ -39,7 +308,12 @@ func (v *vaultProxy) GenerateSecretId(
 	appRole string,
 	allowedIPv4, allowedIPv6 string,
 	secretValidity, wrapperValidity time.Duration,
-) (string, error) {
+	options ...SecretIdOption,
+) (_ string, err error) {
+	ctx, span := startSpan(ctx, "generate_secret_id", attribute.String("app_role", appRole))
+	defer func() { endSpan(span, err) }()
+
+	opts := newSecretIdOptions(options...)
 	if allowedIPv4 == "" && allowedIPv6 == "" {
 		return "", fmt.Errorf("at least one authorised IP address must be provided")
 	}
@@ -65,18 +339,16 @@ func (v *vaultProxy) GenerateSecretId(
 	// temporarily include this to allow exercising this codepath
 	// even when vault is not available
 	if appRole == "mock" {
-		prohibitedCharactersInTags := regexp.MustCompile(`[^a-zA-Z0-9_\-\:]+`)
 		return prohibitedCharactersInTags.ReplaceAllLiteralString(fmt.Sprintf("mock-wrapped-token-for-%v-and-%v", allowedIPv4, allowedIPv6), "_"), nil
 	}
-	resp, err := v.client.Auth.AppRoleWriteSecretId(
+	if err := v.ensureLoggedIn(ctx); err != nil {
+		return "", err
+	}
+	resp, err := v.client.AppRoleWriteSecretId(
 		ctx,
 		appRole,
-		schema.AppRoleWriteSecretIdRequest{
-			CidrList:        cidrs,
-			NumUses:         1,
-			TokenBoundCidrs: cidrs,
-			Ttl:             fmt.Sprintf("%.f", secretValidity.Seconds()),
-		},
+		secretIdRequest(cidrs, secretValidity, opts),
+		vault.WithMountPath(opts.mountPath),
 		vault.WithResponseWrapping(wrapperValidity),
 	)
 	if err != nil {
@@ -85,3 +357,20 @@ func (v *vaultProxy) GenerateSecretId(
 	wrapped := resp.WrapInfo.Token
 	return wrapped, nil
 }
+
+// secretIdRequest builds the request for a SecretID bound to the given CIDRs.
+func secretIdRequest(
+	cidrs []string,
+	secretValidity time.Duration,
+	opts secretIdOptions,
+) schema.AppRoleWriteSecretIdRequest {
+	request := schema.AppRoleWriteSecretIdRequest{
+		NumUses:         int32(opts.numUses),
+		TokenBoundCidrs: cidrs,
+		Ttl:             fmt.Sprintf("%.f", secretValidity.Seconds()),
+	}
+	if opts.bindSecretIdCidrs {
+		request.CidrList = cidrs
+	}
+	return request
+}
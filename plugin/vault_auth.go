@@ -0,0 +1,168 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault-client-go"
+	"github.com/hashicorp/vault-client-go/schema"
+)
+
+// The methods the autoscaler can authenticate with vault with, selected by
+// the VAULT_AUTH_METHOD environment variable.
+const (
+	// vaultAuthToken uses the token in VAULT_TOKEN.
+	vaultAuthToken = "token"
+	// vaultAuthJWT logs in with a JWT, such as a Nomad workload identity.
+	vaultAuthJWT = "jwt"
+	// vaultAuthAppRole logs in with the autoscaler's own AppRole.
+	vaultAuthAppRole = "approle"
+)
+
+// vaultAuth holds how the autoscaler authenticates with vault.
+type vaultAuth struct {
+	method    string
+	mountPath string
+	// role and jwt are used by the jwt method. The JWT may be given as the
+	// path to a file, which is read again on each login, as workload
+	// identities are rotated.
+	role string
+	jwt  string
+	// roleID and secretID are used by the approle method.
+	roleID   string
+	secretID string
+}
+
+// usesLogin returns whether a token must be obtained by logging in, rather
+// than being provided by the environment.
+func (a vaultAuth) usesLogin() bool {
+	return a.method == vaultAuthJWT || a.method == vaultAuthAppRole
+}
+
+type VaultOption func(*vaultAuth)
+
+// WithJWTAuth logs in to vault with the JWT, or the JWT in the file at the
+// path, as the role of the JWT auth method mounted at mountPath.
+func WithJWTAuth(mountPath, role, jwt string) VaultOption {
+	return func(a *vaultAuth) {
+		*a = vaultAuth{method: vaultAuthJWT, mountPath: mountPath, role: role, jwt: jwt}
+	}
+}
+
+// WithAppRoleAuth logs in to vault with the RoleID and SecretID, or the
+// SecretID in the file at the path, of the AppRole auth method mounted at
+// mountPath.
+func WithAppRoleAuth(mountPath, roleID, secretID string) VaultOption {
+	return func(a *vaultAuth) {
+		*a = vaultAuth{method: vaultAuthAppRole, mountPath: mountPath, roleID: roleID, secretID: secretID}
+	}
+}
+
+// vaultAuthFromEnvironment returns the auth method configured by the
+// environment. By default, the token in VAULT_TOKEN is used.
+func vaultAuthFromEnvironment() (vaultAuth, error) {
+	method := os.Getenv("VAULT_AUTH_METHOD")
+	mountPath := os.Getenv("VAULT_AUTH_MOUNT")
+	if mountPath == "" {
+		mountPath = method
+	}
+	var auth vaultAuth
+	switch method {
+	case "", vaultAuthToken:
+		return vaultAuth{method: vaultAuthToken}, nil
+	case vaultAuthJWT:
+		WithJWTAuth(mountPath, os.Getenv("VAULT_AUTH_ROLE"), os.Getenv("VAULT_AUTH_JWT"))(&auth)
+		if auth.role == "" || auth.jwt == "" {
+			return vaultAuth{}, fmt.Errorf("VAULT_AUTH_ROLE and VAULT_AUTH_JWT are required by the %v auth method", method)
+		}
+	case vaultAuthAppRole:
+		WithAppRoleAuth(mountPath, os.Getenv("VAULT_ROLE_ID"), os.Getenv("VAULT_SECRET_ID"))(&auth)
+		if auth.roleID == "" || auth.secretID == "" {
+			return vaultAuth{}, fmt.Errorf("VAULT_ROLE_ID and VAULT_SECRET_ID are required by the %v auth method", method)
+		}
+	default:
+		return vaultAuth{}, fmt.Errorf(
+			"VAULT_AUTH_METHOD must be %q, %q or %q",
+			vaultAuthToken,
+			vaultAuthJWT,
+			vaultAuthAppRole,
+		)
+	}
+	return auth, nil
+}
+
+// ensureLoggedIn logs in to vault, unless the token is provided by the
+// environment or has already been obtained.
+func (v *vaultProxy) ensureLoggedIn(ctx context.Context) error {
+	if !v.auth.usesLogin() {
+		return nil
+	}
+	v.loginMutex.Lock()
+	defer v.loginMutex.Unlock()
+	if v.loggedIn && (v.loginRefreshAt.IsZero() || v.clock.Now().Before(v.loginRefreshAt)) {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, connectionCheckTimeout)
+	defer cancel()
+	var (
+		resp *vault.Response[map[string]interface{}]
+		err  error
+	)
+	switch v.auth.method {
+	case vaultAuthJWT:
+		var jwt string
+		if jwt, err = pathOrContents(v.auth.jwt); err != nil {
+			return fmt.Errorf("cannot read the JWT: %w", err)
+		}
+		resp, err = v.client.JwtLogin(
+			ctx,
+			schema.JwtLoginRequest{Jwt: strings.TrimSpace(jwt), Role: v.auth.role},
+			vault.WithMountPath(v.auth.mountPath),
+		)
+	case vaultAuthAppRole:
+		var secretID string
+		if secretID, err = pathOrContents(v.auth.secretID); err != nil {
+			return fmt.Errorf("cannot read the SecretID: %w", err)
+		}
+		resp, err = v.client.AppRoleLogin(
+			ctx,
+			schema.AppRoleLoginRequest{RoleId: v.auth.roleID, SecretId: strings.TrimSpace(secretID)},
+			vault.WithMountPath(v.auth.mountPath),
+		)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot log in to vault with the %v auth method: %w", v.auth.method, err)
+	}
+	if resp.Auth == nil || resp.Auth.ClientToken == "" {
+		return fmt.Errorf("logging in to vault with the %v auth method returned no token", v.auth.method)
+	}
+	if err := v.client.SetToken(resp.Auth.ClientToken); err != nil {
+		return err
+	}
+	v.loggedIn = true
+	v.loginRenewable = resp.Auth.Renewable
+	v.loginRefreshAt = time.Time{}
+	if lease := time.Duration(resp.Auth.LeaseDuration) * time.Second; !resp.Auth.Renewable && lease > 0 {
+		v.loginRefreshAt = v.clock.Now().Add(lease * 2 / 3)
+	}
+	return nil
+}
+
+// loginToken returns whether the token obtained by logging in can be renewed
+// and, if not, when it is replaced.
+func (v *vaultProxy) loginToken() (renewable bool, refreshAt time.Time) {
+	v.loginMutex.Lock()
+	defer v.loginMutex.Unlock()
+	return v.loginRenewable, v.loginRefreshAt
+}
+
+// logOut forgets the token obtained by logging in, so that the next request
+// logs in again.
+func (v *vaultProxy) logOut() {
+	v.loginMutex.Lock()
+	defer v.loginMutex.Unlock()
+	v.loggedIn = false
+}
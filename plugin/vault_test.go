@@ -1,9 +1,18 @@
 package plugin
 
 import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/coder/quartz"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault-client-go"
+	"github.com/hashicorp/vault-client-go/schema"
 	"github.com/stretchr/testify/require"
 )
 
@@ -15,3 +24,330 @@ func TestMockVault(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, `mock-wrapped-token-for-1_2_3_4-and-fe80::_10`, secret)
 }
+
+func TestSecretIdOptions(t *testing.T) {
+	require.Equal(t, "approle", newSecretIdOptions().mountPath)
+	require.True(t, newSecretIdOptions().bindSecretIdCidrs)
+	require.Equal(t, 1, newSecretIdOptions().numUses)
+	require.Equal(t, "approle-droplets", newSecretIdOptions(WithAppRoleMountPath("approle-droplets")).mountPath)
+}
+
+func TestSecretIdRequest(t *testing.T) {
+	cidrs := []string{"1.2.3.4/32"}
+
+	request := secretIdRequest(cidrs, time.Hour, newSecretIdOptions())
+	require.Equal(t, cidrs, request.CidrList)
+	require.Equal(t, cidrs, request.TokenBoundCidrs)
+	require.Equal(t, "3600", request.Ttl)
+	require.Equal(t, int32(1), request.NumUses)
+
+	// only the tokens are bound to the addresses
+	request = secretIdRequest(cidrs, time.Hour, newSecretIdOptions(WithSecretIdCidrs(false)))
+	require.Empty(t, request.CidrList)
+	require.Equal(t, cidrs, request.TokenBoundCidrs)
+}
+
+func TestSecretIdRequestNumUses(t *testing.T) {
+	request := secretIdRequest(nil, time.Hour, newSecretIdOptions(WithNumUses(2)))
+	require.Equal(t, int32(2), request.NumUses)
+
+	request = secretIdRequest(nil, time.Hour, newSecretIdOptions(WithNumUses(0)))
+	require.Equal(t, int32(0), request.NumUses)
+}
+
+// stubVaultClient returns the queued token renewal responses in turn.
+type stubVaultClient struct {
+	renewals []*vault.Response[map[string]interface{}]
+	renewed  chan struct{}
+	// lookUpErr is returned when the token is looked up, and otherwise
+	// lookUpData
+	lookUpErr  error
+	lookUpData map[string]interface{}
+	lookUps    int
+	// loginAuth is returned by logging in, whose requests are recorded along
+	// with the tokens set
+	loginAuth     *vault.ResponseAuth
+	jwtLogins     []schema.JwtLoginRequest
+	appRoleLogins []schema.AppRoleLoginRequest
+	tokens        []string
+}
+
+func (s *stubVaultClient) AppRoleWriteSecretId(
+	ctx context.Context,
+	roleName string,
+	request schema.AppRoleWriteSecretIdRequest,
+	options ...vault.RequestOption,
+) (*vault.Response[schema.AppRoleWriteSecretIdResponse], error) {
+	return nil, errors.New("not implemented")
+}
+
+func (s *stubVaultClient) TokenRenewSelf(
+	ctx context.Context,
+	request schema.TokenRenewSelfRequest,
+	options ...vault.RequestOption,
+) (*vault.Response[map[string]interface{}], error) {
+	defer func() { s.renewed <- struct{}{} }()
+	resp := s.renewals[0]
+	s.renewals = s.renewals[1:]
+	if resp == nil {
+		return nil, &vault.ResponseError{StatusCode: http.StatusForbidden}
+	}
+	return resp, nil
+}
+
+func (s *stubVaultClient) TokenLookUpSelf(
+	ctx context.Context,
+	options ...vault.RequestOption,
+) (*vault.Response[map[string]interface{}], error) {
+	s.lookUps++
+	if s.lookUpErr != nil {
+		return nil, s.lookUpErr
+	}
+	return &vault.Response[map[string]interface{}]{Data: s.lookUpData}, nil
+}
+
+func (s *stubVaultClient) JwtLogin(
+	ctx context.Context,
+	request schema.JwtLoginRequest,
+	options ...vault.RequestOption,
+) (*vault.Response[map[string]interface{}], error) {
+	s.jwtLogins = append(s.jwtLogins, request)
+	return &vault.Response[map[string]interface{}]{Auth: s.loginAuth}, nil
+}
+
+func (s *stubVaultClient) AppRoleLogin(
+	ctx context.Context,
+	request schema.AppRoleLoginRequest,
+	options ...vault.RequestOption,
+) (*vault.Response[map[string]interface{}], error) {
+	s.appRoleLogins = append(s.appRoleLogins, request)
+	return &vault.Response[map[string]interface{}]{Auth: s.loginAuth}, nil
+}
+
+func (s *stubVaultClient) SetToken(token string) error {
+	s.tokens = append(s.tokens, token)
+	return nil
+}
+
+func TestRenewToken(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), 2*time.Second)
+	defer cancel()
+	clock := quartz.NewMock(t)
+	client := &stubVaultClient{
+		renewals: []*vault.Response[map[string]interface{}]{
+			{Auth: &vault.ResponseAuth{Renewable: true, LeaseDuration: 60}},
+			nil,
+			{Auth: &vault.ResponseAuth{Renewable: true, LeaseDuration: 60}},
+			{Auth: &vault.ResponseAuth{Renewable: false}},
+		},
+		renewed: make(chan struct{}, 4),
+	}
+	v := &vaultProxy{client: client, clock: clock, hasToken: true}
+
+	trap := clock.Trap().NewTimer()
+	defer trap.Close()
+	done := make(chan struct{})
+	go func() {
+		v.RenewToken(ctx, hclog.NewNullLogger())
+		close(done)
+	}()
+
+	// the token is renewed once two thirds of its lease have elapsed,
+	// and failed renewals are retried
+	for _, wait := range []time.Duration{40 * time.Second, tokenRenewalRetryInterval, 40 * time.Second} {
+		call := trap.MustWait(ctx)
+		<-client.renewed
+		require.Equal(t, wait, call.Duration)
+		call.MustRelease(ctx)
+		clock.Advance(wait).MustWait(ctx)
+	}
+
+	// renewal stops once the token is no longer renewable
+	<-client.renewed
+	select {
+	case <-done:
+	case <-ctx.Done():
+		t.Fatal("token renewal did not stop")
+	}
+	require.Empty(t, client.renewals)
+}
+
+func TestRenewTokenWithoutToken(t *testing.T) {
+	// without a token, nothing is renewed
+	v := &vaultProxy{client: &stubVaultClient{}, clock: quartz.NewMock(t)}
+	v.RenewToken(t.Context(), hclog.NewNullLogger())
+}
+
+func TestStartRenewingToken(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), 2*time.Second)
+	defer cancel()
+	clock := quartz.NewMock(t)
+	client := &stubVaultClient{
+		renewals: []*vault.Response[map[string]interface{}]{
+			{Auth: &vault.ResponseAuth{Renewable: true, LeaseDuration: 60}},
+		},
+		renewed: make(chan struct{}, 1),
+	}
+	v := &vaultProxy{client: client, clock: clock, hasToken: true}
+
+	// a token which is not renewable, e.g. a root token, is left alone
+	v.StartRenewingToken(ctx, hclog.NewNullLogger())
+	require.Equal(t, 1, client.lookUps)
+	require.Empty(t, client.renewed)
+
+	// a renewable token is renewed until the context is done
+	client.lookUpData = map[string]interface{}{"renewable": true}
+	trap := clock.Trap().NewTimer()
+	defer trap.Close()
+	renewCtx, stop := context.WithCancel(ctx)
+	v.StartRenewingToken(renewCtx, hclog.NewNullLogger())
+	<-client.renewed
+	trap.MustWait(ctx).MustRelease(ctx)
+	stop()
+	require.Eventually(t, func() bool {
+		_, ok := clock.Peek()
+		return !ok
+	}, time.Second, time.Millisecond)
+}
+
+func TestCheckConnection(t *testing.T) {
+	v := &vaultProxy{client: &stubVaultClient{}, clock: quartz.NewMock(t)}
+	require.ErrorContains(t, v.CheckConnection(t.Context()), "VAULT_TOKEN")
+
+	v.hasToken = true
+	require.NoError(t, v.CheckConnection(t.Context()))
+
+	v.client = &stubVaultClient{lookUpErr: &vault.ResponseError{StatusCode: http.StatusForbidden}}
+	require.ErrorContains(t, v.CheckConnection(t.Context()), "cannot look up the vault token")
+}
+
+func TestTargetPlugin_SetConfigChecksVault(t *testing.T) {
+	client := &stubVaultClient{lookUpErr: errors.New("connection refused")}
+	v := &vaultProxy{client: client, clock: quartz.NewMock(t), hasToken: true}
+	plugin := NewDODropletsPlugin(t.Context(), hclog.NewNullLogger(), v)
+
+	// vault is only checked when secure introduction is configured
+	require.NoError(t, plugin.SetConfig(map[string]string{"token": "t0ken"}))
+	require.Zero(t, client.lookUps)
+	require.ErrorContains(t, plugin.SetConfig(map[string]string{
+		"token":                       "t0ken",
+		"secure_introduction_backend": "vault",
+	}), "connection refused")
+
+	// once the check succeeds, it is not repeated
+	client.lookUpErr = nil
+	require.NoError(t, plugin.checkVault(t.Context()))
+	require.NoError(t, plugin.checkVault(t.Context()))
+	require.Equal(t, 2, client.lookUps)
+
+	// the pre-shared token needs no check
+	require.NoError(t, plugin.SetConfig(map[string]string{
+		"token":                                "t0ken",
+		"secure_introduction_backend":          "pre_shared_token",
+		"secure_introduction_pre_shared_token": "s3cret",
+	}))
+	require.Equal(t, 2, client.lookUps)
+
+	// nor does the mock approle, even if vault is unreachable
+	client.lookUpErr = errors.New("connection refused")
+	require.NoError(t, plugin.SetConfig(map[string]string{
+		"token":                       "t0ken",
+		"secure_introduction_approle": "mock",
+	}))
+	require.Equal(t, 2, client.lookUps)
+}
+
+func TestVaultAuthFromEnvironment(t *testing.T) {
+	t.Setenv("VAULT_AUTH_METHOD", "")
+	t.Setenv("VAULT_AUTH_MOUNT", "")
+	auth, err := vaultAuthFromEnvironment()
+	require.NoError(t, err)
+	require.Equal(t, vaultAuth{method: "token"}, auth)
+
+	t.Setenv("VAULT_AUTH_METHOD", "jwt")
+	_, err = vaultAuthFromEnvironment()
+	require.ErrorContains(t, err, "VAULT_AUTH_ROLE")
+	t.Setenv("VAULT_AUTH_ROLE", "autoscaler")
+	t.Setenv("VAULT_AUTH_JWT", "/secrets/nomad_vault_default.jwt")
+	auth, err = vaultAuthFromEnvironment()
+	require.NoError(t, err)
+	require.Equal(t, vaultAuth{
+		method:    "jwt",
+		mountPath: "jwt",
+		role:      "autoscaler",
+		jwt:       "/secrets/nomad_vault_default.jwt",
+	}, auth)
+
+	t.Setenv("VAULT_AUTH_METHOD", "approle")
+	t.Setenv("VAULT_AUTH_MOUNT", "approle-autoscaler")
+	t.Setenv("VAULT_ROLE_ID", "role-id")
+	_, err = vaultAuthFromEnvironment()
+	require.ErrorContains(t, err, "VAULT_SECRET_ID")
+	t.Setenv("VAULT_SECRET_ID", "secret-id")
+	auth, err = vaultAuthFromEnvironment()
+	require.NoError(t, err)
+	require.Equal(t, vaultAuth{
+		method:    "approle",
+		mountPath: "approle-autoscaler",
+		roleID:    "role-id",
+		secretID:  "secret-id",
+	}, auth)
+
+	t.Setenv("VAULT_AUTH_METHOD", "kerberos")
+	_, err = vaultAuthFromEnvironment()
+	require.ErrorContains(t, err, "VAULT_AUTH_METHOD")
+}
+
+func TestVaultJWTLogin(t *testing.T) {
+	jwtFile := filepath.Join(t.TempDir(), "nomad_vault_default.jwt")
+	require.NoError(t, os.WriteFile(jwtFile, []byte("eyJhbGciOi.first\n"), 0o600))
+	clock := quartz.NewMock(t)
+	client := &stubVaultClient{
+		loginAuth: &vault.ResponseAuth{ClientToken: "hvs.first", LeaseDuration: 60},
+	}
+	auth := vaultAuth{}
+	WithJWTAuth("jwt", "autoscaler", jwtFile)(&auth)
+	v := &vaultProxy{client: client, clock: clock, hasToken: true, auth: auth}
+
+	// the token is obtained by logging in before it is first used
+	require.NoError(t, v.CheckConnection(t.Context()))
+	require.NoError(t, v.CheckConnection(t.Context()))
+	require.Equal(t, []schema.JwtLoginRequest{{Jwt: "eyJhbGciOi.first", Role: "autoscaler"}}, client.jwtLogins)
+	require.Equal(t, []string{"hvs.first"}, client.tokens)
+
+	// a token which cannot be renewed is replaced before it expires, with
+	// the JWT read again, as it may have been rotated
+	require.NoError(t, os.WriteFile(jwtFile, []byte("eyJhbGciOi.second"), 0o600))
+	clock.Advance(40 * time.Second)
+	require.NoError(t, v.CheckConnection(t.Context()))
+	require.Len(t, client.jwtLogins, 2)
+	require.Equal(t, "eyJhbGciOi.second", client.jwtLogins[1].Jwt)
+
+	// and so is one which could not be renewed
+	v.logOut()
+	require.NoError(t, v.CheckConnection(t.Context()))
+	require.Len(t, client.jwtLogins, 3)
+}
+
+func TestVaultAppRoleLogin(t *testing.T) {
+	client := &stubVaultClient{
+		loginAuth: &vault.ResponseAuth{ClientToken: "hvs.approle", Renewable: true, LeaseDuration: 3600},
+	}
+	auth := vaultAuth{}
+	WithAppRoleAuth("approle", "role-id", "secret-id")(&auth)
+	v := &vaultProxy{client: client, clock: quartz.NewMock(t), hasToken: true, auth: auth}
+
+	// the stub cannot generate SecretIDs, but logs in first
+	_, err := v.GenerateSecretId(t.Context(), "droplet-approle", "1.2.3.4", "", time.Hour, time.Minute)
+	require.Error(t, err)
+	require.Equal(t, []schema.AppRoleLoginRequest{{RoleId: "role-id", SecretId: "secret-id"}}, client.appRoleLogins)
+	require.Equal(t, []string{"hvs.approle"}, client.tokens)
+}
+
+func TestVaultLoginWithoutToken(t *testing.T) {
+	client := &stubVaultClient{loginAuth: &vault.ResponseAuth{}}
+	auth := vaultAuth{}
+	WithAppRoleAuth("approle", "role-id", "secret-id")(&auth)
+	v := &vaultProxy{client: client, clock: quartz.NewMock(t), hasToken: true, auth: auth}
+	require.ErrorContains(t, v.CheckConnection(t.Context()), "returned no token")
+}
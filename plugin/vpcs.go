@@ -0,0 +1,31 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/digitalocean/godo"
+)
+
+// resolveVPC finds the ID of the VPC with the given name in one of the
+// given regions. It is an error if no VPC, or more than one, matches.
+func resolveVPC(ctx context.Context, vpcs VPCs, name string, regions []string) (string, error) {
+	var matches []string
+	for vpc, err := range Unpaginate(ctx, vpcs.List, godo.ListOptions{PerPage: 200}) {
+		if err != nil {
+			return "", fmt.Errorf("cannot list VPCs: %w", err)
+		}
+		if vpc.Name == name && slices.Contains(regions, vpc.RegionSlug) {
+			matches = append(matches, vpc.ID)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no VPC named %q found in region(s) %v", name, regions)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("%v VPCs named %q found in region(s) %v: %v", len(matches), name, regions, matches)
+	}
+}
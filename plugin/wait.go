@@ -2,46 +2,271 @@ package plugin
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/coder/quartz"
+	"github.com/digitalocean/godo"
 	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/scaleutils/nodepool"
+	"github.com/hashicorp/nomad/api"
 )
 
+const (
+	defaultStatePollInterval    = 3 * time.Second
+	defaultStatePollMaxInterval = 30 * time.Second
+	defaultReadyCheckTimeout    = 5 * time.Minute
+	// defaultReservationWaitTimeout is how long a new droplet is waited for
+	// before reserved addresses are assigned to it.
+	defaultReservationWaitTimeout = 5 * time.Minute
+)
+
+// waitForDropletState polls the droplet until it reaches the desired state.
+// The interval between checks starts at interval, and doubles after each
+// check up to maxInterval, so that droplets which take a long time don't
+// cost many API calls. An error getting the droplet is returned straight away.
 func waitForDropletState(
 	ctx context.Context,
 	desiredState string, dropletId int,
 	droplets Droplets,
+	interval, maxInterval time.Duration,
+	clock quartz.Clock,
 	log hclog.Logger,
 ) error {
-	attempts := 0
-	ticker := time.NewTicker(3 * time.Second)
-	defer ticker.Stop()
 	log.Debug(
 		fmt.Sprintf(
 			"Waiting for droplet to become %s",
 			desiredState,
 		),
 	)
-	for {
-		attempts += 1
-
-		log.Debug(fmt.Sprintf("Checking droplet status... (attempt: %d)", attempts))
+	return poll(ctx, clock, interval, maxInterval, func(ctx context.Context) (bool, error) {
 		droplet, _, err := droplets.Get(ctx, dropletId)
 		if err != nil {
-			return err
+			return false, err
 		}
+		log.Trace("polled droplet state", "status", droplet.Status)
+		return droplet.Status == desiredState, nil
+	})
+}
 
-		if droplet.Status == desiredState {
-			return nil
+// poll calls check until it reports that the wait is over or returns an
+// error, or the context is done. The interval between checks starts at
+// interval, give or take 10%, and doubles after each check up to
+// maxInterval. Unlike with retry, a check which finds that the wait is not
+// over has not failed, so it is neither logged nor counted as a retry.
+func poll(
+	ctx context.Context,
+	clock quartz.Clock,
+	interval, maxInterval time.Duration,
+	check func(ctx context.Context) (bool, error),
+) error {
+	for {
+		done, err := check(ctx)
+		if err != nil || done {
+			return err
 		}
-
-		// Wait 3 seconds
+		timer := clock.NewTimer(time.Duration(float64(interval) * (0.9 + rand.Float64()/5)))
 		select {
 		case <-ctx.Done():
+			timer.Stop()
 			return ctx.Err()
-		case <-ticker.C:
-			break
+		case <-timer.C:
+		}
+		interval = min(2*interval, max(maxInterval, interval))
+	}
+}
+
+// waitForNodesToJoin waits until the Nomad node pool of the target has at
+// least desired nodes which are ready and eligible for scheduling, giving up
+// after the template's node join timeout. Droplets which DigitalOcean reports
+// as active may still never join the cluster, e.g. if their image is broken.
+func (t *TargetPlugin) waitForNodesToJoin(
+	ctx context.Context,
+	template *dropletTemplate,
+	config map[string]string,
+	desired int64,
+) error {
+	if t.nomadNodes == nil {
+		return errors.New("no Nomad client is configured")
+	}
+	pool, err := nodepool.NewClusterNodePoolIdentifier(config)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, template.nodeJoinTimeout)
+	defer cancel()
+	return retry(
+		ctx,
+		t.logger,
+		template.name,
+		stableRetryInterval,
+		math.MaxInt,
+		func(ctx context.Context, cancel context.CancelCauseFunc) error {
+			nodes, _, err := t.nomadNodes.List((&api.QueryOptions{}).WithContext(ctx))
+			if err != nil {
+				return fmt.Errorf("error listing Nomad nodes: %w", err)
+			}
+			var ready int64
+			for _, node := range nodes {
+				if pool.IsPoolMember(node) &&
+					node.Status == api.NodeStatusReady &&
+					node.SchedulingEligibility == api.NodeSchedulingEligible {
+					ready++
+				}
+			}
+			if ready < desired {
+				return fmt.Errorf(
+					"waiting for nodes to join %s %q: %d of %d are ready",
+					pool.Key(),
+					pool.Value(),
+					ready,
+					desired,
+				)
+			}
+			return nil
+		},
+		withBackoff(2, stableRetryMaxInterval),
+	)
+}
+
+// waitForDropletsToBeReachable waits until a TCP connection can be made to
+// the ready check port of each of the droplets, on its first IPv4 address,
+// giving up after the template's ready check timeout.
+func (t *TargetPlugin) waitForDropletsToBeReachable(
+	ctx context.Context,
+	template *dropletTemplate,
+	dropletIDs []int,
+) error {
+	ctx, cancel := context.WithTimeout(ctx, template.readyCheckTimeout)
+	defer cancel()
+	wg := &sync.WaitGroup{}
+	errorChannel := make(chan error, len(dropletIDs))
+	for _, dropletID := range dropletIDs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			log := t.logger.With(logKeyAction, "ready_check", logKeyDropletID, strconv.Itoa(dropletID))
+			err := retry(
+				ctx,
+				log,
+				template.name,
+				stableRetryInterval,
+				math.MaxInt,
+				func(ctx context.Context, cancel context.CancelCauseFunc) error {
+					droplet, _, err := template.client.Droplets().Get(ctx, dropletID)
+					if err != nil {
+						return err
+					}
+					if droplet.Networks == nil || len(droplet.Networks.V4) == 0 {
+						return errors.New("droplet has no IPv4 address yet")
+					}
+					address := net.JoinHostPort(
+						droplet.Networks.V4[0].IPAddress,
+						strconv.Itoa(template.readyCheckPort),
+					)
+					ctx, cancelDial := context.WithTimeout(ctx, template.requestTimeout)
+					defer cancelDial()
+					conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", address)
+					if err != nil {
+						return err
+					}
+					_ = conn.Close()
+					return nil
+				},
+				withBackoff(2, stableRetryMaxInterval),
+			)
+			if err != nil {
+				log.Error("droplet is not reachable", "error", err)
+				errorChannel <- fmt.Errorf("droplet %v is not reachable: %w", dropletID, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errorChannel)
+	var errorList []error
+	for err := range errorChannel {
+		errorList = append(errorList, err)
+	}
+	return errors.Join(errorList...)
+}
+
+// activeDroplets remembers since when droplets have been active, as far as
+// the plugin has observed, so that new droplets only count as ready after a
+// grace period. DigitalOcean does not report when a droplet became active, so
+// a droplet which was already active when first observed is assumed to have
+// been active since it was created.
+type activeDroplets struct {
+	mutex sync.Mutex
+	clock quartz.Clock
+	// since holds when each droplet of each pool became active, or the zero
+	// time for the droplets which have been observed but were not yet active
+	since map[string]map[int]time.Time
+}
+
+func newActiveDroplets(clock quartz.Clock) *activeDroplets {
+	return &activeDroplets{
+		clock: clock,
+		since: make(map[string]map[int]time.Time),
+	}
+}
+
+// settling returns how many of the droplets of the pool are active but have
+// not yet been active for the grace period. The droplets must be all those of
+// the pool, as the droplets which are missing, such as those which have been
+// deleted, are forgotten.
+func (a *activeDroplets) settling(pool string, droplets []godo.Droplet, gracePeriod time.Duration) int64 {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	now := a.clock.Now()
+	poolSince, ok := a.since[pool]
+	if !ok {
+		poolSince = make(map[int]time.Time)
+		a.since[pool] = poolSince
+	}
+	defer func() {
+		if len(poolSince) == 0 {
+			delete(a.since, pool)
+		}
+	}()
+	listed := make(map[int]bool, len(droplets))
+	for _, droplet := range droplets {
+		listed[droplet.ID] = true
+	}
+	maps.DeleteFunc(poolSince, func(dropletID int, _ time.Time) bool {
+		return !listed[dropletID]
+	})
+	var count int64
+	for _, droplet := range droplets {
+		since, observed := poolSince[droplet.ID]
+		if !isReady(droplet) {
+			if !observed {
+				poolSince[droplet.ID] = time.Time{}
+			}
+			continue
+		}
+		if since.IsZero() {
+			since = now
+			if created, err := time.Parse(time.RFC3339, droplet.Created); err == nil && !observed {
+				since = created
+			}
+			poolSince[droplet.ID] = since
+		}
+		if now.Sub(since) < gracePeriod {
+			count++
+		} else {
+			// a droplet which has been active for long enough is assumed
+			// to have been active since it was created from now on, so it
+			// no longer needs to be remembered
+			delete(poolSince, droplet.ID)
 		}
 	}
+	return count
 }
@@ -0,0 +1,275 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/coder/quartz"
+	"github.com/digitalocean/godo"
+	"github.com/google/uuid"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+	"github.com/stretchr/testify/require"
+)
+
+// slowDroplets reports droplets as powered off only once they have been
+// checked a number of times.
+type slowDroplets struct {
+	Droplets
+	checks   int
+	offAfter int
+}
+
+func (s *slowDroplets) Get(ctx context.Context, id int) (*godo.Droplet, *godo.Response, error) {
+	s.checks++
+	status := "active"
+	if s.checks >= s.offAfter {
+		status = "off"
+	}
+	return &godo.Droplet{ID: id, Status: status}, &godo.Response{}, nil
+}
+
+func TestWaitForDropletState(t *testing.T) {
+	ctx := t.Context()
+	clock := quartz.NewMock(t)
+	trap := clock.Trap().NewTimer()
+	defer trap.Close()
+	droplets := &slowDroplets{offAfter: 5}
+	output := &bytes.Buffer{}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- waitForDropletState(
+			ctx,
+			"off",
+			1,
+			droplets,
+			10*time.Second,
+			20*time.Second,
+			clock,
+			hclog.New(&hclog.LoggerOptions{Output: output, Level: hclog.Info}),
+		)
+	}()
+
+	// the interval doubles, up to the maximum, give or take the jitter
+	for _, interval := range []time.Duration{10 * time.Second, 20 * time.Second, 20 * time.Second, 20 * time.Second} {
+		call := trap.MustWait(ctx)
+		require.InDelta(t, interval, call.Duration, float64(interval)/10)
+		call.MustRelease(ctx)
+		_, w := clock.AdvanceNext()
+		w.MustWait(ctx)
+	}
+	require.NoError(t, <-errs)
+	require.Equal(t, 5, droplets.checks)
+	// a droplet which is not yet off is not a failure worth reporting
+	require.Empty(t, output.String())
+}
+
+func TestWaitForDropletStateCancelled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	err := waitForDropletState(
+		ctx,
+		"off",
+		1,
+		&slowDroplets{offAfter: 1000},
+		10*time.Second,
+		20*time.Second,
+		quartz.NewMock(t),
+		hclog.NewNullLogger(),
+	)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestScaleOutWaitsForNodesToJoin(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	mock := createMockGodo()
+	config := map[string]string{
+		"name":              "mydropletname",
+		"region":            "lon1",
+		"size":              "s1",
+		"snapshot_id":       "12345",
+		"token":             "t0ken",
+		"vpc_uuid":          uuid.New().String(),
+		"node_class":        "workers",
+		"node_join_timeout": "100ms",
+	}
+	// only one of the droplets joined the node pool
+	nomadNodes := &mockNomadNodes{nodes: map[string]*api.Node{
+		"1": {
+			ID:                    "1",
+			NodeClass:             "workers",
+			Status:                api.NodeStatusReady,
+			SchedulingEligibility: api.NodeSchedulingEligible,
+		},
+		"2": {
+			ID:                    "2",
+			NodeClass:             "workers",
+			Status:                api.NodeStatusInit,
+			SchedulingEligibility: api.NodeSchedulingEligible,
+		},
+		"3": {
+			ID:                    "3",
+			NodeClass:             "other",
+			Status:                api.NodeStatusReady,
+			SchedulingEligibility: api.NodeSchedulingEligible,
+		},
+	}}
+	tp := &TargetPlugin{
+		ctx:        ctx,
+		config:     config,
+		logger:     hclog.NewNullLogger(),
+		client:     mock,
+		nomadNodes: nomadNodes,
+	}
+	template := Must(tp.createDropletTemplate(config))
+
+	_, err := tp.scaleOut(ctx, nil, 2, 2, template, config)
+	require.ErrorContains(t, err, "1 of 2 are ready")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	nomadNodes.nodes["2"].Status = api.NodeStatusReady
+	require.NoError(t, tp.waitForNodesToJoin(ctx, template, config, 2))
+}
+
+func TestScaleOutWaitsForDropletsToBeReachable(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	mock := createMockGodo()
+	mock.dropletIPv4 = "127.0.0.1"
+	config := map[string]string{
+		"name":                "mydropletname",
+		"region":              "lon1",
+		"size":                "s1",
+		"snapshot_id":         "12345",
+		"token":               "t0ken",
+		"vpc_uuid":            uuid.New().String(),
+		"ready_check_port":    strconv.Itoa(listener.Addr().(*net.TCPAddr).Port),
+		"ready_check_timeout": "200ms",
+	}
+	tp := &TargetPlugin{
+		ctx:    ctx,
+		config: config,
+		logger: hclog.NewNullLogger(),
+		client: mock,
+	}
+	template := Must(tp.createDropletTemplate(config))
+	_, err = tp.scaleOut(ctx, nil, 2, 2, template, config)
+	require.NoError(t, err)
+
+	// nothing is listening any more
+	listener.Close()
+	_, err = tp.scaleOut(ctx, nil, 3, 1, template, config)
+	require.ErrorContains(t, err, "droplet 3 is not reachable")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestActiveDropletsSettling(t *testing.T) {
+	clock := quartz.NewMock(t)
+	active := newActiveDroplets(clock)
+	created := clock.Now().Format(time.RFC3339)
+	newDroplet := godo.Droplet{ID: 1, Status: "new", Created: created}
+	// already active when first observed, having been created long ago
+	oldDroplet := godo.Droplet{
+		ID:      2,
+		Status:  "active",
+		Created: clock.Now().Add(-time.Hour).Format(time.RFC3339),
+	}
+	grace := 3 * time.Minute
+
+	require.EqualValues(t, 0, active.settling("pool", []godo.Droplet{newDroplet, oldDroplet}, grace))
+
+	// the new droplet becomes active a minute after it was created, and
+	// only counts as ready once it has been active for the grace period
+	clock.Advance(time.Minute)
+	newDroplet.Status = "active"
+	require.EqualValues(t, 1, active.settling("pool", []godo.Droplet{newDroplet, oldDroplet}, grace))
+	clock.Advance(2 * time.Minute)
+	require.EqualValues(t, 1, active.settling("pool", []godo.Droplet{newDroplet, oldDroplet}, grace))
+	clock.Advance(time.Minute)
+	require.EqualValues(t, 0, active.settling("pool", []godo.Droplet{newDroplet, oldDroplet}, grace))
+	require.Empty(t, active.since["pool"])
+	require.EqualValues(t, 0, active.settling("pool", []godo.Droplet{newDroplet, oldDroplet}, grace))
+
+	// a droplet first observed as active is assumed to have been active
+	// since it was created
+	recentDroplet := godo.Droplet{
+		ID:      3,
+		Status:  "active",
+		Created: clock.Now().Add(-time.Minute).Format(time.RFC3339),
+	}
+	require.EqualValues(t, 1, active.settling("pool", []godo.Droplet{recentDroplet}, grace))
+	clock.Advance(2 * time.Minute)
+	require.EqualValues(t, 0, active.settling("pool", []godo.Droplet{recentDroplet}, grace))
+
+	// droplets which are no longer listed, e.g. as they were deleted, are
+	// forgotten, along with pools which have no droplets left
+	deletedDroplet := godo.Droplet{ID: 4, Status: "new", Created: created}
+	require.EqualValues(t, 0, active.settling("pool", []godo.Droplet{deletedDroplet}, grace))
+	require.Contains(t, active.since["pool"], 4)
+	require.EqualValues(t, 0, active.settling("pool", nil, grace))
+	require.NotContains(t, active.since, "pool")
+}
+
+func TestCountDropletsWithReadyGracePeriod(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	clock := quartz.NewMock(t)
+	mock := createMockGodo()
+	mock.droplets[1] = &godo.Droplet{
+		ID:      1,
+		Status:  "active",
+		Tags:    []string{"mydropletname"},
+		Created: clock.Now().Format(time.RFC3339),
+	}
+	config := map[string]string{
+		"name":               "mydropletname",
+		"region":             "lon1",
+		"size":               "s1",
+		"snapshot_id":        "12345",
+		"token":              "t0ken",
+		"ready_grace_period": "2m",
+	}
+	tp := &TargetPlugin{
+		ctx:            ctx,
+		config:         config,
+		logger:         hclog.NewNullLogger(),
+		client:         mock,
+		activeDroplets: newActiveDroplets(clock),
+	}
+	template := Must(tp.createDropletTemplate(config))
+	require.Equal(t, 2*time.Minute, template.readyGracePeriod)
+
+	counts, err := tp.countDroplets(ctx, template)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, counts.total)
+	require.EqualValues(t, 0, counts.active)
+	require.False(t, counts.isStable(1, "out"))
+
+	clock.Advance(2 * time.Minute)
+	counts, err = tp.countDroplets(ctx, template)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, counts.active)
+	require.True(t, counts.isStable(1, "out"))
+
+	config["ready_grace_period"] = "-1s"
+	_, err = tp.createDropletTemplate(config)
+	require.ErrorContains(t, err, "ready_grace_period")
+}